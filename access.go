@@ -0,0 +1,158 @@
+package ramfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"9fans.net/go/plan9"
+)
+
+// accessKey selects the counters of the access statistics.
+type accessKey struct {
+	path string // of the fid; empty for requests without one
+	uid  string
+	typ  uint8 // of the request
+}
+
+// accessCount holds the counters of one path, user and request type.
+type accessCount struct {
+	ops    uint64
+	errors uint64
+	bytes  uint64 // read or written
+}
+
+// accessLog aggregates the requests of all connections over intervals
+// of FS.AccessInterval, instead of tracing every message.
+type accessLog struct {
+	mu      sync.Mutex
+	fs      *FS
+	started bool // the interval task is running
+	cur     map[accessKey]*accessCount
+	last    []byte // report of the last complete interval
+}
+
+func newAccessLog(fs *FS) *accessLog {
+	return &accessLog{fs: fs, cur: make(map[accessKey]*accessCount)}
+}
+
+// record counts the transaction req of a connection of the user uid.
+func (a *accessLog) record(req *request, uid string) {
+	every := a.fs.AccessInterval
+	if every <= 0 {
+		return
+	}
+	key := accessKey{uid: uid, typ: req.Tx.Type}
+	if f := req.Fid; f != nil {
+		f.mu.RLock()
+		n := f.node
+		f.mu.RUnlock()
+		if n != nil {
+			key.path = n.path()
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.started {
+		a.started = true
+		a.fs.sweep.add("access", every, a.rotate)
+	}
+	c := a.cur[key]
+	if c == nil {
+		c = &accessCount{}
+		a.cur[key] = c
+	}
+	c.ops++
+	switch req.Rx.Type {
+	case plan9.Rerror:
+		c.errors++
+	case plan9.Rread:
+		c.bytes += uint64(len(req.Rx.Data))
+	case plan9.Rwrite:
+		c.bytes += uint64(req.Rx.Count)
+	}
+}
+
+// rotate ends the current interval.
+func (a *accessLog) rotate() {
+	a.mu.Lock()
+	cur := a.cur
+	a.cur = make(map[accessKey]*accessCount)
+	a.mu.Unlock()
+
+	keys := make([]accessKey, 0, len(cur))
+	for k := range cur {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.path != b.path {
+			return a.path < b.path
+		}
+		if a.uid != b.uid {
+			return a.uid < b.uid
+		}
+		return a.typ < b.typ
+	})
+	var buf bytes.Buffer
+	for _, k := range keys {
+		c := cur[k]
+		fmt.Fprintf(&buf, "%s %s %d %d %d %s\n", fcallName(k.typ), k.uid,
+			c.ops, c.errors, c.bytes, k.path)
+	}
+
+	a.mu.Lock()
+	a.last = buf.Bytes()
+	a.mu.Unlock()
+}
+
+func (a *accessLog) report() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+// fcallNames are the names of the requests in /adm/access.
+var fcallNames = map[uint8]string{
+	plan9.Tversion: "version",
+	plan9.Tauth:    "auth",
+	plan9.Tattach:  "attach",
+	plan9.Tflush:   "flush",
+	plan9.Twalk:    "walk",
+	plan9.Topen:    "open",
+	plan9.Tcreate:  "create",
+	plan9.Tread:    "read",
+	plan9.Twrite:   "write",
+	plan9.Tclunk:   "clunk",
+	plan9.Tremove:  "remove",
+	plan9.Tstat:    "stat",
+	plan9.Twstat:   "wstat",
+}
+
+func fcallName(typ uint8) string {
+	if name, ok := fcallNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("type%d", typ)
+}
+
+// accessFile is the synthetic file /adm/access. Reading it lists the
+// requests of the last complete interval of FS.AccessInterval per path,
+// user and request type as lines "type uname ops errors bytes path",
+// where bytes is the amount of data read or written.
+type accessFile struct {
+	fs *FS
+}
+
+func (f *accessFile) ReadAt(p []byte, offset int64) (int, error) {
+	return readReport(f.fs.access.report(), p, offset)
+}
+
+func (f *accessFile) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, perror("writing access file")
+}
+
+func (f *accessFile) Len() uint64  { return uint64(0) }
+func (f *accessFile) Close() error { return nil }
@@ -0,0 +1,285 @@
+package ramfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+// Compression selects the compression of images and tar archives.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd // requires the zstd command of the host
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compress returns a writer compressing the data written to w with c.
+// Close flushes the compressed data; it does not close w.
+func compress(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		z := &zstdCmd{cmd: exec.Command("zstd", "-q", "-c")}
+		z.cmd.Stdout = w
+		z.cmd.Stderr = &z.stderr
+		in, err := z.cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := z.cmd.Start(); err != nil {
+			return nil, err
+		}
+		z.in = in
+		return z, nil
+	}
+	return nil, perror("unknown compression")
+}
+
+// decompress returns a reader of the data of r, which is decompressed if
+// it starts like gzip or zstd compressed data.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		z := &zstdCmd{cmd: exec.Command("zstd", "-d", "-q", "-c")}
+		z.cmd.Stdin = br
+		z.cmd.Stderr = &z.stderr
+		out, err := z.cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := z.cmd.Start(); err != nil {
+			return nil, err
+		}
+		z.out = out
+		return z, nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// zstdCmd compresses or decompresses with the zstd command, as the
+// standard library has no zstd.
+type zstdCmd struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	in     io.WriteCloser // compressing
+	out    io.ReadCloser  // decompressing
+	done   bool
+}
+
+func (z *zstdCmd) Write(p []byte) (int, error) { return z.in.Write(p) }
+
+// Read returns the error of zstd instead of io.EOF if it failed, e.g.
+// on corrupt data.
+func (z *zstdCmd) Read(p []byte) (int, error) {
+	n, err := z.out.Read(p)
+	if err == io.EOF && !z.done {
+		if e := z.wait(); e != nil {
+			err = e
+		}
+	}
+	return n, err
+}
+
+func (z *zstdCmd) Close() error {
+	if z.in != nil {
+		z.in.Close()
+		return z.wait()
+	}
+	if !z.done {
+		z.cmd.Process.Kill()
+		z.wait()
+	}
+	return nil
+}
+
+func (z *zstdCmd) wait() error {
+	z.done = true
+	if err := z.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(z.stderr.String()); msg != "" {
+			return perror("zstd: " + msg)
+		}
+		return perror("zstd: " + err.Error())
+	}
+	return nil
+}
+
+// ExportTar writes the file or directory name of the main tree to w as a
+// tar archive compressed with c. The entries of a directory are named
+// relative to it. Like Save, the archive shows the state at the time
+// ExportTar was called; synthetic files and the files of host
+// directories are left out.
+func (fs *FS) ExportTar(w io.Writer, name string, c Compression) error {
+	n, err := fs.walk(path.Clean(name))
+	if err != nil {
+		return err
+	}
+	fs.frozen.Lock()
+	root := freeze(n, nil, false)
+	fs.frozen.Unlock()
+
+	cw, err := compress(w, c)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	if root.dir.Mode&plan9.DMDIR != 0 {
+		err = writeTarDir(tw, root, "")
+	} else {
+		err = writeTar(tw, root, root.dir.Name)
+	}
+	if e := tw.Close(); err == nil {
+		err = e
+	}
+	if e := cw.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// writeTarDir writes the entries of the frozen directory dir, whose
+// entries are named with the prefix.
+func writeTarDir(tw *tar.Writer, dir *node, prefix string) error {
+	for _, name := range dir.names("", -1) {
+		c := dir.children[name]
+		if err := writeTar(tw, c, prefix+name); err != nil {
+			return err
+		}
+		if c.dir.Mode&plan9.DMDIR != 0 {
+			if err := writeTarDir(tw, c, prefix+name+"/"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeTar writes the header and data of the frozen file n as name.
+func writeTar(tw *tar.Writer, n *node, name string) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     int64(n.dir.Mode & 0777),
+		Uname:    n.dir.Uid,
+		Gname:    n.dir.Gid,
+		ModTime:  time.Unix(int64(n.dir.Mtime), 0),
+		Typeflag: tar.TypeReg,
+	}
+	if n.dir.Mode&plan9.DMDIR != 0 {
+		hdr.Name += "/"
+		hdr.Typeflag = tar.TypeDir
+	} else {
+		hdr.Size = int64(n.file.Len())
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Size == 0 {
+		return nil
+	}
+	_, err := io.Copy(tw, io.NewSectionReader(n.file, 0, hdr.Size))
+	return err
+}
+
+// ImportTar extracts the tar archive read from r into the directory name
+// of the main tree, as the hostowner. Archives compressed with gzip or
+// zstd are detected. Directories and regular files are created with the
+// permissions and modification times of the archive, existing files
+// are overwritten. Other entries, e.g. links, are skipped.
+func (fs *FS) ImportTar(r io.Reader, name string) error {
+	u, err := fs.As(fs.hostowner)
+	if err != nil {
+		return err
+	}
+	name = path.Clean(name)
+	dr, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	// the files get the permissions and times of the archive last, so
+	// read-only directories can be filled first
+	hdrs := make(map[*node]*tar.Header)
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p := path.Join(name, path.Clean("/"+hdr.Name))
+		if p == name {
+			continue
+		}
+		perm := Perm(hdr.Mode & 0777)
+		var n *node
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if n, err = fs.walk(p); err == nil && n.Stat().Mode&plan9.DMDIR == 0 {
+				return perror(p + ": not a directory")
+			}
+			if err != nil {
+				fid, err := u.Create(p, plan9.OREAD, plan9.DMDIR|perm)
+				if err != nil {
+					return err
+				}
+				fid.Close()
+				n = fid.node
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := u.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return err
+			}
+			n = f.fid.node
+		default:
+			continue
+		}
+		hdrs[n] = hdr
+	}
+	for n, hdr := range hdrs {
+		n.mu.Lock()
+		n.dir.Mode = n.dir.Mode&^0777 | plan9.Perm(hdr.Mode&0777)
+		n.dir.Mtime = uint32(hdr.ModTime.Unix())
+		n.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package ramfs
+
+import (
+	"path"
+
+	"9fans.net/go/plan9"
+)
+
+// UserFS gives access to the file server with the permissions of a
+// single user, as a 9P2000 client attached as that user would have.
+type UserFS struct {
+	fs  *FS
+	uid string
+	ro  error // errPerm for a read-only user
+}
+
+// As returns a handle acting as the user uname. The methods of FS act
+// as the hostowner. The handle of a read-only user cannot change files.
+func (fs *FS) As(uname string) (*UserFS, error) {
+	user, err := fs.group.Get(uname)
+	if err != nil {
+		return nil, err
+	}
+	u := &UserFS{fs: fs, uid: user.Name}
+	if fs.group.isReadOnly(u.uid) {
+		u.ro = errPerm
+	}
+	return u, nil
+}
+
+// Uid returns the user the handle acts as.
+func (u *UserFS) Uid() string { return u.uid }
+
+// walk returns the file name, which requires permission to search the
+// directories above it.
+func (u *UserFS) walk(name string) (*node, error) {
+	return walkRoot(u.fs.root, u.uid, name)
+}
+
+// Create creates the file name as described by FS.Create. It requires
+// write permission in the directory.
+func (u *UserFS) Create(name string, mode uint8, perm Perm) (*Fid, error) {
+	name = path.Clean(name)
+	dname, name := path.Dir(name), path.Base(name)
+	dir, err := u.walk(dname)
+	if err != nil {
+		return nil, err
+	}
+
+	fid := &Fid{uid: u.uid, node: dir, ro: u.ro}
+	if err := fid.Create(name, mode, perm); err != nil {
+		return nil, err
+	}
+	return fid, nil
+}
+
+// Open opens the file name as described by FS.Open.
+func (u *UserFS) Open(name string, mode uint8) (*Fid, error) {
+	node, err := u.walk(path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+
+	fid := &Fid{uid: u.uid, node: node, ro: u.ro}
+	if err := fid.Open(mode); err != nil {
+		return nil, err
+	}
+	return fid, nil
+}
+
+// Remove removes the file name, which requires write permission in its
+// directory.
+func (u *UserFS) Remove(name string) error {
+	node, err := u.walk(path.Clean(name))
+	if err != nil {
+		return err
+	}
+
+	fid := &Fid{uid: u.uid, node: node, ro: u.ro}
+	return fid.Remove()
+}
+
+// Stat returns a copy of the directory entry of the file name.
+func (u *UserFS) Stat(name string) (*plan9.Dir, error) {
+	node, err := u.walk(path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	dir := *node.Stat()
+	return &dir, nil
+}
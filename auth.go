@@ -0,0 +1,165 @@
+package ramfs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"9fans.net/go/plan9"
+)
+
+var errAuthFailed = perror("authentication failed")
+
+// An Authenticator proves the identity of the users attaching to the
+// file server. If FS.Auth is set, every Tattach must present an afid
+// on which a conversation started by Tauth succeeded for its uname.
+type Authenticator interface {
+	// Start begins the authentication of uname for aname. The client
+	// reads and writes the returned conversation through the afid.
+	Start(uname, aname string) (AuthConv, error)
+}
+
+// AuthConv is the server side of an authentication conversation.
+type AuthConv interface {
+	Buffer
+
+	// Authenticated reports whether the conversation proved the
+	// identity of the user.
+	Authenticated() bool
+}
+
+// SharedSecret is an Authenticator proving the identity of a user by a
+// secret shared between the user and the file server, keyed by uid.
+// Reading the afid returns a random challenge as a line of hex digits.
+// The client proves its identity by writing SecretResponse of its
+// secret and the challenge; a wrong response fails the conversation.
+type SharedSecret map[string]string
+
+// Start begins the conversation. Users without a secret are given a
+// challenge as well, but can't answer it.
+func (s SharedSecret) Start(uname, aname string) (AuthConv, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	secret, found := s[uname]
+	return &secretConv{challenge: hex.EncodeToString(nonce), secret: secret, known: found}, nil
+}
+
+// SecretResponse returns the response to a challenge of SharedSecret:
+// the hex encoded HMAC-SHA256 of the challenge keyed with secret.
+func SecretResponse(secret, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.TrimSpace(challenge)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type secretConv struct {
+	mu        sync.Mutex
+	challenge string
+	secret    string
+	known     bool
+	done      bool // answered, successfully or not
+	ok        bool
+}
+
+func (c *secretConv) ReadAt(p []byte, offset int64) (int, error) {
+	return readReport([]byte(c.challenge+"\n"), p, offset)
+}
+
+func (c *secretConv) WriteAt(p []byte, offset int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return 0, perror("authentication already done")
+	}
+	c.done = true
+	want := SecretResponse(c.secret, c.challenge)
+	if !c.known || !hmac.Equal([]byte(strings.TrimSpace(string(p))), []byte(want)) {
+		return 0, errAuthFailed
+	}
+	c.ok = true
+	return len(p), nil
+}
+
+func (c *secretConv) Len() uint64  { return uint64(0) }
+func (c *secretConv) Close() error { return nil }
+
+func (c *secretConv) Authenticated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ok
+}
+
+// newAuthNode creates an authentication file for uid in the root of the
+// filesystem. Authentication files are hidden from directory listings
+// and can't be walked to; they are reachable only through the afid of a
+// Tauth request and are removed when the afid is clunked.
+func (fs *FS) newAuthNode(uid string, b Buffer) (*node, error) {
+	path, err := fs.newPath()
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("#a%d", path)
+	n := newNode(fs, name, uid, "adm", 0600|plan9.DMAUTH, path, b)
+	n.parent = fs.root
+	n.orclose = true
+
+	fs.root.mu.Lock()
+	fs.root.link(name, n)
+	fs.root.mu.Unlock()
+	return n, nil
+}
+
+func isAuth(n *node) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.dir.Mode&plan9.DMAUTH != 0
+}
+
+// auth starts an authentication conversation for uname on the afid f,
+// which is opened for reading and writing the conversation.
+func (fs *FS) auth(f *Fid, uname, aname string) error {
+	if fs.Auth == nil {
+		return perror("authentication not required")
+	}
+	conv, err := fs.Auth.Start(uname, aname)
+	if err != nil {
+		return err
+	}
+	n, err := fs.newAuthNode(uname, conv)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node = n
+	f.uid = uname
+	f.opened = true
+	f.mode = plan9.ORDWR
+	return n.Open(f, plan9.ORDWR)
+}
+
+// checkAuth verifies that afid proves the identity of uname.
+func (fs *FS) checkAuth(afid *Fid, uname string) error {
+	if afid == nil {
+		return perror("authentication required")
+	}
+	afid.mu.RLock()
+	n, uid := afid.node, afid.uid
+	afid.mu.RUnlock()
+	if n == nil || !isAuth(n) {
+		return perror("not an authentication fid")
+	}
+	conv, ok := n.file.(AuthConv)
+	if !ok || uid != uname || !conv.Authenticated() {
+		return errAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package ramfs
+
+import (
+	"path"
+
+	"9fans.net/go/plan9"
+)
+
+// A CreateSpec describes a file or directory created by CreateBatch.
+type CreateSpec struct {
+	Name string // path of the file
+	Perm Perm   // permissions as in Create; DMDIR creates a directory
+	Data []byte // contents of a file
+}
+
+// CreateBatch creates the files and directories described by specs as
+// the hostowner, with permissions assigned as in Create. The parent
+// directory of each file must exist or be created by an earlier spec,
+// and can't be a host directory served by MountHost.
+// Unlike a sequence of Create calls, CreateBatch allocates all qid paths
+// at once, builds the new files before making them visible, and locks
+// each existing directory only once to insert its new entries, which
+// makes seeding many files, e.g. from a tar archive, faster.
+//
+// If a spec fails, CreateBatch returns its index and the error, and
+// none of the files are created. If a file of the same name is created
+// concurrently in an existing directory, CreateBatch fails as well, but
+// the files already inserted in other directories stay.
+func (fs *FS) CreateBatch(specs []CreateSpec) (int, error) {
+	user, err := fs.group.Get(fs.hostowner)
+	if err != nil {
+		return 0, err
+	}
+	uid := user.Name
+
+	paths, err := fs.newPaths(len(specs))
+	if err != nil {
+		return 0, err
+	}
+
+	b := &batch{
+		fs:      fs,
+		uid:     uid,
+		created: make(map[string]*node),
+		dirs:    make(map[string]*node),
+		entries: make(map[*node][]*node),
+	}
+	for i, spec := range specs {
+		if err := b.add(spec, paths[i]); err != nil {
+			b.discard()
+			for _, p := range paths[i:] {
+				fs.delPath(p)
+			}
+			return i, err
+		}
+	}
+	count, err := b.insert(len(specs))
+	if err != nil {
+		return count, err
+	}
+	for _, n := range b.nodes {
+		fs.created(n, uid, n.Stat().Length)
+	}
+	return count, nil
+}
+
+// newPaths allocates n qid paths in a single pass.
+func (fs *FS) newPaths(n int) ([]uint64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	paths := make([]uint64, 0, n)
+	for path := range fs.pathmap {
+		if len(paths) == n {
+			break
+		}
+		delete(fs.pathmap, path)
+		paths = append(paths, path)
+	}
+	for len(paths) < n {
+		if fs.path == maxPath {
+			for _, path := range paths {
+				fs.pathmap[path] = true
+			}
+			return nil, perror("out of paths")
+		}
+		paths = append(paths, fs.path)
+		fs.path++
+	}
+	return paths, nil
+}
+
+// batch holds the files of a CreateBatch call until they are inserted
+// in the existing directories.
+type batch struct {
+	fs      *FS
+	uid     string
+	created map[string]*node  // new files and directories by path
+	nodes   []*node           // new files and directories in order
+	dirs    map[string]*node  // existing directories by path
+	entries map[*node][]*node // new entries of existing directories
+	order   []*node           // existing directories in order of first use
+}
+
+// add builds the file described by spec with the qid path qpath.
+func (b *batch) add(spec CreateSpec, qpath uint64) error {
+	fs := b.fs
+	name := path.Clean(spec.Name)
+	dname, base := path.Dir(name), fs.normName(path.Base(name))
+	if err := fs.checkName(base); err != nil {
+		return err
+	}
+	if spec.Perm&DMAUTH != 0 {
+		return perror("can't create authentication file")
+	}
+	if spec.Perm&DMDIR != 0 && len(spec.Data) > 0 {
+		return perror("is a directory")
+	}
+	name = childPath(dname, base)
+	if _, found := b.created[name]; found {
+		return perror("file " + name + " exists")
+	}
+
+	dir, existing, err := b.dir(dname)
+	if err != nil {
+		return err
+	}
+	if !dir.HasPerm(b.uid, plan9.DMWRITE) {
+		return errPerm
+	}
+
+	dir.mu.RLock()
+	_, found := dir.children[base]
+	entries := len(dir.children)
+	gid := dir.newGid()
+	setgid, scratch := dir.setgid, dir.scratch
+	dir.mu.RUnlock()
+	if found {
+		return perror("file " + name + " exists")
+	}
+	if existing {
+		entries += len(b.entries[dir])
+	}
+	if max := fs.MaxEntries; max > 0 && entries >= max {
+		return perror("directory full")
+	}
+
+	perm := dir.createPerm(plan9.Perm(spec.Perm))
+	var buf Buffer
+	if perm&plan9.DMDIR == 0 {
+		buf = fs.newBuffer(name, Perm(perm), uint64(len(spec.Data)))
+	}
+	n := newNode(fs, base, b.uid, gid, perm, qpath, buf)
+	n.parent = dir
+	n.setgid = setgid && perm&plan9.DMDIR != 0
+	n.scratch = scratch
+	if len(spec.Data) > 0 {
+		if _, err := n.WriteAt(spec.Data, 0); err != nil {
+			return err
+		}
+	}
+
+	b.created[name] = n
+	b.nodes = append(b.nodes, n)
+	if existing {
+		if len(b.entries[dir]) == 0 {
+			b.order = append(b.order, dir)
+		}
+		b.entries[dir] = append(b.entries[dir], n)
+	} else {
+		dir.link(base, n)
+	}
+	return nil
+}
+
+// dir returns the directory name, which is either created by the batch
+// or already exists.
+func (b *batch) dir(name string) (*node, bool, error) {
+	if n, found := b.created[name]; found {
+		if n.dir.Mode&plan9.DMDIR == 0 {
+			return nil, false, perror("not a directory")
+		}
+		return n, false, nil
+	}
+	if n, found := b.dirs[name]; found {
+		return n, true, nil
+	}
+	n, err := b.fs.walk(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if n.Stat().Mode&plan9.DMDIR == 0 {
+		return nil, false, perror("not a directory")
+	}
+	if n.hostPath() != "" {
+		return nil, false, perror("can't create host files in batch")
+	}
+	b.dirs[name] = n
+	return n, true, nil
+}
+
+// insert makes the new files visible, locking each existing directory
+// once.
+func (b *batch) insert(count int) (int, error) {
+	fs := b.fs
+	fs.frozen.RLock()
+	defer fs.frozen.RUnlock()
+
+	for i, dir := range b.order {
+		entries := b.entries[dir]
+		dir.mu.Lock()
+		for _, n := range entries {
+			if _, found := dir.children[n.dir.Name]; found {
+				dir.mu.Unlock()
+				for _, d := range b.order[i:] {
+					b.discardEntries(b.entries[d])
+				}
+				return 0, perror("file " + childPath(dir.path(), n.dir.Name) + " exists")
+			}
+		}
+		for _, n := range entries {
+			dir.link(n.dir.Name, n)
+		}
+		dir.mu.Unlock()
+	}
+	return count, nil
+}
+
+// discard releases the qid paths and quota of all files of the batch.
+func (b *batch) discard() {
+	for _, dir := range b.order {
+		b.discardEntries(b.entries[dir])
+	}
+}
+
+func (b *batch) discardEntries(entries []*node) {
+	for _, n := range entries {
+		each(n, func(c *node) {
+			if c.charged() {
+				b.fs.quota.release(c.dir.Gid, c.dir.Length)
+			}
+			if c.file != nil {
+				c.file.Close()
+			}
+			b.fs.delPath(c.dir.Qid.Path)
+		})
+	}
+}
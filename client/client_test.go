@@ -0,0 +1,235 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9"
+	"github.com/mars9/ramfs"
+	"github.com/mars9/ramfs/client"
+)
+
+func pipe(t *testing.T, fs *ramfs.FS) *client.Conn {
+	server, rwc := net.Pipe()
+	go fs.ServeConn(server)
+	conn, err := client.NewConn(context.Background(), rwc)
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	return conn
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	conn := pipe(t, ramfs.New("adm"))
+	defer conn.Close()
+	fsys, err := conn.Attach(ctx, nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	defer fsys.Close()
+
+	dir, err := fsys.Create(ctx, "/a", plan9.OREAD, plan9.DMDIR|0775)
+	if err != nil {
+		t.Fatalf("create dir: %v", err)
+	}
+	dir.Close()
+	f, err := fsys.Create(ctx, "/a/file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// larger than a message
+	data := bytes.Repeat([]byte("0123456789"), client.DefaultMsize/4)
+	if n, err := f.WriteAt(data, 0); err != nil || n != len(data) {
+		t.Fatalf("write: %d %v", n, err)
+	}
+	buf := make([]byte, len(data)+10)
+	n, err := f.ReadAt(buf, 0)
+	if err != io.EOF || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("read: %d bytes, %v", n, err)
+	}
+	// overwrite and extend
+	data = append(bytes.ToUpper(data[:len(data)-100]), bytes.Repeat([]byte("x"), 1000)...)
+	if n, err := f.WriteAt(data[100:], 100); err != nil || n != len(data)-100 {
+		t.Fatalf("write: %d %v", n, err)
+	}
+	buf = make([]byte, len(data))
+	if n, err := f.ReadAt(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("read: %d bytes, %v", n, err)
+	}
+	f.Close()
+
+	d, err := fsys.Stat(ctx, "/a/file")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if d.Name != "file" || d.Length != uint64(len(data)) {
+		t.Fatalf("stat: unexpected name %q length %d", d.Name, d.Length)
+	}
+	d.Null()
+	d.Name = "renamed"
+	if err := fsys.Wstat(ctx, "/a/file", d); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	dirs, err := fsys.ReadDir(ctx, "/a")
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	if len(dirs) != 1 || dirs[0].Name != "renamed" {
+		t.Fatalf("readdir: unexpected entries %v", dirs)
+	}
+
+	if _, err := fsys.Open(ctx, "/a/file", plan9.OREAD); err == nil {
+		t.Fatalf("open: expected error for renamed file")
+	}
+	if _, err := fsys.Open(ctx, "/a/renamed/x", plan9.OREAD); err == nil {
+		t.Fatalf("open: expected error for walk through a file")
+	}
+	if err := fsys.Remove(ctx, "/a/renamed"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := fsys.Stat(ctx, "/a/renamed"); err == nil {
+		t.Fatalf("stat: expected error for removed file")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := fsys.Stat(canceled, "/a"); err != context.Canceled {
+		t.Fatalf("stat: expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	fs := ramfs.New("adm")
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fs.Serve(ln)
+	defer fs.Close()
+
+	ctx := context.Background()
+	pool := &client.Pool{Network: "tcp", Addr: ln.Addr().String(), MaxIdle: 1}
+	defer pool.Close()
+	a, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	b, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if a == b {
+		t.Fatalf("get: expected distinct connections")
+	}
+	pool.Put(a)
+	pool.Put(b) // exceeds MaxIdle
+	if err := b.Close(); err != client.ErrClosed {
+		t.Fatalf("expected connection above MaxIdle to be closed, got %v", err)
+	}
+	c, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if c != a {
+		t.Fatalf("get: expected idle connection")
+	}
+	fsys, err := c.Attach(ctx, nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, err := fsys.Stat(ctx, "/"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	fsys.Close()
+	pool.Put(c)
+}
+
+func TestClientFlush(t *testing.T) {
+	fs := ramfs.New("adm")
+	ctx := context.Background()
+	conn := pipe(t, fs)
+	defer conn.Close()
+	fsys, err := conn.Attach(ctx, nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	defer fsys.Close()
+
+	// concurrent requests are outstanding at the same time
+	fs.SetFaults(ramfs.Faults{Delay: 100 * time.Millisecond, DelayRate: 1})
+	start := time.Now()
+	var wg sync.WaitGroup
+	errc := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fsys.Stat(ctx, "/"); err != nil {
+				errc <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatalf("stat: %v", err)
+	}
+	if d := time.Since(start); d > 700*time.Millisecond {
+		t.Fatalf("stat: requests were not pipelined, took %v", d)
+	}
+
+	// a canceled request is flushed and the connection stays usable
+	fs.SetFaults(ramfs.Faults{Delay: time.Hour, DelayRate: 1})
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := fsys.Stat(timeout, "/"); err != context.DeadlineExceeded {
+		t.Fatalf("stat: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	fs.SetFaults(ramfs.Faults{})
+	if _, err := fsys.Stat(ctx, "/adm"); err != nil {
+		t.Fatalf("stat after flush: %v", err)
+	}
+
+	// the fid of a flushed remove is not reused
+	f, err := fsys.Create(ctx, "/file", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.Close()
+	fs.SetFaults(ramfs.Faults{Delay: 100 * time.Millisecond, DelayRate: 1})
+	timeout, cancel = context.WithTimeout(ctx, 150*time.Millisecond)
+	defer cancel()
+	if err := fsys.Remove(timeout, "/file"); err != context.DeadlineExceeded {
+		t.Fatalf("remove: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	fs.SetFaults(ramfs.Faults{})
+	if _, err := fsys.Stat(ctx, "/file"); err != nil {
+		t.Fatalf("stat after flushed remove: %v", err)
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	os.Setenv("NAMESPACE", filepath.FromSlash("/tmp/ns.test"))
+	defer os.Unsetenv("NAMESPACE")
+
+	tests := []struct {
+		name, path string
+	}{
+		{"ramfs", "/tmp/ns.test/ramfs"},
+		{"/run/ramfs.sock", "/run/ramfs.sock"},
+		{"run//ramfs", "run/ramfs"},
+	}
+	for _, tt := range tests {
+		if path := client.SocketPath(tt.name); path != filepath.FromSlash(tt.path) {
+			t.Errorf("%s: expected %s, got %s", tt.name, filepath.FromSlash(tt.path), path)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Package client implements a 9P2000 client for ramfs and other 9P2000
+// file servers.
+//
+// A Conn is a connection to a file server, an Fsys a tree attached on
+// it and a File an open file of the tree:
+//
+//	conn, err := client.Dial(ctx, "tcp", "localhost:5640")
+//	...
+//	fsys, err := conn.Attach(ctx, nil, "glenda", "")
+//	...
+//	f, err := fsys.Open(ctx, "/lib/profile", plan9.OREAD)
+//	...
+//	n, err := f.ReadAt(buf, 0)
+//
+// All methods taking a context abandon the request once the context is
+// done.
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"9fans.net/go/plan9"
+)
+
+// DefaultMsize is the maximum message size proposed to the server.
+const DefaultMsize = 128*1024 + plan9.IOHDRSZ
+
+// Error is an error reported by the file server or the protocol.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrClosed is returned by the methods of a closed connection.
+var ErrClosed = Error("connection closed")
+
+// Conn is a connection to a 9P2000 file server. It is safe for
+// concurrent use: requests are sent as soon as they are issued and may
+// be answered in any order.
+type Conn struct {
+	rwc   io.ReadWriteCloser
+	msize uint32
+
+	wmu sync.Mutex // serializes writes of rwc
+
+	mu   sync.Mutex
+	tags map[uint16]chan *plan9.Fcall
+	tag  uint16 // next tag tried
+	err  error  // set once the connection is unusable
+
+	fidmu sync.Mutex
+	next  uint32
+	free  []uint32
+}
+
+// Dial connects to the file server at the given network address and
+// negotiates the protocol version.
+func Dial(ctx context.Context, network, addr string) (*Conn, error) {
+	var d net.Dialer
+	rwc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(ctx, rwc)
+}
+
+// NewConn negotiates the protocol version on rwc and returns the
+// connection using it. rwc is closed if the negotiation fails.
+func NewConn(ctx context.Context, rwc io.ReadWriteCloser) (*Conn, error) {
+	c := &Conn{rwc: rwc, msize: DefaultMsize, tags: make(map[uint16]chan *plan9.Fcall)}
+	rx, err := c.version(ctx)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	if rx.Msize < c.msize {
+		c.msize = rx.Msize
+	}
+	go c.recv()
+	return c, nil
+}
+
+// version negotiates the protocol version before any other request is
+// outstanding.
+func (c *Conn) version(ctx context.Context) (*plan9.Fcall, error) {
+	type result struct {
+		rx  *plan9.Fcall
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		tx := &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: c.msize, Version: "9P2000"}
+		if err := plan9.WriteFcall(c.rwc, tx); err != nil {
+			done <- result{nil, err}
+			return
+		}
+		rx, err := plan9.ReadFcall(c.rwc)
+		done <- result{rx, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		c.rwc.Close()
+		return nil, ctx.Err()
+	}
+	switch {
+	case r.err != nil:
+		return nil, r.err
+	case r.rx.Type == plan9.Rerror:
+		return nil, Error(r.rx.Ename)
+	case r.rx.Type != plan9.Rversion:
+		return nil, Error("unexpected reply " + r.rx.String())
+	case r.rx.Version != "9P2000":
+		return nil, Error("unsupported version " + r.rx.Version)
+	}
+	return r.rx, nil
+}
+
+// Msize returns the negotiated maximum message size.
+func (c *Conn) Msize() uint32 { return c.msize }
+
+// Close closes the connection. Outstanding requests fail with
+// ErrClosed and the fids of the connection are released by the server.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err == ErrClosed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.err = ErrClosed
+	c.mu.Unlock()
+	return c.rwc.Close()
+}
+
+// broken reports whether the connection is unusable.
+func (c *Conn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// recv reads the replies and hands them to the requests waiting for
+// them, until the connection fails.
+func (c *Conn) recv() {
+	for {
+		rx, err := plan9.ReadFcall(c.rwc)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch, found := c.tags[rx.Tag]
+		if found {
+			ch <- rx // never blocks, a tag is answered once
+		}
+		c.mu.Unlock()
+		if !found {
+			c.fail(Error("unexpected reply " + rx.String()))
+			return
+		}
+	}
+}
+
+// fail makes the connection unusable and wakes all outstanding
+// requests.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	for tag, ch := range c.tags {
+		close(ch)
+		delete(c.tags, tag)
+	}
+	c.mu.Unlock()
+	c.rwc.Close()
+}
+
+// newTag registers a new outstanding request.
+func (c *Conn) newTag() (uint16, chan *plan9.Fcall, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	if len(c.tags) >= plan9.NOTAG {
+		return 0, nil, Error("too many outstanding requests")
+	}
+	for {
+		tag := c.tag
+		c.tag++
+		if c.tag == plan9.NOTAG {
+			c.tag = 0
+		}
+		if _, found := c.tags[tag]; !found {
+			// buffered, so a reply to a flushed request is dropped
+			ch := make(chan *plan9.Fcall, 1)
+			c.tags[tag] = ch
+			return tag, ch, nil
+		}
+	}
+}
+
+// freeTag releases tag once its reply was received or it was flushed.
+func (c *Conn) freeTag(tag uint16) {
+	c.mu.Lock()
+	delete(c.tags, tag)
+	c.mu.Unlock()
+}
+
+// send writes tx.
+func (c *Conn) send(tx *plan9.Fcall) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := plan9.WriteFcall(c.rwc, tx); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// rpc sends tx and waits for the reply. Once ctx is done, tx is
+// flushed and the error of ctx returned.
+func (c *Conn) rpc(ctx context.Context, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tag, ch, err := c.newTag()
+	if err != nil {
+		return nil, err
+	}
+	tx.Tag = tag
+	if err := c.send(tx); err != nil {
+		return nil, err
+	}
+
+	var rx *plan9.Fcall
+	select {
+	case rx = <-ch:
+		c.freeTag(tag)
+	case <-ctx.Done():
+		c.flush(tag)
+		return nil, ctx.Err()
+	}
+	switch {
+	case rx == nil:
+		return nil, c.closedErr()
+	case rx.Type == plan9.Rerror:
+		return nil, Error(rx.Ename)
+	case rx.Type != tx.Type+1:
+		err := Error("unexpected reply " + rx.String())
+		c.fail(err)
+		return nil, err
+	}
+	return rx, nil
+}
+
+// flush flushes the outstanding request tag. The tag is reused only
+// after the server answered the flush, as the reply to the request may
+// arrive before.
+func (c *Conn) flush(oldtag uint16) {
+	tag, flushed, err := c.newTag()
+	if err != nil {
+		return
+	}
+	if c.send(&plan9.Fcall{Type: plan9.Tflush, Tag: tag, Oldtag: oldtag}) != nil {
+		return
+	}
+	go func() {
+		<-flushed
+		c.freeTag(tag)
+		c.freeTag(oldtag)
+	}()
+}
+
+// closedErr returns the error that made the connection unusable.
+func (c *Conn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// newFid returns an unused fid number.
+func (c *Conn) newFid() uint32 {
+	c.fidmu.Lock()
+	defer c.fidmu.Unlock()
+	if n := len(c.free); n > 0 {
+		fid := c.free[n-1]
+		c.free = c.free[:n-1]
+		return fid
+	}
+	fid := c.next
+	c.next++
+	return fid
+}
+
+// putFid releases fid for reuse.
+func (c *Conn) putFid(fid uint32) {
+	c.fidmu.Lock()
+	c.free = append(c.free, fid)
+	c.fidmu.Unlock()
+}
+
+// dropFid releases fid after a failed request creating or clunking it.
+// If the request was flushed, the server may have created fid or kept
+// it nevertheless, so it is never reused.
+func (c *Conn) dropFid(ctx context.Context, fid uint32) {
+	if ctx.Err() == nil {
+		c.putFid(fid)
+	}
+}
+
+// clunk clunks fid and releases it. The server forgets the fid even if
+// the clunk fails, unless it was flushed.
+func (c *Conn) clunk(ctx context.Context, fid uint32) error {
+	_, err := c.rpc(ctx, &plan9.Fcall{Type: plan9.Tclunk, Fid: fid})
+	c.dropFid(ctx, fid)
+	return err
+}
+
+// Auth returns the authentication file the user uname proves its
+// identity through, before attaching to the tree aname.
+func (c *Conn) Auth(ctx context.Context, uname, aname string) (*File, error) {
+	afid := c.newFid()
+	rx, err := c.rpc(ctx, &plan9.Fcall{Type: plan9.Tauth, Afid: afid, Uname: uname, Aname: aname})
+	if err != nil {
+		c.dropFid(ctx, afid)
+		return nil, err
+	}
+	return c.file(afid, rx.Aqid, 0), nil
+}
+
+// Attach attaches the user uname to the tree aname of the file server.
+// afid is the authentication file returned by Auth, or nil if the
+// server requires no authentication.
+func (c *Conn) Attach(ctx context.Context, afid *File, uname, aname string) (*Fsys, error) {
+	tx := &plan9.Fcall{Type: plan9.Tattach, Fid: c.newFid(), Afid: plan9.NOFID, Uname: uname, Aname: aname}
+	if afid != nil {
+		tx.Afid = afid.fid
+	}
+	if _, err := c.rpc(ctx, tx); err != nil {
+		c.dropFid(ctx, tx.Fid)
+		return nil, err
+	}
+	return &Fsys{c: c, fid: tx.Fid}, nil
+}
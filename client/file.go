@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"9fans.net/go/plan9"
+)
+
+// File is an open file of a file server.
+type File struct {
+	c      *Conn
+	fid    uint32
+	qid    plan9.Qid
+	iounit uint32
+}
+
+// file returns the open file fid. An iounit of 0 is replaced by the
+// largest count fitting a message.
+func (c *Conn) file(fid uint32, qid plan9.Qid, iounit uint32) *File {
+	if max := c.msize - plan9.IOHDRSZ; iounit == 0 || iounit > max {
+		iounit = max
+	}
+	return &File{c: c, fid: fid, qid: qid, iounit: iounit}
+}
+
+// Qid returns the qid of the file.
+func (f *File) Qid() plan9.Qid { return f.qid }
+
+// Close clunks the file.
+func (f *File) Close() error {
+	return f.c.clunk(context.Background(), f.fid)
+}
+
+// Stat returns the directory entry of the file.
+func (f *File) Stat(ctx context.Context) (*plan9.Dir, error) {
+	return f.c.stat(ctx, f.fid)
+}
+
+// Wstat changes the directory entry of the file to d.
+func (f *File) Wstat(ctx context.Context, d *plan9.Dir) error {
+	return f.c.wstat(ctx, f.fid, d)
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext reads len(p) bytes at offset off into p. Reads larger
+// than a message are split into several requests, which are sent
+// without waiting for the replies. It returns io.EOF if the file ends
+// before.
+func (f *File) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := f.pipeline(ctx, p[n:], off+int64(n), f.read)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// read reads up to iounit bytes at offset off into p.
+func (f *File) read(ctx context.Context, p []byte, off int64) (int, error) {
+	count := uint32(len(p))
+	if count > f.iounit {
+		count = f.iounit
+	}
+	rx, err := f.c.rpc(ctx, &plan9.Fcall{Type: plan9.Tread, Fid: f.fid, Offset: uint64(off), Count: count})
+	if err == Error("EOF") {
+		// ramfs reports reads beyond the end of a file as an error
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rx.Data) == 0 {
+		return 0, io.EOF
+	}
+	return copy(p, rx.Data), nil
+}
+
+// WriteAt implements io.WriterAt.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext writes p at offset off. Writes larger than a message
+// are split into several requests. Those overwriting data of the file
+// are sent without waiting for the replies; those extending it are sent
+// one at a time, as ramfs appends data written beyond the end of a file
+// at its end.
+func (f *File) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	var n int
+	if len(p) > int(f.iounit) && f.qid.Type&plan9.QTAPPEND == 0 {
+		d, err := f.Stat(ctx)
+		if err != nil {
+			return 0, err
+		}
+		inside := int64(d.Length) - off
+		if inside > int64(len(p)) {
+			inside = int64(len(p))
+		}
+		for int64(n) < inside {
+			m, err := f.pipeline(ctx, p[n:inside], off+int64(n), f.write)
+			n += m
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	for first := n == 0; first || n < len(p); first = false {
+		m, err := f.write(ctx, p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// maxPipeline is the maximum number of requests of a transfer sent
+// without waiting for the replies.
+const maxPipeline = 16
+
+// pipeline transfers p at offset off with up to maxPipeline concurrent
+// calls of fn, each for up to iounit bytes. It returns the number of
+// bytes transferred before the first short or failed call.
+func (f *File) pipeline(ctx context.Context, p []byte, off int64, fn func(context.Context, []byte, int64) (int, error)) (int, error) {
+	if len(p) <= int(f.iounit) || f.qid.Type&(plan9.QTDIR|plan9.QTAPPEND) != 0 {
+		return fn(ctx, p, off)
+	}
+	var chunks [][]byte
+	for len(p) > 0 && len(chunks) < maxPipeline {
+		k := len(p)
+		if k > int(f.iounit) {
+			k = int(f.iounit)
+		}
+		chunks, p = append(chunks, p[:k]), p[k:]
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	results := make([]result, len(chunks))
+	var wg sync.WaitGroup
+	for i, b := range chunks {
+		wg.Add(1)
+		go func(i int, b []byte, off int64) {
+			results[i].n, results[i].err = fn(ctx, b, off)
+			wg.Done()
+		}(i, b, off)
+		off += int64(len(b))
+	}
+	wg.Wait()
+
+	var n int
+	for i, r := range results {
+		n += r.n
+		if r.err != nil || r.n < len(chunks[i]) {
+			return n, r.err
+		}
+	}
+	return n, nil
+}
+
+// write writes up to iounit bytes of p at offset off.
+func (f *File) write(ctx context.Context, p []byte, off int64) (int, error) {
+	if len(p) > int(f.iounit) {
+		p = p[:f.iounit]
+	}
+	rx, err := f.c.rpc(ctx, &plan9.Fcall{Type: plan9.Twrite, Fid: f.fid, Offset: uint64(off), Data: p})
+	if err != nil {
+		return 0, err
+	}
+	if rx.Count == 0 && len(p) > 0 {
+		return 0, io.ErrShortWrite
+	}
+	return int(rx.Count), nil
+}
+
+// ReadDir returns the entries of the open directory.
+func (f *File) ReadDir(ctx context.Context) ([]*plan9.Dir, error) {
+	var dirs []*plan9.Dir
+	buf := make([]byte, f.iounit)
+	for off := int64(0); ; {
+		n, err := f.read(ctx, buf, off)
+		if err == io.EOF {
+			return dirs, nil
+		}
+		if err != nil {
+			return dirs, err
+		}
+		off += int64(n)
+		for b := buf[:n]; len(b) > 0; {
+			if len(b) < 2 {
+				return dirs, Error("short directory entry")
+			}
+			size := int(b[0]) | int(b[1])<<8 + 2
+			if len(b) < size {
+				return dirs, Error("short directory entry")
+			}
+			d, err := plan9.UnmarshalDir(b[:size])
+			if err != nil {
+				return dirs, err
+			}
+			dirs = append(dirs, d)
+			b = b[size:]
+		}
+	}
+}
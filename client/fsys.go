@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"9fans.net/go/plan9"
+)
+
+// Fsys is a tree of a file server attached by a user. Names are
+// interpreted relative to the root of the tree.
+type Fsys struct {
+	c   *Conn
+	fid uint32
+}
+
+// Conn returns the connection the tree is attached on.
+func (fs *Fsys) Conn() *Conn { return fs.c }
+
+// Close clunks the root of the tree.
+func (fs *Fsys) Close() error {
+	return fs.c.clunk(context.Background(), fs.fid)
+}
+
+// walk returns a new fid for the file name.
+func (fs *Fsys) walk(ctx context.Context, name string) (uint32, error) {
+	var elems []string
+	for _, e := range strings.Split(name, "/") {
+		if e != "" && e != "." {
+			elems = append(elems, e)
+		}
+	}
+
+	fid := fs.c.newFid()
+	tx := &plan9.Fcall{Type: plan9.Twalk, Fid: fs.fid, Newfid: fid}
+	for first := true; first || len(elems) > 0; first = false {
+		n := len(elems)
+		if n > plan9.MAXWELEM {
+			n = plan9.MAXWELEM
+		}
+		tx.Wname = elems[:n]
+		rx, err := fs.c.rpc(ctx, tx)
+		if err == nil && len(rx.Wqid) < n {
+			err = Error("file does not exist")
+		}
+		if err != nil {
+			if first {
+				fs.c.dropFid(ctx, fid)
+			} else {
+				fs.c.clunk(context.Background(), fid)
+			}
+			return 0, err
+		}
+		elems = elems[n:]
+		tx.Fid = fid
+	}
+	return fid, nil
+}
+
+// Open opens the file name with the given mode.
+func (fs *Fsys) Open(ctx context.Context, name string, mode uint8) (*File, error) {
+	fid, err := fs.walk(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rx, err := fs.c.rpc(ctx, &plan9.Fcall{Type: plan9.Topen, Fid: fid, Mode: mode})
+	if err != nil {
+		fs.c.clunk(context.Background(), fid)
+		return nil, err
+	}
+	return fs.c.file(fid, rx.Qid, rx.Iounit), nil
+}
+
+// Create creates the file name with the given permissions and opens it
+// with mode.
+func (fs *Fsys) Create(ctx context.Context, name string, mode uint8, perm plan9.Perm) (*File, error) {
+	dir, elem := path.Split(name)
+	fid, err := fs.walk(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	rx, err := fs.c.rpc(ctx, &plan9.Fcall{Type: plan9.Tcreate, Fid: fid, Name: elem, Mode: mode, Perm: perm})
+	if err != nil {
+		fs.c.clunk(context.Background(), fid)
+		return nil, err
+	}
+	return fs.c.file(fid, rx.Qid, rx.Iounit), nil
+}
+
+// Remove removes the file name.
+func (fs *Fsys) Remove(ctx context.Context, name string) error {
+	fid, err := fs.walk(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = fs.c.rpc(ctx, &plan9.Fcall{Type: plan9.Tremove, Fid: fid})
+	fs.c.dropFid(ctx, fid)
+	return err
+}
+
+// Stat returns the directory entry of the file name.
+func (fs *Fsys) Stat(ctx context.Context, name string) (*plan9.Dir, error) {
+	fid, err := fs.walk(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.c.clunk(context.Background(), fid)
+	return fs.c.stat(ctx, fid)
+}
+
+// Wstat changes the directory entry of the file name to d. Fields of d
+// set to their don't touch values, see plan9.Dir.Null, are left
+// unchanged.
+func (fs *Fsys) Wstat(ctx context.Context, name string, d *plan9.Dir) error {
+	fid, err := fs.walk(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer fs.c.clunk(context.Background(), fid)
+	return fs.c.wstat(ctx, fid, d)
+}
+
+// ReadDir returns the entries of the directory name.
+func (fs *Fsys) ReadDir(ctx context.Context, name string) ([]*plan9.Dir, error) {
+	f, err := fs.Open(ctx, name, plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadDir(ctx)
+}
+
+func (c *Conn) stat(ctx context.Context, fid uint32) (*plan9.Dir, error) {
+	rx, err := c.rpc(ctx, &plan9.Fcall{Type: plan9.Tstat, Fid: fid})
+	if err != nil {
+		return nil, err
+	}
+	return plan9.UnmarshalDir(rx.Stat)
+}
+
+func (c *Conn) wstat(ctx context.Context, fid uint32, d *plan9.Dir) error {
+	stat, err := d.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = c.rpc(ctx, &plan9.Fcall{Type: plan9.Twstat, Fid: fid, Stat: stat})
+	return err
+}
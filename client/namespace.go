@@ -0,0 +1,34 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	p9client "9fans.net/go/plan9/client"
+)
+
+// Namespace returns the name space directory holding the Unix domain
+// sockets of posted services: $NAMESPACE if set, otherwise the directory
+// of plan9port, or a directory in the temporary directory on Windows,
+// where the plan9port name contains characters invalid in file names.
+func Namespace() string {
+	if runtime.GOOS != "windows" {
+		return p9client.Namespace()
+	}
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns
+	}
+	return filepath.Join(os.TempDir(), "ns."+os.Getenv("USERNAME"))
+}
+
+// SocketPath returns the path of the Unix domain socket of the service
+// name in the name space directory. A name containing a path separator
+// is a path already and returned cleaned.
+func SocketPath(name string) string {
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		return filepath.Clean(name)
+	}
+	return filepath.Join(Namespace(), name)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// A Pool keeps idle connections to a file server for reuse. The zero
+// value must be given Network and Addr before use.
+type Pool struct {
+	Network string
+	Addr    string
+
+	// MaxIdle is the maximum number of idle connections kept. If zero,
+	// two connections are kept.
+	MaxIdle int
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// Get returns an idle connection of the pool, or dials a new one.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !c.broken() {
+			p.mu.Unlock()
+			return c, nil
+		}
+	}
+	p.mu.Unlock()
+	return Dial(ctx, p.Network, p.Addr)
+}
+
+// Put returns c to the pool. All trees attached on c must be closed
+// before. Broken connections and connections exceeding MaxIdle are
+// closed.
+func (p *Pool) Put(c *Conn) {
+	max := p.MaxIdle
+	if max == 0 {
+		max = 2
+	}
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < max && !c.broken() {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Close closes the idle connections. Connections put back later are
+// closed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
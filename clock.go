@@ -0,0 +1,17 @@
+package ramfs
+
+import "time"
+
+// A Clock tells the time used for the modification and access times of
+// files and for the expiry of scratch files.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the time of the clock of the file server.
+func (fs *FS) now() time.Time {
+	if fs == nil || fs.Clock == nil {
+		return time.Now()
+	}
+	return fs.Clock.Now()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFile returns the name of the configuration file, which is
+// $RACON_CONFIG or racon/config in the user configuration directory,
+// usually ~/.config/racon/config.
+func configFile() string {
+	if name := os.Getenv("RACON_CONFIG"); name != "" {
+		return name
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "racon", "config")
+}
+
+// A config holds the options of the configuration file: the defaults
+// and those of each profile.
+type config struct {
+	name     string
+	defaults []option
+	profiles map[string][]option
+}
+
+type option struct {
+	line       int
+	key, value string
+}
+
+// readConfig reads the configuration file name, if it exists. Each line
+// holds an option name and its value, e.g. "addr build.local:5640".
+// Options following a line "[name]" belong to the profile name and are
+// used only if it is selected with -s; those before the first profile
+// are defaults. Blank lines and lines starting with # are ignored.
+func readConfig(name string) (*config, error) {
+	c := &config{name: name, profiles: make(map[string][]option)}
+	if name == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			profile = strings.TrimSpace(line[1 : len(line)-1])
+			if _, found := c.profiles[profile]; found || profile == "" {
+				return nil, fmt.Errorf("%s:%d: bad or duplicate profile %q", name, i+1, profile)
+			}
+			c.profiles[profile] = nil
+			continue
+		}
+		key, value := line, ""
+		if n := strings.IndexAny(line, " \t"); n >= 0 {
+			key, value = line[:n], strings.TrimSpace(line[n:])
+		}
+		if flag.Lookup(key) == nil || key == "s" {
+			return nil, fmt.Errorf("%s:%d: unknown option %s", name, i+1, key)
+		}
+		o := option{i + 1, key, value}
+		if profile == "" {
+			c.defaults = append(c.defaults, o)
+		} else {
+			c.profiles[profile] = append(c.profiles[profile], o)
+		}
+	}
+	return c, nil
+}
+
+// apply sets the options of profile, or the defaults for the empty
+// profile, except those in skip. They become the default values of the
+// options.
+func (c *config) apply(profile string, skip map[string]bool) error {
+	opts := c.defaults
+	if profile != "" {
+		var found bool
+		if opts, found = c.profiles[profile]; !found {
+			return fmt.Errorf("profile %s not found in %s", profile, c.name)
+		}
+	}
+	for _, o := range opts {
+		if skip[o.key] {
+			continue
+		}
+		if err := setDefault(o.key, o.value); err != nil {
+			return fmt.Errorf("%s:%d: %v", c.name, o.line, err)
+		}
+	}
+	return nil
+}
+
+// envOptions sets options from the environment variables named prefix
+// followed by the upper-case option name, e.g. RACON_ADDR.
+func envOptions(prefix string) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, found := os.LookupEnv(prefix + strings.ToUpper(f.Name))
+		if !found || err != nil {
+			return
+		}
+		if e := flag.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s%s: %v", prefix, strings.ToUpper(f.Name), e)
+		}
+	})
+	return err
+}
+
+// setDefault sets the option key without marking it as set on the
+// command line.
+func setDefault(key, value string) error {
+	f := flag.Lookup(key)
+	if value == "" {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			value = "true"
+		}
+	}
+	if err := f.Value.Set(value); err != nil {
+		return fmt.Errorf("option %s: %v", key, err)
+	}
+	return nil
+}
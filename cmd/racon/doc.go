@@ -9,20 +9,66 @@ Options:
   -addr="localhost:5640": service network address
   -aname="": attach to the file system named aname
   -d=false: make directories
+  -i=1s: polling interval of wait
+  -keyfile="": authenticate with the secret read from file
   -l=false: use a long listing format
+  -n=1: number of ping requests
   -net="tcp": connect on the named network
-  -snappy=false: use snappy en-/decompression
+  -progress=false: report throughput and ETA of transfers on stderr
+  -quiet=false: report errors only by the exit status
+  -resume=false: continue an interrupted put or get; needs access to /adm/ctl
+  -s="": use the server profile of the config file
+  -snappy=false: transfer data snappy compressed
   -uname="$USER": username (default: $USER)
+  -v=false: print every status field
 
 Commands:
-  chgrp group file... - change file group
-  chmod mode file...  - change file modes
-  create [-d] file... - make directories or files
-  ls [-l] file        - list contents of directory of file
-  mount mntpt         - mount remote filesystem
-  noop                - send attach request
-  read file...        - write the contents of file to stdout
-  stat file...        - write status information to stdout
-  write file          - read stdin and write contents to file
+  chgrp group file...      - change file group
+  chmod mode file...       - change file modes
+  create [-d] file...      - make directories or files
+  diff old file            - list files added, removed or modified since old
+  get [-resume] file local - copy file to the local file
+  ls [-l] file             - list contents of directory of file
+  mount mntpt              - mount remote filesystem
+  ping [-n count]          - measure version, attach and stat latency
+  put [-resume] local file - copy the local file to file
+  read file...             - write the contents of file to stdout
+  stat [-v] file...        - write status information to stdout
+  truncate length file...  - set the length of files
+  wait [-i interval] file  - wait until file is created, changed or removed
+  write file               - read stdin and write contents to file
+
+Options are set, in increasing order of precedence, by the
+configuration file, by environment variables and on the command line.
+The configuration file $RACON_CONFIG, by default
+~/.config/racon/config, holds an option name and value per line:
+
+  # build server
+  addr build.local:5640
+  uname glenda
+
+Options following a line "[profile]" form a server profile, which is
+used with -s profile and overrides the options before the first
+profile. Profiles name servers together with the credentials used for
+them:
+
+  [cache]
+  addr cache.local:5640
+  uname build
+  aname cache
+
+Each option can also be set by the environment variable RACON_ followed
+by the upper-case option name, e.g. RACON_ADDR or RACON_UNAME. Options
+set by the environment or on the command line override the profile.
+
+Commands taking several files continue with the next file after an
+error. Each error is reported on stderr in a single line of the form
+
+  racon: op file: error
+
+where file is quoted as a Go string if it contains blanks, colons or
+unprintable characters. The exit status is 0 if all operations
+succeeded, 1 if any failed, 2 for a bad command line and 3 if the
+connection to the server could not be established.
 */
 package main
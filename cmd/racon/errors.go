@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Exit statuses of racon.
+const (
+	exitOK    = 0 // all operations succeeded
+	exitFail  = 1 // at least one operation failed
+	exitUsage = 2 // bad command line
+	exitConn  = 3 // connecting or attaching to the server failed
+)
+
+// status is the exit status after all operations are done.
+var status = exitOK
+
+// warn reports that op failed on name and continues with the next
+// operation. racon then exits with exitFail.
+func warn(op, name string, err error) {
+	printError(op, name, err)
+	status = exitFail
+}
+
+// fatal reports that op failed on name and exits with code.
+func fatal(code int, op, name string, err error) {
+	printError(op, name, err)
+	os.Exit(code)
+}
+
+// usageError reports a bad command line and exits with exitUsage.
+func usageError(format string, a ...interface{}) {
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "racon: usage: "+format+"\n", a...)
+	}
+	os.Exit(exitUsage)
+}
+
+// printError writes the error line "racon: op name: error" to stderr
+// unless -quiet is set. The name is quoted if it contains blanks or
+// colons, so the line can be split at the first ": " following it.
+func printError(op, name string, err error) {
+	if *quiet {
+		return
+	}
+	msg := strings.Replace(err.Error(), "\n", " ", -1)
+	switch {
+	case name == "":
+		fmt.Fprintf(os.Stderr, "racon: %s: %s\n", op, msg)
+	case strings.ContainsAny(name, " \t\n:\"") || !strconv.CanBackquote(name):
+		fmt.Fprintf(os.Stderr, "racon: %s %s: %s\n", op, strconv.Quote(name), msg)
+	default:
+		fmt.Fprintf(os.Stderr, "racon: %s %s: %s\n", op, name, msg)
+	}
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"9fans.net/go/plan9"
 	"9fans.net/go/plan9/client"
 	"code.google.com/p/snappy-go/snappy"
+	rclient "github.com/mars9/ramfs/client"
 )
 
 const (
@@ -24,9 +32,17 @@ var (
 	network = flag.String("net", "tcp", "connect on the named network")
 	mkdir   = flag.Bool("d", false, "make directories")
 	long    = flag.Bool("l", false, "use a long listing format")
-	uname   = flag.String("uname", os.Getenv("USER"), "username (default: $USER)")
+	uname   = flag.String("uname", currentUser(), "username (default: $USER)")
 	aname   = flag.String("aname", "", "attach to the file system named aname")
-	comp    = flag.Bool("snappy", false, "use snappy en-/decompression")
+	comp    = flag.Bool("snappy", false, "transfer data snappy compressed")
+	count   = flag.Int("n", 1, "number of ping requests")
+	poll    = flag.Duration("i", time.Second, "polling interval of wait")
+	resume  = flag.Bool("resume", false, "continue an interrupted put or get; needs access to /adm/ctl")
+	report  = flag.Bool("progress", false, "report throughput and ETA of transfers on stderr")
+	quiet   = flag.Bool("quiet", false, "report errors only by the exit status")
+	verbose = flag.Bool("v", false, "print every status field")
+	server  = flag.String("s", "", "use the server profile of the config file")
+	keyfile = flag.String("keyfile", "", "authenticate with the secret read from file")
 )
 
 const usageMsg = `
@@ -62,6 +78,8 @@ func usage() {
 			}
 		case 2:
 			name = fmt.Sprintf("%s %s file", n, c.text)
+		case 5:
+			name = fmt.Sprintf("%s %s file local", n, c.text)
 		case 3:
 			if len(c.text) != 0 {
 				name = fmt.Sprintf("%s %s file...", n, c.text)
@@ -80,16 +98,28 @@ func usage() {
 	}
 	names = append(names, "mount mntpt")
 	help["mount mntpt"] = "mount remote filesystem"
+	names = append(names, "ping [-n count]")
+	help["ping [-n count]"] = "measure version, attach and stat latency"
 
 	sort.Strings(names)
 	for _, n := range names {
 		fmt.Fprintf(os.Stderr, "  %-*s - %s\n", max, n, help[n])
 	}
-	os.Exit(2)
+	os.Exit(exitUsage)
 }
 
 func main() {
 	flag.Usage = usage
+	conf, err := readConfig(configFile())
+	if err != nil {
+		fatal(exitUsage, "config", "", err)
+	}
+	if err := conf.apply("", nil); err != nil {
+		fatal(exitUsage, "config", "", err)
+	}
+	if err := envOptions("RACON_"); err != nil {
+		fatal(exitUsage, "environment", "", err)
+	}
 	flag.Parse()
 	if flag.NArg() < 1 {
 		flag.Usage()
@@ -99,63 +129,78 @@ func main() {
 	os.Args = flag.Args()
 	flag.Parse()
 	args := flag.Args()
-	xprint := func(code int, format string, a ...interface{}) {
-		fmt.Fprintf(os.Stderr, format, a...)
-		os.Exit(code)
+	if *server != "" {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if err := conf.apply(*server, set); err != nil {
+			fatal(exitUsage, "config", "", err)
+		}
 	}
-
 	if name == "mount" {
 		if len(args) != 1 {
-			xprint(2, "mount requires 1 argument\n")
+			usageError("mount requires 1 argument")
 		}
-		cmount(args)
-		os.Exit(0)
+		if err := mount(*network, *addr, *uname, args[0]); err != nil {
+			fatal(exitFail, "mount", *addr, err)
+		}
+		os.Exit(exitOK)
+	}
+	if name == "ping" {
+		if len(args) != 0 {
+			usageError("ping takes no arguments")
+		}
+		if *count < 1 {
+			usageError("ping count must be positive")
+		}
+		if err := ping(*count); err != nil {
+			fatal(exitConn, "ping", *addr, err)
+		}
+		os.Exit(exitOK)
 	}
 
 	cmd, found := cmds[name]
 	if !found {
-		fmt.Fprintf(os.Stderr, "unknown command %s\n", name)
-		os.Exit(2)
+		usageError("unknown command %s", name)
 	}
 	switch cmd.arg {
 	case 0, 1, 2:
 		if len(args) != cmd.arg {
 			switch cmd.arg {
 			case 0:
-				xprint(2, "%s takes no arguments\n", name)
+				usageError("%s takes no arguments", name)
 			case 1:
-				xprint(2, "%s requires 1 argument\n", name)
+				usageError("%s requires 1 argument", name)
 			default:
-				xprint(2, "%s requires %d arguments\n", name, cmd.arg)
+				usageError("%s requires %d arguments", name, cmd.arg)
 			}
 		}
+	case 5:
+		if len(args) != 2 {
+			usageError("%s requires 2 arguments", name)
+		}
 	case 3:
 		if len(args) == 0 {
-			xprint(2, "%s requires at least 1 argument\n", name)
+			usageError("%s requires at least 1 argument", name)
 		}
 	case 4:
 		if len(args) == 0 || len(args) == 1 {
-			xprint(2, "%s requires at least 2 arguments\n", name)
+			usageError("%s requires at least 2 arguments", name)
 		}
 	}
 
-	if *network == "unix" {
-		ns := client.Namespace()
-		*addr = fmt.Sprintf("%s%s%s", ns, string(os.PathSeparator), *addr)
-	}
-	conn, err := client.Dial(*network, *addr)
+	conn, err := dial()
 	if err != nil {
-		xprint(1, "%s\n", err.Error())
+		fatal(exitConn, "dial", *addr, err)
 	}
 	defer conn.Close()
 
-	fsys, err := conn.Attach(nil, *uname, "")
+	fsys, err := attach(conn)
 	if err != nil {
-		xprint(1, "mount: %v\n", err)
+		fatal(exitConn, "attach", *addr, err)
 	}
 
 	cmd.fn(fsys, args)
-	os.Exit(0)
+	os.Exit(status)
 }
 
 type cmd struct {
@@ -166,32 +211,140 @@ type cmd struct {
 }
 
 var cmds = map[string]cmd{
-	"noop":   cmd{noop, 0, "", "send attach request"},
-	"create": cmd{create, 3, "[-d]", "make directories or files"},
-	"write":  cmd{write, 1, "", "read stdin and write contents to file"},
-	"read":   cmd{read, 3, "", "write the contents of file to stdout"},
-	"ls":     cmd{readdir, 1, "[-l]", "list contents of directory of file"},
-	"stat":   cmd{stat, 3, "", "write status information to stdout"},
-	"chgrp":  cmd{chgrp, 4, "group", "change file group"},
-	"chmod":  cmd{chmod, 4, "mode", "change file modes"},
+	"create":   cmd{create, 3, "[-d]", "make directories or files"},
+	"write":    cmd{write, 1, "", "read stdin and write contents to file"},
+	"read":     cmd{read, 3, "", "write the contents of file to stdout"},
+	"ls":       cmd{readdir, 1, "[-l]", "list contents of directory of file"},
+	"stat":     cmd{stat, 3, "[-v]", "write status information to stdout"},
+	"chgrp":    cmd{chgrp, 4, "group", "change file group"},
+	"chmod":    cmd{chmod, 4, "mode", "change file modes"},
+	"diff":     cmd{diff, 2, "old", "list files added, removed or modified since old"},
+	"put":      cmd{put, 2, "[-resume] local", "copy the local file to file"},
+	"get":      cmd{get, 5, "[-resume]", "copy file to the local file"},
+	"truncate": cmd{truncate, 4, "length", "set the length of files"},
+	"wait":     cmd{wait, 1, "[-i interval]", "wait until file is created, changed or removed"},
 }
 
-func noop(fs *client.Fsys, args []string) {}
+// dial connects to the file server. The address of the unix network
+// is a socket path or the name of a service posted in the name space.
+func dial() (*client.Conn, error) {
+	addr := *addr
+	if *network == "unix" {
+		addr = rclient.SocketPath(addr)
+	}
+	c, err := client.Dial(*network, addr)
+	if err != nil && *network == "unix" && runtime.GOOS == "windows" {
+		err = fmt.Errorf("%v (unix sockets require Windows 10 1803 or later; try -net tcp)", err)
+	}
+	return c, err
+}
+
+// currentUser returns $USER, or $USERNAME on Windows.
+func currentUser() string {
+	if u := os.Getenv("USER"); u != "" || runtime.GOOS != "windows" {
+		return u
+	}
+	return os.Getenv("USERNAME")
+}
+
+// attach attaches to the file server. With -keyfile the user first
+// proves its identity by answering the challenge of the server with the
+// shared secret.
+func attach(conn *client.Conn) (*client.Fsys, error) {
+	if *keyfile == "" {
+		return conn.Attach(nil, *uname, attachName())
+	}
+	secret, err := ioutil.ReadFile(*keyfile)
+	if err != nil {
+		return nil, err
+	}
+	afid, err := conn.Auth(*uname, attachName())
+	if err != nil {
+		return nil, err
+	}
+	defer afid.Close()
+	challenge := make([]byte, 128)
+	n, err := afid.ReadAt(challenge, 0)
+	if err != nil {
+		return nil, err
+	}
+	// the response is the HMAC-SHA256 of the challenge keyed with the
+	// secret, as expected by ramfs.SharedSecret
+	mac := hmac.New(sha256.New, bytes.TrimSpace(secret))
+	mac.Write(bytes.TrimSpace(challenge[:n]))
+	if _, err := afid.WriteAt([]byte(hex.EncodeToString(mac.Sum(nil))), 0); err != nil {
+		return nil, err
+	}
+	return conn.Attach(afid, *uname, attachName())
+}
+
+// attachName returns the aname sent in Tattach. With -snappy the server
+// is asked to snappy encode all data transfers on the connection.
+func attachName() string {
+	if *comp {
+		return *aname + "!snappy"
+	}
+	return *aname
+}
+
+// ping measures the round-trip time of a Tversion, Tattach and Tstat
+// exchange count times and prints the min/avg/max latency.
+func ping(count int) error {
+	var min, max, sum time.Duration
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		conn, err := dial() // Tversion
+		if err != nil {
+			return err
+		}
+		version := time.Since(start)
+
+		start = time.Now()
+		fsys, err := attach(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		attach := time.Since(start)
+
+		start = time.Now()
+		_, err = fsys.Stat("/")
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		stat := time.Since(start)
+
+		rtt := version + attach + stat
+		if i == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += rtt
+		fmt.Printf("seq=%d version=%v attach=%v stat=%v time=%v\n",
+			i, version, attach, stat, rtt)
+	}
+	fmt.Printf("round-trip min/avg/max = %v/%v/%v\n",
+		min, sum/time.Duration(count), max)
+	return nil
+}
 
 func create(fs *client.Fsys, args []string) {
 	var err error
 	for _, name := range args {
-		fid := &client.Fid{}
+		var fid *client.Fid
 		if *mkdir {
 			fid, err = fs.Create(name, plan9.OREAD, 0775|plan9.DMDIR)
 		} else {
 			fid, err = fs.Create(name, plan9.OREAD, 0664)
 		}
-		fid.Close()
-
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "create %s: %v\n", name, err)
+			warn("create", name, err)
+			continue
 		}
+		fid.Close()
 	}
 }
 
@@ -202,42 +355,43 @@ func write(fs *client.Fsys, args []string) {
 	offset := int64(0)
 	f, err := fs.Open(name, plan9.OWRITE)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "open %s: %v\n", name, err)
-		os.Exit(1)
+		fatal(exitFail, "open", name, err)
 	}
 	defer f.Close()
 
+	total := int64(-1)
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+		total = fi.Size()
+	}
+	p := newProgress(name, total, 0)
+	defer p.finish()
 	for {
 		n, err := os.Stdin.Read(data)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			fmt.Fprintf(os.Stderr, "read stdin: %v\n", err)
-			os.Exit(1)
+			fatal(exitFail, "read", "stdin", err)
 		}
 
 		if *comp {
 			buf, err = snappy.Encode(buf, data[0:n])
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "compress %s: %v", name, err)
-				os.Exit(1)
+				fatal(exitFail, "compress", name, err)
 			}
 		} else {
 			buf = data[0:n]
 		}
 
-		n = len(buf)
 		m, err := f.WriteAt(buf, offset)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "write %s: %v\n", name, err)
-			os.Exit(1)
+			fatal(exitFail, "write", name, err)
 		}
-		if m != n {
-			fmt.Fprintf(os.Stderr, "short write %s: %v\n", name, err)
-			os.Exit(1)
+		if m != len(buf) {
+			fatal(exitFail, "write", name, io.ErrShortWrite)
 		}
-		offset += int64(m)
+		offset += int64(n)
+		p.add(n)
 	}
 }
 
@@ -248,10 +402,15 @@ func read(fs *client.Fsys, args []string) {
 	for _, name := range args {
 		f, err := fs.Open(name, plan9.OREAD)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "open %s: %v\n", name, err)
+			warn("open", name, err)
 			continue
 		}
 
+		total := int64(-1)
+		if d, err := f.Stat(); err == nil {
+			total = int64(d.Length)
+		}
+		p := newProgress(name, total, 0)
 		offset := int64(0)
 		for {
 			n, err := f.ReadAt(data, offset)
@@ -259,28 +418,26 @@ func read(fs *client.Fsys, args []string) {
 				if err == io.EOF {
 					break
 				}
-				fmt.Fprintf(os.Stderr, "read %s: %v\n", name, err)
-				f.Close()
-				continue
+				warn("read", name, err)
+				break
 			}
 
-			offset += int64(n)
-
 			if *comp {
 				buf, err = snappy.Decode(buf, data[0:n])
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "decompress %s: %v", name, err)
-					os.Exit(1)
+					fatal(exitFail, "decompress", name, err)
 				}
 			} else {
 				buf = data[0:n]
 			}
+			offset += int64(len(buf))
+			p.add(len(buf))
 
 			if _, err = os.Stdout.Write(buf); err != nil {
-				fmt.Fprintf(os.Stderr, "write stdout: %v", err)
-				os.Exit(1)
+				fatal(exitFail, "write", "stdout", err)
 			}
 		}
+		p.finish()
 		f.Close()
 	}
 }
@@ -289,24 +446,41 @@ func stat(fs *client.Fsys, args []string) {
 	for _, name := range args {
 		d, err := fs.Stat(name)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "stat %s: %v\n", name, err)
+			warn("stat", name, err)
 			continue
 		}
-		fmt.Printf("%s\n", d)
+		if *verbose {
+			printDir(d)
+		} else {
+			fmt.Printf("%s\n", d)
+		}
 	}
 }
 
+func printDir(d *plan9.Dir) {
+	fmt.Printf("name:     %s\n", d.Name)
+	fmt.Printf("qid.path: %#016x\n", d.Qid.Path)
+	fmt.Printf("qid.vers: %d\n", d.Qid.Vers)
+	fmt.Printf("qid.type: %#02x\n", d.Qid.Type)
+	fmt.Printf("mode:     %s (%#o)\n", d.Mode, uint32(d.Mode))
+	fmt.Printf("uid:      %s\n", d.Uid)
+	fmt.Printf("gid:      %s\n", d.Gid)
+	fmt.Printf("muid:     %s\n", d.Muid)
+	fmt.Printf("length:   %d\n", d.Length)
+	fmt.Printf("atime:    %s (%d)\n", time.Unix(int64(d.Atime), 0), d.Atime)
+	fmt.Printf("mtime:    %s (%d)\n", time.Unix(int64(d.Mtime), 0), d.Mtime)
+	fmt.Printf("type:     %d\n", d.Type)
+	fmt.Printf("dev:      %d\n", d.Dev)
+}
+
 func chgrp(fs *client.Fsys, args []string) {
 	for _, name := range args[1:] {
-		d, err := fs.Stat(name)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "stat %s: %v\n", name, err)
-			return
-		}
+		// leave the other fields, e.g. the length, unchanged
+		var d plan9.Dir
+		d.Null()
 		d.Gid = args[0]
-		if err = fs.Wstat(name, d); err != nil {
-			fmt.Fprintf(os.Stderr, "wstat %s: %v\n", name, err)
-			return
+		if err := fs.Wstat(name, &d); err != nil {
+			warn("wstat", name, err)
 		}
 	}
 }
@@ -314,23 +488,255 @@ func chgrp(fs *client.Fsys, args []string) {
 func chmod(fs *client.Fsys, args []string) {
 	mode, err := strconv.ParseInt(args[0], 8, 0)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "chmod: %v\n", err)
-		return
+		usageError("bad mode %s", args[0])
 	}
 	for _, name := range args[1:] {
-		d, err := fs.Stat(name)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "stat %s: %v\n", name, err)
+		var d plan9.Dir
+		d.Null()
+		d.Mode = plan9.Perm(mode)
+		if err := fs.Wstat(name, &d); err != nil {
+			warn("wstat", name, err)
+		}
+	}
+}
+
+func truncate(fs *client.Fsys, args []string) {
+	length, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		usageError("bad length %s", args[0])
+	}
+	for _, name := range args[1:] {
+		var d plan9.Dir
+		d.Null()
+		d.Length = length
+		if err := fs.Wstat(name, &d); err != nil {
+			warn("wstat", name, err)
+		}
+	}
+}
+
+// wait polls the status of a file until its qid changes, which happens
+// on every write, or until it is created or removed.
+func wait(fs *client.Fsys, args []string) {
+	name := args[0]
+	d, err := fs.Stat(name)
+	for {
+		time.Sleep(*poll)
+		nd, nerr := fs.Stat(name)
+		switch {
+		case (err == nil) != (nerr == nil):
+			return
+		case err == nil && nd.Qid != d.Qid:
 			return
 		}
-		d.Mode = plan9.Perm(mode)
-		if err = fs.Wstat(name, d); err != nil {
-			fmt.Fprintf(os.Stderr, "wstat %s: %v\n", name, err)
+	}
+}
+
+// diff asks the server to compare the directories old and new with the
+// ctl command diff and prints the reply.
+func diff(fs *client.Fsys, args []string) {
+	reply, err := query(fs, fmt.Sprintf("diff %s %s", args[0], args[1]))
+	if err != nil {
+		fatal(exitFail, "diff", "", err)
+	}
+	os.Stdout.Write(reply)
+}
+
+// query writes the command req to /adm/ctl and returns the reply read
+// back on the same fid.
+func query(fs *client.Fsys, req string) ([]byte, error) {
+	f, err := fs.Open("/adm/ctl", plan9.ORDWR)
+	if err != nil {
+		return nil, fmt.Errorf("/adm/ctl: %v", err)
+	}
+	defer f.Close()
+
+	data := []byte(req + "\n")
+	if *comp {
+		if data, err = snappy.Encode(nil, data); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		return nil, err
+	}
+
+	var reply []byte
+	data = make([]byte, IOUNIT)
+	buf := []byte{}
+	offset := int64(0)
+	for {
+		n, err := f.ReadAt(data, offset)
+		if err == io.EOF || n == 0 {
+			return reply, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+		if *comp {
+			if buf, err = snappy.Decode(buf, data[0:n]); err != nil {
+				return nil, err
+			}
+		} else {
+			buf = data[0:n]
+		}
+		reply = append(reply, buf...)
+	}
+}
+
+// put copies the local file to file. With -resume a partial copy of the
+// same data, as left by an interrupted put, is continued.
+func put(fs *client.Fsys, args []string) {
+	local, name := args[0], args[1]
+	src, err := os.Open(local)
+	if err != nil {
+		fatal(exitFail, "open", local, err)
+	}
+	defer src.Close()
+
+	offset := int64(0)
+	var f *client.Fid
+	if d, err := fs.Stat(name); err == nil {
+		mode := plan9.OWRITE | plan9.OTRUNC
+		if *resume {
+			if offset = resumeOffset(fs, src, name, int64(d.Length)); offset > 0 {
+				mode = plan9.OWRITE
+			}
+		}
+		f, err = fs.Open(name, uint8(mode))
+	} else {
+		f, err = fs.Create(name, plan9.OWRITE, 0664)
+	}
+	if err != nil {
+		fatal(exitFail, "open", name, err)
+	}
+	defer f.Close()
+
+	data := make([]byte, IOUNIT)
+	if *comp {
+		// leave room for the snappy overhead in a single message
+		data = data[:(IOUNIT-32)*6/7]
+	}
+	total := int64(-1)
+	if fi, err := src.Stat(); err == nil {
+		total = fi.Size()
+	}
+	p := newProgress(name, total, offset)
+	defer p.finish()
+	buf := []byte{}
+	for {
+		n, err := src.ReadAt(data, offset)
+		if n == 0 && err == io.EOF {
 			return
 		}
+		if err != nil && err != io.EOF {
+			fatal(exitFail, "read", local, err)
+		}
+		if *comp {
+			if buf, err = snappy.Encode(buf, data[0:n]); err != nil {
+				fatal(exitFail, "compress", name, err)
+			}
+		} else {
+			buf = data[0:n]
+		}
+		if m, err := f.WriteAt(buf, offset); err != nil || m != len(buf) {
+			fatal(exitFail, "write", name, err)
+		}
+		offset += int64(n)
+		p.add(n)
+	}
+}
+
+// get copies file to the local file. With -resume a partial copy of the
+// same data, as left by an interrupted get, is continued.
+func get(fs *client.Fsys, args []string) {
+	name, local := args[0], args[1]
+	d, err := fs.Stat(name)
+	if err != nil {
+		fatal(exitFail, "stat", name, err)
+	}
+
+	offset := int64(0)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if *resume {
+		if dst, err := os.Open(local); err == nil {
+			if fi, err := dst.Stat(); err == nil && uint64(fi.Size()) <= d.Length {
+				if offset = resumeOffset(fs, dst, name, fi.Size()); offset > 0 {
+					flags = os.O_WRONLY
+				}
+			}
+			dst.Close()
+		}
+	}
+	dst, err := os.OpenFile(local, flags, 0664)
+	if err != nil {
+		fatal(exitFail, "open", local, err)
+	}
+
+	f, err := fs.Open(name, plan9.OREAD)
+	if err != nil {
+		fatal(exitFail, "open", name, err)
+	}
+	defer f.Close()
+
+	p := newProgress(name, int64(d.Length), offset)
+	defer p.finish()
+	data := make([]byte, IOUNIT)
+	buf := []byte{}
+	for {
+		n, err := f.ReadAt(data, offset)
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			fatal(exitFail, "read", name, err)
+		}
+		if *comp {
+			if buf, err = snappy.Decode(buf, data[0:n]); err != nil {
+				fatal(exitFail, "decompress", name, err)
+			}
+		} else {
+			buf = data[0:n]
+		}
+		if _, err := dst.WriteAt(buf, offset); err != nil {
+			fatal(exitFail, "write", local, err)
+		}
+		offset += int64(len(buf))
+		p.add(len(buf))
+	}
+	if err := dst.Close(); err != nil {
+		fatal(exitFail, "close", local, err)
 	}
 }
 
+// resumeOffset returns length if the first length bytes of the local
+// file and of file are the same, which the server verifies by hashing,
+// and 0 otherwise. The hash is queried on /adm/ctl, so users who may
+// not open it, i.e. are not members of adm, can't resume; their
+// transfers start over with a warning.
+func resumeOffset(fs *client.Fsys, local *os.File, name string, length int64) int64 {
+	fi, err := local.Stat()
+	if err != nil || length == 0 || length > fi.Size() {
+		return 0
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(local, 0, length)); err != nil {
+		return 0
+	}
+	reply, err := query(fs, fmt.Sprintf("sum sha256 %s %d", name, length))
+	if err != nil {
+		// not a failure; the transfer restarts
+		printError("resume", name, fmt.Errorf("%v; copying the whole file", err))
+		return 0
+	}
+	sum := strings.Fields(string(reply))
+	if len(sum) == 0 || sum[0] != hex.EncodeToString(h.Sum(nil)) {
+		return 0
+	}
+	return length
+}
+
 func timeStamp(dtime uint32) string {
 	now := time.Now()
 	mtime := time.Unix(int64(dtime), 0)
@@ -351,22 +757,19 @@ func readdir(fs *client.Fsys, args []string) {
 	name := args[0]
 	fi, err := fs.Stat(name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "stat %s: %v\n", name, err)
-		os.Exit(1)
+		fatal(exitFail, "stat", name, err)
 	}
 
 	f, err := fs.Open(name, plan9.OREAD)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "open %s: %v\n", name, err)
-		os.Exit(1)
+		fatal(exitFail, "open", name, err)
 	}
 	defer f.Close()
 
 	if fi.Mode&plan9.DMDIR != 0 {
 		dirs, err := f.Dirreadall()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "dirread %s: %v\n", name, err)
-			os.Exit(1)
+			fatal(exitFail, "dirread", name, err)
 		}
 		sort.Sort(byName(dirs))
 
@@ -418,8 +821,7 @@ func readdir(fs *client.Fsys, args []string) {
 	} else {
 		d, err := fs.Stat(name)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "stat %s: %v\n", name, err)
-			os.Exit(1)
+			fatal(exitFail, "stat", name, err)
 		}
 		if *long {
 			length := fmt.Sprintf("%d", d.Length)
@@ -438,9 +840,3 @@ func readdir(fs *client.Fsys, args []string) {
 		}
 	}
 }
-
-func cmount(args []string) {
-	if err := mount(*network, *addr, *uname, args[0]); err != nil {
-		fmt.Fprintf(os.Stderr, "mount %s: %v\n", *addr, err)
-	}
-}
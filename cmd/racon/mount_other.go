@@ -2,8 +2,11 @@
 
 package main
 
-import "errors"
+import (
+	"fmt"
+	"runtime"
+)
 
 func mount(network, addr, uname, mntpt string) error {
-	return errors.New("mount not supported")
+	return fmt.Errorf("mount not supported on %s; connect a 9P client to the service address instead", runtime.GOOS)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// progress reports the state of a transfer on stderr when -progress is
+// set, at most twice a second.
+type progress struct {
+	name  string
+	total int64 // bytes to transfer; negative if unknown
+	done  int64
+	start time.Time
+	first int64 // bytes already transferred at start, e.g. with -resume
+	last  time.Time
+}
+
+// newProgress returns the progress of transferring name, of which done
+// of total bytes are already transferred. It returns nil, which reports
+// nothing, unless -progress is set.
+func newProgress(name string, total, done int64) *progress {
+	if !*report {
+		return nil
+	}
+	now := time.Now()
+	return &progress{name: name, total: total, done: done, first: done, start: now, last: now}
+}
+
+// add accounts n more bytes transferred.
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+	p.done += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= 500*time.Millisecond {
+		p.last = now
+		p.print("\r")
+	}
+}
+
+// finish prints the final state of the transfer.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.print("\r")
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progress) print(prefix string) {
+	elapsed := time.Since(p.start)
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(p.done-p.first) / elapsed.Seconds()
+	}
+
+	line := fmt.Sprintf("%s: %s", p.name, size(float64(p.done)))
+	if p.total >= 0 {
+		percent := int64(100)
+		if p.total > 0 {
+			percent = 100 * p.done / p.total
+		}
+		line += fmt.Sprintf(" of %s (%d%%)", size(float64(p.total)), percent)
+	}
+	line += fmt.Sprintf(", %s/s", size(rate))
+	if p.total >= 0 && rate > 0 && p.done < p.total {
+		eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		line += fmt.Sprintf(", ETA %v", eta.Truncate(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "%s%-70s", prefix, line)
+}
+
+// size formats a number of bytes for humans.
+func size(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
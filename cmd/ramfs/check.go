@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"github.com/mars9/ramfs"
+)
+
+const checkUsage = `
+Check starts an ephemeral in-process file server, runs a conformance
+suite and a quick benchmark against it and prints a report. The exit
+status is 1 if any check failed.
+`
+
+// checkOwner is the hostowner of the ephemeral file server.
+const checkOwner = "check"
+
+// A conformance check runs in a directory of its own, c.dir.
+type conformance struct {
+	name string
+	fn   func(c *checker) error
+}
+
+var suite = []conformance{
+	{"attach", checkAttach},
+	{"create, write and read", checkReadWrite},
+	{"read at end of file", checkReadEOF},
+	{"write across blocks", checkBlocks},
+	{"walk to missing file", checkWalkMissing},
+	{"walk .. at root", checkDotDot},
+	{"directory read", checkDirRead},
+	{"remove non-empty directory", checkRemoveDir},
+	{"rename with wstat", checkRename},
+	{"permission denied", checkPerm},
+	{"ctl query", checkCtl},
+}
+
+// checker holds the connection of a check to the ephemeral server.
+type checker struct {
+	network, addr string
+	fsys          *client.Fsys
+	dir           string // directory for the files of the check
+}
+
+// attach returns a new attach as uid. The connection is closed when
+// the check is done.
+func (c *checker) attach(uid string) (*client.Fsys, *client.Conn, error) {
+	conn, err := client.Dial(c.network, c.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsys, err := conn.Attach(nil, uid, "")
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return fsys, conn, nil
+}
+
+func (c *checker) path(name string) string {
+	return c.dir + "/" + name
+}
+
+// writeFile creates the file name with data.
+func (c *checker) writeFile(name string, data []byte) error {
+	fid, err := c.fsys.Create(c.path(name), plan9.OWRITE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	_, err = fid.WriteAt(data, 0)
+	return err
+}
+
+// readFile returns the data of the file name.
+func (c *checker) readFile(name string) ([]byte, error) {
+	fid, err := c.fsys.Open(c.path(name), plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	var data []byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := fid.ReadAt(buf, int64(len(data)))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		data = append(data, buf[:n]...)
+	}
+}
+
+func checkAttach(c *checker) error {
+	d, err := c.fsys.Stat("/")
+	if err != nil {
+		return err
+	}
+	if d.Qid.Type&plan9.QTDIR == 0 {
+		return fmt.Errorf("root qid type %#x is not a directory", d.Qid.Type)
+	}
+	return nil
+}
+
+func checkReadWrite(c *checker) error {
+	data := []byte("hello, world\n")
+	if err := c.writeFile("hello", data); err != nil {
+		return err
+	}
+	got, err := c.readFile("hello")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %q, want %q", got, data)
+	}
+	d, err := c.fsys.Stat(c.path("hello"))
+	if err != nil {
+		return err
+	}
+	if d.Length != uint64(len(data)) {
+		return fmt.Errorf("length %d, want %d", d.Length, len(data))
+	}
+	dir, err := c.fsys.Stat(c.dir)
+	if err != nil {
+		return err
+	}
+	if want := 0644 & (dir.Mode | ^plan9.Perm(0666)) & 0777; d.Mode&0777 != want {
+		return fmt.Errorf("mode %o, want %o", d.Mode&0777, want)
+	}
+	if d.Uid != checkOwner {
+		return fmt.Errorf("owner %s, want %s", d.Uid, checkOwner)
+	}
+	return nil
+}
+
+func checkReadEOF(c *checker) error {
+	if err := c.writeFile("eof", []byte("abc")); err != nil {
+		return err
+	}
+	fid, err := c.fsys.Open(c.path("eof"), plan9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	buf := make([]byte, 16)
+	n, err := fid.ReadAt(buf, 3)
+	if n != 0 || (err != nil && err != io.EOF) {
+		return fmt.Errorf("read at 3 returned %d bytes, %v", n, err)
+	}
+	return nil
+}
+
+func checkBlocks(c *checker) error {
+	data := make([]byte, ramfs.BLOCKSIZE+ramfs.BLOCKSIZE/2)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := c.writeFile("blocks", data); err != nil {
+		return err
+	}
+	got, err := c.readFile("blocks")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("data read differs from data written")
+	}
+	return nil
+}
+
+func checkWalkMissing(c *checker) error {
+	if _, err := c.fsys.Stat(c.path("missing/file")); err == nil {
+		return fmt.Errorf("walk to a missing file succeeded")
+	}
+	return nil
+}
+
+func checkDotDot(c *checker) error {
+	root, err := c.fsys.Stat("/")
+	if err != nil {
+		return err
+	}
+	d, err := c.fsys.Stat("/..")
+	if err != nil {
+		return err
+	}
+	if d.Qid != root.Qid {
+		return fmt.Errorf("qid of /.. is %v, want %v", d.Qid, root.Qid)
+	}
+	return nil
+}
+
+func checkDirRead(c *checker) error {
+	fid, err := c.fsys.Create(c.path("list"), plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		return err
+	}
+	fid.Close()
+	want := map[string]bool{"a": true, "b": true, "c": true}
+	for name := range want {
+		if err := c.writeFile("list/"+name, nil); err != nil {
+			return err
+		}
+	}
+	fid, err = c.fsys.Open(c.path("list"), plan9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	dirs, err := fid.Dirreadall()
+	if err != nil {
+		return err
+	}
+	if len(dirs) != len(want) {
+		return fmt.Errorf("read %d entries, want %d", len(dirs), len(want))
+	}
+	for _, d := range dirs {
+		if !want[d.Name] {
+			return fmt.Errorf("unexpected entry %s", d.Name)
+		}
+	}
+	return nil
+}
+
+func checkRemoveDir(c *checker) error {
+	fid, err := c.fsys.Create(c.path("full"), plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		return err
+	}
+	fid.Close()
+	if err := c.writeFile("full/file", nil); err != nil {
+		return err
+	}
+	c.fsys.Remove(c.path("full"))
+	if _, err := c.fsys.Stat(c.path("full")); err != nil {
+		return fmt.Errorf("non-empty directory removed: %v", err)
+	}
+	if err := c.fsys.Remove(c.path("full/file")); err != nil {
+		return err
+	}
+	return c.fsys.Remove(c.path("full"))
+}
+
+func checkRename(c *checker) error {
+	if err := c.writeFile("old", []byte("data")); err != nil {
+		return err
+	}
+	d := plan9.Dir{}
+	d.Null()
+	d.Name = "new"
+	if err := c.fsys.Wstat(c.path("old"), &d); err != nil {
+		return err
+	}
+	if _, err := c.fsys.Stat(c.path("old")); err == nil {
+		return fmt.Errorf("old name still exists")
+	}
+	got, err := c.readFile("new")
+	if err != nil {
+		return err
+	}
+	if string(got) != "data" {
+		return fmt.Errorf("read %q after rename, want %q", got, "data")
+	}
+	return nil
+}
+
+func checkPerm(c *checker) error {
+	if err := c.writeFile("private", []byte("secret")); err != nil {
+		return err
+	}
+	fsys, conn, err := c.attach("none")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fid, err := fsys.Open(c.path("private"), plan9.OWRITE)
+	if err == nil {
+		fid.Close()
+		return fmt.Errorf("none opened a 0644 file of %s for writing", checkOwner)
+	}
+	return nil
+}
+
+func checkCtl(c *checker) error {
+	fsys, conn, err := c.attach("adm")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fid, err := fsys.Open("/adm/ctl", plan9.ORDWR)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	if _, err := fid.Write([]byte("du /adm")); err != nil {
+		return err
+	}
+	buf := make([]byte, 8192)
+	n, err := fid.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("empty reply to du")
+	}
+	return nil
+}
+
+// benchmark runs op repeatedly for about d and returns the number of
+// runs and the time taken.
+func benchmark(d time.Duration, op func(i int) error) (int, time.Duration, error) {
+	start := time.Now()
+	n := 0
+	for time.Since(start) < d {
+		if err := op(n); err != nil {
+			return n, time.Since(start), err
+		}
+		n++
+	}
+	return n, time.Since(start), nil
+}
+
+// bench reports the latency of small operations and the throughput of
+// large transfers.
+func bench(c *checker, d time.Duration) error {
+	fmt.Printf("\nBenchmark:\n")
+	n, t, err := benchmark(d, func(int) error {
+		_, err := c.fsys.Stat(c.dir)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+	fmt.Printf("  %-24s %8d ops %12v/op\n", "walk and stat", n, t/time.Duration(n))
+
+	n, t, err = benchmark(d, func(i int) error {
+		return c.writeFile(fmt.Sprintf("bench.%d", i), nil)
+	})
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	fmt.Printf("  %-24s %8d ops %12v/op\n", "create", n, t/time.Duration(n))
+
+	fid, err := c.fsys.Create(c.path("bench"), plan9.ORDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	data := make([]byte, 64*1024)
+	n, t, err = benchmark(d, func(i int) error {
+		_, err := fid.WriteAt(data, int64(i%256)*int64(len(data)))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	fmt.Printf("  %-24s %8d ops %12.1f MB/s\n", "write 64 KB", n, throughput(n*len(data), t))
+
+	n, t, err = benchmark(d, func(i int) error {
+		_, err := fid.ReadAt(data, int64(i%256)*int64(len(data)))
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("read: %v", err)
+	}
+	fmt.Printf("  %-24s %8d ops %12.1f MB/s\n", "read 64 KB", n, throughput(n*len(data), t))
+	return nil
+}
+
+func throughput(bytes int, t time.Duration) float64 {
+	return float64(bytes) / (1 << 20) / t.Seconds()
+}
+
+// check implements "ramfs check".
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	benchTime := flags.Duration("benchtime", time.Second, "run time of each benchmark; 0 skips the benchmark")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [options]\n", os.Args[0])
+		fmt.Fprint(os.Stderr, checkUsage)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+
+	dir, err := ioutil.TempDir("", "ramfs-check")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("ramfs check: %s/%s, %s, GOMAXPROCS=%d\n\n",
+		runtime.GOOS, runtime.GOARCH, runtime.Version(), runtime.GOMAXPROCS(0))
+
+	fs := ramfs.New(checkOwner)
+	c := &checker{network: "unix", addr: filepath.Join(dir, "ramfs")}
+	served := make(chan error, 1)
+	go func() { served <- fs.Listen(c.network, c.addr) }()
+	defer fs.Halt()
+
+	var conn *client.Conn
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c.fsys, conn, err = c.attach(checkOwner)
+		if err == nil {
+			break
+		}
+		select {
+		case err = <-served:
+		default:
+			if time.Since(start) < 5*time.Second {
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s: start server: %v\n", os.Args[0], err)
+		return 1
+	}
+	defer conn.Close()
+
+	failed := 0
+	for i, t := range suite {
+		c.dir = fmt.Sprintf("/%s/%d", checkOwner, i)
+		start := time.Now()
+		fid, err := c.fsys.Create(c.dir, plan9.OREAD, plan9.DMDIR|0755)
+		if err == nil {
+			fid.Close()
+			err = t.fn(c)
+		}
+		if err != nil {
+			fmt.Printf("FAIL  %-28s %v\n", t.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok    %-28s %v\n", t.name, time.Since(start).Round(time.Microsecond))
+	}
+	fmt.Printf("\n%d of %d checks passed\n", len(suite)-failed, len(suite))
+
+	if *benchTime > 0 {
+		c.dir = "/" + checkOwner + "/bench"
+		fid, err := c.fsys.Create(c.dir, plan9.OREAD, plan9.DMDIR|0755)
+		if err == nil {
+			fid.Close()
+			err = bench(c, *benchTime)
+		}
+		if err != nil {
+			fmt.Printf("FAIL  benchmark: %v\n", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,5 +1,6 @@
 /*
 Usage: ramfs [options]
+       ramfs check [-benchtime d]
 
 Ramfs starts a 9P2000 file server keeping all files in memory. The
 filesystem is entirely maintained in memory, no external storage is
@@ -11,9 +12,53 @@ Read and Execute permissions for everyone else (0755). Ramfs create
 the necessary directories and files in /adm/ctl, /adm/group and
 /<hostowner>.
 
+Every option can also be set with an environment variable named
+RAMFS_ followed by the upper case option name, e.g. RAMFS_ADDR or
+RAMFS_MEMLIMIT. Options on the command line take precedence.
+
+Ramfs check runs a conformance suite and a quick benchmark against an
+ephemeral in-process instance and prints a report, e.g. to validate a
+build on a new platform before deployment. The exit status is 1 if any
+check failed. -benchtime sets the run time of each benchmark; 0 skips
+the benchmark.
+
 Options:
+  -D=false: print each 9P2000 message to stdout (stderr with -stdio)
+  -access=0: count requests per path, user and type in /adm/access over this interval
   -addr="localhost:5640": service listen address
+  -atime="relatime": access time policy: relatime, strictatime or noatime
+  -checkpoint="": restore the file system from the image file at start and save it there periodically
+  -compress="none": compression of saved images: none, gzip or zstd
+  -dropoversized=false: close connections sending messages larger than msize instead of answering with an error
+  -dump="": save an image of the file system to this file on the dump ctl command
+  -fidleak=0: log fids not clunked within this time (requires -D)
+  -fsck=false: check the image of -load or -checkpoint for inconsistencies, print them and exit (with -repair, save the repaired image to -save-on-exit)
+  -grace=0: time given to connections to complete requests on shutdown
   -hostowner="mason": hostowner (default: $USER)
+  -import="": extract the tar archive into the root at start
+  -interval=5m0s: time between two checkpoints
+  -load="": restore the file system from the image file at start
+  -log="text": log format: text or json
+  -logsample=0: print only every nth request and its reply (requires -D)
+  -maxentries=0: maximum number of entries per directory
+  -maxfids=0: maximum number of fids per connection
+  -maxname=0: maximum length of a file name
+  -memlimit=0: file data size above which the server reports unready
+  -mount=: serve the host directory hostdir read/write as name, name=hostdir (repeatable)
+  -msize=0: maximum message size offered to clients, including the 24 byte header (0 means 131096)
   -net="tcp": stream-oriented network
+  -nfc=false: NFC normalize file names
+  -ordered=false: process requests on the same fid in issue order
+  -repair=false: repair inconsistencies of the loaded image before serving
+  -save-on-exit="": save an image of the file system on SIGTERM or interrupt
+  -secrets="": require authentication with the secrets of the file, lines "uid secret"
+  -sessionttl=0: time the fids of a lost connection are kept for resumption
+  -softlimit=0: percentage of -memlimit and of group quotas above which a warning is logged
+  -srv="": also post the service as srvname (/srv on Plan 9, $NAMESPACE otherwise)
+  -stdio=false: serve a single session on stdin and stdout
+  -timeout=0: maximum processing time per request
+  -umask=0: permission bits cleared from created files (octal)
+  -walkcache=0: number of resolved paths to cache
+  -writetimeout=0: time a client may take to accept part of a reply
 */
 package main
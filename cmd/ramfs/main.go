@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mars9/ramfs"
 )
@@ -19,32 +28,340 @@ is created with Read, Write and Execute permissions for the owner and
 Read and Execute permissions for everyone else (0755). Ramfs create
 the necessary directories and files in /adm/ctl, /adm/group and
 /<hostowner>.
+
+Every option can also be set with an environment variable named
+RAMFS_ followed by the upper case option name, e.g. RAMFS_ADDR or
+RAMFS_MEMLIMIT. Options on the command line take precedence.
+
+Ramfs check runs a conformance suite and a quick benchmark against an
+ephemeral in-process instance and prints a report, e.g. to validate a
+build on a new platform before deployment.
 `
 
+// envFlags sets all flags which have a corresponding environment
+// variable prefix+NAME.
+func envFlags(prefix string) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, found := os.LookupEnv(prefix + strings.ToUpper(f.Name))
+		if !found || err != nil {
+			return
+		}
+		if e := flag.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s%s: %v", prefix, strings.ToUpper(f.Name), e)
+		}
+	})
+	return err
+}
+
+// load restores fs from the image file name, if it exists.
+func load(fs *ramfs.FS, name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fs.Load(bufio.NewReader(f))
+}
+
+// currentUser returns $USER, or $USERNAME on Windows.
+func currentUser() string {
+	if u := os.Getenv("USER"); u != "" || runtime.GOOS != "windows" {
+		return u
+	}
+	return os.Getenv("USERNAME")
+}
+
+// importTar extracts the tar archive file name into the root of fs.
+func importTar(fs *ramfs.FS, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fs.ImportTar(f, "/")
+}
+
+// readSecrets reads the shared secrets of the users from the file name,
+// one line "uid secret" per user. Blank lines and lines starting with #
+// are ignored.
+func readSecrets(name string) (ramfs.SharedSecret, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	secrets := ramfs.SharedSecret{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected uid and secret", name, i+1)
+		}
+		secrets[f[0]] = f[1]
+	}
+	return secrets, nil
+}
+
+// mounts collects the values of the repeatable -mount flag.
+type mounts []string
+
+func (m *mounts) String() string { return strings.Join(*m, " ") }
+
+func (m *mounts) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected name=hostdir")
+	}
+	*m = append(*m, v)
+	return nil
+}
+
+// logOut receives all log messages. It is stderr when stdout carries
+// the 9P2000 session.
+var logOut io.Writer = os.Stdout
+
+// jsonLog writes each log message as a JSON object to logOut.
+func jsonLog(format string, v ...interface{}) {
+	enc := json.NewEncoder(logOut)
+	enc.SetEscapeHTML(false)
+	enc.Encode(struct {
+		Time string `json:"time"`
+		Msg  string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), fmt.Sprintf(format, v...)})
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
+	}
+
 	addr := flag.String("addr", "localhost:5640", "service listen address")
 	network := flag.String("net", "tcp", "stream-oriented network")
-	owner := flag.String("hostowner", os.Getenv("USER"), "hostowner (default: $USER)")
-	chatty := flag.Bool("D", false, "print each 9P2000 message to stdout")
+	stdio := flag.Bool("stdio", false, "serve a single session on stdin and stdout")
+	loadFile := flag.String("load", "", "restore the file system from the image file at start")
+	saveFile := flag.String("save-on-exit", "", "save an image of the file system on SIGTERM or interrupt")
+	checkpoint := flag.String("checkpoint", "", "restore the file system from the image file at start and save it there periodically")
+	interval := flag.Duration("interval", 5*time.Minute, "time between two checkpoints")
+	compression := flag.String("compress", "none", "compression of saved images: none, gzip or zstd")
+	importFile := flag.String("import", "", "extract the tar archive into the root at start")
+	dumpFile := flag.String("dump", "", "save an image of the file system to this file on the dump ctl command")
+	srvname := flag.String("srv", "", "also post the service as srvname (/srv on Plan 9, $NAMESPACE otherwise)")
+	owner := flag.String("hostowner", currentUser(), "hostowner (default: $USER)")
+	chatty := flag.Bool("D", false, "print each 9P2000 message to stdout (stderr with -stdio)")
+	logFormat := flag.String("log", "text", "log format: text or json")
+	timeout := flag.Duration("timeout", 0, "maximum processing time per request")
+	writeTimeout := flag.Duration("writetimeout", 0, "time a client may take to accept part of a reply")
+	grace := flag.Duration("grace", 0, "time given to connections to complete requests on shutdown")
+	ordered := flag.Bool("ordered", false, "process requests on the same fid in issue order")
+	maxFids := flag.Int("maxfids", 0, "maximum number of fids per connection")
+	fidLeak := flag.Duration("fidleak", 0, "log fids not clunked within this time (requires -D)")
+	msize := flag.Uint("msize", 0, "maximum message size offered to clients, including the 24 byte header (0 means 131096)")
+	dropOversized := flag.Bool("dropoversized", false, "close connections sending messages larger than msize instead of answering with an error")
+	logSample := flag.Int("logsample", 0, "print only every nth request and its reply (requires -D)")
+	access := flag.Duration("access", 0, "count requests per path, user and type in /adm/access over this interval")
+	maxEntries := flag.Int("maxentries", 0, "maximum number of entries per directory")
+	maxNameLen := flag.Int("maxname", 0, "maximum length of a file name")
+	memLimit := flag.Uint64("memlimit", 0, "file data size above which the server reports unready")
+	softLimit := flag.Int("softlimit", 0, "percentage of -memlimit and of group quotas above which a warning is logged")
+	walkCache := flag.Int("walkcache", 0, "number of resolved paths to cache")
+	umask := flag.Uint("umask", 0, "permission bits cleared from created files (octal)")
+	normalize := flag.Bool("nfc", false, "NFC normalize file names")
+	atime := flag.String("atime", "relatime", "access time policy: relatime, strictatime or noatime")
+	sessionTTL := flag.Duration("sessionttl", 0, "time the fids of a lost connection are kept for resumption")
+	var hostMounts mounts
+	flag.Var(&hostMounts, "mount", "serve the host directory hostdir read/write as name, name=hostdir (repeatable)")
+	fsck := flag.Bool("fsck", false, "check the image of -load or -checkpoint for inconsistencies, print them and exit (with -repair, save the repaired image to -save-on-exit)")
+	repair := flag.Bool("repair", false, "repair inconsistencies of the loaded image before serving")
+	secrets := flag.String("secrets", "", "require authentication with the secrets of the file, lines \"uid secret\"")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n       %s check [-benchtime d]\n", os.Args[0], os.Args[0])
 		fmt.Fprint(os.Stderr, usageMsg)
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
+	if err := envFlags("RAMFS_"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(2)
+	}
 	flag.Parse()
 
 	fs := ramfs.New(*owner)
+	fs.Timeout = *timeout
+	fs.Grace = *grace
+	fs.WriteTimeout = *writeTimeout
+	fs.MaxEntries = *maxEntries
+	fs.MaxFids = *maxFids
+	fs.Ordered = *ordered
+	fs.FidLeak = *fidLeak
+	fs.LogSample = *logSample
+	fs.DropOversized = *dropOversized
+	if *msize != 0 && (*msize <= 24 || *msize > 1<<32-1) {
+		fmt.Fprintf(os.Stderr, "%s: msize %d out of range\n", os.Args[0], *msize)
+		os.Exit(2)
+	}
+	fs.Msize = uint32(*msize)
+	fs.AccessInterval = *access
+	fs.MaxNameLen = *maxNameLen
+	fs.Normalize = *normalize
+	fs.Umask = ramfs.Perm(*umask)
+	fs.WalkCache = *walkCache
+	fs.MemoryLimit = *memLimit
+	fs.SoftLimit = *softLimit
+	if *softLimit > 0 {
+		fs.LimitWarning = func(name, state string, usage, limit uint64) {
+			log.Printf("%s %s: usage %d limit %d", name, state, usage, limit)
+		}
+	}
+	fs.SessionTTL = *sessionTTL
+	fs.DumpFile = *dumpFile
+	switch *atime {
+	case "relatime":
+		fs.Atime = ramfs.Relatime
+	case "strictatime":
+		fs.Atime = ramfs.Strictatime
+	case "noatime":
+		fs.Atime = ramfs.Noatime
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown atime policy %s\n", os.Args[0], *atime)
+		os.Exit(2)
+	}
+	switch *compression {
+	case "none":
+		fs.Compression = ramfs.Uncompressed
+	case "gzip":
+		fs.Compression = ramfs.Gzip
+	case "zstd":
+		fs.Compression = ramfs.Zstd
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown compression %s\n", os.Args[0], *compression)
+		os.Exit(2)
+	}
+	if *secrets != "" {
+		auth, err := readSecrets(*secrets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			os.Exit(2)
+		}
+		fs.Auth = auth
+	}
+	if *stdio {
+		logOut = os.Stderr
+	}
 	if *chatty {
-		log.SetFlags(log.Ldate | log.Lmicroseconds)
-		fs.Log = log.Printf
+		switch *logFormat {
+		case "text":
+			log.SetFlags(log.Ldate | log.Lmicroseconds)
+			log.SetOutput(logOut)
+			fs.Log = log.Printf
+		case "json":
+			fs.Log = jsonLog
+		default:
+			fmt.Fprintf(os.Stderr, "%s: unknown log format %s\n", os.Args[0], *logFormat)
+			os.Exit(2)
+		}
+	}
+
+	if *loadFile == "" {
+		*loadFile = *checkpoint
+	}
+	if *fsck && *loadFile == "" {
+		fmt.Fprintf(os.Stderr, "%s: -fsck needs an image from -load or -checkpoint\n", os.Args[0])
+		os.Exit(2)
+	}
+	if *loadFile != "" {
+		if err := load(fs, *loadFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: load %s: %v\n", os.Args[0], *loadFile, err)
+			os.Exit(1)
+		}
+	}
+	if *fsck || *repair {
+		problems := fs.Check(*repair)
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], p)
+		}
+		if *fsck {
+			if len(problems) > 0 && !*repair {
+				os.Exit(1)
+			}
+			if *saveFile != "" {
+				if err := fs.SaveFile(*saveFile); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: save %s: %v\n", os.Args[0], *saveFile, err)
+					os.Exit(1)
+				}
+			}
+			os.Exit(0)
+		}
+	}
+	if *importFile != "" {
+		if err := importTar(fs, *importFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: import %s: %v\n", os.Args[0], *importFile, err)
+			os.Exit(1)
+		}
+	}
+	for _, m := range hostMounts {
+		i := strings.Index(m, "=")
+		if err := fs.MountHost(m[:i], m[i+1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: mount %s: %v\n", os.Args[0], m, err)
+			os.Exit(1)
+		}
+	}
+	if *checkpoint != "" {
+		if *interval <= 0 {
+			fmt.Fprintf(os.Stderr, "%s: checkpoint interval must be positive\n", os.Args[0])
+			os.Exit(2)
+		}
+		fs.Checkpoint(*checkpoint, *interval)
+	}
+
+	// save writes the final images on exit.
+	save := func() {
+		for _, name := range []string{*checkpoint, *saveFile} {
+			if name == "" {
+				continue
+			}
+			if err := fs.SaveFile(name); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: save %s: %v\n", os.Args[0], name, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *stdio {
+		fs.ServeStdio()
+		save()
+		os.Exit(0)
+	}
+
+	halted := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fs.Halt()
+		save()
+		close(halted)
+	}()
+
+	if *srvname != "" {
+		go func() {
+			if err := fs.Post(*srvname); err != nil && err != ramfs.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+				os.Exit(1)
+			}
+		}()
 	}
 
-	if err := fs.Listen(*network, *addr); err != nil {
+	if err := fs.Listen(*network, *addr); err != nil && err != ramfs.ErrServerClosed {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
 		os.Exit(1)
 	}
+	<-halted
 	os.Exit(0)
 }
@@ -2,8 +2,23 @@ package ramfs
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"9fans.net/go/plan9"
 )
 
 type member map[string]bool
@@ -14,17 +29,19 @@ type user struct {
 	Member member
 }
 
+func (u user) isMember(uid string) bool {
+	return u.Name == uid || u.Member[uid]
+}
+
 func (u user) Bytes() []byte {
-	member := ""
+	members := make([]string, 0, len(u.Member))
 	for m := range u.Member {
-		member += (m + ",")
-	}
-	if member != "" {
-		member = member[:len(member)-1]
+		members = append(members, m)
 	}
+	sort.Strings(members)
 
 	uid := u.Name
-	return []byte(uid + ":" + uid + ":" + u.Leader + ":" + member)
+	return []byte(uid + ":" + uid + ":" + u.Leader + ":" + strings.Join(members, ","))
 }
 
 type groupmap map[string]user
@@ -61,11 +78,17 @@ func (g groupmap) Exist(uid string) bool {
 }
 
 func (g groupmap) Bytes() []byte {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	buf := make([][]byte, len(g))
 	i := 0
 	n := 0
-	for _, user := range g {
-		buf[i] = user.Bytes()
+	for _, name := range names {
+		buf[i] = g[name].Bytes()
 		n += len(buf[i])
 		i++
 	}
@@ -90,6 +113,8 @@ type group struct {
 	mu       sync.Mutex
 	fs       *FS
 	groupmap groupmap
+	reserved map[string]bool // names of removed users
+	readonly map[string]bool // users whose attaches are read-only
 }
 
 func newGroup(fs *FS, owner string) *group {
@@ -99,7 +124,10 @@ func newGroup(fs *FS, owner string) *group {
 			"adm":  user{"adm", "adm", member{owner: true}},
 			"none": user{"none", "none", member{}},
 			owner:  user{owner, owner, member{}},
-		}}
+		},
+		reserved: make(map[string]bool),
+		readonly: make(map[string]bool),
+	}
 }
 
 func (f *group) Get(uid string) (user, error) {
@@ -147,6 +175,8 @@ func (f *group) WriteAt(p []byte, offset int64) (int, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	switch {
+	case f.reserved[cmd.Args[0]] && !strings.HasPrefix(cmd.Args[1], "+"):
+		err = perror("user " + cmd.Args[0] + " was removed; allow reuse with users reuse " + cmd.Args[0])
 	case len(cmd.Args[1]) > 1 && cmd.Args[1][0] == '+':
 		err = f.groupmap.GroupAdd(cmd.Args[0], cmd.Args[1][1:])
 	case cmd.Args[0] == cmd.Args[1]:
@@ -168,6 +198,13 @@ func (f *group) WriteAt(p []byte, offset int64) (int, error) {
 func (f *group) Len() uint64  { return uint64(0) }
 func (f *group) Close() error { return nil }
 
+// querier is implemented by synthetic files answering commands. The
+// reply of the last command written to a fid can be read back on the
+// same fid.
+type querier interface {
+	Query(uid string, p []byte) ([]byte, error)
+}
+
 type ctl struct {
 	fs *FS
 }
@@ -179,30 +216,408 @@ func (f *ctl) ReadAt(p []byte, offset int64) (int, error) {
 }
 
 func (f *ctl) WriteAt(p []byte, offset int64) (int, error) {
-	var err error
-	cmd := command{}
-	if err = unmarshal(p, &cmd); err != nil {
+	if _, err := f.Query(f.fs.hostowner, p); err != nil {
 		return 0, err
 	}
+	return len(p), nil
+}
+
+func (f *ctl) Query(uid string, p []byte) ([]byte, error) {
+	cmd := command{}
+	if err := unmarshal(p, &cmd); err != nil {
+		return nil, err
+	}
 
 	switch cmd.Name {
 	case "listen":
 		if len(cmd.Args) != 2 {
-			return 0, perror("listen requires 2 arguments")
+			return nil, perror("listen requires 2 arguments")
 		}
 		go f.fs.Listen(cmd.Args[0], cmd.Args[1])
+	case "unlisten":
+		if len(cmd.Args) != 2 {
+			return nil, perror("unlisten requires 2 arguments")
+		}
+		return nil, f.fs.unlisten(cmd.Args[0], cmd.Args[1])
+	case "cp":
+		if len(cmd.Args) != 2 {
+			return nil, perror("cp requires 2 arguments")
+		}
+		return nil, f.fs.copy(uid, cmd.Args[0], cmd.Args[1])
+	case "clone":
+		if len(cmd.Args) != 2 {
+			return nil, perror("clone requires 2 arguments")
+		}
+		return nil, f.fs.clone(uid, cmd.Args[0], cmd.Args[1])
+	case "snap":
+		if len(cmd.Args) != 1 {
+			return nil, perror("snap requires 1 argument")
+		}
+		return nil, f.fs.Snap(cmd.Args[0])
+	case "rmsnap":
+		if len(cmd.Args) != 1 {
+			return nil, perror("rmsnap requires 1 argument")
+		}
+		return nil, f.fs.RemoveSnap(cmd.Args[0])
+	case "lssnap":
+		var reply []byte
+		for _, name := range f.fs.Snaps() {
+			reply = append(reply, name+"\n"...)
+		}
+		return reply, nil
+	case "users":
+		return f.fs.users(uid, cmd.Args)
+	case "diff":
+		if len(cmd.Args) != 2 {
+			return nil, perror("diff requires 2 arguments")
+		}
+		changes, err := f.fs.diff(uid, cmd.Args[0], cmd.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		var reply []byte
+		for _, c := range changes {
+			reply = append(reply, c.String()+"\n"...)
+		}
+		return reply, nil
+	case "clunk":
+		if len(cmd.Args) != 2 {
+			return nil, perror("clunk requires 2 arguments")
+		}
+		id, err := strconv.ParseUint(cmd.Args[0], 10, 32)
+		if err != nil {
+			return nil, perror("bad connection " + cmd.Args[0])
+		}
+		num, err := strconv.ParseUint(cmd.Args[1], 10, 32)
+		if err != nil {
+			return nil, perror("bad fid " + cmd.Args[1])
+		}
+		return nil, f.fs.clunkFid(uint32(id), uint32(num))
+	case "revoke":
+		if len(cmd.Args) != 1 {
+			return nil, perror("revoke requires 1 argument")
+		}
+		n, err := f.fs.revoke(cmd.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("%d\n", n)), nil
+	case "dump":
+		if len(cmd.Args) != 0 {
+			return nil, perror("dump takes no arguments")
+		}
+		return nil, f.fs.dump()
+	case "fault":
+		return f.fs.fault(cmd.Args)
+	case "memory":
+		if len(cmd.Args) != 0 {
+			return nil, perror("memory takes no arguments")
+		}
+		return f.fs.Memory().Bytes(), nil
+	case "fsck":
+		repair := false
+		switch {
+		case len(cmd.Args) == 1 && cmd.Args[0] == "repair":
+			repair = true
+		case len(cmd.Args) != 0:
+			return nil, perror("usage: fsck [repair]")
+		}
+		var reply []byte
+		for _, p := range f.fs.Check(repair) {
+			reply = append(reply, p.String()+"\n"...)
+		}
+		return reply, nil
+	case "du":
+		if len(cmd.Args) != 1 {
+			return nil, perror("du requires 1 argument")
+		}
+		return f.fs.du(uid, cmd.Args[0])
+	case "stat":
+		if len(cmd.Args) == 0 {
+			return nil, perror("stat requires at least 1 argument")
+		}
+		return f.fs.statFiles(uid, cmd.Args)
+	case "lsdir":
+		if len(cmd.Args) != 1 {
+			return nil, perror("lsdir requires 1 argument")
+		}
+		return f.fs.lsdir(uid, cmd.Args[0])
+	case "setxattr":
+		if len(cmd.Args) < 3 {
+			return nil, perror("setxattr requires 3 arguments")
+		}
+		value := strings.Join(cmd.Args[2:], " ")
+		return nil, f.fs.setXattr(uid, cmd.Args[0], cmd.Args[1], value)
+	case "rmxattr":
+		if len(cmd.Args) != 2 {
+			return nil, perror("rmxattr requires 2 arguments")
+		}
+		return nil, f.fs.setXattr(uid, cmd.Args[0], cmd.Args[1], "")
+	case "getxattr":
+		if len(cmd.Args) != 2 {
+			return nil, perror("getxattr requires 2 arguments")
+		}
+		value, err := f.fs.xattr(uid, cmd.Args[0], cmd.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(value + "\n"), nil
+	case "lsxattr":
+		if len(cmd.Args) != 1 {
+			return nil, perror("lsxattr requires 1 argument")
+		}
+		attrs, err := f.fs.listXattr(uid, cmd.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		var reply []byte
+		for _, attr := range attrs {
+			reply = append(reply, attr+"\n"...)
+		}
+		return reply, nil
+	case "setgid":
+		if len(cmd.Args) != 2 || (cmd.Args[1] != "on" && cmd.Args[1] != "off") {
+			return nil, perror("usage: setgid path on|off")
+		}
+		return nil, f.fs.setgid(uid, cmd.Args[0], cmd.Args[1] == "on")
+	case "scratch":
+		var ttl time.Duration
+		switch {
+		case len(cmd.Args) == 2 && cmd.Args[1] == "off":
+		case len(cmd.Args) == 2 && cmd.Args[1] == "on":
+		case len(cmd.Args) == 3 && cmd.Args[1] == "on":
+			var err error
+			if ttl, err = time.ParseDuration(cmd.Args[2]); err != nil || ttl <= 0 {
+				return nil, perror("bad ttl " + cmd.Args[2])
+			}
+		default:
+			return nil, perror("usage: scratch path on [ttl]|off")
+		}
+		return nil, f.fs.setScratch(uid, cmd.Args[0], cmd.Args[1] == "on", ttl)
+	case "umask":
+		if len(cmd.Args) != 1 {
+			return nil, perror("umask requires 1 argument")
+		}
+		umask, err := strconv.ParseUint(cmd.Args[0], 8, 32)
+		if err != nil || umask > 0777 {
+			return nil, perror("bad umask " + cmd.Args[0])
+		}
+		f.fs.setUmask(Perm(umask))
+	case "regroup":
+		if len(cmd.Args) != 1 {
+			return nil, perror("regroup requires 1 argument")
+		}
+		return nil, f.fs.regroup(cmd.Args[0])
+	case "sum":
+		if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+			return nil, perror("sum requires 2 or 3 arguments")
+		}
+		length := int64(-1)
+		if len(cmd.Args) == 3 {
+			n, err := strconv.ParseInt(cmd.Args[2], 10, 64)
+			if err != nil || n < 0 {
+				return nil, perror("bad length " + cmd.Args[2])
+			}
+			length = n
+		}
+		return f.fs.sum(uid, cmd.Args[0], cmd.Args[1], length)
 	default:
-		return 0, perror("invalid command " + cmd.Name)
-	}
-	if err != nil {
-		return 0, err
+		return nil, perror("invalid command " + cmd.Name)
 	}
-	return len(p), nil
+	return nil, nil
 }
 
 func (f *ctl) Len() uint64  { return uint64(0) }
 func (f *ctl) Close() error { return nil }
 
+// du reports the number of entries of the directory name and the number
+// of files, directories and bytes of the tree below it.
+func (fs *FS) du(uid, name string) ([]byte, error) {
+	n, err := fs.walkAs(uid, path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	if !n.HasPerm(uid, plan9.DMREAD) {
+		return nil, errPerm
+	}
+
+	n.mu.RLock()
+	entries := len(n.children)
+	n.mu.RUnlock()
+
+	files, dirs, size := 0, 0, uint64(0)
+	each(n, func(c *node) {
+		if c == n {
+			return
+		}
+		stat := c.Stat()
+		if stat.Mode&plan9.DMDIR != 0 {
+			dirs++
+		} else {
+			files++
+			size += stat.Length
+		}
+	})
+	return []byte(fmt.Sprintf("%s entries %d files %d dirs %d bytes %d\n",
+		name, entries, files, dirs, size)), nil
+}
+
+// statLine formats the stat of the file name as a line of the replies of
+// stat and lsdir: "name mode uid gid muid length mtime".
+func statLine(name string, d *plan9.Dir) string {
+	return fmt.Sprintf("%s %v %s %s %s %d %d\n", name, d.Mode, d.Uid, d.Gid, d.Muid, d.Length, d.Mtime)
+}
+
+// statFiles runs the ctl command "stat path...", returning the stats of
+// all files in one reply. It requires permission to search all
+// directories above the files, as walking to them would.
+func (fs *FS) statFiles(uid string, names []string) ([]byte, error) {
+	var reply []byte
+	for _, name := range names {
+		n, err := fs.walkAs(uid, path.Clean(name))
+		if err != nil {
+			return nil, perror(name + ": " + err.Error())
+		}
+		if n.parent != n && !n.parent.HasPerm(uid, plan9.DMEXEC) {
+			return nil, perror(name + ": " + errPerm.Error())
+		}
+		reply = append(reply, statLine(name, n.Stat())...)
+	}
+	return reply, nil
+}
+
+// lsdir runs the ctl command "lsdir path", returning the stats of all
+// entries of the directory in name order in one reply, like reading the
+// directory does in several.
+func (fs *FS) lsdir(uid, name string) ([]byte, error) {
+	n, err := fs.walkAs(uid, path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	if n.Stat().Mode&plan9.DMDIR == 0 {
+		return nil, perror("not a directory")
+	}
+	if !n.HasPerm(uid, plan9.DMREAD) {
+		return nil, errPerm
+	}
+
+	n.mu.RLock()
+	names := n.names("", -1)
+	children := make([]*node, len(names))
+	for i, name := range names {
+		children[i] = n.children[name]
+	}
+	n.mu.RUnlock()
+
+	var reply []byte
+	for _, c := range children {
+		stat := c.Stat()
+		if stat.Mode&plan9.DMAUTH != 0 {
+			continue
+		}
+		reply = append(reply, statLine(stat.Name, stat)...)
+	}
+	return reply, nil
+}
+
+// setgid marks the directory name setgid: files created in it inherit
+// its group and new subdirectories are setgid too. Only the owner or the
+// group leader may change the mark.
+func (fs *FS) setgid(uid, name string, on bool) error {
+	n, err := fs.walkAs(uid, path.Clean(name))
+	if err != nil {
+		return err
+	}
+
+	fs.frozen.RLock()
+	defer fs.frozen.RUnlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.dir.Mode&plan9.DMDIR == 0 {
+		return perror("not a directory")
+	}
+	if uid != n.dir.Uid {
+		g, err := fs.group.Get(n.dir.Gid)
+		if err != nil || g.Leader != uid {
+			return perror("not owner")
+		}
+	}
+	n.setgid = on
+	return nil
+}
+
+// regroup changes the group of every file whose group no longer exists
+// to gid.
+func (fs *FS) regroup(gid string) error {
+	if _, err := fs.group.Get(gid); err != nil {
+		return err
+	}
+	for _, root := range fs.roots() {
+		each(root, func(n *node) {
+			fs.frozen.RLock()
+			n.mu.Lock()
+			if _, err := fs.group.Get(n.dir.Gid); err != nil {
+				if n.charged() {
+					fs.quota.move(n.dir.Gid, gid, n.dir.Length)
+				}
+				n.dir.Gid = gid
+			}
+			n.mu.Unlock()
+			fs.frozen.RUnlock()
+		})
+	}
+	return nil
+}
+
+var hashes = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// sum hashes the contents of the file name using the hash function algo
+// and returns a line in the format of sha1sum(1). A non-negative length
+// hashes only the first length bytes, e.g. to verify the part of a file
+// transferred before an interruption.
+func (fs *FS) sum(uid, algo, name string, length int64) ([]byte, error) {
+	newHash, found := hashes[algo]
+	if !found {
+		return nil, perror("unknown hash " + algo)
+	}
+
+	n, err := fs.walkAs(uid, path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	if n.Stat().Mode&plan9.DMDIR != 0 {
+		return nil, perror("is a directory")
+	}
+	if !n.HasPerm(uid, plan9.DMREAD) {
+		return nil, errPerm
+	}
+
+	h := newHash()
+	data := make([]byte, IOUNIT)
+	offset := int64(0)
+	for length < 0 || offset < length {
+		if length >= 0 && length-offset < int64(len(data)) {
+			data = data[:length-offset]
+		}
+		m, err := n.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if m == 0 {
+			break
+		}
+		h.Write(data[:m])
+		offset += int64(m)
+	}
+	return []byte(hex.EncodeToString(h.Sum(nil)) + "  " + name + "\n"), nil
+}
+
 var (
 	userSep   = []byte(":")
 	memberSep = []byte(",")
@@ -1,20 +1,49 @@
 package ramfs
 
 import (
+	"context"
+	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"9fans.net/go/plan9"
 )
 
 type request struct {
 	Fid *Fid
+	New *Fid // newfid of a Twalk
 	Tx  *plan9.Fcall
 	Rx  *plan9.Fcall
 	Err error
+
+	// ctx is canceled when the request is answered, flushed or the
+	// connection ends, which aborts it if it is still outstanding.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	flushed bool   // guarded by conn.x; the reply is not sent
+	traced  bool   // the request and its reply are logged
+	msize   uint32 // of the connection when the request was read; 0 is MSIZE
+	state   int32  // reqPending, reqCommitted or reqAbandoned; accessed atomically
+
+	wait []chan struct{} // preceding requests on the same fids
+	done chan struct{}   // closed when the request is processed
 }
 
+// States of a request changing files.
+const (
+	reqPending   = iota
+	reqCommitted // the handler began to change files
+	reqAbandoned // answered before the handler began
+)
+
 type conn struct {
+	id     uint32
+	msize  uint32          // negotiated by Tversion; accessed atomically
+	ctx    context.Context // canceled when the connection ends
+	cancel context.CancelFunc
 	f, x   sync.Mutex
 	rwc    io.ReadWriteCloser
 	fidnew chan<- (chan *Fid)
@@ -24,6 +53,60 @@ type conn struct {
 	uid    string
 	fidmap map[uint32]*Fid
 	log    LogFunc
+	sample int    // trace every sample-th request
+	seq    uint64 // requests received, used by the receiving goroutine
+	stats  *session
+	access *accessLog
+	done   chan struct{} // closed when the connection ends
+
+	maxFids int // maximum number of fids; zero means no limit
+
+	// The fids of a connection attached with a session token are kept
+	// in sessions for ttl when it ends; token is guarded by f.
+	sessions *sessions
+	ttl      time.Duration
+	token    string
+
+	writeTimeout time.Duration // per chunk of a reply; zero means none
+
+	// Messages larger than msize are answered with an Rerror, or end
+	// the connection if dropOversized is set. Those and malformed
+	// messages are counted in violations.
+	dropOversized bool
+	violations    *uint64
+
+	// If ordered is set, requests on the same fid are processed in the
+	// order they were received. last holds the done channel of the last
+	// request per fid and is only used by the receiving goroutine.
+	ordered bool
+	last    map[uint32]chan struct{}
+
+	// guarded by x
+	inflight int
+	versions int // Tversion requests waiting in abort
+	draining bool
+	idle     *sync.Cond
+	tags     map[uint16]*request // outstanding requests by tag
+}
+
+func newConn(ctx context.Context, rwc io.ReadWriteCloser, fidnew chan<- (chan *Fid), work chan<- *transaction) *conn {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &conn{
+		ctx:    ctx,
+		cancel: cancel,
+		rwc:    rwc,
+		fidnew: fidnew,
+		work:   work,
+		msize:  MSIZE,
+		uid:    "none",
+		fidmap: make(map[uint32]*Fid),
+		stats:  newSession(),
+		done:   make(chan struct{}),
+		last:   make(map[uint32]chan struct{}),
+		tags:   make(map[uint16]*request),
+	}
+	c.idle = sync.NewCond(&c.x)
+	return c
 }
 
 func (c *conn) NewFid() *Fid {
@@ -32,33 +115,79 @@ func (c *conn) NewFid() *Fid {
 	return <-ch
 }
 
-func (c *conn) GetFid(num uint32) *Fid {
+func (c *conn) GetFid(num uint32) (*Fid, error) {
 	c.f.Lock()
 	defer c.f.Unlock()
 
 	fid, found := c.fidmap[num]
 	if found {
-		return fid
+		return fid, nil
+	}
+	if c.maxFids > 0 && len(c.fidmap) >= c.maxFids {
+		return nil, errTooManyFids
 	}
 
 	fid = c.NewFid()
 	fid.num = num
 	fid.uid = c.uid
+	fid.born = time.Now()
 	c.fidmap[fid.num] = fid
-	return fid
+	c.stats.fids(len(c.fidmap))
+	return fid, nil
 }
 
-func (c *conn) DelFid(num uint32) {
+// lookupFid returns the fid num of a request other than Tauth and
+// Tattach, which must have been established by one of them or a walk.
+func (c *conn) lookupFid(num uint32) (*Fid, error) {
 	c.f.Lock()
+	defer c.f.Unlock()
 	fid, found := c.fidmap[num]
 	if !found {
-		panic("fid not found")
+		return nil, perror("unknown fid")
+	}
+	fid.mu.RLock()
+	defer fid.mu.RUnlock()
+	if fid.node == nil {
+		return nil, perror("unknown fid") // newfid of a walk in progress
 	}
+	return fid, nil
+}
 
-	if fid.refCount() == 0 {
+// newFid is GetFid for the fid of a Tauth or Tattach, which must not be
+// in use.
+func (c *conn) newFid(num uint32) (*Fid, error) {
+	c.f.Lock()
+	_, found := c.fidmap[num]
+	c.f.Unlock()
+	if found {
+		return nil, perror("fid in use")
+	}
+	return c.GetFid(num)
+}
+
+// checkFids logs fids which are not clunked within age, once each.
+func (c *conn) checkFids(age time.Duration) {
+	c.f.Lock()
+	defer c.f.Unlock()
+	for num, fid := range c.fidmap {
+		if fid.reported || time.Since(fid.born) < age {
+			continue
+		}
+		fid.reported = true
+		c.log("fid %d of %s not clunked after %v: %s", num, c.stats.user(),
+			time.Since(fid.born).Truncate(time.Second), fid.node.path())
+	}
+}
+
+// DelFid removes the fid num unless it is in use by another request.
+// The fid may be gone already, e.g. if a Tversion reset the fids.
+func (c *conn) DelFid(num uint32) {
+	c.f.Lock()
+	defer c.f.Unlock()
+	fid, found := c.fidmap[num]
+	if found && fid.refCount() == 0 {
 		delete(c.fidmap, num)
 	}
-	c.f.Unlock()
 }
 
 func (c *conn) setErr(err error) {
@@ -74,20 +203,143 @@ func (c *conn) getErr() error {
 	return err
 }
 
+// begin accounts a new request and reports whether it may be served.
+// Requests arriving while the connection is draining are rejected.
+func (c *conn) begin() bool {
+	c.x.Lock()
+	defer c.x.Unlock()
+	c.inflight++
+	return !c.draining
+}
+
+// end marks a request accounted by begin as answered.
+func (c *conn) end() {
+	c.x.Lock()
+	c.inflight--
+	c.idle.Broadcast()
+	c.x.Unlock()
+}
+
+// drain rejects new requests and closes the connection as soon as all
+// outstanding requests are answered, or after grace at the latest.
+func (c *conn) drain(grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	c.drainUntil(ctx.Done())
+}
+
+// drainUntil is drain with an abort channel instead of a grace period.
+// It reports whether all outstanding requests were answered.
+func (c *conn) drainUntil(abort <-chan struct{}) bool {
+	c.x.Lock()
+	c.draining = true
+	c.x.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		c.x.Lock()
+		for c.inflight > 0 {
+			c.idle.Wait()
+		}
+		c.x.Unlock()
+		close(idle)
+	}()
+
+	defer c.rwc.Close()
+	select {
+	case <-idle:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+func (c *conn) reply(req *request, reqout chan<- *request) {
+	if c.getErr() == nil {
+		reqout <- req
+	} else {
+		c.untag(req)
+		c.end()
+	}
+}
+
+// tag registers req as outstanding until it is answered.
+func (c *conn) tag(req *request) {
+	c.x.Lock()
+	c.tags[req.Tx.Tag] = req
+	c.x.Unlock()
+}
+
+// untag removes req from the outstanding requests and reports whether
+// its reply is to be sent, i.e. it was not flushed.
+func (c *conn) untag(req *request) bool {
+	c.x.Lock()
+	defer c.x.Unlock()
+	if c.tags[req.Tx.Tag] == req {
+		delete(c.tags, req.Tx.Tag)
+	}
+	return !req.flushed
+}
+
+// flush aborts the outstanding request tagged oldtag, as requested by
+// a Tflush. The reply of the request is not sent, so the Rflush may be
+// sent at once; a reply sent already precedes it. The tag is free for
+// reuse once the Rflush is sent.
+func (c *conn) flush(oldtag uint16) {
+	c.x.Lock()
+	req, found := c.tags[oldtag]
+	if found {
+		req.flushed = true
+		delete(c.tags, oldtag)
+	}
+	c.x.Unlock()
+	if found {
+		req.cancel()
+	}
+}
+
+// abort aborts all outstanding requests but the Tversion req, as flushed
+// ones, and waits until they are answered, so none of them uses a fid
+// after the Tversion reset the fids. Concurrent Tversion requests don't
+// wait for each other.
+func (c *conn) abort(req *request) {
+	c.x.Lock()
+	defer c.x.Unlock()
+	for tag, r := range c.tags {
+		if r != req && r.Tx.Type != plan9.Tversion {
+			r.flushed = true
+			delete(c.tags, tag)
+			r.cancel()
+		}
+	}
+	c.versions++
+	for c.inflight > c.versions {
+		c.idle.Wait()
+	}
+	c.versions--
+}
+
 func (c *conn) recv() <-chan *request {
 	reqout := make(chan *request, 64)
 
 	go func() {
 		defer close(reqout)
-		var err error
 		for {
-			req := &request{Rx: &plan9.Fcall{}}
-			req.Tx, err = plan9.ReadFcall(c.rwc)
+			req, err := c.read()
 			if err != nil {
+				if _, ok := err.(plan9.ProtocolError); ok {
+					c.violation("%v, closing connection", err)
+				}
 				c.setErr(err)
+				c.cancel() // the client is gone; abort its requests
 				return
 			}
-			if c.log != nil {
+			if req.Err == errTooLarge {
+				c.violation("%s tag %d too large, rejected", fcallName(req.Tx.Type), req.Tx.Tag)
+			}
+			c.seq++
+			if c.log != nil && (c.sample <= 1 || c.seq%uint64(c.sample) == 1) {
+				req.traced = true
 				c.log("-> %s", req.Tx)
 			}
 			reqout <- req
@@ -97,29 +349,164 @@ func (c *conn) recv() <-chan *request {
 	return reqout
 }
 
+// errTooLarge answers a message larger than the msize.
+var errTooLarge = perror("message too large")
+
+// read reads the next request. A message larger than the msize is
+// skipped and returned with Err set to errTooLarge, unless
+// dropOversized is set, so it can be answered without being held in
+// memory.
+func (c *conn) read() (*request, error) {
+	var hdr [7]byte // size[4] type[1] tag[2]
+	if _, err := io.ReadFull(c.rwc, hdr[:4]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:4])
+	if size < uint32(len(hdr)) {
+		return nil, plan9.ProtocolError("invalid length")
+	}
+	if size > atomic.LoadUint32(&c.msize) {
+		if c.dropOversized {
+			return nil, plan9.ProtocolError(errTooLarge.Error())
+		}
+		if _, err := io.ReadFull(c.rwc, hdr[4:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, c.rwc, int64(size)-int64(len(hdr))); err != nil {
+			return nil, err
+		}
+		tx := &plan9.Fcall{Type: hdr[4], Tag: binary.LittleEndian.Uint16(hdr[5:])}
+		return &request{Tx: tx, Rx: &plan9.Fcall{}, Err: errTooLarge}, nil
+	}
+
+	buf := make([]byte, size)
+	copy(buf, hdr[:4])
+	if _, err := io.ReadFull(c.rwc, buf[4:]); err != nil {
+		return nil, err
+	}
+	tx, err := plan9.UnmarshalFcall(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &request{Tx: tx, Rx: &plan9.Fcall{}, msize: atomic.LoadUint32(&c.msize)}, nil
+}
+
+// violation counts and logs a protocol violation of the client.
+func (c *conn) violation(format string, v ...interface{}) {
+	if c.violations != nil {
+		atomic.AddUint64(c.violations, 1)
+	}
+	if c.log != nil {
+		c.log(format, v...)
+	}
+}
+
+// reject answers req, rejected on receipt, with its error.
+func (c *conn) reject(req *request, reqout chan<- *request) {
+	c.begin()
+	req.Rx.Type = plan9.Rerror
+	req.Rx.Ename = req.Err.Error()
+	req.Rx.Tag = req.Tx.Tag
+	c.stats.account(req)
+	c.reply(req, reqout)
+}
+
+// dispatch processes req in a new goroutine. Requests must be
+// dispatched in the order they were received.
+func (c *conn) dispatch(req *request, reqout chan<- *request) {
+	if c.ordered {
+		switch req.Tx.Type {
+		case plan9.Tversion:
+			c.last = make(map[uint32]chan struct{})
+		case plan9.Tauth, plan9.Tflush:
+			// no fid, or must not wait for the flushed request
+		default:
+			req.done = make(chan struct{})
+			fids := []uint32{req.Tx.Fid}
+			if req.Tx.Type == plan9.Twalk && req.Tx.Newfid != req.Tx.Fid {
+				fids = append(fids, req.Tx.Newfid)
+			}
+			for _, fid := range fids {
+				if ch, found := c.last[fid]; found {
+					req.wait = append(req.wait, ch)
+				}
+				c.last[fid] = req.done
+			}
+		}
+	}
+
+	req.ctx, req.cancel = context.WithCancel(c.ctx)
+	c.tag(req)
+	c.wg.Add(1)
+	go c.proc(req, reqout)
+}
+
 func (c *conn) proc(req *request, reqout chan<- *request) {
 	defer c.wg.Done()
+	defer req.cancel()
+	if req.done != nil {
+		defer close(req.done)
+	}
+	for _, ch := range req.wait {
+		select {
+		case <-ch:
+		case <-req.ctx.Done():
+		}
+	}
+
+	if !c.begin() {
+		req.Rx.Type = plan9.Rerror
+		req.Rx.Ename = errShutdown.Error()
+		req.Rx.Tag = req.Tx.Tag
+		c.reply(req, reqout)
+		return
+	}
 
 	switch req.Tx.Type {
 	case plan9.Tversion:
-		c.f.Lock() // abort all outstanding I/O
-		for num := range c.fidmap {
-			delete(c.fidmap, num)
-		}
+		c.abort(req) // abort all outstanding I/O
+		c.f.Lock()
+		fids := c.fidmap
+		c.fidmap = make(map[uint32]*Fid)
+		c.stats.fids(0)
 		c.f.Unlock()
+		clunkAll(fids)
+	case plan9.Tflush:
+		if req.Tx.Oldtag != req.Tx.Tag {
+			c.flush(req.Tx.Oldtag)
+		}
 	case plan9.Tauth:
-		// nothing
+		req.Fid, req.Err = c.newFid(req.Tx.Afid)
+		if req.Err == nil {
+			req.Fid.incRef()
+		}
+	case plan9.Tattach:
+		req.Fid, req.Err = c.newFid(req.Tx.Fid)
+		if req.Err == nil {
+			req.Fid.incRef()
+			c.f.Lock()
+			req.Fid.afid = c.fidmap[req.Tx.Afid]
+			c.f.Unlock()
+		}
 	default:
-		req.Fid = c.GetFid(req.Tx.Fid)
-		req.Fid.incRef()
-		if req.Tx.Type == plan9.Twalk {
-			req.Fid.New = c.GetFid(req.Tx.Newfid)
+		req.Fid, req.Err = c.lookupFid(req.Tx.Fid)
+		if req.Err == nil {
+			req.Fid.incRef()
+			switch {
+			case req.Tx.Type != plan9.Twalk:
+			case req.Tx.Newfid == req.Tx.Fid:
+				req.New = req.Fid
+			default:
+				req.New, req.Err = c.newFid(req.Tx.Newfid)
+			}
 		}
 	}
 
-	txn := &transaction{req, make(chan *request)}
-	c.work <- txn
-	req = <-txn.ch
+	if req.Err == nil && req.Tx.Type != plan9.Tflush {
+		txn := &transaction{req, make(chan *request)}
+		c.work <- txn
+		req = <-txn.ch
+	}
 	if req.Err != nil {
 		req.Rx.Type = plan9.Rerror
 		req.Rx.Ename = req.Err.Error()
@@ -128,57 +515,136 @@ func (c *conn) proc(req *request, reqout chan<- *request) {
 		req.Rx.Fid = req.Tx.Fid
 	}
 	req.Rx.Tag = req.Tx.Tag
+	c.stats.account(req)
+	if c.access != nil {
+		c.access.record(req, c.stats.user())
+	}
 
 	switch req.Rx.Type {
-	case plan9.Rversion, plan9.Rauth:
+	case plan9.Rversion:
+		atomic.StoreUint32(&c.msize, req.Rx.Msize)
+	case plan9.Rflush:
 		// nothing
 	case plan9.Rattach:
 		c.f.Lock()
 		c.uid = req.Fid.uid
 		c.f.Unlock()
 		req.Fid.decRef()
-		c.DelFid(req.Fid.num)
-	case plan9.Rwalk, plan9.Rclunk:
+		if _, token := sessionToken(req.Tx.Aname); token != "" && c.ttl > 0 {
+			c.resume(token, req.Fid.uid)
+		}
+	case plan9.Rclunk, plan9.Rremove:
 		req.Fid.decRef()
 		c.DelFid(req.Fid.num)
+	case plan9.Rwalk:
+		req.Fid.decRef()
+		// the newfid of a partial walk is not established
+		if len(req.Rx.Wqid) < len(req.Tx.Wname) && req.New != req.Fid {
+			c.DelFid(req.New.num)
+		}
 	case plan9.Rerror:
 		if req.Fid != nil {
 			req.Fid.decRef()
+			// the fid of a failed auth or attach is not established,
+			// nor the newfid of a failed walk
+			if req.Tx.Type == plan9.Tauth || req.Tx.Type == plan9.Tattach {
+				c.DelFid(req.Fid.num)
+			}
+			if req.New != nil && req.New != req.Fid {
+				c.DelFid(req.New.num)
+			}
 		}
 	default:
 		req.Fid.decRef()
 	}
 
-	if c.getErr() == nil {
-		reqout <- req
+	c.reply(req, reqout)
+}
+
+// writeChunk is the size of the chunks replies are written in when a
+// write timeout is set.
+const writeChunk = 64 * 1024
+
+// write sends rx to the client. With a write timeout, rx is written in
+// chunks, each of which must be accepted by the client within the
+// timeout, so a stalled client is detected even in the middle of a
+// large message.
+func (c *conn) write(rx *plan9.Fcall) error {
+	d, ok := c.rwc.(interface {
+		SetWriteDeadline(t time.Time) error
+	})
+	if c.writeTimeout <= 0 || !ok {
+		return plan9.WriteFcall(c.rwc, rx)
+	}
+
+	buf, err := rx.Bytes()
+	if err != nil {
+		return err
 	}
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > writeChunk {
+			n = writeChunk
+		}
+		if err := d.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+		m, err := c.rwc.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		buf = buf[m:]
+	}
+	return d.SetWriteDeadline(time.Time{})
 }
 
 func (c *conn) send(reqin <-chan *request) error {
 	defer c.rwc.Close()
+	defer c.cancel()
 	reqout := make(chan *request)
 
+	// a canceled context, e.g. of ListenContext, tears the connection down
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			c.rwc.Close()
+		case <-c.done:
+		}
+	}()
+
 	go func() {
 		for req := range reqin {
-			if c.getErr() == nil {
-				c.wg.Add(1)
-				go c.proc(req, reqout)
+			switch {
+			case c.getErr() != nil:
+			case req.Err != nil:
+				c.reject(req, reqout)
+			default:
+				c.dispatch(req, reqout)
 			}
 		}
 		c.wg.Wait()
 		close(reqout)
+		close(c.done)
+		if c.log != nil {
+			c.log("%s", c.stats)
+		}
 	}()
 
 	for req := range reqout {
-		if c.getErr() == nil {
-			if c.log != nil {
+		if c.untag(req) && c.getErr() == nil {
+			if req.traced {
 				c.log("<- %s", req.Rx)
 			}
-			err := plan9.WriteFcall(c.rwc, req.Rx)
+			err := c.write(req.Rx)
 			if err != nil {
+				if c.log != nil {
+					c.log("write: %v, closing connection", err)
+				}
 				c.setErr(err)
+				c.rwc.Close()
 			}
 		}
+		c.end()
 	}
 
 	return c.getErr()
@@ -0,0 +1,391 @@
+package ramfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+var update = flag.Bool("update", false, "record the golden files of the wire tests")
+
+// A wireTest is a canonical sequence of requests. Its golden file in
+// testdata/wire holds the requests and the replies of the file server
+// as hex encoded messages, T and R lines, each preceded by a comment
+// line with the message in text.
+type wireTest struct {
+	name string
+	tx   []*plan9.Fcall
+}
+
+var wireTests = []wireTest{
+	{"session", []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "adm", Aname: ""},
+		{Type: plan9.Tstat, Fid: 0},
+		{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"adm", "ctl"}},
+		{Type: plan9.Tclunk, Fid: 1},
+		{Type: plan9.Tclunk, Fid: 0},
+	}},
+	{"file", []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "adm", Aname: ""},
+		{Type: plan9.Twalk, Fid: 0, Newfid: 1},
+		{Type: plan9.Tcreate, Fid: 1, Name: "data", Perm: 0664, Mode: plan9.ORDWR},
+		{Type: plan9.Twrite, Fid: 1, Offset: 0, Data: []byte("hello, world\n")},
+		{Type: plan9.Tread, Fid: 1, Offset: 7, Count: 64},
+		{Type: plan9.Tread, Fid: 1, Offset: 64, Count: 64},
+		{Type: plan9.Tstat, Fid: 1},
+		{Type: plan9.Twstat, Fid: 1, Stat: wireRename("renamed")},
+		{Type: plan9.Tremove, Fid: 1},
+		{Type: plan9.Tclunk, Fid: 0},
+	}},
+	{"errors", []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "adm", Aname: ""},
+		{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "adm", Aname: ""},
+		{Type: plan9.Tattach, Fid: 1, Afid: 5, Uname: "adm", Aname: ""},
+		{Type: plan9.Tauth, Afid: 2, Uname: "adm", Aname: ""},
+		{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"missing"}},
+		{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"adm", "missing"}},
+		{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"adm"}},
+		{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"adm"}},
+		{Type: plan9.Topen, Fid: 1, Mode: plan9.OWRITE},
+		{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD},
+		{Type: plan9.Tread, Fid: 1, Count: 64},
+		{Type: plan9.Tstat, Fid: 9},
+		{Type: plan9.Tcreate, Fid: 1, Name: "ctl", Perm: 0664, Mode: plan9.OREAD},
+		{Type: plan9.Tclunk, Fid: 1},
+		{Type: plan9.Tclunk, Fid: 0},
+	}},
+}
+
+// wireRename returns the stat of a Twstat changing only the name.
+func wireRename(name string) []byte {
+	var d plan9.Dir
+	d.Null()
+	d.Name = name
+	b, err := d.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// normalize clears the tag, the path and version of qids and the times
+// of stats in the reply b, which differ between runs.
+func normalize(b []byte) ([]byte, error) {
+	rx, err := plan9.UnmarshalFcall(b)
+	if err != nil {
+		return nil, err
+	}
+	rx.Tag = 0
+	clear := func(q *plan9.Qid) { q.Path, q.Vers = 0, 0 }
+	clear(&rx.Qid)
+	clear(&rx.Aqid)
+	for i := range rx.Wqid {
+		clear(&rx.Wqid[i])
+	}
+	if rx.Type == plan9.Rstat {
+		d, err := plan9.UnmarshalDir(rx.Stat)
+		if err != nil {
+			return nil, err
+		}
+		clear(&d.Qid)
+		d.Atime, d.Mtime = 0, 0
+		if rx.Stat, err = d.Bytes(); err != nil {
+			return nil, err
+		}
+	}
+	return rx.Bytes()
+}
+
+// exchange sends the requests reqs to a new file server, one at a time, and
+// returns the normalized replies.
+func exchange(t *testing.T, reqs [][]byte) [][]byte {
+	server, conn := net.Pipe()
+	go New("adm").ServeConn(server)
+	defer conn.Close()
+
+	var replies [][]byte
+	for _, b := range reqs {
+		if _, err := conn.Write(b); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		b, err := rx.Bytes()
+		if err != nil {
+			t.Fatalf("reply: %v", err)
+		}
+		if b, err = normalize(b); err != nil {
+			t.Fatalf("normalize: %v", err)
+		}
+		replies = append(replies, b)
+	}
+	return replies
+}
+
+func record(t *testing.T, file string, test wireTest) {
+	var reqs [][]byte
+	for i, tx := range test.tx {
+		if tx.Type != plan9.Tversion {
+			tx.Tag = uint16(i)
+		}
+		b, err := tx.Bytes()
+		if err != nil {
+			t.Fatalf("%s: %v", tx, err)
+		}
+		reqs = append(reqs, b)
+	}
+
+	var buf bytes.Buffer
+	for i, rx := range exchange(t, reqs) {
+		fmt.Fprintf(&buf, "# %s\nT %x\n", test.tx[i], reqs[i])
+		f, _ := plan9.UnmarshalFcall(rx)
+		fmt.Fprintf(&buf, "# %s\nR %x\n", f, rx)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("write golden file: %v", err)
+	}
+}
+
+func replay(t *testing.T, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read golden file: %v (record it with -update)", err)
+	}
+	var reqs, want [][]byte
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		b, err := hex.DecodeString(strings.TrimSpace(text[1:]))
+		if err != nil {
+			t.Fatalf("%s:%d: %v", file, line, err)
+		}
+		switch text[0] {
+		case 'T':
+			reqs = append(reqs, b)
+		case 'R':
+			want = append(want, b)
+		default:
+			t.Fatalf("%s:%d: bad line %q", file, line, text)
+		}
+	}
+	if len(reqs) != len(want) {
+		t.Fatalf("%s: %d requests but %d replies", file, len(reqs), len(want))
+	}
+
+	for i, got := range exchange(t, reqs) {
+		if !bytes.Equal(got, want[i]) {
+			tx, _ := plan9.UnmarshalFcall(reqs[i])
+			g, _ := plan9.UnmarshalFcall(got)
+			w, _ := plan9.UnmarshalFcall(want[i])
+			t.Errorf("%s: reply to %s:\ngot  %s\nwant %s", file, tx, g, w)
+		}
+	}
+}
+
+func TestWireGolden(t *testing.T) {
+	for _, test := range wireTests {
+		file := filepath.Join("testdata", "wire", test.name+".golden")
+		if *update {
+			record(t, file, test)
+		}
+		replay(t, file)
+	}
+}
+
+func TestOversizedMessage(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		fs := New("adm")
+		fs.DropOversized = drop
+		server, conn := net.Pipe()
+		go fs.ServeConn(server)
+
+		rpc := func(tx *plan9.Fcall) (*plan9.Fcall, error) {
+			if err := plan9.WriteFcall(conn, tx); err != nil {
+				return nil, err
+			}
+			return plan9.ReadFcall(conn)
+		}
+		if _, err := rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"}); err != nil {
+			t.Fatalf("version: %v", err)
+		}
+		rx, err := rpc(&plan9.Fcall{Type: plan9.Twrite, Tag: 5, Fid: 1, Data: make([]byte, 8192)})
+		if drop {
+			if err == nil {
+				t.Errorf("drop: expected closed connection, got %s", rx)
+			}
+		} else if err != nil || rx.Type != plan9.Rerror || rx.Tag != 5 || rx.Ename != errTooLarge.Error() {
+			t.Errorf("expected Rerror %q tag 5, got %v (%v)", errTooLarge, rx, err)
+		} else if rx, err = rpc(&plan9.Fcall{Type: plan9.Tattach, Tag: 6, Afid: plan9.NOFID, Uname: "adm"}); err != nil || rx.Type != plan9.Rattach {
+			t.Errorf("attach after oversized message: %v (%v)", rx, err)
+		}
+		conn.Close()
+		if n := fs.ProtocolErrors(); n != 1 {
+			t.Errorf("drop %v: expected 1 protocol error, got %d", drop, n)
+		}
+	}
+}
+
+func TestIounit(t *testing.T) {
+	fs := New("adm")
+	if err := fs.WriteFileAtomic("/data", bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	server, conn := net.Pipe()
+	go fs.ServeConn(server)
+	defer conn.Close()
+
+	rpc := func(tx *plan9.Fcall) *plan9.Fcall {
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if rx.Type == plan9.Rerror {
+			t.Fatalf("%s: %s", tx, rx.Ename)
+		}
+		return rx
+	}
+	const msize = 1024
+	rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "9P2000"})
+	rpc(&plan9.Fcall{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "adm"})
+	rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"data"}})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD}); rx.Iounit != msize-plan9.IOHDRSZ {
+		t.Fatalf("expected iounit %d, got %d", msize-plan9.IOHDRSZ, rx.Iounit)
+	}
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 4096}); len(rx.Data) != msize-plan9.IOHDRSZ {
+		t.Fatalf("expected count %d, got %d", msize-plan9.IOHDRSZ, len(rx.Data))
+	}
+	rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 2})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tcreate, Fid: 2, Name: "new", Perm: 0644, Mode: plan9.OWRITE}); rx.Iounit != msize-plan9.IOHDRSZ {
+		t.Fatalf("expected iounit %d, got %d", msize-plan9.IOHDRSZ, rx.Iounit)
+	}
+}
+
+func TestMsize(t *testing.T) {
+	fs := New("adm")
+	fs.Msize = 4096 + plan9.IOHDRSZ
+	if err := fs.WriteFileAtomic("/data", bytes.Repeat([]byte("x"), 8192), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	server, conn := net.Pipe()
+	go fs.ServeConn(server)
+	defer conn.Close()
+
+	rpc := func(tx *plan9.Fcall) *plan9.Fcall {
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if rx.Type == plan9.Rerror {
+			t.Fatalf("%s: %s", tx, rx.Ename)
+		}
+		return rx
+	}
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 65536, Version: "9P2000"}); rx.Msize != fs.Msize {
+		t.Fatalf("expected msize %d, got %d", fs.Msize, rx.Msize)
+	}
+	rpc(&plan9.Fcall{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "adm"})
+	rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"data"}})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD}); rx.Iounit != 4096 {
+		t.Fatalf("expected iounit 4096, got %d", rx.Iounit)
+	}
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 8192}); len(rx.Data) != 4096 {
+		t.Fatalf("expected count 4096, got %d", len(rx.Data))
+	}
+}
+
+func TestVersionAbort(t *testing.T) {
+	fs := New("adm")
+	server, conn := net.Pipe()
+	go fs.ServeConn(server)
+	defer conn.Close()
+
+	send := func(tx *plan9.Fcall) {
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	recv := func() *plan9.Fcall {
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return rx
+	}
+	rpc := func(tx *plan9.Fcall) *plan9.Fcall {
+		send(tx)
+		return recv()
+	}
+	setup := func() {
+		rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"})
+		if rx := rpc(&plan9.Fcall{Type: plan9.Tattach, Tag: 1, Fid: 0, Afid: plan9.NOFID, Uname: "adm"}); rx.Type != plan9.Rattach {
+			t.Fatalf("attach: %s", rx)
+		}
+		if rx := rpc(&plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 0, Newfid: 1}); rx.Type != plan9.Rwalk {
+			t.Fatalf("walk: %s", rx)
+		}
+	}
+	setup()
+
+	// concurrent clunks of the same fid
+	fs.SetFaults(Faults{Delay: 50 * time.Millisecond, DelayRate: 1})
+	send(&plan9.Fcall{Type: plan9.Tclunk, Tag: 2, Fid: 1})
+	send(&plan9.Fcall{Type: plan9.Tclunk, Tag: 3, Fid: 1})
+	recv()
+	recv()
+	fs.SetFaults(Faults{})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tstat, Tag: 4, Fid: 1}); rx.Type != plan9.Rerror {
+		t.Fatalf("stat: expected error for clunked fid, got %s", rx)
+	}
+
+	// a Tversion aborts the outstanding clunk, whose reply is not sent
+	if rx := rpc(&plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 0, Newfid: 1}); rx.Type != plan9.Rwalk {
+		t.Fatalf("walk: %s", rx)
+	}
+	fs.SetFaults(Faults{Delay: 200 * time.Millisecond, DelayRate: 1})
+	send(&plan9.Fcall{Type: plan9.Tclunk, Tag: 2, Fid: 1})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"}); rx.Type != plan9.Rversion {
+		t.Fatalf("version: expected Rversion, got %s", rx)
+	}
+	fs.SetFaults(Faults{})
+	time.Sleep(300 * time.Millisecond)
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tstat, Tag: 4, Fid: 0}); rx.Type != plan9.Rerror {
+		t.Fatalf("stat: expected error for fid reset by version, got %s", rx)
+	}
+	setup()
+
+	// the fids reset by a Tversion are clunked
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tcreate, Tag: 1, Fid: 1, Name: "excl", Perm: plan9.DMEXCL | 0664, Mode: plan9.ORDWR}); rx.Type != plan9.Rcreate {
+		t.Fatalf("create: %s", rx)
+	}
+	setup()
+	if rx := rpc(&plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 0, Newfid: 2, Wname: []string{"excl"}}); rx.Type != plan9.Rwalk {
+		t.Fatalf("walk: %s", rx)
+	}
+	if rx := rpc(&plan9.Fcall{Type: plan9.Topen, Tag: 1, Fid: 2, Mode: plan9.OREAD}); rx.Type != plan9.Ropen {
+		t.Fatalf("open: expected exclusive use file closed by version, got %s", rx)
+	}
+}
@@ -0,0 +1,243 @@
+package ramfs
+
+import (
+	"io"
+	"path"
+
+	"9fans.net/go/plan9"
+)
+
+// Copy duplicates the file src to the new file dst. File data is shared
+// copy-on-write between both files, so copying takes constant time and
+// memory until either file is modified. Copy requires read permission on
+// src and write permission in the directory of dst, which can't be a
+// host directory served by MountHost.
+func (fs *FS) Copy(src, dst string) error {
+	user, err := fs.group.Get(fs.hostowner)
+	if err != nil {
+		return err
+	}
+	return fs.copy(user.Name, src, dst)
+}
+
+func (fs *FS) copy(uid, src, dst string) error {
+	from, err := fs.walkAs(uid, path.Clean(src))
+	if err != nil {
+		return err
+	}
+	if from.Stat().Mode&plan9.DMDIR != 0 {
+		return perror("is a directory")
+	}
+	if !from.HasPerm(uid, plan9.DMREAD) {
+		return errPerm
+	}
+
+	dst = path.Clean(dst)
+	dir, err := fs.walkAs(uid, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if dir.hostPath() != "" {
+		return perror("can't copy into a host directory")
+	}
+	if !dir.HasPerm(uid, plan9.DMWRITE) {
+		return errPerm
+	}
+	c, err := copyNode(uid, from, dir, path.Base(dst))
+	if err != nil {
+		return err
+	}
+	fs.created(c, uid, c.Stat().Length)
+	return nil
+}
+
+// Clone copies the directory src and everything below it to the new
+// directory dst. Files share their data copy-on-write as in Copy. Clone
+// requires read and execute permission on all directories below src,
+// read permission on all files and write permission in the directory of
+// dst, which can't be a host directory served by MountHost.
+func (fs *FS) Clone(src, dst string) error {
+	user, err := fs.group.Get(fs.hostowner)
+	if err != nil {
+		return err
+	}
+	return fs.clone(user.Name, src, dst)
+}
+
+func (fs *FS) clone(uid, src, dst string) error {
+	from, err := fs.walkAs(uid, path.Clean(src))
+	if err != nil {
+		return err
+	}
+	if from.Stat().Mode&plan9.DMDIR == 0 {
+		return perror("not a directory")
+	}
+
+	dst = path.Clean(dst)
+	dir, err := fs.walkAs(uid, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if dir.hostPath() != "" {
+		return perror("can't clone into a host directory")
+	}
+	if !dir.HasPerm(uid, plan9.DMWRITE) {
+		return errPerm
+	}
+	for n := dir; ; n = n.parent {
+		if n == from {
+			return perror("can't clone a directory into itself")
+		}
+		if n.parent == n {
+			break
+		}
+	}
+	return cloneNode(uid, from, dir, path.Base(dst))
+}
+
+// cloneNode copies the directory n and its contents to name in the
+// directory dir.
+func cloneNode(uid string, n, dir *node, name string) error {
+	if !n.HasPerm(uid, plan9.DMREAD|plan9.DMEXEC) {
+		return errPerm
+	}
+
+	dir.mu.RLock()
+	_, found := dir.children[dir.fs.normName(name)]
+	dir.mu.RUnlock()
+	if found {
+		return perror("file exists")
+	}
+
+	n.mu.RLock()
+	mode := n.dir.Mode
+	xattr := n.copyXattr()
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	n.mu.RUnlock()
+
+	c, err := dir.Create(uid, name, plan9.OREAD, mode)
+	if err != nil {
+		return err
+	}
+	c.fs.created(c, uid, 0)
+	c.fs.frozen.RLock()
+	c.mu.Lock()
+	c.xattr = xattr
+	c.mu.Unlock()
+	c.fs.frozen.RUnlock()
+
+	for _, child := range children {
+		stat := child.Stat()
+		switch {
+		case stat.Mode&plan9.DMAUTH != 0:
+			continue
+		case stat.Mode&plan9.DMDIR != 0:
+			err = cloneNode(uid, child, c, stat.Name)
+		case !child.HasPerm(uid, plan9.DMREAD):
+			err = errPerm
+		default:
+			var f *node
+			if f, err = copyNode(uid, child, c, stat.Name); err == nil {
+				c.fs.created(f, uid, f.Stat().Length)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyNode copies the file n to name in the directory dir.
+func copyNode(uid string, n, dir *node, name string) (*node, error) {
+	fs := dir.fs
+	name = fs.normName(name)
+	if err := fs.checkName(name); err != nil {
+		return nil, err
+	}
+
+	path, err := fs.newPath()
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	perm := dir.createPerm(n.dir.Mode)
+	length := n.dir.Length
+	xattr := n.copyXattr()
+	var b Buffer
+	if f, ok := n.file.(*file); ok {
+		b = f.clone()
+	}
+	n.mu.Unlock()
+	if b == nil {
+		// synthetic files are copied byte by byte
+		if b, err = readAll(n); err != nil {
+			fs.delPath(path)
+			return nil, err
+		}
+		length = b.Len()
+	}
+	if s, ok := fs.newBuffer(childPath(dir.path(), name), Perm(perm), length).(*storage); ok {
+		if err := copyBuffer(s, b); err != nil {
+			fs.delPath(path)
+			return nil, err
+		}
+		b = s
+	}
+
+	dir.mu.RLock()
+	gid := dir.newGid()
+	dir.mu.RUnlock()
+	if err := fs.quota.charge(gid, length); err != nil {
+		fs.delPath(path)
+		return nil, err
+	}
+	c := newNode(fs, name, uid, gid, perm, path, b)
+	c.dir.Length = length
+	c.xattr = xattr
+	c.parent = dir
+
+	fs.frozen.RLock()
+	defer fs.frozen.RUnlock()
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	if dir.dir.Mode&plan9.DMDIR == 0 {
+		fs.delPath(path)
+		fs.quota.release(gid, length)
+		return nil, perror("not a directory")
+	}
+	if _, found := dir.children[name]; found {
+		fs.delPath(path)
+		fs.quota.release(gid, length)
+		return nil, perror("file exists")
+	}
+	if fs.MaxEntries > 0 && len(dir.children) >= fs.MaxEntries {
+		fs.delPath(path)
+		fs.quota.release(gid, length)
+		return nil, perror("directory full")
+	}
+	dir.link(name, c)
+	return c, nil
+}
+
+func readAll(n *node) (*file, error) {
+	f := newFile(BLOCKSIZE)
+	data := make([]byte, IOUNIT)
+	offset := int64(0)
+	for {
+		m, err := n.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if m == 0 {
+			break
+		}
+		f.WriteAt(data[:m], offset)
+		offset += int64(m)
+	}
+	return f, nil
+}
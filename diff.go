@@ -0,0 +1,184 @@
+package ramfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"9fans.net/go/plan9"
+)
+
+// A Change describes a file which differs between two directories.
+type Change struct {
+	Op   byte   // '+' added, '-' removed or 'M' modified
+	Path string // path relative to the compared directories
+}
+
+func (c Change) String() string { return fmt.Sprintf("%c %s", c.Op, c.Path) }
+
+// Diff compares the directories a and b and returns the files which were
+// added, removed or modified in b, sorted by path. A file is modified if
+// its type, permissions or contents differ. The names are resolved like
+// the aname of an attach, so "snap/<name>/path" refers to a snapshot.
+// Only the top of an added or removed directory is reported.
+func (fs *FS) Diff(a, b string) ([]Change, error) {
+	return fs.diff(fs.hostowner, a, b)
+}
+
+func (fs *FS) diff(uid, a, b string) ([]Change, error) {
+	na, _, err := fs.resolve(uid, a)
+	if err != nil {
+		return nil, err
+	}
+	nb, _, err := fs.resolve(uid, b)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range []*node{na, nb} {
+		if n.Stat().Mode&plan9.DMDIR == 0 {
+			return nil, perror("not a directory")
+		}
+	}
+
+	var changes []Change
+	if err := diffDir(uid, na, nb, "/", &changes); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func diffDir(uid string, a, b *node, name string, changes *[]Change) error {
+	if !a.HasPerm(uid, plan9.DMREAD) || !b.HasPerm(uid, plan9.DMREAD) {
+		return errPerm
+	}
+	ca, cb := children(a), children(b)
+	for elem, x := range ca {
+		p := path.Join(name, elem)
+		y, found := cb[elem]
+		if !found {
+			*changes = append(*changes, Change{'-', p})
+			continue
+		}
+
+		dx, dy := x.Stat(), y.Stat()
+		if (dx.Mode^dy.Mode)&plan9.DMDIR != 0 {
+			*changes = append(*changes, Change{'M', p})
+			continue
+		}
+		if dx.Mode&plan9.DMDIR != 0 {
+			if dx.Mode != dy.Mode {
+				*changes = append(*changes, Change{'M', p})
+			}
+			if err := diffDir(uid, x, y, p, changes); err != nil {
+				return err
+			}
+			continue
+		}
+		if dx.Mode != dy.Mode || !sameData(x, y) {
+			*changes = append(*changes, Change{'M', p})
+		}
+	}
+	for elem := range cb {
+		if _, found := ca[elem]; !found {
+			*changes = append(*changes, Change{'+', path.Join(name, elem)})
+		}
+	}
+	return nil
+}
+
+// children returns the entries of the directory n which are kept in
+// snapshots, leaving out synthetic and authentication files.
+func children(n *node) map[string]*node {
+	n.mu.RLock()
+	list := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		list = append(list, c)
+	}
+	n.mu.RUnlock()
+
+	m := make(map[string]*node, len(list))
+	for _, c := range list {
+		stat := c.Stat()
+		if stat.Mode&plan9.DMAUTH != 0 {
+			continue
+		}
+		if !stored(c.file) && stat.Mode&plan9.DMDIR == 0 {
+			continue
+		}
+		m[stat.Name] = c
+	}
+	return m
+}
+
+// sameData reports whether the files x and y have the same contents. An
+// unchanged qid proves equality for a file and its snapshot; otherwise
+// the blocks are compared, where blocks shared copy-on-write are equal
+// without looking at their contents.
+func sameData(x, y *node) bool {
+	if x == y {
+		return true
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	y.mu.RLock()
+	defer y.mu.RUnlock()
+
+	if x.dir.Qid == y.dir.Qid && x.dir.Length == y.dir.Length &&
+		x.dir.Qid.Type&plan9.QTTMP == 0 {
+		return true
+	}
+	if x.dir.Length != y.dir.Length {
+		return false
+	}
+	fx, okx := x.file.(*file)
+	fy, oky := y.file.(*file)
+	if !okx || !oky {
+		return sameBuffer(x.file, y.file)
+	}
+	if fx.block == nil || fy.block == nil {
+		bx, by := fx.blockAt(0), fy.blockAt(0)
+		if fx.block == nil && fy.block == nil && len(bx) > 0 && &bx[0] == &by[0] {
+			return true
+		}
+		return sameBuffer(x.file, y.file)
+	}
+	for num, bx := range fx.block {
+		by := fy.block[num]
+		if len(bx) == len(by) && len(bx) > 0 && &bx[0] == &by[0] {
+			continue
+		}
+		if !bytes.Equal(bx, by) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameBuffer compares the data of the buffers x and y of equal length.
+func sameBuffer(x, y Buffer) bool {
+	bx := make([]byte, IOUNIT)
+	by := make([]byte, IOUNIT)
+	offset := int64(0)
+	for {
+		n, err := x.ReadAt(bx, offset)
+		if err != nil && err != io.EOF {
+			return false
+		}
+		if n == 0 {
+			return true
+		}
+		m, err := y.ReadAt(by[:n], offset)
+		if (err != nil && err != io.EOF) || m == 0 {
+			return false
+		}
+		if !bytes.Equal(bx[:m], by[:m]) {
+			return false
+		}
+		offset += int64(m)
+	}
+}
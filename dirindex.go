@@ -0,0 +1,70 @@
+package ramfs
+
+import "sort"
+
+// indexMin is the number of entries from which a directory keeps a
+// sorted index of their names alongside the children map, so ordered
+// listings need not sort the entire directory. The index is dropped
+// again when the directory shrinks below half of it.
+const indexMin = 256
+
+// link adds the entry c under name to the directory n, replacing an
+// existing one. The caller holds n.mu.
+func (n *node) link(name string, c *node) {
+	if _, found := n.children[name]; !found && n.index != nil {
+		i := sort.SearchStrings(n.index, name)
+		n.index = append(n.index, "")
+		copy(n.index[i+1:], n.index[i:])
+		n.index[i] = name
+	}
+	n.children[name] = c
+	if n.index == nil && len(n.children) >= indexMin {
+		n.index = n.sortNames()
+	}
+}
+
+// unlink removes the entry name from the directory n. The caller holds
+// n.mu.
+func (n *node) unlink(name string) {
+	if _, found := n.children[name]; !found {
+		return
+	}
+	delete(n.children, name)
+	if n.index == nil {
+		return
+	}
+	if len(n.children) < indexMin/2 {
+		n.index = nil
+		return
+	}
+	i := sort.SearchStrings(n.index, name)
+	n.index = append(n.index[:i], n.index[i+1:]...)
+}
+
+func (n *node) sortNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// names returns up to max names of the entries of the directory n in
+// order, starting after the name after; all if max is negative. The
+// caller holds n.mu.
+func (n *node) names(after string, max int) []string {
+	names := n.index
+	if names == nil {
+		names = n.sortNames()
+	}
+	i := 0
+	if after != "" {
+		i = sort.Search(len(names), func(i int) bool { return names[i] > after })
+	}
+	names = names[i:]
+	if max >= 0 && len(names) > max {
+		names = names[:max]
+	}
+	return append([]string(nil), names...)
+}
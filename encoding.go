@@ -0,0 +1,70 @@
+package ramfs
+
+import (
+	"strings"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// Content encodings a client may negotiate by appending "!<encoding>" to
+// the aname of an attach request. File data is always stored raw; the
+// encoding only applies to the data transferred in Tread and Twrite
+// messages on fids derived from that attach, so clients using different
+// encodings can share the same files. An encoded Twrite is stored whole
+// or fails with a short write error.
+const (
+	EncodingNone   = ""
+	EncodingSnappy = "snappy"
+)
+
+// parseAname splits aname into the file tree path and the requested
+// content encoding. A trailing session token is ignored.
+func parseAname(aname string) (string, string, error) {
+	aname, _ = sessionToken(aname)
+	i := strings.LastIndex(aname, "!")
+	if i < 0 {
+		return aname, EncodingNone, nil
+	}
+
+	enc := aname[i+1:]
+	switch enc {
+	case EncodingNone, EncodingSnappy:
+	default:
+		return "", "", perror("unknown encoding " + enc)
+	}
+	return aname[:i], enc, nil
+}
+
+// rawCount returns the number of raw bytes which can be read such that
+// the encoded data does not exceed count bytes.
+func rawCount(enc string, count uint32) uint32 {
+	switch enc {
+	case EncodingSnappy:
+		// snappy.MaxEncodedLen(n) == 32 + n + n/6
+		if count <= 32 {
+			return 0
+		}
+		return (count - 32) * 6 / 7
+	}
+	return count
+}
+
+func encode(enc string, p []byte) ([]byte, error) {
+	switch enc {
+	case EncodingSnappy:
+		return snappy.Encode(nil, p)
+	}
+	return p, nil
+}
+
+func decode(enc string, p []byte) ([]byte, error) {
+	switch enc {
+	case EncodingSnappy:
+		data, err := snappy.Decode(nil, p)
+		if err != nil {
+			return nil, perror("snappy: " + err.Error())
+		}
+		return data, nil
+	}
+	return p, nil
+}
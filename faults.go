@@ -0,0 +1,148 @@
+package ramfs
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+// Faults describes the faults injected into the requests of the file
+// server to let client authors test their retry logic. Rates are
+// probabilities from 0, never, to 1, always.
+//
+// Tversion, Tauth, Tattach, Tflush and Tclunk requests and the requests
+// on files in /adm are never failed, so the faults can always be turned
+// off.
+type Faults struct {
+	Delay     time.Duration // delay of a delayed request
+	DelayRate float64       // probability of delaying a request
+	ShortRate float64       // probability of a short read of a file
+	ErrorRate float64       // probability of failing a request
+	Error     string        // error of failed requests; "injected fault" if empty
+}
+
+// SetFaults sets the faults injected into the requests. The zero Faults
+// turns fault injection off.
+func (fs *FS) SetFaults(f Faults) {
+	if f == (Faults{}) {
+		fs.faults.Store((*Faults)(nil))
+		return
+	}
+	fs.faults.Store(&f)
+}
+
+// Faults returns the faults injected into the requests.
+func (fs *FS) Faults() Faults {
+	if f, _ := fs.faults.Load().(*Faults); f != nil {
+		return *f
+	}
+	return Faults{}
+}
+
+func (fs *FS) loadFaults() *Faults {
+	f, _ := fs.faults.Load().(*Faults)
+	return f
+}
+
+// inject delays req or fails it as configured.
+func (f *Faults) inject(req *request) error {
+	if f.DelayRate > 0 && rand.Float64() < f.DelayRate {
+		timer := time.NewTimer(f.Delay)
+		select {
+		case <-timer.C:
+		case <-req.ctx.Done():
+			timer.Stop()
+			return errCanceled
+		}
+	}
+	switch req.Tx.Type {
+	case plan9.Tversion, plan9.Tauth, plan9.Tattach, plan9.Tflush, plan9.Tclunk:
+		return nil
+	}
+	if isAdm(req) {
+		return nil
+	}
+	if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+		if f.Error == "" {
+			return perror("injected fault")
+		}
+		return perror(f.Error)
+	}
+	return nil
+}
+
+// isAdm reports whether req is on a file in /adm or walks into /adm.
+func isAdm(req *request) bool {
+	p := req.Fid.node.path()
+	if req.Tx.Type == plan9.Twalk && p == "/" && len(req.Tx.Wname) > 0 {
+		p += req.Tx.Wname[0]
+	}
+	return p == "/adm" || strings.HasPrefix(p, "/adm/")
+}
+
+// shorten truncates the data of a successful read of a file, unless it
+// is encoded, to a random shorter length.
+func (f *Faults) shorten(req *request) {
+	rx := req.Rx
+	if f.ShortRate <= 0 || req.Tx.Type != plan9.Tread || len(rx.Data) < 2 {
+		return
+	}
+	if req.Fid.enc != EncodingNone || req.Fid.node.Stat().Mode&plan9.DMDIR != 0 {
+		return
+	}
+	if rand.Float64() < f.ShortRate {
+		rx.Data = rx.Data[:1+rand.Intn(len(rx.Data)-1)]
+		rx.Count = uint32(len(rx.Data))
+	}
+}
+
+// fault runs the ctl command "fault", which reports the injected faults,
+// or "fault off", "fault delay duration rate", "fault short rate" or
+// "fault error rate [message]", which change them.
+func (fs *FS) fault(args []string) ([]byte, error) {
+	f := fs.Faults()
+	if len(args) == 0 {
+		return []byte(fmt.Sprintf("delay %v %g\nshort %g\nerror %g %s\n",
+			f.Delay, f.DelayRate, f.ShortRate, f.ErrorRate, f.Error)), nil
+	}
+
+	rate := func(s string) (float64, error) {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r < 0 || r > 1 {
+			return 0, perror("bad rate " + s)
+		}
+		return r, nil
+	}
+	var err error
+	switch {
+	case args[0] == "off" && len(args) == 1:
+		f = Faults{}
+	case args[0] == "delay" && len(args) == 3:
+		if f.Delay, err = time.ParseDuration(args[1]); err != nil || f.Delay < 0 {
+			return nil, perror("bad delay " + args[1])
+		}
+		f.DelayRate, err = rate(args[2])
+	case args[0] == "short" && len(args) == 2:
+		f.ShortRate, err = rate(args[1])
+	case args[0] == "error" && len(args) >= 2:
+		f.ErrorRate, err = rate(args[1])
+		f.Error = ""
+		for i, s := range args[2:] {
+			if i > 0 {
+				f.Error += " "
+			}
+			f.Error += s
+		}
+	default:
+		return nil, perror("usage: fault [off | delay duration rate | short rate | error rate [message]]")
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.SetFaults(f)
+	return nil, nil
+}
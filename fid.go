@@ -2,6 +2,7 @@ package ramfs
 
 import (
 	"sync"
+	"time"
 
 	"9fans.net/go/plan9"
 )
@@ -16,9 +17,20 @@ type Fid struct {
 	uid    string
 	node   *node
 	opened bool
-	buf    []byte // used for Dirread
+	mode   uint8  // open mode; valid if opened
+	buf    []byte // directory entries of the last read at offset 0
+	dirOff int64  // offset following the last directory read
+	enc    string // content encoding negotiated at attach
+	ro     error  // error of changes: attached to a snapshot or as a read-only user
+	reply  []byte // reply of the last query written to a querier
+	txn    *txn   // changes queued by the ctl command begin; nil if none
 	ref    uint16
 	New    *Fid
+	afid   *Fid // afid of a Tattach
+
+	born     time.Time // allocation time, for leak detection
+	reported bool      // reported as leaked; guarded by conn.f
+	revoked  bool      // closed by the clunk or revoke ctl command
 }
 
 func (f *Fid) incRef() {
@@ -43,27 +55,76 @@ func (f *Fid) refCount() uint16 {
 	return f.ref
 }
 
+func (f *Fid) isRevoked() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.revoked
+}
+
 func (f *Fid) isOpen() bool {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	return f.opened
 }
 
+// canRead reports whether f is open for reading: OREAD, ORDWR or OEXEC.
+func (f *Fid) canRead() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.opened && f.mode&3 != plan9.OWRITE
+}
+
+// canWrite reports whether f is open for writing: OWRITE or ORDWR.
+func (f *Fid) canWrite() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.opened && (f.mode&3 == plan9.OWRITE || f.mode&3 == plan9.ORDWR)
+}
+
 // WalkFunc is the type of the function called for each file or directory
-// visited by Walk.
+// visited by Walk. The fid represents the visited file; it is not the
+// fid walked to.
 type WalkFunc func(fid *Fid, path []string) error
 
-// Walk walks the file tree.
+// Walk walks the file tree to f.New. It is an error to walk a fid that
+// is open for I/O, even with no names. f.New is changed only if all
+// names are walked; if the walk fails after some of them, fn has been
+// called for each of those.
 func (f *Fid) Walk(name []string, fn WalkFunc) error {
+	return f.walkTo(f.New, name, fn)
+}
+
+// walkTo walks the file tree to newfid, which may be f. Unlike the New
+// field, newfid is not shared by concurrent walks from f. Neither f nor
+// newfid is changed unless the walk succeeds.
+func (f *Fid) walkTo(newfid *Fid, name []string, fn WalkFunc) error {
 	if len(name) > plan9.MAXWELEM {
 		return perror("too many names in walk")
 	}
+	if f.isRevoked() {
+		return errRevoked
+	}
+	if f.isOpen() {
+		return perror("cannot walk open fid")
+	}
 
-	f.New.node = f.node
-	return walk(f.node, name, func(n *node, p []string) error {
-		f.New.node = n
-		return fn(f.New, p)
+	f.mu.RLock()
+	walked := &Fid{uid: f.uid, node: f.node, enc: f.enc, ro: f.ro}
+	f.mu.RUnlock()
+	err := walk(walked.node, walked.uid, name, func(n *node, p []string) error {
+		walked.node = n
+		return fn(walked, p)
 	})
+	if err != nil {
+		return err
+	}
+
+	newfid.mu.Lock()
+	newfid.node = walked.node
+	newfid.enc = walked.enc
+	newfid.ro = walked.ro
+	newfid.mu.Unlock()
+	return nil
 }
 
 // Close informs the file server that the current file represented by fid
@@ -72,7 +133,10 @@ func (f *Fid) Close() error {
 	if !f.isOpen() {
 		return perror("file not open for I/O")
 	}
-	if f.node.dir.Mode&plan9.ORCLOSE != 0 {
+	f.mu.RLock()
+	mode := f.mode
+	f.mu.RUnlock()
+	if mode&plan9.ORCLOSE != 0 {
 		parent := f.node.parent
 		if !f.node.HasPerm(f.uid, plan9.DMWRITE) {
 			return errPerm
@@ -83,9 +147,26 @@ func (f *Fid) Close() error {
 	}
 
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	if !f.opened {
+		f.mu.Unlock()
+		return perror("file not open for I/O")
+	}
 	f.opened = false
-	return f.node.Close()
+	if mode&plan9.ORCLOSE == 0 {
+		defer f.mu.Unlock()
+		return f.node.Close(f)
+	}
+	var name string
+	h := f.node.fs.hooksOf(f.node)
+	if h != nil && h.OnRemove != nil {
+		name = f.node.path()
+	}
+	err := f.node.Close(f)
+	f.mu.Unlock()
+	if err == nil && name != "" {
+		h.OnRemove(name, f.uid)
+	}
+	return err
 }
 
 // Create asks the file server to create a new file with the name
@@ -105,20 +186,46 @@ func (f *Fid) Close() error {
 // The names . and .. are special; it is illegal to create files with
 // these names.
 func (f *Fid) Create(name string, mode uint8, perm Perm) error {
-	if !f.node.HasPerm(f.uid, plan9.DMWRITE) {
-		return errPerm
+	if f.isRevoked() {
+		return errRevoked
 	}
-
-	node, err := f.node.Create(f.uid, name, mode, plan9.Perm(perm))
+	node, err := f.create(name, mode, perm)
 	if err != nil {
 		return err
 	}
 
+	if h := node.fs.hooksOf(node); h != nil && h.OnCreate != nil {
+		h.OnCreate(node.path(), f.uid)
+	}
+	return nil
+}
+
+// create creates and opens the file name in the directory of the fid f,
+// which must not be open.
+func (f *Fid) create(name string, mode uint8, perm Perm) (*node, error) {
 	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.opened {
+		return nil, perror("file already open for I/O")
+	}
+	if f.ro != nil {
+		return nil, f.ro
+	}
+	if !f.node.HasPerm(f.uid, plan9.DMWRITE) {
+		return nil, errPerm
+	}
+
+	node, err := f.node.Create(f.uid, name, mode, plan9.Perm(perm))
+	if err != nil {
+		return nil, err
+	}
+	if err := node.Open(f, mode); err != nil {
+		return nil, err
+	}
 	f.node = node
 	f.opened = true
-	f.mu.Unlock()
-	return nil
+	f.mode = mode
+	return node, nil
 }
 
 // Open asks the file server to check permissions and prepare a fid for
@@ -138,8 +245,8 @@ func (f *Fid) Create(name string, mode uint8, perm Perm) error {
 // it on close. If the file is marked for exclusive use, only one client
 // can have the file open at any time.
 func (f *Fid) Open(mode uint8) error {
-	if f.isOpen() {
-		return perror("file already open for I/O")
+	if f.isRevoked() {
+		return errRevoked
 	}
 
 	perm := plan9.Perm(0)
@@ -150,29 +257,44 @@ func (f *Fid) Open(mode uint8) error {
 		perm = plan9.DMWRITE
 	case plan9.ORDWR:
 		perm = plan9.DMREAD | plan9.DMWRITE
+	case plan9.OEXEC:
+		perm = plan9.DMEXEC
 	}
 	if (mode & plan9.OTRUNC) != 0 {
 		perm |= plan9.DMWRITE
 	}
 
+	// The state is checked and changed under one lock, so concurrent
+	// opens of a fid can't both succeed.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.opened {
+		return perror("file already open for I/O")
+	}
+	if f.ro != nil && (perm&plan9.DMWRITE != 0 || mode&plan9.ORCLOSE != 0) {
+		return f.ro
+	}
 	if !f.node.HasPerm(f.uid, plan9.Perm(perm)) {
 		return errPerm
 	}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
+	if err := f.node.Open(f, mode); err != nil {
+		return err
+	}
 	f.opened = true
-	return f.node.Open(mode)
+	f.mode = mode
+	return nil
 }
 
 // Remove asks the file server both to remove the file represented by fid
 // and to clunk the fid, even if the remove fails.
 func (f *Fid) Remove() error {
-	if !f.isOpen() {
-		return perror("file not open for I/O")
+	if f.isRevoked() {
+		return errRevoked
+	}
+	if f.ro != nil {
+		return f.ro
 	}
-
 	parent := f.node.parent
 	if !f.node.HasPerm(f.uid, plan9.DMWRITE) {
 		return errPerm
@@ -181,9 +303,17 @@ func (f *Fid) Remove() error {
 		return errPerm
 	}
 
+	var name string
+	h := f.node.fs.hooksOf(f.node)
+	if h != nil && h.OnRemove != nil {
+		name = f.node.path()
+	}
 	if err := f.node.Remove(); err != nil {
 		return err
 	}
+	if name != "" {
+		h.OnRemove(name, f.uid)
+	}
 	return nil
 }
 
@@ -192,29 +322,79 @@ func (f *Fid) Remove() error {
 // beginning of the file.
 //
 // For directories, ReadAt returns an integral number of directory
-// entries exactly as in stat, one for each member of the directory.
+// entries exactly as in stat, one for each member of the directory. A
+// read at offset 0 takes a snapshot of the entries, which later reads
+// continue; their offset must be the end of an entry returned before,
+// usually the offset of the previous read plus the bytes it returned.
 func (f *Fid) ReadAt(p []byte, offset int64) (int, error) {
+	if f.isRevoked() {
+		return 0, errRevoked
+	}
 	if !f.isOpen() {
 		return 0, perror("file not open for I/O")
 	}
+	if !f.canRead() {
+		return 0, perror("file not open for reading")
+	}
 
 	stat := f.node.Stat()
-	var err error
 	if stat.Mode&plan9.DMDIR != 0 {
-		if offset == 0 {
-			f.buf, err = f.node.Readdir()
-			if err != nil {
-				return 0, err
-			}
+		return f.readdir(p, offset)
+	}
+	if _, ok := f.node.file.(querier); ok {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		if offset >= int64(len(f.reply)) {
+			return 0, nil
 		}
-
-		n := copy(p, f.buf)
-		f.buf = f.buf[n:]
-		return n, nil
+		return copy(p, f.reply[offset:]), nil
 	}
 	return f.node.ReadAt(p, offset)
 }
 
+// readdir reads the directory entries at offset of the snapshot taken
+// by the last read at offset 0.
+func (f *Fid) readdir(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if offset == 0 {
+		buf, err := f.node.Readdir()
+		if err != nil {
+			return 0, err
+		}
+		f.buf, f.dirOff = buf, 0
+	}
+	if offset != f.dirOff && !entryBoundary(f.buf, offset) {
+		return 0, perror("bad offset in directory read")
+	}
+
+	data := f.buf[offset:]
+	n := 0
+	for n < len(data) {
+		size := int(data[n]) | int(data[n+1])<<8 + 2
+		if n+size > len(p) {
+			break
+		}
+		n += size
+	}
+	if n == 0 && len(data) > 0 {
+		return 0, perror("read count too small for directory entry")
+	}
+	copy(p, data[:n])
+	f.dirOff = offset + int64(n)
+	return n, nil
+}
+
+// entryBoundary reports whether offset is the end of a directory entry
+// of buf, or 0.
+func entryBoundary(buf []byte, offset int64) bool {
+	off := int64(0)
+	for off < offset && off+2 <= int64(len(buf)) {
+		off += int64(buf[off]) | int64(buf[off+1])<<8 + 2
+	}
+	return off == offset
+}
+
 // WriteAt asks that len(p) bytes of data be recorded in the file
 // identified by fid, which must be opened for writing, starting offset
 // bytes after the beginning of the file. If the file is append–only, the
@@ -224,15 +404,61 @@ func (f *Fid) ReadAt(p []byte, offset int64) (int, error) {
 // WriteAt records the number of bytes actually written. It is usually an
 // error if this is not the same as requested.
 func (f *Fid) WriteAt(p []byte, offset int64) (int, error) {
+	return f.write(p, offset, false)
+}
+
+// write is WriteAt, but if adopt is set, the file may keep p instead of
+// a copy of it. The caller must not modify p afterwards.
+func (f *Fid) write(p []byte, offset int64, adopt bool) (int, error) {
+	if f.isRevoked() {
+		return 0, errRevoked
+	}
 	if !f.isOpen() {
 		return 0, perror("file not open for I/O")
 	}
+	if !f.canWrite() {
+		return 0, perror("file not open for writing")
+	}
 
 	stat := f.node.Stat()
 	if stat.Mode&plan9.DMDIR != 0 {
 		return 0, perror("is a directory")
 	}
-	return f.node.WriteAt(p, offset)
+	if q, ok := f.node.file.(querier); ok {
+		reply, err := f.query(q, p)
+		if err != nil {
+			return 0, err
+		}
+		f.mu.Lock()
+		f.reply = reply
+		f.mu.Unlock()
+		return len(p), nil
+	}
+	n, err := f.node.write(p, offset, adopt)
+	if n > 0 {
+		if h := f.node.fs.hooksOf(f.node); h != nil && h.OnWrite != nil {
+			h.OnWrite(f.node.path(), f.uid, offset, n)
+		}
+	}
+	return n, err
+}
+
+// truncate sets the length of the file, which must be opened for
+// writing, to size.
+func (f *Fid) truncate(size int64) error {
+	if f.isRevoked() {
+		return errRevoked
+	}
+	if !f.isOpen() {
+		return perror("file not open for I/O")
+	}
+	if !f.canWrite() {
+		return perror("file not open for writing")
+	}
+	if size < 0 {
+		return perror("negative length")
+	}
+	return f.node.setLength(uint64(size))
 }
 
 // Stat inquires about the file identified by fid. The reply will contain
@@ -250,12 +476,23 @@ func (f *Fid) Stat() ([]byte, error) {
 // wstat; the other defined permission and mode bits can. The gid can be
 // changed: by the owner if also a member of the new group; or by the
 // group leader of the file's current group if also leader of the new
-// group.
+// group. The length can be changed by anyone with write permission on
+// the file, except for directories and append-only files; the file is
+// truncated or extended with zeros. The access and modification times
+// can be changed like the mode, the uid and muid by the hostowner only.
+// Fields set to the "don't touch" values, ~0 or the empty string, are
+// left unchanged.
 //
 // Either all the changes in Wstat request happen, or none of them does:
 // if the request succeeds, all changes were made; if it fails, none
 // were.
 func (f *Fid) Wstat(data []byte) error {
+	if f.isRevoked() {
+		return errRevoked
+	}
+	if f.ro != nil {
+		return f.ro
+	}
 	stat, err := plan9.UnmarshalDir(data)
 	if err != nil {
 		return err
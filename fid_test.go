@@ -71,7 +71,7 @@ func TestPermission(t *testing.T) {
 	fs.group.groupmap["adm"].Member["glenda"] = true
 
 	for i, perm := range tests.perm {
-		name := fmt.Sprintf("/file-%d", i)
+		name := fmt.Sprintf("file-%d", i)
 		f, err := fs.root.Create("adm", name, plan9.ORDWR, perm)
 		if err != nil {
 			t.Fatalf("create %s: %v", name, err)
@@ -94,7 +94,7 @@ func TestPermission(t *testing.T) {
 				t.Fatalf("open rdwr %d:%d: %q: expected %v, got %v",
 					i, j, test.uid.Name, test.result[1], err)
 			}
-			f.Close()
+			f.Close(nil)
 
 			fid = Fid{node: f, uid: test.uid.Name}
 			mode = uint8(plan9.OREAD)
@@ -104,6 +104,154 @@ func TestPermission(t *testing.T) {
 			}
 			fid.Close()
 		}
-		f.Close()
+		f.Close(nil)
+	}
+}
+
+var directionTests = []struct {
+	mode        uint8
+	read, write bool
+}{
+	{plan9.OREAD, true, false},
+	{plan9.OWRITE, false, true},
+	{plan9.ORDWR, true, true},
+	{plan9.OEXEC, true, false},
+	{plan9.OWRITE | plan9.OTRUNC, false, true},
+}
+
+func TestOpenDirection(t *testing.T) {
+	fs := New("adm")
+	f, err := fs.root.Create("adm", "file", plan9.ORDWR, 0777)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, test := range directionTests {
+		fid := Fid{node: f, uid: "adm"}
+		if err := fid.Open(test.mode); err != nil {
+			t.Fatalf("open %d: %v", test.mode, err)
+		}
+		if _, err := fid.WriteAt([]byte("data"), 0); (err == nil) != test.write {
+			t.Fatalf("write with mode %d: expected allowed %v, got %v", test.mode, test.write, err)
+		}
+		if _, err := fid.ReadAt(make([]byte, 4), 0); (err == nil) != test.read {
+			t.Fatalf("read with mode %d: expected allowed %v, got %v", test.mode, test.read, err)
+		}
+		fid.Close()
+	}
+}
+
+func TestOpenExec(t *testing.T) {
+	fs := New("adm")
+	f, err := fs.root.Create("adm", "file", plan9.ORDWR, 0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	fid := Fid{node: f, uid: "adm"}
+	if err := fid.Open(plan9.OEXEC); err != errPerm {
+		t.Fatalf("open exec without permission: expected %v, got %v", errPerm, err)
+	}
+	f.dir.Mode = 0755
+	if err := fid.Open(plan9.OEXEC); err != nil {
+		t.Fatalf("open exec: %v", err)
+	}
+	defer fid.Close()
+	if _, err := fid.WriteAt([]byte("data"), 0); err == nil {
+		t.Fatalf("write: expected error for fid opened OEXEC")
+	}
+}
+
+func TestDirReadOffsets(t *testing.T) {
+	fs := New("adm")
+	dir, err := fs.root.Create("adm", "dir", plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := dir.Create("adm", fmt.Sprintf("file%d", i), plan9.OREAD, 0644); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	fid := &Fid{uid: "adm", node: dir}
+	if err := fid.Open(plan9.OREAD); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	// one entry per read, as each is larger than half the buffer
+	buf := make([]byte, 80)
+	var names []string
+	var offsets []int64
+	offset := int64(0)
+	for {
+		n, err := fid.ReadAt(buf, offset)
+		if err != nil {
+			t.Fatalf("read at %d: %v", offset, err)
+		}
+		if n == 0 {
+			break
+		}
+		d, err := plan9.UnmarshalDir(buf[:n])
+		if err != nil {
+			t.Fatalf("read at %d: partial entry: %v", offset, err)
+		}
+		names = append(names, d.Name)
+		offsets = append(offsets, offset)
+		offset += int64(n)
+		if offset == int64(n) {
+			// the listing is a snapshot of the first read
+			dir.Create("adm", "late", plan9.OREAD, 0644)
+		}
+	}
+	if fmt.Sprint(names) != "[file0 file1 file2 file3 file4]" {
+		t.Fatalf("unexpected entries %v", names)
+	}
+
+	// rereading an earlier entry
+	if n, err := fid.ReadAt(buf, offsets[2]); err != nil || n == 0 {
+		t.Fatalf("reread at %d: %d %v", offsets[2], n, err)
+	}
+	if _, err := fid.ReadAt(buf, offsets[2]+1); err == nil {
+		t.Fatalf("read: expected error for offset inside an entry")
+	}
+	if _, err := fid.ReadAt(buf[:10], 0); err == nil {
+		t.Fatalf("read: expected error for count below entry size")
+	}
+	if n, _ := fid.ReadAt(make([]byte, 8192), 0); n == 0 {
+		t.Fatalf("read: expected entries")
+	} else if _, err := fid.ReadAt(buf, int64(n)); err != nil {
+		t.Fatalf("read at end: %v", err)
+	}
+}
+
+func TestWalkPartial(t *testing.T) {
+	fs := New("adm")
+	fid := &Fid{node: fs.root, uid: "adm"}
+	newfid := &Fid{uid: "adm"}
+	visited := 0
+	count := func(f *Fid, p []string) error {
+		visited++
+		return nil
+	}
+
+	if err := fid.walkTo(newfid, []string{"adm", "missing"}, count); err == nil {
+		t.Fatalf("walk: expected error")
+	}
+	if visited != 1 {
+		t.Fatalf("expected 1 file visited, got %d", visited)
+	}
+	if newfid.node != nil {
+		t.Fatalf("failed walk changed newfid")
+	}
+	if err := fid.walkTo(fid, []string{"adm", "missing"}, count); err == nil {
+		t.Fatalf("walk: expected error")
+	}
+	if fid.node != fs.root {
+		t.Fatalf("failed walk changed fid")
+	}
+
+	if err := fid.walkTo(fid, []string{"adm", "ctl"}, count); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if name := fid.node.Stat().Name; name != "ctl" {
+		t.Fatalf("expected fid at ctl, got %s", name)
 	}
 }
@@ -0,0 +1,194 @@
+package ramfs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+var errRevoked = perror("fid revoked")
+
+// fidsFile is the synthetic file /adm/fids. Reading it lists the open
+// fids of all connections as lines "conn fid uname mode age path",
+// where mode is r, w, rw or x, followed by t for OTRUNC and c for
+// ORCLOSE, and age is the time since the fid was allocated.
+type fidsFile struct {
+	fs *FS
+}
+
+func (f *fidsFile) ReadAt(p []byte, offset int64) (int, error) {
+	return readReport(f.fs.openFids(), p, offset)
+}
+
+func (f *fidsFile) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, perror("writing fids file")
+}
+
+func (f *fidsFile) Len() uint64  { return uint64(0) }
+func (f *fidsFile) Close() error { return nil }
+
+// openFid describes an open fid of a connection.
+type openFid struct {
+	conn, num uint32
+	uid       string
+	mode      uint8
+	age       time.Duration
+	n         *node
+}
+
+// addConn registers c for the listing of open fids and for Shutdown and
+// assigns its id, which is unique among all connections of the file
+// server, whichever listener served them. It fails if the file server is
+// stopped or has run out of ids.
+func (fs *FS) addConn(c *conn) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed || fs.connid == maxConn {
+		return false
+	}
+	c.id = fs.connid
+	fs.connid++
+	fs.conns[c] = true
+	fs.active.Add(1)
+	return true
+}
+
+func (fs *FS) delConn(c *conn) {
+	fs.mu.Lock()
+	delete(fs.conns, c)
+	fs.mu.Unlock()
+	fs.active.Done()
+}
+
+func (fs *FS) isClosed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.closed
+}
+
+// openFids returns the report read from /adm/fids, sorted by connection
+// and fid.
+func (fs *FS) openFids() []byte {
+	fs.mu.Lock()
+	conns := make([]*conn, 0, len(fs.conns))
+	for c := range fs.conns {
+		conns = append(conns, c)
+	}
+	fs.mu.Unlock()
+
+	var fids []openFid
+	now := time.Now()
+	for _, c := range conns {
+		c.f.Lock()
+		for num, fid := range c.fidmap {
+			fid.mu.RLock()
+			if fid.opened {
+				fids = append(fids, openFid{c.id, num, fid.uid, fid.mode, now.Sub(fid.born), fid.node})
+			}
+			fid.mu.RUnlock()
+		}
+		c.f.Unlock()
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		if fids[i].conn != fids[j].conn {
+			return fids[i].conn < fids[j].conn
+		}
+		return fids[i].num < fids[j].num
+	})
+
+	var buf []byte
+	for _, f := range fids {
+		buf = append(buf, fmt.Sprintf("%d %d %s %s %s %s\n", f.conn, f.num, f.uid,
+			modeString(f.mode), f.age.Truncate(time.Second), f.n.path())...)
+	}
+	return buf
+}
+
+// modeString formats an open mode as listed in /adm/fids.
+func modeString(mode uint8) string {
+	s := [...]string{"r", "w", "rw", "x"}[mode&3]
+	if mode&plan9.OTRUNC != 0 {
+		s += "t"
+	}
+	if mode&plan9.ORCLOSE != 0 {
+		s += "c"
+	}
+	return s
+}
+
+// revoke closes f as a clunk would, removing the file if it was opened
+// with ORCLOSE. All later requests on f but clunk fail.
+func (f *Fid) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = true
+	if f.opened {
+		f.opened = false
+		f.node.Close(f)
+	}
+}
+
+// clunkFid runs the ctl command "clunk conn fid", revoking the fid num
+// of the connection id as listed in /adm/fids.
+func (fs *FS) clunkFid(id, num uint32) error {
+	fs.mu.Lock()
+	var c *conn
+	for cc := range fs.conns {
+		if cc.id == id {
+			c = cc
+			break
+		}
+	}
+	fs.mu.Unlock()
+	if c == nil {
+		return perror(fmt.Sprintf("connection %d not found", id))
+	}
+
+	c.f.Lock()
+	fid, found := c.fidmap[num]
+	c.f.Unlock()
+	if !found {
+		return perror(fmt.Sprintf("fid %d not found", num))
+	}
+	fid.revoke()
+	return nil
+}
+
+// revoke runs the ctl command "revoke path", revoking all open fids of
+// the file name in the main tree. It returns the number of fids revoked.
+func (fs *FS) revoke(name string) (int, error) {
+	n, err := fs.walk(path.Clean(name))
+	if err != nil {
+		return 0, err
+	}
+
+	fs.mu.Lock()
+	conns := make([]*conn, 0, len(fs.conns))
+	for c := range fs.conns {
+		conns = append(conns, c)
+	}
+	fs.mu.Unlock()
+
+	var fids []*Fid
+	for _, c := range conns {
+		c.f.Lock()
+		for _, fid := range c.fidmap {
+			fid.mu.RLock()
+			if fid.opened && fid.node == n {
+				fids = append(fids, fid)
+			}
+			fid.mu.RUnlock()
+		}
+		c.f.Unlock()
+	}
+	if len(fids) == 0 {
+		return 0, perror("no open fids on " + name)
+	}
+	for _, fid := range fids {
+		fid.revoke()
+	}
+	return len(fids), nil
+}
@@ -6,24 +6,50 @@ type perror string
 
 func (e perror) Error() string { return string(e) }
 
-type buffer interface {
-	ReadAt(p []byte, offset int64) (int, error)
-	WriteAt(p []byte, offset int64) (int, error)
-	Len() uint64
-	Close() error
-}
+// inlineSize is the size up to which the data of a file is kept inline
+// instead of in a block map, if the block size is larger.
+const inlineSize = 4 * 1024
 
 type file struct {
 	size      uint64
+	inline    []byte // data of a small file while block is nil
+	ishared   bool   // inline shared copy-on-write
 	block     map[uint64][]byte
+	shared    map[uint64]bool // blocks shared copy-on-write
 	blockSize uint64
 }
 
 func newFile(blockSize uint64) *file {
-	return &file{
-		block:     make(map[uint64][]byte),
-		blockSize: blockSize,
+	f := &file{blockSize: blockSize}
+	if blockSize <= inlineSize {
+		f.block = make(map[uint64][]byte)
+	}
+	return f
+}
+
+// blockAt returns block num of f; block 0 is the inline data of a small
+// file.
+func (f *file) blockAt(num uint64) []byte {
+	if f.block == nil {
+		if num == 0 {
+			return f.inline
+		}
+		return nil
 	}
+	return f.block[num]
+}
+
+// spill moves the inline data of f to block 0 of a new block map, once
+// the file grows beyond the inline size.
+func (f *file) spill() {
+	f.block = make(map[uint64][]byte)
+	if len(f.inline) > 0 {
+		f.block[0] = f.inline
+		if f.ishared {
+			f.shared = map[uint64]bool{0: true}
+		}
+	}
+	f.inline, f.ishared = nil, false
 }
 
 func (f *file) WriteAt(p []byte, offset int64) (int, error) {
@@ -35,9 +61,14 @@ func (f *file) WriteAt(p []byte, offset int64) (int, error) {
 	if off > f.size {
 		off = f.size
 	}
+	if f.block == nil {
+		if end := off + uint64(len(p)); end <= inlineSize {
+			return f.writeInline(p, off), nil
+		}
+		f.spill()
+	}
 	num := off / f.blockSize
 	off = off % f.blockSize
-	expanded := false
 
 	n := 0
 	for len(p) > 0 {
@@ -46,28 +77,30 @@ func (f *file) WriteAt(p []byte, offset int64) (int, error) {
 			consume = uint64(len(p))
 		}
 
-		if _, found := f.block[num]; !found {
-			f.block[num] = make([]byte, consume)
-			expanded = true
-		} else {
-			if (off + consume) > uint64(len(f.block[num])) {
-				data := make([]byte, off+consume)
-				copy(data, f.block[num])
-				f.block[num] = data
-				expanded = true
+		block, found := f.block[num]
+		switch end := off + consume; {
+		case !found:
+			block = make([]byte, consume)
+		case end > uint64(len(block)):
+			if f.shared[num] || end > uint64(cap(block)) {
+				data := make([]byte, end, f.grow(uint64(cap(block)), end))
+				copy(data, block)
+				block = data
 			}
+			block = block[:end]
+		case f.shared[num]:
+			data := make([]byte, len(block))
+			copy(data, block)
+			block = data
 		}
+		f.block[num] = block
+		delete(f.shared, num)
 
-		m := copy(f.block[num][off:], p)
+		m := copy(block[off:], p)
 		p = p[m:]
 		n += m
-
-		if expanded {
-			if uint64(m) > f.size {
-				f.size += uint64(m) - f.size
-			} else {
-				f.size += uint64(m)
-			}
+		if end := num*f.blockSize + off + uint64(m); end > f.size {
+			f.size = end
 		}
 
 		off = 0
@@ -76,6 +109,73 @@ func (f *file) WriteAt(p []byte, offset int64) (int, error) {
 	return n, nil
 }
 
+// writeInline writes p at off to the inline data of f, which remains
+// within the inline size.
+func (f *file) writeInline(p []byte, off uint64) int {
+	end := off + uint64(len(p))
+	if end > uint64(len(f.inline)) || f.ishared {
+		if f.ishared || end > uint64(cap(f.inline)) {
+			n := uint64(len(f.inline))
+			if end > n {
+				n = end
+			}
+			data := make([]byte, n, f.grow(uint64(cap(f.inline)), n))
+			copy(data, f.inline)
+			f.inline = data
+			f.ishared = false
+		}
+		if end > uint64(len(f.inline)) {
+			f.inline = f.inline[:end]
+		}
+	}
+	m := copy(f.inline[off:], p)
+	if end > f.size {
+		f.size = end
+	}
+	return m
+}
+
+// grow returns the capacity of a block of capacity c grown to hold at
+// least n bytes. The capacity doubles, so appending small writes to a
+// block copies it only a few times, but never exceeds the block size.
+func (f *file) grow(c, n uint64) uint64 {
+	if c *= 2; c < n {
+		c = n
+	}
+	if c > f.blockSize {
+		c = f.blockSize
+	}
+	return c
+}
+
+// adopt writes p at offset like WriteAt, but keeps p as a new block of f
+// instead of copying it if p starts a block at the end of the file. The
+// caller must not modify p afterwards.
+func (f *file) adopt(p []byte, offset int64) (int, error) {
+	if f.block == nil {
+		switch {
+		case offset != 0 || f.size != 0 || len(p) == 0:
+			return f.WriteAt(p, offset)
+		case len(p) <= inlineSize:
+			f.inline, f.ishared = p[:len(p):len(p)], false
+			f.size = uint64(len(p))
+			return len(p), nil
+		}
+		f.spill()
+	}
+	if offset < 0 || uint64(offset) != f.size || f.size%f.blockSize != 0 ||
+		len(p) == 0 || uint64(len(p)) > f.blockSize {
+		return f.WriteAt(p, offset)
+	}
+	num := f.size / f.blockSize
+	if _, found := f.block[num]; found {
+		return f.WriteAt(p, offset)
+	}
+	f.block[num] = p[:len(p):len(p)]
+	f.size += uint64(len(p))
+	return len(p), nil
+}
+
 func (f *file) ReadAt(p []byte, offset int64) (int, error) {
 	if offset < 0 {
 		return 0, perror("negative offset")
@@ -91,6 +191,9 @@ func (f *file) ReadAt(p []byte, offset int64) (int, error) {
 	if off+count > f.size {
 		count = f.size - off
 	}
+	if f.block == nil {
+		return copy(p[:count], f.inline[off:]), nil
+	}
 	off = off % f.blockSize
 
 	n := 0
@@ -104,5 +207,52 @@ func (f *file) ReadAt(p []byte, offset int64) (int, error) {
 	return n, nil
 }
 
+// clone returns a copy of f sharing all blocks copy-on-write. A shared
+// block is copied by the first write to it through either file.
+func (f *file) clone() *file {
+	c := &file{size: f.size, blockSize: f.blockSize}
+	if f.block == nil {
+		c.inline = f.inline
+		c.ishared, f.ishared = true, true
+		return c
+	}
+	c.block = make(map[uint64][]byte, len(f.block))
+	c.shared = make(map[uint64]bool, len(f.block))
+	if f.shared == nil {
+		f.shared = make(map[uint64]bool, len(f.block))
+	}
+	for num, b := range f.block {
+		c.block[num] = b
+		c.shared[num] = true
+		f.shared[num] = true
+	}
+	return c
+}
+
+// truncate shrinks f to size bytes, dropping the blocks beyond it. The
+// data before size is not copied; shared blocks stay shared.
+func (f *file) truncate(size uint64) {
+	if size >= f.size {
+		return
+	}
+	f.size = size
+	if f.block == nil {
+		f.inline = f.inline[:size]
+		return
+	}
+	last := size / f.blockSize
+	for num := range f.block {
+		switch {
+		case num > last, num == last && size%f.blockSize == 0:
+			delete(f.block, num)
+			delete(f.shared, num)
+		case num == last:
+			if end := size % f.blockSize; uint64(len(f.block[num])) > end {
+				f.block[num] = f.block[num][:end]
+			}
+		}
+	}
+}
+
 func (f *file) Len() uint64  { return f.size }
 func (f *file) Close() error { return nil }
@@ -151,3 +151,187 @@ func TestLength(t *testing.T) {
 		t.Fatalf("length differ: expected 5, got %d", file.Len())
 	}
 }
+
+func TestClone(t *testing.T) {
+	f := &file{
+		block:     make(map[uint64][]byte),
+		blockSize: uint64(4),
+	}
+	if _, err := f.WriteAt([]byte("aaaabbbbcc"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	c := f.clone()
+	if _, err := c.WriteAt([]byte("xx"), 5); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("yyy"), 8); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	for _, test := range []struct {
+		f      *file
+		result string
+	}{
+		{f, "aaaabbbbyyy"},
+		{c, "aaaabxxbcc"},
+	} {
+		data := make([]byte, 16)
+		n, err := test.f.ReadAt(data, 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(data[:n]) != test.result {
+			t.Fatalf("expected %q, got %q", test.result, data[:n])
+		}
+	}
+	if &f.block[0][0] != &c.block[0][0] {
+		t.Fatalf("expected unmodified block to be shared")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	f := newFile(4)
+	if _, err := f.WriteAt([]byte("aaaabbbbcc"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	c := f.clone()
+	f.truncate(6)
+	if len(f.block) != 2 || f.Len() != 6 {
+		t.Fatalf("expected 2 blocks, length 6, got %d, %d", len(f.block), f.Len())
+	}
+	if _, err := f.WriteAt([]byte("zzzz"), 6); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f.truncate(4)
+	if len(f.block) != 1 || f.Len() != 4 {
+		t.Fatalf("expected 1 block, length 4, got %d, %d", len(f.block), f.Len())
+	}
+	for _, test := range []struct {
+		f      *file
+		result string
+	}{
+		{f, "aaaa"},
+		{c, "aaaabbbbcc"},
+	} {
+		data := make([]byte, 16)
+		n, _ := test.f.ReadAt(data, 0)
+		if string(data[:n]) != test.result {
+			t.Fatalf("expected %q, got %q", test.result, data[:n])
+		}
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	f := newFile(8)
+	p := []byte("aaaabbbb")
+	if _, err := f.adopt(p, 0); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if &f.block[0][0] != &p[0] {
+		t.Fatalf("expected block aligned write to be adopted")
+	}
+	q := []byte("cc")
+	if _, err := f.adopt(q, 8); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	c := f.clone()
+
+	// Not at a block boundary: copied, and the shared block is
+	// grown without touching the clone.
+	r := []byte("dd")
+	if _, err := f.adopt(r, 10); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if &f.block[1][0] == &q[0] {
+		t.Fatalf("expected shared block to be copied")
+	}
+	r[0] = 'x'
+
+	for _, test := range []struct {
+		f      *file
+		result string
+	}{
+		{f, "aaaabbbbccdd"},
+		{c, "aaaabbbbcc"},
+	} {
+		data := make([]byte, 16)
+		n, err := test.f.ReadAt(data, 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(data[:n]) != test.result {
+			t.Fatalf("expected %q, got %q", test.result, data[:n])
+		}
+	}
+}
+
+func TestGrowInPlace(t *testing.T) {
+	f := newFile(BLOCKSIZE)
+	chunk := bytes.Repeat([]byte("x"), 1024)
+	allocs := 0
+	var last *byte
+	for i := 0; i < 64; i++ {
+		if _, err := f.WriteAt(chunk, int64(i*len(chunk))); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if p := &f.blockAt(0)[0]; p != last {
+			allocs++
+			last = p
+		}
+	}
+	if f.size != 64*1024 {
+		t.Fatalf("expected size %d, got %d", 64*1024, f.size)
+	}
+	if allocs > 8 {
+		t.Fatalf("block reallocated %d times for 64 appends", allocs)
+	}
+}
+
+func TestInline(t *testing.T) {
+	f := newFile(BLOCKSIZE)
+	if _, err := f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if f.block != nil {
+		t.Fatalf("expected small file to be kept inline")
+	}
+	c := f.clone()
+	if _, err := c.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// growing beyond the inline size spills the data into blocks
+	big := bytes.Repeat([]byte("x"), inlineSize)
+	if _, err := f.WriteAt(big, 5); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if f.block == nil || f.size != 5+inlineSize {
+		t.Fatalf("expected file of %d bytes in blocks, got %d", 5+inlineSize, f.size)
+	}
+	for _, test := range []struct {
+		f      *file
+		result string
+	}{
+		{f, "hello" + string(big)},
+		{c, "Jello"},
+	} {
+		data := make([]byte, 2*inlineSize)
+		n, err := test.f.ReadAt(data, 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(data[:n]) != test.result {
+			t.Fatalf("expected %d bytes %.8q, got %d bytes %.8q", len(test.result), test.result, n, data[:n])
+		}
+	}
+
+	a := newFile(BLOCKSIZE)
+	p := []byte("adopted")
+	if _, err := a.adopt(p, 0); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if &a.blockAt(0)[0] != &p[0] {
+		t.Fatalf("expected small write to be adopted inline")
+	}
+}
@@ -23,12 +23,17 @@ References:
 package ramfs
 
 import (
+	"context"
+	"io"
 	"net"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"9fans.net/go/plan9"
+	"github.com/mars9/ramfs/client"
 )
 
 const maxPath = uint64(1<<64 - 1)
@@ -67,25 +72,225 @@ const (
 	DMEXEC   = plan9.DMEXEC   // mode bit for execute permission
 )
 
+// QidType returns the Qid type bits corresponding to the mode bits of
+// perm. Mode bits without a Qid counterpart are ignored.
+func QidType(perm Perm) uint8 {
+	typ := uint8(perm >> 24)
+	return typ & (QTDIR | QTAPPEND | QTEXCL | QTAUTH | QTTMP)
+}
+
 // LogFunc can be used to enable a trace of general debugging messages.
 type LogFunc func(format string, v ...interface{})
 
 // FS represents a a 9P2000 file server.
 type FS struct {
+	panics    uint64 // accessed atomically; keep 64-bit aligned
+	violation uint64 // protocol violations of clients; ditto
 	mu        sync.Mutex
+	frozen    sync.RWMutex // read locked by changes to the trees, locked by freeze
 	path      uint64
 	pathmap   map[uint64]bool
 	fidnew    chan (chan *Fid)
 	root      *node
+	trees     map[string]*node
+	snaps     map[string]*node // read-only snapshots of the main tree
+	listeners map[string]*listener
+	conns     map[*conn]bool // served connections, for /adm/fids
+	connid    uint32         // id of the next connection
+	active    sync.WaitGroup // served connections not yet detached
+	closed    bool           // set by Shutdown
+	sessions  *sessions      // fids of lost connections kept for resumption
+	faults    atomic.Value   // *Faults injected into requests; nil if off
+	hooks     atomic.Value   // map[string]*Hooks by tree name
 	group     *group
+	cache     walkCache
+	quota     *quotas
+	sweep     *sweeper
+	access    *accessLog
+	scratch   map[*node]*task // expiry of scratch directories with a ttl
+	hostmu    sync.RWMutex    // guards node.host
+	storage   []StoragePolicy
 	hostowner string
 	chatty    bool // not sync'd
 	Log       LogFunc
+
+	// Atime determines when the access time of a file is updated on
+	// read.
+	Atime AtimePolicy
+
+	// MaxEntries limits the number of entries per directory and
+	// MaxNameLen the length of a file name in bytes. Zero means no
+	// limit.
+	MaxEntries int
+	MaxNameLen int
+
+	// MaxWalk limits the number of names in a single walk and MaxDepth
+	// the number of directories descended by it. Zero means no limit.
+	MaxWalk  int
+	MaxDepth int
+
+	// Normalize enables NFC normalization of file names on create,
+	// rename and walk, so names created by different clients compare
+	// consistently.
+	Normalize bool
+
+	// Umask holds permission bits cleared from every created file, in
+	// addition to the masking against the directory permissions. It can
+	// be changed at run time with the umask ctl command.
+	Umask Perm
+
+	// WalkCache is the maximum number of resolved paths cached for
+	// repeated lookups. Zero disables the cache.
+	WalkCache int
+
+	// Timeout is the maximum processing time of a transaction. Requests
+	// exceeding it are answered with an error, except creates, writes,
+	// removes and wstats which began to change files: they are answered
+	// with their result. Zero means no limit.
+	Timeout time.Duration
+
+	// WriteTimeout is the time a client may take to accept each chunk
+	// of a reply. Connections of stalled clients are closed. Zero
+	// means no limit.
+	WriteTimeout time.Duration
+
+	// Grace is the period the connections of a stopped listener are
+	// given to complete outstanding requests before they are closed.
+	Grace time.Duration
+
+	// Ordered makes requests on the same fid be processed in the order
+	// they were issued. By default the requests of a connection are
+	// processed concurrently, so e.g. a Tread may overtake a preceding
+	// Twrite on the same fid.
+	Ordered bool
+
+	// MaxFids limits the number of fids of a single connection. Zero
+	// means no limit.
+	MaxFids int
+
+	// FidLeak enables logging of fids which are not clunked within the
+	// given duration, together with the path of their file, to help
+	// finding fid leaks in clients. Zero disables the check.
+	FidLeak time.Duration
+
+	// Msize is the maximum message size, including the IOHDRSZ bytes of
+	// the message header, offered to the clients in Rversion. A client
+	// may negotiate a smaller one for its connection; the counts of its
+	// reads and the iounit of its open files are limited to that. Zero,
+	// or a size not larger than IOHDRSZ, selects MSIZE.
+	Msize uint32
+
+	// DropOversized closes the connection of a client sending a message
+	// larger than the negotiated msize. By default the message is
+	// skipped and answered with an Rerror. Either way it is counted by
+	// ProtocolErrors.
+	DropOversized bool
+
+	// LogSample traces only every LogSample-th request and its reply
+	// with Log, to keep the trace of a busy server small. Zero or one
+	// traces all messages.
+	LogSample int
+
+	// AccessInterval enables the aggregation of the requests of all
+	// connections per path, user and request type over intervals of the
+	// given duration. The counters of the last complete interval are
+	// listed in /adm/access. Zero disables the aggregation.
+	AccessInterval time.Duration
+
+	// MemoryLimit is the amount of file data in bytes above which
+	// /adm/health reports the file server as unready. Extending a file
+	// by a change of its length beyond it fails. Zero means no limit.
+	MemoryLimit uint64
+
+	// SoftLimit is the percentage of MemoryLimit and of the group quotas
+	// above which the usage is reported with state warning in /adm/stats,
+	// giving notice before writes fail. Each change of the state of a
+	// limit is passed to LimitWarning, or logged if it is nil. Zero
+	// disables the warnings.
+	SoftLimit int
+
+	// LimitWarning is called with the name of a limit, "memory" or
+	// "quota gid", when its state changes to ok, warning or exceeded.
+	// It is called while the changed file is locked, so it must not
+	// access the file server.
+	LimitWarning func(name, state string, usage, limit uint64)
+
+	// SweepRate limits the maintenance tasks run in the background, such
+	// as the FidLeak check, to the given number per second. Zero means
+	// no limit.
+	SweepRate int
+
+	// SaveWorkers is the number of goroutines reading files in parallel
+	// during Save. Zero selects GOMAXPROCS.
+	SaveWorkers int
+
+	// Auth requires the clients to authenticate with Tauth before they
+	// attach. Nil disables authentication.
+	Auth Authenticator
+
+	// SessionTTL is the time the fids of a lost connection are kept if
+	// it attached with a session token, the aname suffix
+	// "!session=<token>". A client reconnecting within that time and
+	// attaching with the same token and uname gets back the fids whose
+	// files still exist, under their old numbers. The token should be
+	// random, it is the only proof of the session. Zero disables
+	// resumption; the fids of a lost connection are clunked at once.
+	SessionTTL time.Duration
+
+	// DumpFile is the file of the host an image of the file system is
+	// saved to by the dump ctl command. If empty, dump is disabled.
+	DumpFile string
+
+	// Compression is the compression of the images written by SaveFile,
+	// and so of checkpoints and dumps. Load detects it.
+	Compression Compression
+
+	// Clock tells the time of the modification and access times of
+	// files and of the expiry of scratch files. A fixed or stepped clock
+	// makes file times reproducible in tests, a skewed one simulates the
+	// clock of another machine. Nil selects the system clock.
+	Clock Clock
+}
+
+// AtimePolicy determines when the access time of a file is updated.
+type AtimePolicy int
+
+const (
+	Relatime    AtimePolicy = iota // update if not newer than mtime or older than a day
+	Strictatime                    // update on every read
+	Noatime                        // never update
+)
+
+// update reports whether the access time atime of a file modified at
+// mtime should be set to now.
+func (p AtimePolicy) update(atime, mtime, now uint32) bool {
+	switch p {
+	case Strictatime:
+		return atime != now
+	case Noatime:
+		return false
+	}
+	return atime <= mtime || now-atime >= 24*60*60
+}
+
+// Tree describes the root of a file tree. The zero Mode selects the
+// default permissions 0755.
+type Tree struct {
+	Owner string // owner of the root directory
+	Group string // group of the root directory
+	Mode  Perm   // permissions of the root directory
+	NoAdm bool   // omit /adm and the home directory
+
+	// DefaultGroup is the group of files created in directories which
+	// are not setgid. If empty, files inherit the group of their
+	// directory.
+	DefaultGroup string
 }
 
 // New starts a 9P2000 file server keeping all files in memory. The
 // filesystem is entirely maintained in memory, no external storage is
-// used. File data is allocated in 128 * 1024 byte blocks.
+// used. File data is allocated in 128 * 1024 byte blocks unless a
+// storage policy added by AddStorage selects another Buffer.
 //
 // The root of the filesystem is owned by the user who invoked ramfs and
 // is created with Read, Write and Execute permissions for the owner and
@@ -98,38 +303,220 @@ func New(hostowner string) *FS {
 		owner = "adm"
 	}
 	fs := &FS{
-		path:      uint64(5),
 		pathmap:   make(map[uint64]bool),
 		fidnew:    make(chan (chan *Fid)),
+		trees:     make(map[string]*node),
+		snaps:     make(map[string]*node),
+		listeners: make(map[string]*listener),
+		conns:     make(map[*conn]bool),
+		sessions:  newSessions(),
 		hostowner: owner,
 	}
 	fs.group = newGroup(fs, owner)
+	fs.sweep = newSweeper(fs)
+	fs.access = newAccessLog(fs)
+	fs.quota = newQuotas(fs)
+	fs.scratch = make(map[*node]*task)
+
+	root, err := fs.newTree(Tree{Owner: owner, Group: "adm"})
+	if err != nil {
+		panic(err) // can't happen
+	}
+	fs.root = root
+	go fs.newFid(fs.fidnew)
+	return fs
+}
+
+// AddTree creates a new file tree with the layout described by t. Clients
+// select the tree by attaching with aname; tree names take precedence
+// over directories of the same name in the root of the filesystem.
+func (fs *FS) AddTree(aname string, t Tree) error {
+	names := split(path.Clean(aname))
+	if len(names) != 1 || names[0] == "snap" {
+		return perror("invalid tree name " + aname)
+	}
+	if _, err := fs.group.Get(t.Owner); err != nil {
+		return err
+	}
+	if _, err := fs.group.Get(t.Group); err != nil {
+		return err
+	}
+	if t.DefaultGroup != "" {
+		if _, err := fs.group.Get(t.DefaultGroup); err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	_, found := fs.trees[names[0]]
+	fs.mu.Unlock()
+	if found {
+		return perror("tree " + names[0] + " exists")
+	}
 
-	root := newNode(fs, "/", owner, "adm", 0755|plan9.DMDIR, 0, nil)
-	adm := newNode(fs, "adm", "adm", "adm", 0770|plan9.DMDIR, 1, nil)
-	group := newNode(fs, "group", "adm", "adm", 0660, 2, fs.group)
-	ctl := newNode(fs, "ctl", "adm", "adm", 0220, 3, newCtl(fs))
+	root, err := fs.newTree(t)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	fs.trees[names[0]] = root
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *FS) newTree(t Tree) (*node, error) {
+	mode := t.Mode & 0777
+	if mode == 0 {
+		mode = 0755
+	}
 
-	root.children["adm"] = adm
-	adm.children["group"] = group
-	adm.children["ctl"] = ctl
+	var paths [11]uint64
+	for i := range paths {
+		path, err := fs.newPath()
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = path
+		if t.NoAdm {
+			break
+		}
+	}
+
+	root := newNode(fs, "/", t.Owner, t.Group, plan9.Perm(mode)|plan9.DMDIR, paths[0], nil)
 	root.parent = root
+	root.defgid = t.DefaultGroup
+	if t.NoAdm {
+		return root, nil
+	}
+
+	adm := newNode(fs, "adm", "adm", "adm", 0775|plan9.DMDIR, paths[1], nil)
+	group := newNode(fs, "group", "adm", "adm", 0660, paths[2], fs.group)
+	ctl := newNode(fs, "ctl", "adm", "adm", 0660, paths[3], newCtl(fs))
+	health := newNode(fs, "health", "adm", "adm", 0444, paths[5], newHealth(fs))
+	quota := newNode(fs, "quota", "adm", "adm", 0660, paths[6], &quotaFile{fs})
+	usage := newNode(fs, "usage", "adm", "adm", 0444, paths[7], &usageFile{fs})
+	fids := newNode(fs, "fids", "adm", "adm", 0440, paths[8], &fidsFile{fs})
+	access := newNode(fs, "access", "adm", "adm", 0440, paths[9], &accessFile{fs})
+	stats := newNode(fs, "stats", "adm", "adm", 0444, paths[10], &statsFile{fs})
+
+	root.link("adm", adm)
+	adm.link("group", group)
+	adm.link("ctl", ctl)
+	adm.link("health", health)
+	adm.link("quota", quota)
+	adm.link("usage", usage)
+	adm.link("fids", fids)
+	adm.link("access", access)
+	adm.link("stats", stats)
 	adm.parent = root
 	group.parent = adm
 	ctl.parent = adm
-	if owner != "adm" {
-		n := newNode(fs, owner, owner, owner, 0750|plan9.DMDIR, 4, nil)
+	health.parent = adm
+	quota.parent = adm
+	usage.parent = adm
+	fids.parent = adm
+	access.parent = adm
+	stats.parent = adm
+	if t.Owner != "adm" {
+		n := newNode(fs, t.Owner, t.Owner, t.Owner, 0750|plan9.DMDIR, paths[4], nil)
 		n.parent = root
-		root.children[owner] = n
+		root.link(t.Owner, n)
+	} else {
+		fs.delPath(paths[4])
 	}
+	return root, nil
+}
 
-	fs.root = root
-	go fs.newFid(fs.fidnew)
-	return fs
+func (fs *FS) umask() Perm {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Umask & 0777
+}
+
+func (fs *FS) setUmask(umask Perm) {
+	fs.mu.Lock()
+	fs.Umask = umask & 0777
+	fs.mu.Unlock()
+}
+
+// Panics returns the number of transactions aborted by a panic.
+func (fs *FS) Panics() uint64 { return atomic.LoadUint64(&fs.panics) }
+
+// ProtocolErrors returns the number of malformed or oversized messages
+// received from clients.
+func (fs *FS) ProtocolErrors() uint64 { return atomic.LoadUint64(&fs.violation) }
+
+func (fs *FS) logf(format string, v ...interface{}) {
+	if fs.Log != nil {
+		fs.Log(format, v...)
+	}
+}
+
+// ErrServerClosed is returned by Listen, Serve and Post once the file
+// server is stopped by Halt, Close or Shutdown.
+var ErrServerClosed = perror("server closed")
+
+// Halt closes the filesystem, rendering it unusable for I/O. All
+// listeners are stopped and Halt waits until their connections are
+// drained, giving them the grace period of the file server.
+func (fs *FS) Halt() error {
+	ctx, cancel := context.WithTimeout(context.Background(), fs.Grace)
+	defer cancel()
+	fs.Shutdown(ctx)
+	return nil
+}
+
+// Close closes the filesystem like Halt, but aborts the outstanding
+// requests of all connections at once.
+func (fs *FS) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fs.Shutdown(ctx)
+	return nil
 }
 
-// Halt closes the filesystem, rendering it unusable for I/O.
-func (fs *FS) Halt() error { return nil }
+// Shutdown stops all listeners, rejects new requests and waits until
+// the outstanding requests of all connections are answered or ctx is
+// done, whichever comes first, and closes the connections. The fids of
+// all connections and of all sessions kept for resumption are clunked.
+// Shutdown returns the error of ctx if requests had to be aborted.
+func (fs *FS) Shutdown(ctx context.Context) error {
+	fs.mu.Lock()
+	fs.closed = true
+	listeners := fs.listeners
+	fs.listeners = make(map[string]*listener)
+	conns := make([]*conn, 0, len(fs.conns))
+	for c := range fs.conns {
+		conns = append(conns, c)
+	}
+	fs.mu.Unlock()
+
+	for _, l := range listeners {
+		l.close()
+	}
+	var wg sync.WaitGroup
+	var aborted uint32
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *conn) {
+			if !c.drainUntil(ctx.Done()) {
+				atomic.StoreUint32(&aborted, 1)
+			}
+			wg.Done()
+		}(c)
+	}
+	wg.Wait()
+	// The fids of a connection are clunked or kept for its session by
+	// its serveConn goroutine after the connection is closed; clear
+	// must follow them.
+	fs.active.Wait()
+	fs.sessions.clear()
+
+	if aborted != 0 {
+		return ctx.Err()
+	}
+	return nil
+}
 
 func (fs *FS) newPath() (uint64, error) {
 	fs.mu.Lock()
@@ -166,14 +553,76 @@ func (fs *FS) newFid(fidnew <-chan (chan *Fid)) {
 }
 
 func (fs *FS) walk(name string) (*node, error) {
-	root := fs.root
+	return walkRoot(fs.root, "", name)
+}
+
+// walkAs returns the file name of the main tree, which uid must be
+// allowed to search as in walk.
+func (fs *FS) walkAs(uid, name string) (*node, error) {
+	return walkRoot(fs.root, uid, name)
+}
+
+// roots returns the roots of all file trees.
+func (fs *FS) roots() []*node {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	roots := []*node{fs.root}
+	for _, root := range fs.trees {
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// tree returns the root of the file tree selected by aname and the
+// remaining path within that tree.
+func (fs *FS) tree(aname string) (*node, string) {
+	names := split(aname)
+	if len(names) > 0 {
+		fs.mu.Lock()
+		root, found := fs.trees[names[0]]
+		fs.mu.Unlock()
+		if found {
+			return root, "/" + strings.Join(names[1:], "/")
+		}
+	}
+	return fs.root, aname
+}
+
+// resolve returns the file selected by the aname name, which uid must
+// be allowed to search as in walk, and whether it belongs to a read-only
+// snapshot.
+func (fs *FS) resolve(uid, name string) (*node, bool, error) {
+	name = path.Clean(name)
+	root, rest, ro := fs.snapRoot(name)
+	if !ro {
+		root, rest = fs.tree(name)
+	}
+	n, err := walkRoot(root, uid, rest)
+	return n, ro, err
+}
+
+// walkRoot returns the file name in the tree root, which uid must be
+// allowed to search as in walk.
+func walkRoot(root *node, uid, name string) (*node, error) {
 	path := split(name)
 	if len(path) == 0 {
-		return fs.root, nil
+		return root, nil
+	}
+	max := root.fs.WalkCache
+	var gen uint64
+	if max > 0 {
+		n, found, g := root.fs.cache.get(root, name)
+		gen = g
+		if found {
+			if uid != "" && !searchable(n, uid) {
+				return nil, errPerm
+			}
+			return n, nil
+		}
 	}
 
 	base := &node{}
-	err := walk(root, path, func(n *node, path []string) error {
+	err := walk(root, uid, path, func(n *node, path []string) error {
 		if len(path) == 0 {
 			base = n
 		}
@@ -182,17 +631,34 @@ func (fs *FS) walk(name string) (*node, error) {
 	if err != nil {
 		return nil, err
 	}
+	if max > 0 {
+		root.fs.cache.put(root, name, base, max, gen)
+	}
 	return base, nil
 }
 
+// searchable reports whether uid may search all directories above n,
+// as a walk to n from the root of its tree requires.
+func searchable(n *node, uid string) bool {
+	for ; n.parent != nil && n.parent != n; n = n.parent {
+		if !n.parent.HasPerm(uid, plan9.DMEXEC) {
+			return false
+		}
+	}
+	return true
+}
+
 func (fs *FS) createHome(uid string) error {
 	path, err := fs.newPath()
 	if err != nil {
 		return err
 	}
 	n := newNode(fs, uid, uid, uid, 0750|plan9.DMDIR, path, nil)
+	n.parent = fs.root
+	fs.frozen.RLock()
+	defer fs.frozen.RUnlock()
 	fs.root.mu.Lock()
-	fs.root.children[uid] = n
+	fs.root.link(uid, n)
 	fs.root.mu.Unlock()
 	return nil
 }
@@ -200,6 +666,10 @@ func (fs *FS) createHome(uid string) error {
 // Attach identifies the user and may select the file tree to access. As
 // a result of the attach transaction, the client will have a connection
 // to the root directory of the desired file tree, represented by Fid.
+// An aname suffix "!snappy" selects snappy encoded data transfers, a
+// final suffix "!session=<token>" a resumable session (see SessionTTL).
+// The aname "snap/<name>" selects the read-only snapshot name. All changes
+// through the fid of a read-only user are denied.
 func (fs *FS) Attach(uname, aname string) (*Fid, error) {
 	user, err := fs.group.Get(uname)
 	if err != nil {
@@ -207,12 +677,25 @@ func (fs *FS) Attach(uname, aname string) (*Fid, error) {
 	}
 	uid := user.Name
 
-	aname = path.Clean(aname)
-	node, err := fs.walk(aname)
+	aname, enc, err := parseAname(aname)
 	if err != nil {
 		return nil, err
 	}
-	return &Fid{uid: uid, node: node}, nil
+	node, ro, err := fs.resolve(uid, aname)
+	if err != nil {
+		return nil, err
+	}
+	fid := &Fid{uid: uid, node: node, enc: enc}
+	switch {
+	case ro:
+		fid.ro = errReadOnly
+	case fs.group.isReadOnly(uid):
+		fid.ro = errPerm
+	}
+	if h := fs.hooksOf(node); h != nil && h.OnAttach != nil {
+		h.OnAttach(uid, aname)
+	}
+	return fid, nil
 }
 
 // Create asks the file server to create a new file with the name
@@ -232,25 +715,11 @@ func (fs *FS) Attach(uname, aname string) (*Fid, error) {
 // The names . and .. are special; it is illegal to create files with
 // these names.
 func (fs *FS) Create(name string, mode uint8, perm Perm) (*Fid, error) {
-	user, err := fs.group.Get(fs.hostowner)
-	if err != nil {
-		panic(err) // can't happen
-	}
-	uid := user.Name
-
-	name = path.Clean(name)
-	dname, name := path.Dir(name), path.Base(name)
-	dir, err := fs.walk(dname)
+	u, err := fs.As(fs.hostowner)
 	if err != nil {
 		return nil, err
 	}
-	defer dir.Close()
-
-	node, err := dir.Create(uid, name, mode, plan9.Perm(perm))
-	if err != nil {
-		return nil, err
-	}
-	return &Fid{uid: uid, node: node}, nil
+	return u.Create(name, mode, perm)
 }
 
 // Open asks the file server to check permissions and prepare a fid for
@@ -270,31 +739,119 @@ func (fs *FS) Create(name string, mode uint8, perm Perm) (*Fid, error) {
 // it on close. If the file is marked for exclusive use, only one client
 // can have the file open at any time.
 func (fs *FS) Open(name string, mode uint8) (*Fid, error) {
+	u, err := fs.As(fs.hostowner)
+	if err != nil {
+		return nil, err
+	}
+	return u.Open(name, mode)
+}
+
+// Remove asks the file server both to remove the file represented by fid
+// and to clunk the fid, even if the remove fails.
+func (fs *FS) Remove(name string) error {
+	u, err := fs.As(fs.hostowner)
+	if err != nil {
+		return err
+	}
+	return u.Remove(name)
+}
+
+// WriteFileAtomic writes data to a hidden file and renames it to name,
+// replacing any existing file, so readers never observe a partially
+// written file. Permissions are assigned as in Create. Files in host
+// directories served by MountHost can't be replaced atomically.
+func (fs *FS) WriteFileAtomic(name string, data []byte, perm Perm) error {
 	user, err := fs.group.Get(fs.hostowner)
 	if err != nil {
-		panic(err) // can't happen
+		return err
 	}
 	uid := user.Name
 
+	if perm&DMDIR != 0 {
+		return perror("is a directory")
+	}
 	name = path.Clean(name)
-	node, err := fs.walk(name)
+	dname, name := path.Dir(name), fs.normName(path.Base(name))
+	if err := fs.checkName(name); err != nil {
+		return err
+	}
+	dir, err := fs.walk(dname)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if dir.Stat().Mode&plan9.DMDIR == 0 {
+		return perror("not a directory")
+	}
+	if dir.hostPath() != "" {
+		return perror("can't replace host files atomically")
+	}
+	if !dir.HasPerm(uid, plan9.DMWRITE) {
+		return errPerm
 	}
 
-	fid := &Fid{uid: uid, node: node}
-	if err := fid.Open(mode); err != nil {
-		return nil, err
+	path, err := fs.newPath()
+	if err != nil {
+		return err
 	}
-	return fid, nil
+	dir.mu.RLock()
+	gid := dir.newGid()
+	dir.mu.RUnlock()
+	perm = Perm(dir.createPerm(plan9.Perm(perm)))
+	b := fs.newBuffer(childPath(dir.path(), name), perm, uint64(len(data)))
+	tmp := newNode(fs, name, uid, gid, plan9.Perm(perm), path, b)
+	tmp.parent = dir
+	if _, err := tmp.WriteAt(data, 0); err != nil {
+		b.Close()
+		fs.delPath(path)
+		return err
+	}
+
+	fs.frozen.RLock()
+	dir.mu.Lock()
+	old, found := dir.children[name]
+	if found && old.Stat().Mode&plan9.DMDIR != 0 {
+		dir.mu.Unlock()
+		fs.frozen.RUnlock()
+		tmp.discard()
+		return perror("is a directory")
+	}
+	if !found && fs.MaxEntries > 0 && len(dir.children) >= fs.MaxEntries {
+		dir.mu.Unlock()
+		fs.frozen.RUnlock()
+		tmp.discard()
+		return perror("directory full")
+	}
+	dir.link(name, tmp)
+	dir.mu.Unlock()
+
+	if found {
+		// Fids open on the old file keep reading it; remove and
+		// wstat on them fail, as it is no longer linked.
+		fs.cache.invalidate()
+		old.mu.Lock()
+		if old.charged() {
+			fs.quota.release(old.dir.Gid, old.dir.Length)
+		}
+		old.retire()
+		old.mu.Unlock()
+	}
+	fs.frozen.RUnlock()
+
+	if !found {
+		fs.created(tmp, uid, uint64(len(data)))
+	} else if h := fs.hooksOf(tmp); h != nil && h.OnWrite != nil && len(data) > 0 {
+		h.OnWrite(tmp.path(), uid, 0, len(data))
+	}
+	return nil
 }
 
-// Remove asks the file server both to remove the file represented by fid
-// and to clunk the fid, even if the remove fails.
-func (fs *FS) Remove(name string) error {
+// RemoveAll removes name and any children it contains, bottom-up.
+// Removing a file requires write permission in its directory, which is
+// checked on every level. RemoveAll stops at the first error.
+func (fs *FS) RemoveAll(name string) error {
 	user, err := fs.group.Get(fs.hostowner)
 	if err != nil {
-		panic(err) // can't happen
+		return err
 	}
 	uid := user.Name
 
@@ -303,54 +860,212 @@ func (fs *FS) Remove(name string) error {
 	if err != nil {
 		return err
 	}
+	if node.parent == node {
+		return perror("can't remove root")
+	}
+	return removeAll(uid, node)
+}
+
+func removeAll(uid string, n *node) error {
+	if n.Stat().Mode&plan9.DMDIR != 0 {
+		n.mu.RLock()
+		children := make([]*node, 0, len(n.children))
+		for _, c := range n.children {
+			children = append(children, c)
+		}
+		n.mu.RUnlock()
+
+		for _, c := range children {
+			if err := removeAll(uid, c); err != nil {
+				return err
+			}
+		}
+	}
 
-	fid := &Fid{uid: uid, node: node}
-	return fid.Remove()
+	if !n.parent.HasPerm(uid, plan9.DMWRITE) {
+		return errPerm
+	}
+	var name string
+	h := n.fs.hooksOf(n)
+	if h != nil && h.OnRemove != nil {
+		name = n.path()
+	}
+	if err := n.Remove(); err != nil {
+		return err
+	}
+	if name != "" {
+		h.OnRemove(name, uid)
+	}
+	return nil
 }
 
-// Listen listens on the given network address and then serves incoming
-// requests.
-func (fs *FS) Listen(network, addr string) error {
+func (fs *FS) newServer() (*server, chan<- *transaction) {
 	work := make(chan *transaction)
 	srv := &server{
-		work:    work,
-		fs:      fs,
-		conn:    uint32(0),
-		connmap: make(map[uint32]bool),
+		work: work,
+		fs:   fs,
 	}
 	go srv.Listen()
+	return srv, work
+}
+
+// msize returns the maximum message size of the file server.
+func (fs *FS) msize() uint32 {
+	if fs.Msize <= plan9.IOHDRSZ {
+		return MSIZE
+	}
+	return fs.Msize
+}
+
+// serveConn serves the connection rwc until it is closed or ctx is
+// done. If l is not nil, the connection is drained when l is stopped.
+func (fs *FS) serveConn(ctx context.Context, srv *server, work chan<- *transaction, rwc io.ReadWriteCloser, l *listener) {
+	conn := newConn(ctx, rwc, fs.fidnew, work)
+	if !fs.addConn(conn) {
+		rwc.Close()
+		return
+	}
+	defer fs.delConn(conn)
+	defer conn.detach()
+	conn.ttl = fs.SessionTTL
+	conn.sessions = fs.sessions
+	conn.maxFids = fs.MaxFids
+	conn.ordered = fs.Ordered
+	conn.writeTimeout = fs.WriteTimeout
+	conn.access = fs.access
+	conn.dropOversized = fs.DropOversized
+	conn.msize = fs.msize()
+	conn.violations = &fs.violation
+	if l != nil {
+		if !l.add(conn) {
+			rwc.Close()
+			return
+		}
+		defer l.del(conn)
+	}
+	if fs.Log != nil {
+		conn.log = fs.Log
+		conn.sample = fs.LogSample
+		if age := fs.FidLeak; age > 0 {
+			t := fs.sweep.add("fidleak", age/2, func() { conn.checkFids(age) })
+			defer fs.sweep.remove(t)
+		}
+	}
+	conn.send(conn.recv())
+}
+
+// Listen listens on the given network address and then serves incoming
+// requests. It returns nil once the listener is stopped by the unlisten
+// ctl command and ErrServerClosed once the file server is stopped.
+func (fs *FS) Listen(network, addr string) error {
+	return fs.ListenContext(context.Background(), network, addr)
+}
+
+// ListenContext is Listen with a context. Once ctx is done, the listener
+// is stopped, its connections are closed without grace and their
+// outstanding requests are aborted; ListenContext then returns the error
+// of ctx.
+func (fs *FS) ListenContext(ctx context.Context, network, addr string) error {
+	if fs.isClosed() {
+		return ErrServerClosed
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return fs.serve(ctx, ln, network, addr)
+}
+
+// Serve serves incoming requests on the connections accepted by ln, e.g.
+// a listener passed by socket activation or a tls.Listener. The listener
+// is known to the unlisten ctl command by the network and address of
+// ln.Addr. Serve returns nil once the listener is stopped by unlisten,
+// ErrServerClosed once the file server is stopped, and the error of
+// Accept if ln fails otherwise.
+func (fs *FS) Serve(ln net.Listener) error {
+	a := ln.Addr()
+	return fs.serve(context.Background(), ln, a.Network(), a.String())
+}
 
-	listener, err := net.Listen(network, addr)
+func (fs *FS) serve(ctx context.Context, ln net.Listener, network, addr string) error {
+	l, err := fs.addListener(network, addr, ln)
 	if err != nil {
+		ln.Close()
 		return err
 	}
 
-	for {
-		rwc, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		connID, err := srv.newConn()
-		if err != nil {
-			rwc.Close()
-			continue
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fs.removeListener(network, addr, l)
+			l.close()
+		case <-stop:
 		}
+	}()
 
-		go func(rwc net.Conn, id uint32) {
-			defer srv.delConn(id)
-			conn := &conn{
-				rwc:    rwc,
-				fidnew: fs.fidnew,
-				work:   work,
-				uid:    "none",
-				fidmap: make(map[uint32]*Fid),
+	srv, work := fs.newServer()
+	for {
+		rwc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
-			if fs.Log != nil {
-				conn.log = fs.Log
+			if l.isStopped() {
+				if fs.isClosed() {
+					return ErrServerClosed
+				}
+				return nil
 			}
-			conn.send(conn.recv())
-		}(rwc, connID)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			fs.unlisten(network, addr)
+			return err
+		}
+		go fs.serveConn(ctx, srv, work, rwc, l)
+	}
+}
+
+// ServeConn serves a single 9P2000 session on rwc, e.g. one end of a
+// net.Pipe, and returns when the session ends. rwc is closed on return.
+func (fs *FS) ServeConn(rwc io.ReadWriteCloser) {
+	srv, work := fs.newServer()
+	defer close(work)
+	fs.serveConn(context.Background(), srv, work, rwc, nil)
+}
+
+// Dial returns one end of a net.Pipe whose other end is served by the
+// file server, so the process can talk 9P2000 to its own file server
+// without a network listener.
+func (fs *FS) Dial() (net.Conn, error) {
+	if fs.isClosed() {
+		return nil, ErrServerClosed
+	}
+	server, rwc := net.Pipe()
+	go fs.ServeConn(server)
+	return rwc, nil
+}
+
+// DialFsys attaches the user uname to the tree aname over a connection
+// returned by Dial. The connection is closed by fsys.Conn().Close().
+func (fs *FS) DialFsys(ctx context.Context, uname, aname string) (*client.Fsys, error) {
+	rwc, err := fs.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.NewConn(ctx, rwc)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := conn.Attach(ctx, nil, uname, aname)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return fsys, nil
 }
 
 func split(path string) []string {
@@ -372,7 +1087,7 @@ type Perm uint32
 
 type permChar struct {
 	bit Perm
-	c   int
+	c   rune
 }
 
 var permChars = []permChar{
@@ -1,14 +1,26 @@
 package ramfs
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/gob"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"9fans.net/go/plan9"
 	"9fans.net/go/plan9/client"
+	"code.google.com/p/snappy-go/snappy"
 )
 
 var testServerAddr = "localhost:15640"
@@ -104,7 +116,7 @@ func TestFileServerReadWrite(t *testing.T) {
 	c, fs := newFsys(t, "adm")
 	defer c.Close()
 
-	file, err := fs.Open("/file1", plan9.OREAD|plan9.OWRITE)
+	file, err := fs.Open("/file1", plan9.ORDWR)
 	if err != nil {
 		t.Fatalf("open: %v", err)
 	}
@@ -208,3 +220,3385 @@ func TestWalk(t *testing.T) {
 		t.Fatalf("walk: %v", err)
 	}
 }
+
+func TestAddTree(t *testing.T) {
+	fs := New("bootes")
+	if err := fs.AddTree("data", Tree{Owner: "bootes", Group: "bootes", Mode: 0700, NoAdm: true}); err != nil {
+		t.Fatalf("add tree: %v", err)
+	}
+	if err := fs.AddTree("data", Tree{Owner: "bootes", Group: "bootes"}); err == nil {
+		t.Fatalf("add tree: expected error for existing tree")
+	}
+	if err := fs.AddTree("other", Tree{Owner: "glenda", Group: "adm"}); err == nil {
+		t.Fatalf("add tree: expected error for unknown owner")
+	}
+
+	fid, err := fs.Attach("bootes", "data")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	stat := fid.node.Stat()
+	if stat.Uid != "bootes" || stat.Gid != "bootes" || stat.Mode != 0700|plan9.DMDIR {
+		t.Fatalf("expected bootes bootes %s, got %s %s %s",
+			Perm(0700|plan9.DMDIR), stat.Uid, stat.Gid, Perm(stat.Mode))
+	}
+	if len(fid.node.children) != 0 {
+		t.Fatalf("expected empty tree, got %d entries", len(fid.node.children))
+	}
+
+	fid, err = fs.Attach("bootes", "/")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, found := fid.node.children["adm"]; !found {
+		t.Fatalf("expected /adm in default tree")
+	}
+}
+
+func TestSnappyEncoding(t *testing.T) {
+	c, err := client.Dial("tcp", testServerAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	sfs, err := c.Attach(nil, "adm", "!snappy")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	c1, fs := newFsys(t, "adm")
+	defer c1.Close()
+
+	data := bytes.Repeat([]byte("hello snappy "), 100)
+	enc, err := snappy.Encode(nil, data)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	file, err := sfs.Create("/snappy", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer file.Close()
+	if n, err := file.WriteAt(enc, 0); err != nil || n != len(enc) {
+		t.Fatalf("write: %d %v", n, err)
+	}
+
+	raw, err := fs.Open("/snappy", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer raw.Close()
+	buf := make([]byte, 2*len(data))
+	n, err := raw.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatalf("raw read: expected %d bytes, got %d", len(data), n)
+	}
+
+	n, err = file.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	dec, err := snappy.Decode(nil, buf[:n])
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Fatalf("snappy read: expected %d bytes, got %d", len(data), len(dec))
+	}
+
+	if _, err := c.Attach(nil, "adm", "!gzip"); err == nil {
+		t.Fatalf("attach: expected unknown encoding error")
+	}
+}
+
+// shortBuffer is a Buffer writing at most max bytes at a time.
+type shortBuffer struct {
+	sliceBuffer
+	max int
+}
+
+func (b *shortBuffer) WriteAt(p []byte, offset int64) (int, error) {
+	if len(p) > b.max {
+		p = p[:b.max]
+	}
+	return b.sliceBuffer.WriteAt(p, offset)
+}
+
+func TestSnappyShortWrite(t *testing.T) {
+	fs := New("adm")
+	fs.AddStorage(StoragePolicy{Prefix: "/short", New: func(string, Perm) Buffer {
+		return &shortBuffer{max: 10}
+	}})
+	ctx := context.Background()
+	fsys, err := fs.DialFsys(ctx, "adm", "!snappy")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer fsys.Conn().Close()
+
+	file, err := fsys.Create(ctx, "/short", plan9.OWRITE, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer file.Close()
+	enc, err := snappy.Encode(nil, []byte("more than ten bytes"))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := file.WriteAt(enc, 0); err == nil || !strings.Contains(err.Error(), "short write") {
+		t.Fatalf("write: expected short write error, got %v", err)
+	}
+	enc, err = snappy.Encode(nil, []byte("ten bytes!"))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if n, err := file.WriteAt(enc, 0); err != nil || n != len(enc) {
+		t.Fatalf("write: expected %d bytes, got %d %v", len(enc), n, err)
+	}
+}
+
+func TestCtlSum(t *testing.T) {
+	c, fs := newFsys(t, "adm")
+	defer c.Close()
+
+	data := []byte("hello world\n")
+	file, err := fs.Create("/sum", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	file.Close()
+
+	ctl, err := fs.Open("/adm/ctl", plan9.ORDWR)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer ctl.Close()
+	if _, err := ctl.WriteAt([]byte("sum sha1 /sum"), 0); err != nil {
+		t.Fatalf("write ctl: %v", err)
+	}
+	buf := make([]byte, 128)
+	n, err := ctl.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read ctl: %v", err)
+	}
+	expected := fmt.Sprintf("%x  /sum\n", sha1.Sum(data))
+	if string(buf[:n]) != expected {
+		t.Fatalf("expected %q, got %q", expected, buf[:n])
+	}
+
+	if _, err := ctl.WriteAt([]byte("sum sha1 /sum 5"), 0); err != nil {
+		t.Fatalf("write ctl: %v", err)
+	}
+	n, err = ctl.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read ctl: %v", err)
+	}
+	expected = fmt.Sprintf("%x  /sum\n", sha1.Sum(data[:5]))
+	if string(buf[:n]) != expected {
+		t.Fatalf("expected %q, got %q", expected, buf[:n])
+	}
+
+	if _, err := ctl.WriteAt([]byte("sum xxx /sum"), 0); err == nil {
+		t.Fatalf("write ctl: expected unknown hash error")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	fs := New("adm")
+	fs.Timeout = 10 * time.Millisecond
+	srv := &server{fs: fs}
+
+	slow := func(fid *Fid, tx, rx *plan9.Fcall) error {
+		time.Sleep(100 * time.Millisecond)
+		rx.Count = 1
+		return nil
+	}
+	req := &request{Tx: &plan9.Fcall{Type: plan9.Tread}, Rx: &plan9.Fcall{}, ctx: context.Background()}
+	if err := srv.call(slow, req); err != errTimeout {
+		t.Fatalf("expected %v, got %v", errTimeout, err)
+	}
+	if req.Rx.Count != 0 {
+		t.Fatalf("reply of timed out request modified")
+	}
+
+	fs.Timeout = time.Second
+	req = &request{Tx: &plan9.Fcall{Type: plan9.Tread}, Rx: &plan9.Fcall{}, ctx: context.Background()}
+	if err := srv.call(slow, req); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if req.Rx.Count != 1 {
+		t.Fatalf("expected count 1, got %d", req.Rx.Count)
+	}
+
+	// a change begun is answered with its result, not a timeout
+	fs.Timeout = 10 * time.Millisecond
+	req = &request{Tx: &plan9.Fcall{Type: plan9.Twrite}, Rx: &plan9.Fcall{}, ctx: context.Background()}
+	if err := srv.call(changing(req, slow), req); err != nil || req.Rx.Count != 1 {
+		t.Fatalf("change: expected count 1, got %d (%v)", req.Rx.Count, err)
+	}
+	// and a change not begun is not applied once it timed out
+	applied := false
+	req = &request{Tx: &plan9.Fcall{Type: plan9.Twrite}, Rx: &plan9.Fcall{}, ctx: context.Background()}
+	if !req.abandon() {
+		t.Fatalf("abandon: request already committed")
+	}
+	err := changing(req, func(fid *Fid, tx, rx *plan9.Fcall) error {
+		applied = true
+		return nil
+	})(nil, req.Tx, req.Rx)
+	if err != errCanceled || applied {
+		t.Fatalf("abandoned change: expected %v, got %v (applied %v)", errCanceled, err, applied)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	fs := New("adm")
+	srv := &server{fs: fs}
+
+	bad := func(fid *Fid, tx, rx *plan9.Fcall) error {
+		panic("bad request")
+	}
+	for _, timeout := range []time.Duration{0, time.Second} {
+		fs.Timeout = timeout
+		req := &request{Tx: &plan9.Fcall{Type: plan9.Tread}, Rx: &plan9.Fcall{}, ctx: context.Background()}
+		if err := srv.call(bad, req); err != errInternal {
+			t.Fatalf("expected %v, got %v", errInternal, err)
+		}
+	}
+	if n := fs.Panics(); n != 2 {
+		t.Fatalf("expected 2 panics, got %d", n)
+	}
+}
+
+func TestCtlDu(t *testing.T) {
+	fs := New("adm")
+	dir, err := fs.root.Create("adm", "du", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	sub, err := dir.Create("adm", "sub", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i, n := range []*node{dir, sub} {
+		file, err := n.Create("adm", fmt.Sprintf("file%d", i), plan9.ORDWR, 0664)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := file.WriteAt([]byte("data"), 0); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	data, err := newCtl(fs).Query("adm", []byte("du /du"))
+	if err != nil {
+		t.Fatalf("du: %v", err)
+	}
+	expected := "/du entries 2 files 2 dirs 1 bytes 8\n"
+	if string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestWalkCache(t *testing.T) {
+	fs := New("adm")
+	fs.WalkCache = 2
+	dir, err := fs.root.Create("adm", "a", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	file, err := dir.Create("adm", "b", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	n, err := fs.walk("/a/b")
+	if err != nil || n != file {
+		t.Fatalf("walk: %v", err)
+	}
+	n, found, gen := fs.cache.get(fs.root, "/a/b")
+	if !found || n != file {
+		t.Fatalf("expected cached /a/b")
+	}
+	// a walk that raced an invalidation is not cached
+	fs.cache.invalidate()
+	fs.cache.put(fs.root, "/a/b", file, fs.WalkCache, gen)
+	if _, found, _ := fs.cache.get(fs.root, "/a/b"); found {
+		t.Fatalf("stale walk cached")
+	}
+
+	if err := file.Wstat("adm", &plan9.Dir{Mode: 0xFFFFFFFF, Name: "c"}); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	if _, err := fs.walk("/a/b"); err == nil {
+		t.Fatalf("walk: expected error for renamed file")
+	}
+	if n, err := fs.walk("/a/c"); err != nil || n != file {
+		t.Fatalf("walk: %v", err)
+	}
+
+	if err := file.Remove(); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := fs.walk("/a/c"); err == nil {
+		t.Fatalf("walk: expected error for removed file")
+	}
+}
+
+func TestWalkLimits(t *testing.T) {
+	fs := New("adm")
+	n := fs.root
+	for i := 0; i < 4; i++ {
+		var err error
+		if n, err = n.Create("adm", "d", plan9.OREAD, 0775|plan9.DMDIR); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	fs.MaxDepth = 3
+	if _, err := fs.walk("/d/d/d"); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := fs.walk("/d/d/d/d"); err == nil {
+		t.Fatalf("walk: expected depth error")
+	}
+
+	fs.MaxDepth = 0
+	fs.MaxWalk = 4
+	if _, err := fs.walk("/d/d/d/d"); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := walkRoot(fs.root, "", "d/../d/../d"); err == nil {
+		t.Fatalf("walk: expected too many names error")
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	fs := New("adm")
+	dir, err := fs.root.Create("adm", "a", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	sub, err := dir.Create("adm", "b", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, n := range []*node{dir, sub} {
+		if _, err := n.Create("adm", "file", plan9.OREAD, 0664); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	if err := fs.RemoveAll("/"); err == nil {
+		t.Fatalf("remove all: expected error removing root")
+	}
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+	if _, err := fs.walk("/a"); err == nil {
+		t.Fatalf("walk: expected error for removed tree")
+	}
+
+	// read-only directory
+	dir, err = fs.root.Create("adm", "ro", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := dir.Create("adm", "file", plan9.OREAD, 0664); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir.dir.Mode = 0555 | plan9.DMDIR
+	if err := fs.RemoveAll("/ro"); err != errPerm {
+		t.Fatalf("remove all: expected %v, got %v", errPerm, err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	fs := New("adm")
+	if err := fs.WriteFileAtomic("/config", []byte("version 1"), 0664); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	old, err := fs.walk("/config")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if err := fs.WriteFileAtomic("/config", []byte("version 2"), 0664); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	n, err := fs.walk("/config")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+
+	buf := make([]byte, 32)
+	m, err := n.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf[:m]) != "version 2" {
+		t.Fatalf("expected %q, got %q", "version 2", buf[:m])
+	}
+	m, err = old.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf[:m]) != "version 1" {
+		t.Fatalf("expected old file unchanged, got %q", buf[:m])
+	}
+
+	if err := fs.WriteFileAtomic("/adm", nil, 0664); err == nil {
+		t.Fatalf("write: expected error replacing directory")
+	}
+
+	// a fid open on a replaced file neither removes nor renames the new
+	// file, and keeps the qid path until it is closed
+	fid, err := fs.Open("/config", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	qpath := fid.node.Stat().Qid.Path
+	if err := fs.WriteFileAtomic("/config", []byte("version 3"), 0664); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var d plan9.Dir
+	d.Null()
+	d.Name = "renamed"
+	stat, _ := d.Bytes()
+	if err := fid.Wstat(stat); err == nil {
+		t.Fatalf("wstat: expected error renaming replaced file")
+	}
+	if err := fid.Remove(); err == nil {
+		t.Fatalf("remove: expected error on replaced file")
+	}
+	if _, err := fs.walk("/config"); err != nil {
+		t.Fatalf("new file removed through old fid: %v", err)
+	}
+	if fs.pathmap[qpath] {
+		t.Fatalf("qid path of open file released")
+	}
+	if err := fid.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if !fs.pathmap[qpath] {
+		t.Fatalf("qid path of replaced file not released on close")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	fs := New("adm")
+	if err := fs.WriteFileAtomic("/src", []byte("hello"), 0640); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fs.Copy("/src", "/dst"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := fs.Copy("/src", "/dst"); err == nil {
+		t.Fatalf("copy: expected error for existing file")
+	}
+	if err := fs.Copy("/adm", "/dir"); err == nil {
+		t.Fatalf("copy: expected error copying directory")
+	}
+
+	dst, err := fs.walk("/dst")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if length := dst.Stat().Length; length != 5 {
+		t.Fatalf("expected length 5, got %d", length)
+	}
+	if _, err := dst.WriteAt([]byte("j"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	src, _ := fs.walk("/src")
+	buf := make([]byte, 5)
+	if _, err := src.ReadAt(buf, 0); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected source unchanged, got %q (%v)", buf, err)
+	}
+
+	// synthetic file
+	if err := fs.Copy("/adm/group", "/group"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	fs := New("adm")
+	if err := fs.WriteFileAtomic("/file", []byte("data"), 0664); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	ctl := newCtl(fs)
+	if _, err := ctl.Query("adm", []byte("setxattr /file content-type text/plain; charset=utf-8")); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	if err := fs.SetXattr("/file", "sum", "abc"); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	data, err := ctl.Query("adm", []byte("getxattr /file content-type"))
+	if err != nil {
+		t.Fatalf("getxattr: %v", err)
+	}
+	if string(data) != "text/plain; charset=utf-8\n" {
+		t.Fatalf("expected content type, got %q", data)
+	}
+	data, err = ctl.Query("adm", []byte("lsxattr /file"))
+	if err != nil {
+		t.Fatalf("lsxattr: %v", err)
+	}
+	if string(data) != "content-type\nsum\n" {
+		t.Fatalf("expected attribute list, got %q", data)
+	}
+
+	if err := fs.Copy("/file", "/copy"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if value, err := fs.Xattr("/copy", "sum"); err != nil || value != "abc" {
+		t.Fatalf("expected copied attribute, got %q (%v)", value, err)
+	}
+
+	if err := fs.RemoveXattr("/file", "sum"); err != nil {
+		t.Fatalf("rmxattr: %v", err)
+	}
+	if _, err := fs.Xattr("/file", "sum"); err == nil {
+		t.Fatalf("getxattr: expected error for removed attribute")
+	}
+	if _, err := ctl.Query("none", []byte("setxattr /file a b")); err != errPerm {
+		t.Fatalf("setxattr: expected %v, got %v", errPerm, err)
+	}
+}
+
+func TestSetgid(t *testing.T) {
+	fs := New("adm")
+	fs.group.groupmap["sys"] = user{"sys", "sys", member{"adm": true}}
+	if err := fs.AddTree("proj", Tree{Owner: "adm", Group: "sys", NoAdm: true, DefaultGroup: "adm"}); err != nil {
+		t.Fatalf("add tree: %v", err)
+	}
+	root := fs.trees["proj"]
+
+	file, err := root.Create("adm", "file", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if gid := file.Stat().Gid; gid != "adm" {
+		t.Fatalf("expected default group adm, got %s", gid)
+	}
+
+	root.setgid = true
+	dir, err := root.Create("adm", "dir", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	sub, err := dir.Create("adm", "sub", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if gid := sub.Stat().Gid; gid != "sys" || !sub.setgid {
+		t.Fatalf("expected setgid directory of group sys, got %s %v", gid, sub.setgid)
+	}
+
+	if err := fs.setgid("none", "/", false); err == nil {
+		t.Fatalf("setgid: expected error for non-owner")
+	}
+	if err := fs.setgid("adm", "/adm/ctl", true); err == nil {
+		t.Fatalf("setgid: expected error for file")
+	}
+}
+
+func TestSession(t *testing.T) {
+	s := newSession()
+	fid := &Fid{uid: "glenda"}
+	for _, rx := range []*plan9.Fcall{
+		{Type: plan9.Rattach},
+		{Type: plan9.Rcreate},
+		{Type: plan9.Rwrite, Count: 5},
+		{Type: plan9.Rread, Data: []byte("abc")},
+		{Type: plan9.Rerror},
+		{Type: plan9.Rremove},
+	} {
+		s.account(&request{Fid: fid, Rx: rx})
+	}
+
+	if s.uid != "glenda" || s.ops != 6 || s.errors != 1 || s.read != 3 ||
+		s.written != 5 || s.created != 1 || s.removed != 1 {
+		t.Fatalf("unexpected session statistics: %s", s)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := newConn(context.Background(), nil, nil, nil)
+	c.draining = true
+	reqout := make(chan *request, 1)
+	tx := &plan9.Fcall{Type: plan9.Tstat, Tag: 7}
+	c.dispatch(&request{Tx: tx, Rx: &plan9.Fcall{}}, reqout)
+	req := <-reqout
+	if req.Rx.Type != plan9.Rerror || req.Rx.Ename != errShutdown.Error() {
+		t.Fatalf("expected %q, got %s", errShutdown, req.Rx)
+	}
+	if req.Rx.Tag != 7 {
+		t.Fatalf("expected tag 7, got %d", req.Rx.Tag)
+	}
+
+	fs := New("adm")
+	fs.Grace = time.Second
+	addr := "localhost:15641"
+	done := make(chan error, 1)
+	go func() { done <- fs.Listen("tcp", addr) }()
+
+	var conn *client.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = client.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fsys, err := conn.Attach(nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+
+	if err := fs.Halt(); err != nil {
+		t.Fatalf("halt: %v", err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("listen: expected %q, got %v", ErrServerClosed, err)
+	}
+	if _, err := fsys.Stat("/adm"); err == nil {
+		t.Fatalf("stat: expected error on drained connection")
+	}
+	if _, err := client.Dial("tcp", addr); err == nil {
+		t.Fatalf("dial: expected error after halt")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	fs := New("adm")
+	n, err := fs.walk("/adm/health")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	read := func() string {
+		buf := make([]byte, 128)
+		m, err := n.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return string(buf[:m])
+	}
+
+	if s, expected := read(), "unready listeners 0 memory 0 limit 0\n"; s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+
+	fs.listeners["tcp!test"] = newListener(nil)
+	file, err := fs.root.Create("adm", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if s, expected := read(), "ready listeners 1 memory 4 limit 0\n"; s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+
+	fs.MemoryLimit = 2
+	if s, expected := read(), "unready listeners 1 memory 4 limit 2\n"; s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+
+	// probes read it as any user
+	none, err := fs.As("none")
+	if err != nil {
+		t.Fatalf("as: %v", err)
+	}
+	fid, err := none.Open("/adm/health", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open as none: %v", err)
+	}
+	fid.Close()
+	if _, err := none.Open("/adm/ctl", plan9.OREAD); err == nil {
+		t.Fatalf("open as none: expected error for /adm/ctl")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	fs := New("adm")
+	fs.group.groupmap["glenda"] = user{"glenda", "glenda", member{}}
+	usr, err := fs.root.Create("adm", "usr", plan9.OREAD, 0777|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	file, err := usr.Create("glenda", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fs.Snap("s"); err != nil {
+		t.Fatalf("snap: %v", err)
+	}
+
+	r := fs.Memory()
+	if r.Total.Data != 4 || r.Trees[""].Data != 4 || r.Trees["snap/s"].Data != 0 {
+		t.Fatalf("shared data not counted once: %+v", r)
+	}
+	if u := r.Dirs["/usr"]; u.Nodes != 2 || u.Data != 4 {
+		t.Fatalf("unexpected usage of /usr: %+v", u)
+	}
+	if u := r.Owners["glenda"]; u.Nodes != 2 || u.Data != 4 || u.Overhead == 0 {
+		t.Fatalf("unexpected usage of glenda: %+v", u)
+	}
+	nodes := uint64(0)
+	for _, u := range r.Trees {
+		nodes += u.Nodes
+	}
+	if nodes != r.Total.Nodes {
+		t.Fatalf("tree nodes %d, total %d", nodes, r.Total.Nodes)
+	}
+
+	reply, err := newCtl(fs).Query("adm", []byte("memory"))
+	if err != nil {
+		t.Fatalf("memory: %v", err)
+	}
+	if !bytes.HasPrefix(reply, []byte("total - nodes ")) || !bytes.Contains(reply, []byte("\ndir /usr nodes 2 data 4 ")) {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+}
+
+func TestPost(t *testing.T) {
+	ns, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ns)
+	defer os.Setenv("NAMESPACE", os.Getenv("NAMESPACE"))
+	os.Setenv("NAMESPACE", ns)
+
+	fs := New("adm")
+	done := make(chan error, 1)
+	go func() { done <- fs.Post("ramfs") }()
+
+	var c *client.Conn
+	for i := 0; i < 100; i++ {
+		if c, err = client.Dial("unix", ns+"/ramfs"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	fsys, err := c.Attach(nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, err := fsys.Stat("/adm/ctl"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	c.Close()
+
+	if err := fs.Halt(); err != nil {
+		t.Fatalf("halt: %v", err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("post: expected %q, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServeStdio(t *testing.T) {
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+
+	sr, cw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, sw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin, os.Stdout = sr, sw
+
+	done := make(chan struct{})
+	go func() {
+		New("adm").ServeStdio()
+		close(done)
+	}()
+
+	c, err := client.NewConn(stdio{cr, cw})
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	fsys, err := c.Attach(nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, err := fsys.Stat("/adm/ctl"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ServeStdio did not return at EOF")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	fs := New("adm")
+	if _, err := fs.group.WriteAt([]byte("uname glenda glenda"), 0); err != nil {
+		t.Fatalf("uname: %v", err)
+	}
+	if err := fs.AddTree("data", Tree{Owner: "glenda", Group: "glenda", NoAdm: true}); err != nil {
+		t.Fatalf("add tree: %v", err)
+	}
+	dir, err := fs.root.Create("adm", "dir", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	file, err := dir.Create("adm", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := file.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fs.SetXattr("/dir/file", "user.color", "red"); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	root, _ := fs.tree("data")
+	if _, err := root.Create("glenda", "notes", plan9.ORDWR, 0600); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := fs.Save(buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored := New("adm")
+	if err := restored.Load(buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	n, err := restored.walk("/dir/file")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if n.Stat().Qid != file.Stat().Qid {
+		t.Fatalf("expected qid %v, got %v", file.Stat().Qid, n.Stat().Qid)
+	}
+	f, err := readAll(n)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	got := make([]byte, f.Len())
+	f.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("file data differs after load")
+	}
+	if value, err := restored.Xattr("/dir/file", "user.color"); err != nil || value != "red" {
+		t.Fatalf("xattr: expected red, got %q (%v)", value, err)
+	}
+	if _, err := restored.group.Get("glenda"); err != nil {
+		t.Fatalf("group: %v", err)
+	}
+	root, _ = restored.tree("data")
+	if _, err := walkRoot(root, "", "/notes"); err != nil {
+		t.Fatalf("walk data tree: %v", err)
+	}
+	if _, err := newCtl(restored).Query("adm", []byte("du /dir")); err != nil {
+		t.Fatalf("ctl after load: %v", err)
+	}
+	if path, _ := restored.newPath(); path == file.Stat().Qid.Path {
+		t.Fatalf("qid path %d reused after load", path)
+	}
+}
+
+func TestSaveVersions(t *testing.T) {
+	fs := New("adm")
+	fs.quota.set("adm", 4096)
+	buf := &bytes.Buffer{}
+	if err := fs.Save(buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	restored := New("adm")
+	restored.quota.set("sys", 1)
+	if err := restored.Load(buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if limit := restored.quota.limits(); len(limit) != 1 || limit["adm"] != 4096 {
+		t.Fatalf("unexpected quotas after load: %v", limit)
+	}
+
+	// A later version adding fields is read as long as it is compatible,
+	// images written before the magic line are migrated.
+	image := func(magic bool, version, compat int) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		if magic {
+			buf.WriteString(saveMagic)
+		}
+		enc := gob.NewEncoder(buf)
+		enc.Encode(&struct {
+			Version int
+			Compat  int
+			Path    uint64
+			Extra   string
+		}{version, compat, 100, "unknown"})
+		enc.Encode(&struct {
+			Root  bool
+			Dir   plan9.Dir
+			Extra []int
+		}{true, *fs.root.Stat(), []int{1}})
+		return buf
+	}
+	tests := []struct {
+		magic           bool
+		version, compat int
+		ok              bool
+	}{
+		{false, 1, 0, true},
+		{false, 2, 1, true},
+		{true, saveVersion, saveCompat, true},
+		{true, saveVersion + 1, saveVersion, true},
+		{true, saveVersion + 1, saveVersion + 1, false},
+		{true, saveVersion + 1, 0, false},
+		{false, saveVersion, saveCompat, false},
+		{true, 0, 0, false},
+	}
+	for _, tt := range tests {
+		restored := New("adm")
+		restored.quota.set("sys", 1)
+		err := restored.Load(image(tt.magic, tt.version, tt.compat))
+		if (err == nil) != tt.ok {
+			t.Fatalf("load version %d compat %d magic %v: %v", tt.version, tt.compat, tt.magic, err)
+		}
+		if err != nil {
+			continue
+		}
+		limit := restored.quota.limits()
+		if keep := tt.version == 1; keep != (limit["sys"] == 1) {
+			t.Fatalf("version %d: unexpected quotas after load: %v", tt.version, limit)
+		}
+	}
+	if err := New("adm").Load(strings.NewReader("garbage")); err == nil {
+		t.Fatalf("loaded garbage")
+	}
+}
+
+func TestAs(t *testing.T) {
+	fs := New("adm")
+	if _, err := fs.group.WriteAt([]byte("uname glenda glenda"), 0); err != nil {
+		t.Fatalf("uname: %v", err)
+	}
+	if _, err := fs.As("nobody"); err == nil {
+		t.Fatalf("as: expected error for unknown user")
+	}
+	glenda, err := fs.As("glenda")
+	if err != nil {
+		t.Fatalf("as: %v", err)
+	}
+
+	if _, err := glenda.Create("/file", plan9.OREAD, 0644); err != errPerm {
+		t.Fatalf("create in /: expected %v, got %v", errPerm, err)
+	}
+	if _, err := glenda.Open("/adm/ctl", plan9.OWRITE); err != errPerm {
+		t.Fatalf("open /adm/ctl: expected %v, got %v", errPerm, err)
+	}
+
+	if _, err := glenda.Create("/glenda/file", plan9.OREAD, 0644); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir, err := glenda.Stat("/glenda/file")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if dir.Uid != "glenda" {
+		t.Fatalf("expected owner glenda, got %s", dir.Uid)
+	}
+	if err := glenda.Remove("/glenda/file"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := glenda.Stat("/glenda/file"); err == nil {
+		t.Fatalf("stat: expected error after remove")
+	}
+}
+
+func TestFidLimits(t *testing.T) {
+	fs := New("adm")
+	c := newConn(context.Background(), nil, fs.fidnew, nil)
+	c.maxFids = 2
+	for _, num := range []uint32{1, 2, 1} {
+		if _, err := c.GetFid(num); err != nil {
+			t.Fatalf("fid %d: %v", num, err)
+		}
+	}
+	if _, err := c.GetFid(3); err != errTooManyFids {
+		t.Fatalf("expected %v, got %v", errTooManyFids, err)
+	}
+	if c.stats.maxFids != 2 {
+		t.Fatalf("expected peak of 2 fids, got %d", c.stats.maxFids)
+	}
+
+	var logged []string
+	c.log = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+	n, err := fs.walk("/adm/ctl")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	c.fidmap[1].node = n
+	c.fidmap[1].born = time.Now().Add(-time.Minute)
+	c.checkFids(time.Second)
+	c.checkFids(time.Second)
+	if len(logged) != 1 {
+		t.Fatalf("expected 1 leaked fid report, got %q", logged)
+	}
+	if !strings.HasSuffix(logged[0], "/adm/ctl") {
+		t.Fatalf("expected report of /adm/ctl, got %q", logged[0])
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	fs := New("adm")
+	work := make(chan *transaction)
+	c := newConn(context.Background(), nil, fs.fidnew, work)
+	c.ordered = true
+	fid, err := c.GetFid(1)
+	if err != nil {
+		t.Fatalf("fid: %v", err)
+	}
+	fid.node = fs.root
+
+	var mu sync.Mutex
+	var order []uint8
+	go func() {
+		for txn := range work {
+			go func(t *transaction) {
+				if t.req.Tx.Type == plan9.Twrite {
+					time.Sleep(50 * time.Millisecond)
+				}
+				mu.Lock()
+				order = append(order, t.req.Tx.Type)
+				mu.Unlock()
+				t.ch <- t.req
+			}(txn)
+		}
+	}()
+
+	reqout := make(chan *request, 3)
+	for _, typ := range []uint8{plan9.Twrite, plan9.Tread, plan9.Tclunk} {
+		tx := &plan9.Fcall{Type: typ, Fid: 1}
+		c.dispatch(&request{Tx: tx, Rx: &plan9.Fcall{}}, reqout)
+	}
+	for i := 0; i < 3; i++ {
+		<-reqout
+	}
+	close(work)
+
+	expected := []uint8{plan9.Twrite, plan9.Tread, plan9.Tclunk}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := newConn(context.Background(), server, nil, nil)
+	c.writeTimeout = 20 * time.Millisecond
+	rx := &plan9.Fcall{Type: plan9.Rread, Tag: 1, Data: make([]byte, 4*writeChunk)}
+
+	go io.Copy(ioutil.Discard, client)
+	if err := c.write(rx); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	stalled, client := net.Pipe()
+	defer client.Close()
+	c = newConn(context.Background(), stalled, nil, nil)
+	c.writeTimeout = 20 * time.Millisecond
+	err := c.write(rx)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestCtlClone(t *testing.T) {
+	fs := New("adm")
+	ctl := newCtl(fs)
+	if err := fs.WriteFileAtomic("/file", []byte("hello"), 0640); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, name := range []string{"/src", "/src/sub"} {
+		if _, err := fs.Create(name, plan9.OREAD, 0755|plan9.DMDIR); err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+	}
+	if err := fs.WriteFileAtomic("/src/sub/file", []byte("data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := ctl.Query("adm", []byte("cp /file /copy")); err != nil {
+		t.Fatalf("cp: %v", err)
+	}
+	if _, err := ctl.Query("adm", []byte("clone /src /dst")); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if _, err := ctl.Query("adm", []byte("clone /src /dst")); err == nil {
+		t.Fatalf("clone: expected error for existing directory")
+	}
+	if _, err := ctl.Query("adm", []byte("clone /src /src/sub/x")); err == nil {
+		t.Fatalf("clone: expected error cloning into itself")
+	}
+
+	for name, data := range map[string]string{"/copy": "hello", "/dst/sub/file": "data"} {
+		n, err := fs.walk(name)
+		if err != nil {
+			t.Fatalf("walk %s: %v", name, err)
+		}
+		buf := make([]byte, 16)
+		m, err := n.ReadAt(buf, 0)
+		if err != nil || string(buf[:m]) != data {
+			t.Fatalf("%s: expected %q, got %q (%v)", name, data, buf[:m], err)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	fs := New("adm")
+	quota, err := fs.walk("/adm/quota")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	usage, err := fs.walk("/adm/usage")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := quota.WriteAt([]byte("adm 10"), 0); err != nil {
+		t.Fatalf("set quota: %v", err)
+	}
+	if _, err := quota.WriteAt([]byte("nosuchgroup 10"), 0); err == nil {
+		t.Fatalf("set quota: expected error for unknown group")
+	}
+
+	file, err := fs.root.Create("adm", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("12345678"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("12345"), 6); err != errQuota {
+		t.Fatalf("expected %v, got %v", errQuota, err)
+	}
+	if _, err := file.WriteAt([]byte("abcd"), 4); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	if err := fs.Copy("/file", "/copy"); err != errQuota {
+		t.Fatalf("copy: expected %v, got %v", errQuota, err)
+	}
+
+	buf := make([]byte, 64)
+	m, _ := usage.ReadAt(buf, 0)
+	if expected := "adm 8 10\n"; string(buf[:m]) != expected {
+		t.Fatalf("expected usage %q, got %q", expected, buf[:m])
+	}
+
+	if err := file.Remove(); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	m, _ = usage.ReadAt(buf, 0)
+	if expected := "adm 0 10\n"; string(buf[:m]) != expected {
+		t.Fatalf("expected usage %q, got %q", expected, buf[:m])
+	}
+	m, _ = quota.ReadAt(buf, 0)
+	if expected := "adm 10\n"; string(buf[:m]) != expected {
+		t.Fatalf("expected quotas %q, got %q", expected, buf[:m])
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+	fs := New("adm")
+	fs.MemoryLimit = 100
+	fs.SoftLimit = 80
+	var events []string
+	fs.LimitWarning = func(name, state string, usage, limit uint64) {
+		events = append(events, fmt.Sprintf("%s %s %d %d", name, state, usage, limit))
+	}
+	stats, err := fs.walk("/adm/stats")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	fs.quota.set("adm", 10)
+
+	file, err := fs.root.Create("adm", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("1234567"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no events below the soft limit, got %q", events)
+	}
+	if _, err := file.WriteAt([]byte("8"), 7); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 128)
+	m, _ := stats.ReadAt(buf, 0)
+	if expected := "memory 8 100 ok\nquota adm 8 10 warning\n"; string(buf[:m]) != expected {
+		t.Fatalf("expected stats %q, got %q", expected, buf[:m])
+	}
+
+	fs.MemoryLimit = 8
+	if _, err := file.WriteAt([]byte("9"), 8); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := file.Remove(); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	expected := []string{
+		"quota adm warning 8 10",
+		"memory exceeded 9 8",
+		"memory ok 0 8",
+		"quota adm ok 0 10",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected events %q, got %q", expected, events)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fs := New("adm")
+	if problems := fs.Check(false); len(problems) != 0 {
+		t.Fatalf("expected no problems, got %q", problems)
+	}
+	if err := fs.WriteFileAtomic("/file", []byte("data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := fs.root.Create("adm", "dir", plan9.OREAD, DMDIR|0755); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	file, err := fs.walk("/file")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	dir, err := fs.walk("/dir")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	file.dir.Length = 10
+	dir.dir.Name = "other"
+	dir.parent = file
+	fs.group.groupmap["adm"].Member["ghost"] = true
+
+	expected := []string{
+		"member ghost of group adm not found",
+		"/dir: parent is not its directory",
+		"/dir: named other",
+		"/file: length 10, but 4 bytes of data",
+		"usage of group adm 4, but 10 bytes of files",
+	}
+	problems := func(repair bool) string {
+		var s []string
+		for _, p := range fs.Check(repair) {
+			s = append(s, p.String())
+		}
+		return strings.Join(s, "\n")
+	}
+	if got := problems(false); got != strings.Join(expected, "\n") {
+		t.Fatalf("expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), got)
+	}
+	reply, err := newCtl(fs).Query("adm", []byte("fsck repair"))
+	if err != nil {
+		t.Fatalf("fsck: %v", err)
+	}
+	// The usage matches once the length is repaired.
+	repaired := strings.Join(expected[:4], " (repaired)\n") + " (repaired)\n"
+	if string(reply) != repaired {
+		t.Fatalf("expected repaired problems %q, got %q", repaired, reply)
+	}
+	if got := problems(false); got != "" {
+		t.Fatalf("expected no problems after repair, got\n%s", got)
+	}
+	if dir.parent != fs.root || dir.dir.Name != "dir" || file.dir.Length != 4 {
+		t.Fatalf("not repaired: parent %v name %q length %d", dir.parent == fs.root, dir.dir.Name, file.dir.Length)
+	}
+}
+
+func TestSnap(t *testing.T) {
+	fs := New("adm")
+	if err := fs.WriteFileAtomic("/file", []byte("old"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := newCtl(fs).Query("adm", []byte("snap monday")); err != nil {
+		t.Fatalf("snap: %v", err)
+	}
+	if err := fs.Snap("monday"); err == nil {
+		t.Fatalf("snap: expected error for existing snapshot")
+	}
+	if err := fs.WriteFileAtomic("/file", []byte("new"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	root, err := fs.Attach("adm", "snap/monday")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, err := walkRoot(root.node, "", "/adm/ctl"); err == nil {
+		t.Fatalf("walk: expected synthetic files to be left out")
+	}
+	fid, err := fs.Attach("adm", "snap/monday/file")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if err := fid.Open(plan9.OWRITE); err != errReadOnly {
+		t.Fatalf("open: expected %v, got %v", errReadOnly, err)
+	}
+	if err := fid.Open(plan9.OREAD); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	buf := make([]byte, 8)
+	n, err := fid.ReadAt(buf, 0)
+	if err != nil || string(buf[:n]) != "old" {
+		t.Fatalf("expected %q, got %q (%v)", "old", buf[:n], err)
+	}
+	if err := root.Create("file2", plan9.OREAD, 0644); err != errReadOnly {
+		t.Fatalf("create: expected %v, got %v", errReadOnly, err)
+	}
+
+	if names := fs.Snaps(); len(names) != 1 || names[0] != "monday" {
+		t.Fatalf("expected snapshots [monday], got %v", names)
+	}
+	if err := fs.RemoveSnap("monday"); err != nil {
+		t.Fatalf("rmsnap: %v", err)
+	}
+	if _, err := fs.Attach("adm", "snap/monday"); err == nil {
+		t.Fatalf("attach: expected error for removed snapshot")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	fs := New("adm")
+	mkdir := func(name string) {
+		fid, err := fs.Create(name, plan9.OREAD, plan9.DMDIR|0755)
+		if err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		fid.Close()
+	}
+	mkdir("/d")
+	for name, data := range map[string]string{
+		"/d/same":    "same",
+		"/d/changed": "old",
+		"/d/gone":    "gone",
+	} {
+		if err := fs.WriteFileAtomic(name, []byte(data), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := fs.Snap("old"); err != nil {
+		t.Fatalf("snap: %v", err)
+	}
+	if err := fs.WriteFileAtomic("/d/changed", []byte("new"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fs.Remove("/d/gone"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	mkdir("/d/new")
+	mkdir("/d/new/sub")
+
+	changes, err := fs.Diff("snap/old/d", "/d")
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	expected := []string{"M /changed", "- /gone", "+ /new"}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	for i, c := range changes {
+		if c.String() != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, changes)
+		}
+	}
+
+	reply, err := newCtl(fs).Query("adm", []byte("diff /d /d"))
+	if err != nil || len(reply) != 0 {
+		t.Fatalf("diff: expected no changes, got %q (%v)", reply, err)
+	}
+	if _, err := fs.Diff("/d/same", "/d"); err == nil {
+		t.Fatalf("diff: expected error for file")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	fs := New("adm")
+	users := `# cwfs users
+-1:adm:adm:glenda,sys
+0:none::
+1:tor:tor:
+2:glenda:glenda:
+10000:sys::glenda,tor
+`
+	if err := fs.ImportUsers(strings.NewReader(users)); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	u, err := fs.group.Get("sys")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Leader != "" || !u.isMember("glenda") || !u.isMember("tor") {
+		t.Fatalf("unexpected user %v", u)
+	}
+
+	var buf bytes.Buffer
+	if err := fs.ExportUsers(&buf); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	expected := "adm:adm:adm:glenda,sys\nglenda:glenda:glenda:\nnone:none::\n" +
+		"sys:sys::glenda,tor\ntor:tor:tor:\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	ctl := newCtl(fs)
+	if _, err := ctl.Query("adm", []byte("users export /users")); err != nil {
+		t.Fatalf("users export: %v", err)
+	}
+	if err := fs.ImportUsers(strings.NewReader("1:tor:tor:\n")); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if _, err := fs.group.Get("glenda"); err == nil {
+		t.Fatalf("expected glenda to be removed")
+	}
+	// removed users come back only when their names are reused
+	if _, err := ctl.Query("adm", []byte("users import /users")); err == nil {
+		t.Fatalf("users import: expected error for removed users")
+	}
+	if _, err := fs.group.Get("glenda"); err == nil {
+		t.Fatalf("failed import: expected glenda to stay removed")
+	}
+	for _, uid := range []string{"glenda", "sys"} {
+		if err := fs.ReuseUser(uid); err != nil {
+			t.Fatalf("reuse %s: %v", uid, err)
+		}
+	}
+	if _, err := ctl.Query("adm", []byte("users import /users")); err != nil {
+		t.Fatalf("users import: %v", err)
+	}
+	reply, err := ctl.Query("adm", []byte("users export"))
+	if err != nil || string(reply) != expected {
+		t.Fatalf("expected %q, got %q (%v)", expected, reply, err)
+	}
+
+	for _, bad := range []string{"1:tor\n", "1:tor:tor:ken\n", "1:tor:ken:\n"} {
+		if err := fs.ImportUsers(strings.NewReader(bad)); err == nil {
+			t.Fatalf("import %q: expected error", bad)
+		}
+	}
+
+	// adm owns /adm and is kept whoever the hostowner is
+	fs = New("glenda")
+	if err := fs.ImportUsers(strings.NewReader("1:tor:tor:\n")); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	for _, uid := range []string{"none", "adm", "glenda", "tor"} {
+		if _, err := fs.group.Get(uid); err != nil {
+			t.Fatalf("import: expected user %s: %v", uid, err)
+		}
+	}
+}
+
+func TestRemoveUser(t *testing.T) {
+	fs := New("adm")
+	group := fs.group
+	for _, cmd := range []string{"uname glenda glenda", "uname sys :sys", "uname glenda +sys"} {
+		if _, err := group.WriteAt([]byte(cmd), 0); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+
+	ctl := newCtl(fs)
+	if _, err := ctl.Query("adm", []byte("users remove glenda")); err != nil {
+		t.Fatalf("users remove: %v", err)
+	}
+	if u, _ := fs.group.Get("sys"); u.isMember("glenda") {
+		t.Fatalf("glenda still member of sys")
+	}
+	if _, err := group.WriteAt([]byte("uname glenda glenda"), 0); err == nil {
+		t.Fatalf("expected reserved name to be rejected")
+	}
+	if _, err := group.WriteAt([]byte("uname glenda :glenda"), 0); err == nil {
+		t.Fatalf("expected reserved name to be rejected")
+	}
+	reply, err := ctl.Query("adm", []byte("users reserved"))
+	if err != nil || string(reply) != "glenda\n" {
+		t.Fatalf("expected reserved glenda, got %q (%v)", reply, err)
+	}
+
+	var buf bytes.Buffer
+	if err := fs.Save(&buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	restored := New("adm")
+	if err := restored.Load(&buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := restored.ReuseUser("glenda"); err != nil {
+		t.Fatalf("reuse after load: %v", err)
+	}
+
+	if _, err := ctl.Query("adm", []byte("users reuse glenda")); err != nil {
+		t.Fatalf("users reuse: %v", err)
+	}
+	if _, err := group.WriteAt([]byte("uname glenda :glenda"), 0); err != nil {
+		t.Fatalf("uname after reuse: %v", err)
+	}
+	for _, uid := range []string{"adm", "none", "ken"} {
+		if err := fs.RemoveUser(uid); err == nil {
+			t.Fatalf("remove %s: expected error", uid)
+		}
+	}
+}
+
+func TestWalkOpenFid(t *testing.T) {
+	c, fsys := newFsys(t, "adm")
+	defer c.Close()
+
+	dir, err := fsys.Open("/adm", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer dir.Close()
+	for _, name := range []string{"", "ctl", ".."} {
+		if fid, err := dir.Walk(name); err == nil {
+			fid.Close()
+			t.Fatalf("walk %q on open fid: expected error", name)
+		}
+	}
+	if _, err := fsys.Stat("/adm/ctl"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+}
+
+func TestCreateBatch(t *testing.T) {
+	fs := New("adm")
+	specs := []CreateSpec{{Name: "/src", Perm: DMDIR | 0775}}
+	for i := 0; i < 100; i++ {
+		dir := fmt.Sprintf("/src/d%d", i)
+		specs = append(specs, CreateSpec{Name: dir, Perm: DMDIR | 0775})
+		for j := 0; j < 10; j++ {
+			specs = append(specs, CreateSpec{
+				Name: fmt.Sprintf("%s/f%d", dir, j),
+				Perm: 0664,
+				Data: []byte(dir),
+			})
+		}
+	}
+	specs = append(specs, CreateSpec{Name: "/adm/batch", Perm: 0660})
+	if n, err := fs.CreateBatch(specs); n != len(specs) || err != nil {
+		t.Fatalf("create batch: %d %v", n, err)
+	}
+	n, err := fs.walk("/src/d42/f7")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if data, _ := readAll(n); string(data.blockAt(0)) != "/src/d42" {
+		t.Fatalf("unexpected data %q", data.blockAt(0))
+	}
+	if _, err := fs.walk("/adm/batch"); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+
+	used := fs.path
+	for _, bad := range [][]CreateSpec{
+		{{Name: "/new", Perm: DMDIR | 0775}, {Name: "/src/d1/f1", Perm: 0664}},
+		{{Name: "/new", Perm: DMDIR | 0775}, {Name: "/missing/f", Perm: 0664}},
+		{{Name: "/new", Perm: DMDIR | 0775}, {Name: "/new", Perm: 0664}},
+		{{Name: "/new", Perm: 0664}, {Name: "/new/f", Perm: 0664}},
+	} {
+		if n, err := fs.CreateBatch(bad); n != 1 || err == nil {
+			t.Fatalf("create batch %v: expected failure at 1, got %d %v", bad, n, err)
+		}
+		if _, err := fs.walk("/new"); err == nil {
+			t.Fatalf("failed batch created /new")
+		}
+	}
+	if fs.path > used+2 {
+		t.Fatalf("paths of failed batches not released: next path %d, was %d", fs.path, used)
+	}
+}
+
+// sliceBuffer is a Buffer keeping its data in a single slice.
+type sliceBuffer struct {
+	data []byte
+}
+
+func (b *sliceBuffer) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, b.data[offset:]), nil
+}
+
+func (b *sliceBuffer) WriteAt(p []byte, offset int64) (int, error) {
+	if end := int(offset) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[offset:], p), nil
+}
+
+func (b *sliceBuffer) Len() uint64  { return uint64(len(b.data)) }
+func (b *sliceBuffer) Close() error { return nil }
+
+func TestStorage(t *testing.T) {
+	fs := New("adm")
+	made := 0
+	newSlice := func(name string, perm Perm) Buffer {
+		made++
+		return &sliceBuffer{}
+	}
+	fs.AddStorage(StoragePolicy{Prefix: "/log/", New: newSlice})
+	fs.AddStorage(StoragePolicy{Mode: DMTMP, New: newSlice})
+	fs.AddStorage(StoragePolicy{MinSize: 8, New: newSlice})
+
+	isSlice := func(name string) bool {
+		n, err := fs.walk(name)
+		if err != nil {
+			t.Fatalf("walk %s: %v", name, err)
+		}
+		s, ok := n.file.(*storage)
+		if !ok {
+			return false
+		}
+		_, ok = s.Buffer.(*sliceBuffer)
+		return ok
+	}
+
+	dir, err := fs.Create("/log", plan9.OREAD, DMDIR|0755)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir.Close()
+	fid, err := fs.Create("/log/messages", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := fid.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	fid.Close()
+	fid, err = fs.Create("/tmpfile", plan9.OWRITE, DMTMP|0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	fid.Close()
+	for name, data := range map[string]string{"/small": "small", "/large": "large file"} {
+		if err := fs.WriteFileAtomic(name, []byte(data), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	for name, expected := range map[string]bool{
+		"/log/messages": true,
+		"/tmpfile":      true,
+		"/small":        false,
+		"/large":        true,
+	} {
+		if isSlice(name) != expected {
+			t.Fatalf("%s: expected policy storage %v", name, expected)
+		}
+	}
+	if usage := string(fs.quota.report(true)); usage != "adm 20 0\n" {
+		t.Fatalf("expected usage %q, got %q", "adm 20 0\n", usage)
+	}
+
+	if err := fs.Copy("/small", "/log/small"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if !isSlice("/log/small") {
+		t.Fatalf("copy: expected policy storage")
+	}
+
+	var buf bytes.Buffer
+	if err := fs.Save(&buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	made = 0
+	if err := fs.Load(&buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if made != 4 || !isSlice("/log/messages") {
+		t.Fatalf("load: expected 4 files in policy storage, got %d", made)
+	}
+	fid, err = fs.Open("/log/messages", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer fid.Close()
+	data := make([]byte, 16)
+	n, err := fid.ReadAt(data, 0)
+	if err != nil || string(data[:n]) != "hello" {
+		t.Fatalf("expected %q, got %q (%v)", "hello", data[:n], err)
+	}
+}
+
+// closeBuffer counts the buffers made and closed by a storage policy.
+type closeBuffer struct {
+	sliceBuffer
+	closed *int
+}
+
+func (b *closeBuffer) Close() error {
+	*b.closed++
+	return nil
+}
+
+func TestStorageClose(t *testing.T) {
+	fs := New("adm")
+	made, closed := 0, 0
+	fs.AddStorage(StoragePolicy{Prefix: "/log/", New: func(string, Perm) Buffer {
+		made++
+		return &closeBuffer{closed: &closed}
+	}})
+	dir, err := fs.Create("/log", plan9.OREAD, DMDIR|0755)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir.Close()
+
+	expect := func(what string, m, c int) {
+		t.Helper()
+		if made != m || closed != c {
+			t.Fatalf("%s: expected %d buffers made and %d closed, got %d and %d",
+				what, m, c, made, closed)
+		}
+	}
+	fid, err := fs.Create("/log/messages", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	fid.Close()
+	expect("clunk", 1, 0)
+
+	// failing creates and opens don't make buffers
+	if _, err := fs.Create("/log/messages", plan9.OWRITE, 0644); err == nil {
+		t.Fatalf("create: expected error for existing file")
+	}
+	if _, err := fs.Create("/log/messages/x", plan9.OWRITE, 0644); err == nil {
+		t.Fatalf("create: expected error for file in a file")
+	}
+	excl, err := fs.Create("/log/excl", plan9.OWRITE, DMEXCL|0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := fs.Open("/log/excl", plan9.OWRITE|plan9.OTRUNC); err == nil {
+		t.Fatalf("open: expected error for exclusive use file")
+	}
+	excl.Close()
+	expect("failing create", 2, 0)
+
+	// truncating replaces the buffer
+	fid, err = fs.Open("/log/messages", plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	expect("truncate", 3, 1)
+
+	// a removed file keeps its buffer until its last fid is clunked
+	if err := fs.Remove("/log/messages"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	expect("remove", 3, 1)
+	fid.Close()
+	expect("last clunk", 3, 2)
+}
+
+// listedFid returns the fields of the line of /adm/fids listing name.
+func listedFid(t *testing.T, fsys *client.Fsys, name string) []string {
+	fids, err := fsys.Open("/adm/fids", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer fids.Close()
+	buf := make([]byte, 8192)
+	n, err := fids.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+		elem := strings.Fields(line)
+		if len(elem) != 6 {
+			t.Fatalf("bad line %q", line)
+		}
+		if elem[5] == name {
+			return elem
+		}
+	}
+	return nil
+}
+
+func TestOpenFids(t *testing.T) {
+	c, fsys := newFsys(t, "adm")
+	defer c.Close()
+
+	f, err := fsys.Create("/fidslock", plan9.ORDWR|plan9.ORCLOSE, 0664|plan9.DMEXCL)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer f.Close()
+	elem := listedFid(t, fsys, "/fidslock")
+	if elem == nil || elem[2] != "adm" || elem[3] != "rwc" {
+		t.Fatalf("open /fidslock not listed: %v", elem)
+	}
+	if listedFid(t, fsys, "/adm/fids") == nil {
+		t.Fatalf("open /adm/fids not listed")
+	}
+}
+
+func TestConnIDs(t *testing.T) {
+	fs := New("adm")
+	// every ServeConn serves its connection by a server of its own
+	for i := 0; i < 3; i++ {
+		server, conn := net.Pipe()
+		go fs.ServeConn(server)
+		defer conn.Close()
+		if err := plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := plan9.ReadFcall(conn); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	ids := make(map[uint32]bool)
+	fs.mu.Lock()
+	for c := range fs.conns {
+		ids[c.id] = true
+	}
+	fs.mu.Unlock()
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 connection ids, got %v", ids)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	c, fsys := newFsys(t, "adm")
+	defer c.Close()
+	defer fsys.Remove("/revoked")
+
+	query := func(cmd string) string {
+		ctl, err := fsys.Open("/adm/ctl", plan9.ORDWR)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer ctl.Close()
+		if _, err := ctl.WriteAt([]byte(cmd), 0); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		buf := make([]byte, 64)
+		n, _ := ctl.ReadAt(buf, 0)
+		return string(buf[:n])
+	}
+	revoked := func(f *client.Fid) {
+		_, err := f.ReadAt(make([]byte, 8), 0)
+		if err == nil || !strings.Contains(err.Error(), "fid revoked") {
+			t.Fatalf("read on revoked fid: expected error, got %v", err)
+		}
+	}
+
+	f, err := fsys.Create("/revoked", plan9.ORDWR, 0664|plan9.DMEXCL)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer f.Close()
+	if g, err := fsys.Open("/revoked", plan9.OREAD); err == nil {
+		g.Close()
+		t.Fatalf("exclusive file opened twice")
+	}
+	if reply := query("revoke /revoked"); reply != "1\n" {
+		t.Fatalf("revoke: unexpected reply %q", reply)
+	}
+	revoked(f)
+
+	g, err := fsys.Open("/revoked", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open after revoke: %v", err)
+	}
+	defer g.Close()
+	elem := listedFid(t, fsys, "/revoked")
+	if elem == nil {
+		t.Fatalf("open /revoked not listed")
+	}
+	query("clunk " + elem[0] + " " + elem[1])
+	revoked(g)
+	if listedFid(t, fsys, "/revoked") != nil {
+		t.Fatalf("clunked fid still listed")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	c, fsys := newFsys(t, "adm")
+	if _, err := c.Auth("adm", ""); err == nil {
+		t.Fatalf("auth: expected error without authenticator")
+	}
+	fsys.Stat("/")
+	c.Close()
+
+	fs := New("adm")
+	fs.Auth = SharedSecret{"adm": "secret"}
+	addr := "localhost:15642"
+	done := make(chan error, 1)
+	go func() { done <- fs.Listen("tcp", addr) }()
+	defer func() {
+		fs.Halt()
+		<-done
+	}()
+
+	var conn *client.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = client.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Attach(nil, "adm", ""); err == nil {
+		t.Fatalf("attach: expected error without afid")
+	}
+	auth := func(uname, secret string) (*client.Fid, error) {
+		afid, err := conn.Auth(uname, "")
+		if err != nil {
+			t.Fatalf("auth: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := afid.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatalf("read challenge: %v", err)
+		}
+		_, err = afid.WriteAt([]byte(SecretResponse(secret, string(buf[:n]))), 0)
+		return afid, err
+	}
+
+	afid, err := auth("adm", "wrong")
+	if err == nil {
+		t.Fatalf("auth: expected error for wrong secret")
+	}
+	if _, err := conn.Attach(afid, "adm", ""); err == nil {
+		t.Fatalf("attach: expected error after failed authentication")
+	}
+	afid.Close()
+
+	afid, err = auth("adm", "secret")
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	defer afid.Close()
+	if _, err := conn.Attach(afid, "glenda", ""); err == nil {
+		t.Fatalf("attach: expected error for another user")
+	}
+	fsys, err = conn.Attach(afid, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, err := fsys.Stat("/adm/ctl"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	dirs, err := fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer dirs.Close()
+	entries, err := dirs.Dirreadall()
+	if err != nil {
+		t.Fatalf("dirread: %v", err)
+	}
+	for _, d := range entries {
+		if d.Mode&plan9.DMAUTH != 0 {
+			t.Fatalf("authentication file %s listed", d.Name)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	fs := New("adm")
+	fs.SessionTTL = time.Minute
+	srv, work := fs.newServer()
+	dial := func() (net.Conn, chan struct{}) {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			fs.serveConn(context.Background(), srv, work, server, nil)
+			close(done)
+		}()
+		return client, done
+	}
+	rpc := func(c net.Conn, tx *plan9.Fcall) *plan9.Fcall {
+		if err := plan9.WriteFcall(c, tx); err != nil {
+			t.Fatalf("write %v: %v", tx, err)
+		}
+		rx, err := plan9.ReadFcall(c)
+		if err != nil {
+			t.Fatalf("read reply to %v: %v", tx, err)
+		}
+		return rx
+	}
+	attach := func(c net.Conn, aname string) {
+		rpc(c, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: plan9.VERSION9P})
+		rx := rpc(c, &plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID, Uname: "adm", Aname: aname})
+		if rx.Type != plan9.Rattach {
+			t.Fatalf("attach: %v", rx)
+		}
+	}
+	open := func(c net.Conn, name string) {
+		rpc(c, &plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2})
+		rx := rpc(c, &plan9.Fcall{Type: plan9.Tcreate, Fid: 2, Name: name, Mode: plan9.ORDWR, Perm: 0664 | plan9.DMEXCL})
+		if rx.Type != plan9.Rcreate {
+			t.Fatalf("create: %v", rx)
+		}
+		rx = rpc(c, &plan9.Fcall{Type: plan9.Twrite, Fid: 2, Data: []byte("hello")})
+		if rx.Type != plan9.Rwrite {
+			t.Fatalf("write: %v", rx)
+		}
+	}
+	busy := func(name string) bool {
+		fid, err := fs.Open(name, plan9.OREAD)
+		if err != nil {
+			return true
+		}
+		fid.Close()
+		return false
+	}
+
+	c, done := dial()
+	attach(c, "!session=token")
+	open(c, "resumed")
+	c.Close()
+	<-done
+	if !busy("/resumed") {
+		t.Fatalf("fid of the lost session closed")
+	}
+
+	c, done = dial()
+	attach(c, "!snappy!session=token")
+	rx := rpc(c, &plan9.Fcall{Type: plan9.Tread, Fid: 2, Count: 64})
+	if rx.Type != plan9.Rread || string(rx.Data) != "hello" {
+		t.Fatalf("read on resumed fid: %v", rx)
+	}
+
+	// the token is in use, so this session is not resumable
+	c2, done2 := dial()
+	attach(c2, "!session=token")
+	if rx := rpc(c2, &plan9.Fcall{Type: plan9.Tread, Fid: 2, Count: 64}); rx.Type != plan9.Rerror {
+		t.Fatalf("read on fid of another session: %v", rx)
+	}
+	c2.Close()
+	<-done2
+	c.Close()
+	<-done
+
+	// without a token, the fids of a lost connection are clunked
+	c, done = dial()
+	attach(c, "")
+	open(c, "lost")
+	c.Close()
+	<-done
+	if busy("/lost") {
+		t.Fatalf("fid of a lost connection not clunked")
+	}
+
+	fs.SessionTTL = 10 * time.Millisecond
+	c, done = dial()
+	attach(c, "!session=expiring")
+	open(c, "expired")
+	c.Close()
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	if busy("/expired") {
+		t.Fatalf("fid of an expired session not clunked")
+	}
+}
+
+func TestServe(t *testing.T) {
+	fs := New("adm")
+	server, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		fs.ServeConn(server)
+		close(done)
+	}()
+	c, err := client.NewConn(conn)
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	fsys, err := c.Attach(nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if _, err := fsys.Stat("/adm/ctl"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	c.Close()
+	<-done
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- fs.Serve(ln) }()
+	if c, err = client.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, err := c.Attach(nil, "adm", ""); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	c.Close()
+	cmd := "unlisten tcp " + ln.Addr().String()
+	if _, err := newCtl(fs).Query("adm", []byte(cmd)); err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	// a listener closed behind the back of Serve ends it with an error
+	if ln, err = net.Listen("tcp", "localhost:0"); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { served <- fs.Serve(ln) }()
+	listening := func() bool {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return len(fs.listeners) > 0
+	}
+	for i := 0; i < 100 && !listening(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	ln.Close()
+	if err := <-served; err == nil {
+		t.Fatalf("serve: expected error for closed listener")
+	}
+}
+
+func TestReadOnlyUser(t *testing.T) {
+	fs := New("adm")
+	if _, err := fs.group.WriteAt([]byte("uname glenda glenda"), 0); err != nil {
+		t.Fatalf("uname: %v", err)
+	}
+	if err := fs.WriteFileAtomic("/file", []byte("data"), 0666); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	file, _ := fs.walk("/file")
+	file.dir.Mode = 0666
+	ctl := newCtl(fs)
+	if _, err := ctl.Query("adm", []byte("users readonly glenda")); err != nil {
+		t.Fatalf("users readonly: %v", err)
+	}
+	if reply, err := ctl.Query("adm", []byte("users readonly")); err != nil || string(reply) != "glenda\n" {
+		t.Fatalf("expected read-only glenda, got %q (%v)", reply, err)
+	}
+	if err := fs.SetReadOnly("adm", true); err == nil {
+		t.Fatalf("hostowner made read-only")
+	}
+
+	walk := func(name string) *Fid {
+		fid, err := fs.Attach("glenda", name)
+		if err != nil {
+			t.Fatalf("attach %s: %v", name, err)
+		}
+		return fid
+	}
+	if err := walk("file").Open(plan9.OREAD); err != nil {
+		t.Fatalf("open for reading: %v", err)
+	}
+	if err := walk("file").Open(plan9.OWRITE); err != errPerm {
+		t.Fatalf("open for writing: expected %v, got %v", errPerm, err)
+	}
+	if err := walk("/").Create("new", plan9.OWRITE, 0666); err != errPerm {
+		t.Fatalf("create: expected %v, got %v", errPerm, err)
+	}
+	if err := walk("file").Remove(); err != errPerm {
+		t.Fatalf("remove: expected %v, got %v", errPerm, err)
+	}
+	u, _ := fs.As("glenda")
+	if _, err := u.Create("/new", plan9.OWRITE, 0666); err != errPerm {
+		t.Fatalf("create as glenda: expected %v, got %v", errPerm, err)
+	}
+
+	var buf bytes.Buffer
+	if err := fs.Save(&buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	restored := New("adm")
+	if err := restored.Load(&buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !restored.group.isReadOnly("glenda") {
+		t.Fatalf("read-only user lost by save and load")
+	}
+
+	if _, err := ctl.Query("adm", []byte("users writable glenda")); err != nil {
+		t.Fatalf("users writable: %v", err)
+	}
+	if err := walk("file").Open(plan9.OWRITE); err != nil {
+		t.Fatalf("open for writing after users writable: %v", err)
+	}
+}
+
+func TestSaveWorkers(t *testing.T) {
+	fs := New("adm")
+	fs.SaveWorkers = 8
+	for i := 0; i < 10; i++ {
+		dir, err := fs.root.Create("adm", fmt.Sprintf("d%d", i), plan9.OREAD, 0775|plan9.DMDIR)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			file, err := dir.Create("adm", fmt.Sprintf("f%d", j), plan9.ORDWR, 0664)
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			data := bytes.Repeat([]byte{byte(i*10 + j)}, 1000*j)
+			if _, err := file.WriteAt(data, 0); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := fs.Save(&buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	restored := New("adm")
+	if err := restored.Load(&buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			name := fmt.Sprintf("/d%d/f%d", i, j)
+			a, err := fs.walk(name)
+			if err != nil {
+				t.Fatalf("walk: %v", err)
+			}
+			b, err := restored.walk(name)
+			if err != nil {
+				t.Fatalf("walk: %v", err)
+			}
+			if a.file.Len() != b.file.Len() || !sameBuffer(a.file, b.file) {
+				t.Fatalf("%s: data differs after load", name)
+			}
+		}
+	}
+
+	if err := fs.Save(errWriter{}); err == nil {
+		t.Fatalf("save: expected write error")
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, perror("write error") }
+
+func TestSaveConsistent(t *testing.T) {
+	fs := New("adm")
+	for _, name := range []string{"/a", "/b"} {
+		if err := fs.WriteFileAtomic(name, []byte("old"), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(fs.Save(pw)) }()
+	head := make([]byte, 1)
+	if _, err := io.ReadFull(pr, head); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// the image shows the state when the header was written
+	a, err := fs.Open("/a", plan9.OWRITE)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := a.WriteAt([]byte("new"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	a.Close()
+	if err := fs.Remove("/b"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	restored := New("adm")
+	if err := restored.Load(io.MultiReader(bytes.NewReader(head), pr)); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		fid, err := restored.Open(name, plan9.OREAD)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		data := make([]byte, 8)
+		n, err := fid.ReadAt(data, 0)
+		fid.Close()
+		if err != nil || string(data[:n]) != "old" {
+			t.Fatalf("%s: expected %q, got %q (%v)", name, "old", data[:n], err)
+		}
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	fs := New("adm")
+	fs.SweepRate = 20
+	var mu sync.Mutex
+	var runs []time.Time
+	fn := func() {
+		mu.Lock()
+		runs = append(runs, time.Now())
+		mu.Unlock()
+	}
+	a := fs.sweep.add("a", 10*time.Millisecond, fn)
+	b := fs.sweep.add("b", 10*time.Millisecond, fn)
+	c := fs.sweep.add("panic", 10*time.Millisecond, func() { panic("sweep") })
+	time.Sleep(300 * time.Millisecond)
+	fs.sweep.remove(a)
+	fs.sweep.remove(b)
+	fs.sweep.remove(c)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(runs) < 2 || len(runs) > 7 {
+		t.Fatalf("expected 2 to 7 rate limited runs, got %d", len(runs))
+	}
+	for i := 1; i < len(runs); i++ {
+		if d := runs[i].Sub(runs[i-1]); d < 45*time.Millisecond {
+			t.Fatalf("runs %v apart, expected at least 50ms", d)
+		}
+	}
+	if fs.Panics() == 0 {
+		t.Fatalf("expected panic of task to be counted")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	fs.sweep.mu.Lock()
+	running := fs.sweep.running
+	fs.sweep.mu.Unlock()
+	if running {
+		t.Fatalf("expected sweeper to stop without tasks")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	fs := New("adm")
+	server, conn := net.Pipe()
+	go fs.ServeConn(server)
+	c, err := client.NewConn(conn)
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	defer c.Close()
+	fsys, err := c.Attach(nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+
+	ctl := func(cmd string) {
+		f, err := fsys.Open("/adm/ctl", plan9.OWRITE)
+		if err != nil {
+			t.Fatalf("open ctl: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte(cmd)); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	f, err := fsys.Create("/data", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer f.Close()
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	ctl("fault short 1")
+	n, err := f.ReadAt(make([]byte, len(data)), 0)
+	if err != nil || n == 0 || n >= len(data) {
+		t.Fatalf("short read: read %d bytes of %d, %v", n, len(data), err)
+	}
+
+	ctl("fault error 1 try again")
+	if _, err := f.ReadAt(make([]byte, 10), 0); err == nil || err.Error() != "try again" {
+		t.Fatalf("read: expected injected error, got %v", err)
+	}
+	ctl("fault delay 50ms 1")
+	if got := fs.Faults(); got.Delay != 50*time.Millisecond || got.ErrorRate != 1 || got.ShortRate != 1 {
+		t.Fatalf("unexpected faults %+v", got)
+	}
+	start := time.Now()
+	ctl("fault off")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("request not delayed")
+	}
+	if _, err := f.ReadAt(make([]byte, len(data)), 0); err != nil {
+		t.Fatalf("read after fault off: %v", err)
+	}
+	if _, err := newCtl(fs).Query("adm", []byte("fault error 2")); err == nil {
+		t.Fatalf("fault error 2: expected error")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	fs := New("adm")
+	fs.SessionTTL = time.Minute // the fids are kept for the session until cleared
+	if _, err := fs.root.Create("adm", "data", plan9.OREAD, 0664); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	server, conn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		fs.ServeConn(server)
+		close(served)
+	}()
+	c, err := client.NewConn(conn)
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	defer c.Close()
+	fsys, err := c.Attach(nil, "adm", "!session=shutdown")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	f, err := fsys.Open("/data", plan9.OREAD|plan9.ORCLOSE)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := fs.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("ServeConn did not return on shutdown")
+	}
+	if _, err := fs.walk("/data"); err == nil {
+		t.Fatalf("ORCLOSE file not removed: fids not clunked")
+	}
+
+	if err := fs.Listen("tcp", "localhost:0"); err != ErrServerClosed {
+		t.Fatalf("listen: expected %q, got %v", ErrServerClosed, err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if err := fs.Serve(ln); err != ErrServerClosed {
+		t.Fatalf("serve: expected %q, got %v", ErrServerClosed, err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// fids kept for a token forgotten meanwhile are clunked
+	fid, err := fs.Open("/adm/ctl", plan9.OWRITE)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	fs.sessions.keep("forgotten", map[uint32]*Fid{1: fid}, time.Minute)
+	if fid.isOpen() {
+		t.Fatalf("fid kept for forgotten session not clunked")
+	}
+}
+
+func TestListenContext(t *testing.T) {
+	fs := New("adm")
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- fs.ListenContext(ctx, "tcp", addr) }()
+	var c *client.Conn
+	for i := 0; i < 100; i++ {
+		if c, err = client.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	fsys, err := c.Attach(nil, "adm", "")
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("listen: expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := fsys.Stat("/adm"); err == nil {
+		t.Fatalf("stat: expected error on torn down connection")
+	}
+	if _, err := newCtl(fs).Query("adm", []byte("unlisten tcp "+addr)); err == nil {
+		t.Fatalf("unlisten: listener still known after cancel")
+	}
+
+	// a request blocked by a delay is aborted when the client is gone
+	fs.SetFaults(Faults{Delay: time.Hour, DelayRate: 1})
+	server, conn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		fs.ServeConn(server)
+		close(served)
+	}()
+	tx := &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"}
+	if err := plan9.WriteFcall(conn, tx); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("delayed request not aborted on disconnect")
+	}
+}
+
+func TestScratch(t *testing.T) {
+	fs := New("adm")
+	job, err := fs.root.Create("adm", "job", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ctl := newCtl(fs)
+	for _, cmd := range []string{"scratch /job", "scratch /job on -1s", "scratch /adm/ctl on"} {
+		if _, err := ctl.Query("adm", []byte(cmd)); err == nil {
+			t.Fatalf("%s: expected error", cmd)
+		}
+	}
+	if _, err := ctl.Query("adm", []byte("scratch /job on")); err != nil {
+		t.Fatalf("scratch: %v", err)
+	}
+
+	fid := &Fid{uid: "adm", node: job}
+	if err := fid.Create("out", plan9.ORDWR, 0664); err != nil {
+		t.Fatalf("create in scratch directory: %v", err)
+	}
+	if stat := fid.node.Stat(); stat.Mode&plan9.DMTMP == 0 {
+		t.Fatalf("file in scratch directory not DMTMP: %v", stat.Mode)
+	}
+	sub, err := job.Create("adm", "sub", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !sub.scratch {
+		t.Fatalf("subdirectory of scratch directory not scratch")
+	}
+	if _, err := fs.walk("/job/out"); err != nil {
+		t.Fatalf("open scratch file removed: %v", err)
+	}
+	fid.Close()
+	if _, err := fs.walk("/job/out"); err == nil {
+		t.Fatalf("scratch file not removed on last close")
+	}
+
+	// files unchanged for the ttl and the directories left empty expire
+	if _, err := ctl.Query("adm", []byte("scratch /job on 1h")); err != nil {
+		t.Fatalf("scratch: %v", err)
+	}
+	old, err := sub.Create("adm", "old", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := job.Create("adm", "new", plan9.OREAD, 0664); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	old.dir.Mtime -= 7200
+	sub.dir.Mtime -= 7200
+	expire(job, uint32(time.Now().Add(-time.Hour).Unix()))
+	for name, exists := range map[string]bool{"/job/sub/old": false, "/job/sub": false, "/job/new": true} {
+		if _, err := fs.walk(name); (err == nil) != exists {
+			t.Fatalf("%s: exists %v after expiry, expected %v", name, err == nil, exists)
+		}
+	}
+	fs.mu.Lock()
+	scheduled := fs.scratch[job] != nil
+	fs.mu.Unlock()
+	if !scheduled {
+		t.Fatalf("expiry of scratch directory not scheduled")
+	}
+	if _, err := ctl.Query("adm", []byte("scratch /job off")); err != nil {
+		t.Fatalf("scratch off: %v", err)
+	}
+	if len(fs.scratch) != 0 {
+		t.Fatalf("expiry still scheduled after scratch off")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	fs := New("adm")
+	server, conn := net.Pipe()
+	go fs.ServeConn(server)
+	defer conn.Close()
+
+	rpc := func(tx *plan9.Fcall) *plan9.Fcall {
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return rx
+	}
+	rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tattach, Tag: 1, Fid: 0, Afid: plan9.NOFID, Uname: "adm"}); rx.Type != plan9.Rattach {
+		t.Fatalf("attach: %s", rx)
+	}
+
+	// the reply of a flushed request is never sent
+	fs.SetFaults(Faults{Delay: time.Hour, DelayRate: 1})
+	if err := plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tstat, Tag: 2, Fid: 0}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tflush, Tag: 3, Oldtag: 2}); rx.Type != plan9.Rflush || rx.Tag != 3 {
+		t.Fatalf("flush: expected Rflush tag 3, got %s", rx)
+	}
+	fs.SetFaults(Faults{})
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tstat, Tag: 2, Fid: 0}); rx.Type != plan9.Rstat || rx.Tag != 2 {
+		t.Fatalf("stat: expected Rstat tag 2, got %s", rx)
+	}
+
+	// flushing an answered request only returns Rflush
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tflush, Tag: 4, Oldtag: 2}); rx.Type != plan9.Rflush {
+		t.Fatalf("flush: expected Rflush, got %s", rx)
+	}
+	if rx := rpc(&plan9.Fcall{Type: plan9.Tclunk, Tag: 5, Fid: 0}); rx.Type != plan9.Rclunk {
+		t.Fatalf("clunk: %s", rx)
+	}
+}
+
+func TestDump(t *testing.T) {
+	fs := New("adm")
+	ctl := newCtl(fs)
+	if _, err := ctl.Query("adm", []byte("dump")); err == nil {
+		t.Fatalf("dump: expected error without dump file")
+	}
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs.DumpFile = filepath.Join(dir, "image")
+
+	n, err := fs.root.Create("adm", "data", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := n.WriteAt([]byte("dumped"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := ctl.Query("adm", []byte("dump")); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+
+	f, err := os.Open(fs.DumpFile)
+	if err != nil {
+		t.Fatalf("open image: %v", err)
+	}
+	defer f.Close()
+	restored := New("adm")
+	if err := restored.Load(f); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n, err = restored.walk("/data"); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	buf := make([]byte, 16)
+	if m, _ := n.ReadAt(buf, 0); string(buf[:m]) != "dumped" {
+		t.Fatalf("expected %q, got %q", "dumped", buf[:m])
+	}
+}
+
+func TestBulkStat(t *testing.T) {
+	fs := New("adm")
+	dir, err := fs.root.Create("adm", "dir", plan9.OREAD, 0750|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir.dir.Mode = plan9.DMDIR | 0750 // not masked by the root
+	for _, name := range []string{"b", "a", "c"} {
+		n, err := dir.Create("adm", name, plan9.OREAD, 0640)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := n.WriteAt([]byte(name+name), 0); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	ctl := newCtl(fs)
+	reply, err := ctl.Query("adm", []byte("lsdir /dir"))
+	if err != nil {
+		t.Fatalf("lsdir: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(reply), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("lsdir: expected 3 lines, got %q", reply)
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		f := strings.Fields(lines[i])
+		if len(f) != 7 || f[0] != name || f[1] != "--rw-r-----" || f[2] != "adm" || f[5] != "2" {
+			t.Fatalf("lsdir: unexpected line %q", lines[i])
+		}
+	}
+
+	if reply, err = ctl.Query("adm", []byte("stat /dir/c /dir")); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !strings.HasPrefix(string(reply), "/dir/c --rw-r----- ") ||
+		!strings.Contains(string(reply), "\n/dir d-rwxr-x--- ") {
+		t.Fatalf("stat: unexpected reply %q", reply)
+	}
+	for _, cmd := range []string{"stat /dir/x", "lsdir /dir/a"} {
+		if _, err := ctl.Query("adm", []byte(cmd)); err == nil {
+			t.Fatalf("%s: expected error", cmd)
+		}
+	}
+	for _, cmd := range []string{"stat /dir/a", "lsdir /dir"} {
+		if _, err := ctl.Query("glenda", []byte(cmd)); !strings.Contains(fmt.Sprint(err), "permission denied") {
+			t.Fatalf("%s as glenda: expected permission denied, got %v", cmd, err)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	fs := New("adm")
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "image")
+
+	n, err := fs.root.Create("adm", "data", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := n.WriteAt([]byte("saved"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	stop := fs.Checkpoint(name, 10*time.Millisecond)
+	defer stop()
+
+	var f *os.File
+	for i := 0; i < 100; i++ {
+		if f, err = os.Open(name); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("no checkpoint: %v", err)
+	}
+	defer f.Close()
+	restored := New("adm")
+	if err := restored.Load(f); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n, err = restored.walk("/data"); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	buf := make([]byte, 16)
+	if m, _ := n.ReadAt(buf, 0); string(buf[:m]) != "saved" {
+		t.Fatalf("expected %q, got %q", "saved", buf[:m])
+	}
+}
+
+func TestDial(t *testing.T) {
+	fs := New("adm")
+	ctx := context.Background()
+	fsys, err := fs.DialFsys(ctx, "adm", "")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer fsys.Conn().Close()
+
+	f, err := fsys.Create(ctx, "/data", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("piped"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f.Close()
+	n, err := fs.walk("/data")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	buf := make([]byte, 16)
+	if m, _ := n.ReadAt(buf, 0); string(buf[:m]) != "piped" {
+		t.Fatalf("expected %q, got %q", "piped", buf[:m])
+	}
+
+	fs.Close()
+	if _, err := fsys.Stat(ctx, "/data"); err == nil {
+		t.Fatalf("stat: expected error after close")
+	}
+	if _, err := fs.Dial(); err != ErrServerClosed {
+		t.Fatalf("dial: expected %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	fs := New("adm")
+	if _, err := fs.OpenFile("/data", os.O_RDONLY, 0644); err == nil {
+		t.Fatalf("open: expected error for missing file")
+	}
+	f, err := fs.OpenFile("/data", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := fs.OpenFile("/data", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		t.Fatalf("create: expected error for existing file with O_EXCL")
+	}
+	if _, err := io.Copy(f, strings.NewReader("one\ntwo\nthree\n")); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if off, err := f.Seek(-6, io.SeekEnd); err != nil || off != 8 {
+		t.Fatalf("seek: %d %v", off, err)
+	}
+	if _, err := f.Write([]byte("3")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil || strings.Join(lines, " ") != "one two 3hree" {
+		t.Fatalf("scan: %q %v", lines, err)
+	}
+
+	if err := f.Truncate(3); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	buf := make([]byte, 8)
+	if n, err := f.ReadAt(buf, 0); err != io.EOF || string(buf[:n]) != "one\x00\x00" {
+		t.Fatalf("read: %q %v", buf[:n], err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	f, err = fs.OpenFile("/data", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 0); err == nil {
+		t.Fatalf("writeat: expected error with O_APPEND")
+	}
+	if d, _ := f.Stat(); d.Length != 6 {
+		t.Fatalf("stat: expected length 6, got %d", d.Length)
+	}
+	if typ := f.ContentType(); typ != "" {
+		t.Fatalf("expected no content type, got %q", typ)
+	}
+	if err := fs.SetXattr("/data", "content-type", "text/plain"); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	if typ := f.ContentType(); typ != "text/plain" {
+		t.Fatalf("expected content type text/plain, got %q", typ)
+	}
+	f.Close()
+
+	dir, err := fs.OpenFile("/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open dir: %v", err)
+	}
+	defer dir.Close()
+	var names []string
+	for {
+		dirs, err := dir.ReadDir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(dirs) != 1 {
+			t.Fatalf("readdir: %d entries, %v", len(dirs), err)
+		}
+		names = append(names, dirs[0].Name)
+	}
+	if strings.Join(names, " ") != "adm data" {
+		t.Fatalf("readdir: unexpected entries %v", names)
+	}
+
+	if err := fs.WriteFileAtomic("/index.html", []byte("<p>"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if typ, err := fs.ContentType("/index.html"); err != nil || !strings.HasPrefix(typ, "text/html") {
+		t.Fatalf("expected content type text/html, got %q %v", typ, err)
+	}
+}
+
+func TestMountHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "old"), []byte("host data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := New("adm")
+	if err := fs.MountHost("/host", dir); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	if err := fs.MountHost("/host", dir); err == nil {
+		t.Fatalf("mount: expected error for existing name")
+	}
+	f, err := fs.OpenFile("/host/sub/old", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil || string(data) != "host data" {
+		t.Fatalf("read: %q %v", data, err)
+	}
+	if _, err := f.WriteAt([]byte("HOST"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f.Close()
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "old")); string(data) != "HOST data" {
+		t.Fatalf("host file: expected %q, got %q", "HOST data", data)
+	}
+
+	f, err = fs.OpenFile("/host/sub/new", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.Write([]byte("created"))
+	f.Close()
+	if n, err := fs.walk("/host/sub/new"); err != nil || n.Stat().Length != 7 {
+		t.Fatalf("stat: unexpected length, %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "new")); string(data) != "created" {
+		t.Fatalf("host file: expected %q, got %q", "created", data)
+	}
+
+	n, err := fs.walk("/host/sub")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	d := n.Stat()
+	d.Null()
+	d.Name = "moved"
+	if err := n.Wstat("adm", d); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "moved", "new")); string(data) != "created" {
+		t.Fatalf("host file: expected %q after rename, got %q", "created", data)
+	}
+	if err := fs.Remove("/host/moved/old"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved", "old")); !os.IsNotExist(err) {
+		t.Fatalf("host file: expected removal, got %v", err)
+	}
+	if f, err = fs.OpenFile("/host/moved/new", os.O_WRONLY|os.O_TRUNC, 0); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.Close()
+	if fi, err := os.Stat(filepath.Join(dir, "moved", "new")); err != nil || fi.Size() != 0 {
+		t.Fatalf("host file: expected truncation, got %v", err)
+	}
+
+	// files kept only in memory can't be put into host directories
+	if err := fs.WriteFileAtomic("/host/moved/new", []byte("replaced"), 0644); err == nil {
+		t.Fatalf("write: expected error in host directory")
+	}
+	if err := fs.WriteFileAtomic("/x", []byte("copied"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fs.Copy("/x", "/host/moved/x"); err == nil {
+		t.Fatalf("copy: expected error in host directory")
+	}
+	if err := fs.Clone("/adm", "/host/moved/adm"); err == nil {
+		t.Fatalf("clone: expected error in host directory")
+	}
+	if _, err := fs.CreateBatch([]CreateSpec{{Name: "/host/moved/x", Perm: 0644}}); err == nil {
+		t.Fatalf("batch: expected error in host directory")
+	}
+	// a failing create leaves no file on the host
+	fs.MaxEntries = 1
+	if _, err := fs.Create("/host/moved/stray", plan9.OWRITE, 0644); err == nil {
+		t.Fatalf("create: expected error for full directory")
+	}
+	fs.MaxEntries = 0
+	for _, name := range []string{"new", "x", "adm", "stray"} {
+		_, err := os.Stat(filepath.Join(dir, "moved", name))
+		if name == "new" && err != nil || name != "new" && !os.IsNotExist(err) {
+			t.Fatalf("host file %s: unexpected %v", name, err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "moved", "new")); len(data) != 0 {
+		t.Fatalf("host file: expected no data, got %q", data)
+	}
+}
+
+func TestCompressedImage(t *testing.T) {
+	fs := New("adm")
+	n, err := fs.root.Create("adm", "data", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := n.WriteAt(bytes.Repeat([]byte("saved"), 1000), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd} {
+		if _, err := exec.LookPath("zstd"); c == Zstd && err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		w, err := compress(&buf, c)
+		if err != nil {
+			t.Fatalf("compression %d: %v", c, err)
+		}
+		if err := fs.Save(w); err != nil {
+			t.Fatalf("compression %d: save: %v", c, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("compression %d: close: %v", c, err)
+		}
+		if c != Uncompressed && buf.Len() >= 5000 {
+			t.Errorf("compression %d: image of %d bytes", c, buf.Len())
+		}
+
+		restored := New("adm")
+		if err := restored.Load(&buf); err != nil {
+			t.Fatalf("compression %d: load: %v", c, err)
+		}
+		d, err := restored.walk("/data")
+		if err != nil {
+			t.Fatalf("compression %d: walk: %v", c, err)
+		}
+		if d.Stat().Length != 5000 {
+			t.Errorf("compression %d: length %d", c, d.Stat().Length)
+		}
+	}
+}
+
+func TestTar(t *testing.T) {
+	fs := New("adm")
+	dir, err := fs.root.Create("adm", "dir", plan9.OREAD, plan9.DMDIR|0750)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	n, err := dir.Create("adm", "file", plan9.OREAD, 0640)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := n.WriteAt([]byte("archived"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// created files get the permissions of their directory
+	dir.dir.Mode, n.dir.Mode = plan9.DMDIR|0750, 0640
+	mtime := n.Stat().Mtime
+
+	var buf bytes.Buffer
+	if err := fs.ExportTar(&buf, "/", Gzip); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), gzipMagic) {
+		t.Fatalf("archive not compressed")
+	}
+
+	restored := New("adm")
+	restored.root.Create("adm", "seed", plan9.OREAD, plan9.DMDIR|0777)
+	if err := restored.ImportTar(&buf, "/seed"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if d, err := restored.walk("/seed/dir"); err != nil || d.Stat().Mode != plan9.DMDIR|0750 {
+		t.Fatalf("dir: %v", err)
+	}
+	if n, err = restored.walk("/seed/dir/file"); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	d := n.Stat()
+	if d.Mode != 0640 || d.Mtime != mtime || d.Length != 8 {
+		t.Errorf("expected mode 0640, mtime %d, length 8, got %v", mtime, d)
+	}
+	p := make([]byte, 16)
+	if m, _ := n.ReadAt(p, 0); string(p[:m]) != "archived" {
+		t.Errorf("expected %q, got %q", "archived", p[:m])
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	fs := New("adm")
+	fs.AccessInterval = time.Hour
+	var mu sync.Mutex
+	var traced int
+	fs.Log = func(format string, v ...interface{}) {
+		if strings.HasPrefix(format, "->") {
+			mu.Lock()
+			traced++
+			mu.Unlock()
+		}
+	}
+	fs.LogSample = 4
+
+	ctx := context.Background()
+	fsys, err := fs.DialFsys(ctx, "adm", "")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	f, err := fsys.Create(ctx, "/counted", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := f.WriteAt([]byte("data"), int64(4*i)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	f.Close()
+	fsys.Conn().Close()
+
+	fs.access.rotate()
+	n, err := fs.walk("/adm/access")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	buf := make([]byte, 8192)
+	m, err := n.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(buf[:m]), "write adm 3 0 12 /counted\n") {
+		t.Errorf("writes not counted:\n%s", buf[:m])
+	}
+
+	// version, attach, walk, create, 3 writes, clunk
+	mu.Lock()
+	defer mu.Unlock()
+	if traced != 2 {
+		t.Errorf("expected 2 of 8 requests traced, got %d", traced)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	fs := New("adm")
+	var mu sync.Mutex
+	var events []string
+	event := func(format string, v ...interface{}) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, v...))
+		mu.Unlock()
+	}
+	err := fs.SetHooks("", &Hooks{
+		OnCreate: func(path, uid string) { event("create %s %s", path, uid) },
+		OnRemove: func(path, uid string) { event("remove %s %s", path, uid) },
+		OnWrite: func(path, uid string, offset int64, n int) {
+			event("write %s %s %d %d", path, uid, offset, n)
+		},
+		OnAttach: func(uid, aname string) { event("attach %s %q", uid, aname) },
+	})
+	if err != nil {
+		t.Fatalf("set hooks: %v", err)
+	}
+	if err := fs.SetHooks("missing", &Hooks{}); err == nil {
+		t.Fatalf("set hooks: expected error for unknown tree")
+	}
+
+	ctx := context.Background()
+	fsys, err := fs.DialFsys(ctx, "adm", "")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer fsys.Conn().Close()
+	f, err := fsys.Create(ctx, "/hooked", plan9.OWRITE, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f.Close()
+	if err := fsys.Remove(ctx, "/hooked"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	if err := fs.WriteFileAtomic("/atomic", []byte("new"), 0644); err != nil {
+		t.Fatalf("write atomic: %v", err)
+	}
+	if err := fs.WriteFileAtomic("/atomic", []byte("newer"), 0644); err != nil {
+		t.Fatalf("write atomic: %v", err)
+	}
+	specs := []CreateSpec{
+		{Name: "/batch", Perm: DMDIR | 0775},
+		{Name: "/batch/file", Perm: 0644, Data: []byte("ab")},
+	}
+	if _, err := fs.CreateBatch(specs); err != nil {
+		t.Fatalf("create batch: %v", err)
+	}
+	if err := fs.Copy("/batch/file", "/copy"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := fs.RemoveAll("/batch"); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+
+	want := []string{
+		`attach adm ""`,
+		"create /hooked adm",
+		"write /hooked adm 0 4",
+		"remove /hooked adm",
+		"create /atomic adm",
+		"write /atomic adm 0 3",
+		"write /atomic adm 0 5",
+		"create /batch adm",
+		"create /batch/file adm",
+		"write /batch/file adm 0 2",
+		"create /copy adm",
+		"write /copy adm 0 2",
+		"remove /batch/file adm",
+		"remove /batch adm",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(events, "\n"))
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	fs := New("adm")
+	if err := fs.WriteFileAtomic("/index", []byte("old"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	made, closed := 0, 0
+	fs.AddStorage(StoragePolicy{Prefix: "/pub/", New: func(string, Perm) Buffer {
+		made++
+		return &closeBuffer{closed: &closed}
+	}})
+	var events []string
+	fs.SetHooks("", &Hooks{
+		OnCreate: func(path, uid string) { events = append(events, "create "+path) },
+		OnRemove: func(path, uid string) { events = append(events, "remove "+path) },
+	})
+	ctl, err := fs.Open("/adm/ctl", plan9.ORDWR)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer ctl.Close()
+	run := func(cmds ...string) error {
+		for _, cmd := range cmds {
+			if _, err := ctl.WriteAt([]byte(cmd), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	exists := func(name string) bool {
+		_, err := fs.walk(name)
+		return err == nil
+	}
+
+	if err := run("commit"); err == nil {
+		t.Fatalf("commit: expected error without transaction")
+	}
+	if err := run("begin", "mkdir /pub 0755", "create /pub/index.new 0644", "du /pub"); err == nil {
+		t.Fatalf("expected error for du in transaction")
+	}
+	if exists("/pub") {
+		t.Fatalf("transaction applied before commit")
+	}
+	if err := run("commit"); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if !exists("/pub/index.new") {
+		t.Fatalf("transaction not applied")
+	}
+
+	// A failing change discards the whole transaction.
+	err = run("begin", "remove /index", "rename /pub/index.new index", "remove /missing", "commit")
+	if err == nil {
+		t.Fatalf("commit: expected error for missing file")
+	}
+	if !exists("/index") || !exists("/pub/index.new") || exists("/pub/index") {
+		t.Fatalf("failed transaction applied")
+	}
+	err = run("begin", "create /pub/tmp 0644", "remove /missing", "commit")
+	if err == nil || made != 1 || closed != 0 {
+		t.Fatalf("failed transaction: %d buffers made, %d closed (%v)", made, closed, err)
+	}
+
+	err = run("begin", "remove /index", "rename /pub/index.new index", "remove /pub", "commit")
+	if err == nil {
+		t.Fatalf("commit: expected error for non-empty directory")
+	}
+	if err := run("begin", "remove /index", "rename /pub/index.new index", "commit"); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if exists("/index") || exists("/pub/index.new") || !exists("/pub/index") {
+		t.Fatalf("transaction not applied")
+	}
+	if err := run("begin", "remove /pub/index", "abort"); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	if !exists("/pub/index") {
+		t.Fatalf("aborted transaction applied")
+	}
+
+	// hooks fire for the applied creates and removes
+	if err := run("begin", "create /pub/tmp 0644", "remove /pub/tmp", "commit"); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	want := "create /pub\ncreate /pub/index.new\nremove /index"
+	if got := strings.Join(events, "\n"); got != want {
+		t.Fatalf("expected events\n%s\ngot\n%s", want, got)
+	}
+}
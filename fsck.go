@@ -0,0 +1,309 @@
+package ramfs
+
+import (
+	"fmt"
+	"sort"
+
+	"9fans.net/go/plan9"
+)
+
+// A Problem is an inconsistency of the file server found by Check.
+type Problem struct {
+	Path     string // of the file, prefixed like the Dirs of a MemoryReport; empty for the group database and quotas
+	Message  string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Check validates the invariants of all file trees, the group database
+// and the quotas, and returns the inconsistencies found: parent pointers
+// and names of entries not matching their directory, files linked twice,
+// duplicate or unallocated qid paths, lengths not matching the file data,
+// users and groups of files or groups that don't exist, and group usage
+// not matching the files. Changes wait while Check runs, so it sees a
+// consistent snapshot. If repair is set, the inconsistencies are fixed:
+// files linked twice are unlinked from all but the first directory,
+// files get new qid paths, unknown owners are replaced by the hostowner
+// and unknown groups by the group of the directory.
+func (fs *FS) Check(repair bool) []Problem {
+	fs.frozen.Lock()
+	defer fs.frozen.Unlock()
+
+	c := &fsck{
+		fs:     fs,
+		repair: repair,
+		seen:   make(map[*node]string),
+		paths:  make(map[uint64]string),
+		usage:  make(map[string]uint64),
+	}
+	c.groups()
+
+	fs.mu.Lock()
+	trees := map[string]*node{"": fs.root}
+	for name, root := range fs.trees {
+		trees[name] = root
+	}
+	fs.mu.Unlock()
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prefix := ""
+		if name != "" {
+			prefix = name + ":"
+		}
+		root := trees[name]
+		if root.parent != root {
+			c.report(prefix+"/", "root not its own parent")
+			if repair {
+				root.parent = root
+			}
+		}
+		c.node(root, prefix+"/", "")
+	}
+	c.quotas()
+	return c.problems
+}
+
+// fsck holds the state of a Check.
+type fsck struct {
+	fs       *FS
+	repair   bool
+	seen     map[*node]string // path of each file visited
+	paths    map[uint64]string
+	usage    map[string]uint64 // of stored file data by group
+	problems []Problem
+}
+
+func (c *fsck) report(path, format string, v ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Path:     path,
+		Message:  fmt.Sprintf(format, v...),
+		Repaired: c.repair,
+	})
+}
+
+// known reports whether uid is a user, or a removed one whose name is
+// reserved for the files it owned.
+func (c *fsck) known(uid string) bool {
+	g := c.fs.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.groupmap.Exist(uid) || g.reserved[uid]
+}
+
+// groups checks that the leaders and members of all groups exist.
+func (c *fsck) groups() {
+	g := c.fs.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	names := make([]string, 0, len(g.groupmap))
+	for name := range g.groupmap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := g.groupmap[name]
+		if u.Leader != "" && !g.groupmap.Exist(u.Leader) {
+			c.report("", "leader %s of group %s not found", u.Leader, name)
+			if c.repair {
+				u.Leader = ""
+				g.groupmap[name] = u
+			}
+		}
+		members := make([]string, 0, len(u.Member))
+		for m := range u.Member {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		for _, m := range members {
+			if !g.groupmap.Exist(m) {
+				c.report("", "member %s of group %s not found", m, name)
+				if c.repair {
+					delete(u.Member, m)
+				}
+			}
+		}
+	}
+}
+
+// node checks n, the file name whose directory has the group gid, and
+// the files below it.
+func (c *fsck) node(n *node, name, gid string) {
+	c.seen[n] = name
+	c.qid(n, name)
+
+	n.mu.Lock()
+	for _, owner := range []*string{&n.dir.Uid, &n.dir.Muid} {
+		if !c.known(*owner) {
+			c.report(name, "user %s not found", *owner)
+			if c.repair {
+				*owner = c.fs.hostowner
+			}
+		}
+	}
+	if !c.known(n.dir.Gid) {
+		c.report(name, "group %s not found", n.dir.Gid)
+		if c.repair && gid != "" {
+			n.dir.Gid = gid
+		}
+	}
+	if n.dir.Mode&plan9.DMDIR == 0 {
+		c.data(n, name)
+		n.mu.Unlock()
+		return
+	}
+
+	var children []*node
+	names := n.sortNames()
+	for _, elem := range names {
+		child := n.children[elem]
+		cname := childPath(name, elem)
+		if first, found := c.seen[child]; found {
+			c.report(cname, "also linked as %s", first)
+			if c.repair {
+				n.unlink(elem)
+			}
+			continue
+		}
+		if child.parent != n {
+			c.report(cname, "parent is not its directory")
+			if c.repair {
+				child.parent = n
+			}
+		}
+		if child.dir.Name != elem {
+			c.report(cname, "named %s", child.dir.Name)
+			if c.repair {
+				child.mu.Lock()
+				child.dir.Name = elem
+				child.mu.Unlock()
+			}
+		}
+		c.seen[child] = cname
+		children = append(children, child)
+	}
+	if n.index != nil && fmt.Sprint(n.index) != fmt.Sprint(n.sortNames()) {
+		c.report(name, "directory index out of order")
+		if c.repair {
+			n.index = n.sortNames()
+		}
+	}
+	dirgid := n.dir.Gid
+	n.mu.Unlock()
+
+	for _, child := range children {
+		c.node(child, c.seen[child], dirgid)
+	}
+}
+
+// qid checks that the qid path of n is allocated and unique.
+func (c *fsck) qid(n *node, name string) {
+	fs := c.fs
+	n.mu.RLock()
+	qpath := n.dir.Qid.Path
+	n.mu.RUnlock()
+
+	fs.mu.Lock()
+	free, allocated := fs.pathmap[qpath], qpath < fs.path
+	if free && c.repair {
+		delete(fs.pathmap, qpath)
+	}
+	fs.mu.Unlock()
+
+	first, dup := c.paths[qpath]
+	switch {
+	case dup:
+		c.report(name, "qid path %d also used by %s", qpath, first)
+	case !allocated:
+		c.report(name, "qid path %d not allocated", qpath)
+	case free:
+		c.report(name, "qid path %d in use and free", qpath)
+		c.paths[qpath] = name
+		return
+	default:
+		c.paths[qpath] = name
+		return
+	}
+	if !c.repair {
+		return
+	}
+	qpath, err := fs.newPath()
+	if err != nil {
+		c.report(name, "no qid path to repair: %v", err)
+		return
+	}
+	n.mu.Lock()
+	n.dir.Qid.Path = qpath
+	n.mu.Unlock()
+	c.paths[qpath] = name
+}
+
+// data checks the length of the file n against its data and accounts
+// it to its group. The caller holds n.mu.
+func (c *fsck) data(n *node, name string) {
+	if !stored(n.file) {
+		return
+	}
+	if f, ok := n.file.(*file); ok {
+		size := uint64(len(f.inline))
+		if f.block != nil {
+			size = 0
+			for _, b := range f.block {
+				size += uint64(len(b))
+			}
+		}
+		if size != f.size {
+			c.report(name, "size %d, but %d bytes of data", f.size, size)
+			if c.repair {
+				f.size = size
+			}
+		}
+	}
+	if size := n.file.Len(); n.dir.Length != size {
+		c.report(name, "length %d, but %d bytes of data", n.dir.Length, size)
+		if c.repair {
+			n.dir.Length = size
+		}
+	}
+	c.usage[n.dir.Gid] += n.dir.Length
+}
+
+// quotas checks the usage of all groups against the files.
+func (c *fsck) quotas() {
+	q := c.fs.quota
+	q.mu.Lock()
+	gids := make(map[string]bool)
+	for gid := range q.usage {
+		gids[gid] = true
+	}
+	for gid := range c.usage {
+		gids[gid] = true
+	}
+	names := make([]string, 0, len(gids))
+	for gid := range gids {
+		names = append(names, gid)
+	}
+	sort.Strings(names)
+	for _, gid := range names {
+		if q.usage[gid] != c.usage[gid] {
+			c.report("", "usage of group %s %d, but %d bytes of files", gid, q.usage[gid], c.usage[gid])
+		}
+	}
+	q.mu.Unlock()
+	if c.repair && len(names) > 0 {
+		q.recount(c.fs)
+	}
+}
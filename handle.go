@@ -0,0 +1,221 @@
+package ramfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"9fans.net/go/plan9"
+)
+
+// File is a file opened by OpenFile. Like an *os.File it keeps a file
+// offset, so it can be used with io.Copy, bufio and the like. A File is
+// safe for concurrent use.
+type File struct {
+	fid    *Fid
+	name   string
+	append bool
+
+	mu     sync.Mutex
+	offset int64
+	dirs   []*plan9.Dir // entries not yet returned by ReadDir
+	listed bool         // dirs holds the directory entries
+}
+
+// OpenFile opens the file name like os.OpenFile. The flag is O_RDONLY,
+// O_WRONLY or O_RDWR, optionally or'ed with O_CREATE, O_EXCL, O_TRUNC
+// and O_APPEND of package os. A file is created with perm as described
+// by Create.
+func (u *UserFS) OpenFile(name string, flag int, perm Perm) (*File, error) {
+	name = path.Clean(name)
+	mode := uint8(plan9.OREAD)
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		mode = plan9.OWRITE
+	case os.O_RDWR:
+		mode = plan9.ORDWR
+	}
+	if flag&os.O_TRUNC != 0 {
+		mode |= plan9.OTRUNC
+	}
+
+	var fid *Fid
+	_, err := u.walk(name)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, perror("file exists")
+	case err != nil && flag&os.O_CREATE != 0:
+		fid, err = u.Create(name, mode, perm)
+	default:
+		fid, err = u.Open(name, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &File{fid: fid, name: name, append: flag&os.O_APPEND != 0}, nil
+}
+
+// OpenFile opens the file name as the hostowner, see UserFS.OpenFile.
+func (fs *FS) OpenFile(name string, flag int, perm Perm) (*File, error) {
+	u, err := fs.As(fs.hostowner)
+	if err != nil {
+		return nil, err
+	}
+	return u.OpenFile(name, flag, perm)
+}
+
+// Name returns the name the file was opened with.
+func (f *File) Name() string { return f.name }
+
+// Read reads up to len(p) bytes at the file offset and advances it. At
+// the end of the file, Read returns 0, io.EOF.
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at offset off. It returns io.EOF if the file
+// ends before.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	n, err := f.fid.ReadAt(p, off)
+	if err == nil && n == 0 && len(p) > 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write writes p at the file offset and advances it. If the file was
+// opened with O_APPEND, p is written at the end of the file.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.append {
+		f.offset = int64(f.fid.node.Stat().Length)
+	}
+	n, err := f.fid.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes p at offset off. It is an error for a file opened with
+// O_APPEND.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if f.append {
+		return 0, perror("WriteAt of file opened with O_APPEND")
+	}
+	return f.fid.WriteAt(p, off)
+}
+
+// Seek sets the file offset for the next Read or Write to offset,
+// interpreted according to whence as by io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.fid.node.Stat().Length)
+	case io.SeekStart:
+	default:
+		return f.offset, perror("invalid whence")
+	}
+	if offset < 0 {
+		return f.offset, perror("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir returns the next n entries of the directory, like
+// os.File.ReadDir. If n <= 0, it returns all remaining entries.
+func (f *File) ReadDir(n int) ([]*plan9.Dir, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.listed {
+		dirs, err := f.readdir()
+		if err != nil {
+			return nil, err
+		}
+		f.dirs, f.listed = dirs, true
+	}
+	if n <= 0 || n > len(f.dirs) {
+		if n > 0 && len(f.dirs) == 0 {
+			return nil, io.EOF
+		}
+		n = len(f.dirs)
+	}
+	dirs := f.dirs[:n:n]
+	f.dirs = f.dirs[n:]
+	return dirs, nil
+}
+
+func (f *File) readdir() ([]*plan9.Dir, error) {
+	if !f.fid.isOpen() {
+		return nil, perror("file not open for I/O")
+	}
+	if !f.fid.canRead() {
+		return nil, perror("file not open for reading")
+	}
+	data, err := f.fid.node.Readdir()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []*plan9.Dir
+	for len(data) > 0 {
+		size := int(data[0]) | int(data[1])<<8 + 2
+		d, err := plan9.UnmarshalDir(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, d)
+		data = data[size:]
+	}
+	return dirs, nil
+}
+
+// Stat returns a copy of the directory entry of the file.
+func (f *File) Stat() (*plan9.Dir, error) {
+	dir := *f.fid.node.Stat()
+	return &dir, nil
+}
+
+// ContentType returns the media type of the file for front ends serving
+// it over HTTP or WebDAV, e.g. in a Content-Type header: the value of
+// its content-type extended attribute if set, otherwise the type
+// registered for the extension of its name with package mime, or "" if
+// it is unknown.
+func (f *File) ContentType() string {
+	return f.fid.node.contentType()
+}
+
+// Truncate changes the length of the file, which must be opened for
+// writing. The file offset is unchanged.
+func (f *File) Truncate(size int64) error {
+	return f.fid.truncate(size)
+}
+
+// Sync returns nil; the data is kept in memory only.
+func (f *File) Sync() error {
+	if !f.fid.isOpen() {
+		return perror("file not open for I/O")
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return f.fid.Close()
+}
@@ -0,0 +1,66 @@
+package ramfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// health is the synthetic file /adm/health. Reading it reports whether
+// the file server is accepting connections and within its memory limit.
+type health struct {
+	fs *FS
+}
+
+func newHealth(fs *FS) *health { return &health{fs: fs} }
+
+func (f *health) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, perror("negative offset")
+	}
+
+	data := f.fs.health()
+	if offset > int64(len(data)) {
+		return 0, io.EOF
+	}
+	return copy(p, data[offset:]), nil
+}
+
+func (f *health) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, perror("writing health file")
+}
+
+func (f *health) Len() uint64  { return uint64(0) }
+func (f *health) Close() error { return nil }
+
+// memory returns the number of bytes of file data held by all trees.
+func (fs *FS) memory() uint64 {
+	size := uint64(0)
+	for _, root := range fs.roots() {
+		each(root, func(n *node) {
+			n.mu.RLock()
+			if stored(n.file) {
+				size += n.dir.Length
+			}
+			n.mu.RUnlock()
+		})
+	}
+	return size
+}
+
+// health reports the state of the file server. It is ready if at least
+// one listener accepts connections and the file data does not exceed
+// MemoryLimit.
+func (fs *FS) health() []byte {
+	fs.mu.Lock()
+	listeners := len(fs.listeners)
+	fs.mu.Unlock()
+
+	memory := fs.memory()
+	ready := listeners > 0 && (fs.MemoryLimit == 0 || memory <= fs.MemoryLimit)
+	status := "ready"
+	if !ready {
+		status = "unready"
+	}
+	return []byte(fmt.Sprintf("%s listeners %d memory %d limit %d\n",
+		status, listeners, memory, fs.MemoryLimit))
+}
@@ -0,0 +1,89 @@
+package ramfs
+
+import (
+	"path"
+)
+
+// Hooks are called after the files of a tree were changed through a
+// connection or a UserFS handle, so a program embedding the file server
+// can react to the changes, e.g. start a build when a file below /src
+// is written, without polling. The paths are relative to the root of
+// the tree. The hooks are called by the goroutine serving the request
+// before the reply is sent, with no locks held, so they should return
+// quickly. Nil hooks are skipped.
+//
+// The methods of FS and the ctl commands changing files call the hooks
+// too: WriteFileAtomic, CreateBatch, Copy and Clone call OnCreate for
+// every new file and OnWrite for the data written, and RemoveAll calls
+// OnRemove for every file removed. A file replaced by WriteFileAtomic
+// is reported as written only. Renames, Load and ImportTar call no
+// hooks.
+type Hooks struct {
+	OnCreate func(path, uid string)
+	OnRemove func(path, uid string)
+	OnWrite  func(path, uid string, offset int64, n int)
+	OnAttach func(uid, aname string)
+}
+
+// SetHooks sets the hooks of the tree selected by the aname tree, the
+// empty string for the main tree, replacing the previous ones. Nil
+// removes the hooks.
+func (fs *FS) SetHooks(tree string, h *Hooks) error {
+	tree = path.Clean("/" + tree)[1:]
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, found := fs.trees[tree]; tree != "" && !found {
+		return perror("tree " + tree + " not found")
+	}
+	hooks := make(map[string]*Hooks)
+	if m, ok := fs.hooks.Load().(map[string]*Hooks); ok {
+		for name, h := range m {
+			hooks[name] = h
+		}
+	}
+	if h == nil {
+		delete(hooks, tree)
+	} else {
+		hooks[tree] = h
+	}
+	fs.hooks.Store(hooks)
+	return nil
+}
+
+// hooksOf returns the hooks of the tree of n, or nil.
+func (fs *FS) hooksOf(n *node) *Hooks {
+	hooks, _ := fs.hooks.Load().(map[string]*Hooks)
+	if len(hooks) == 0 {
+		return nil
+	}
+	for n.parent != nil && n.parent != n {
+		n = n.parent
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if n == fs.root {
+		return hooks[""]
+	}
+	for name, root := range fs.trees {
+		if root == n {
+			return hooks[name]
+		}
+	}
+	return nil
+}
+
+// created calls the OnCreate hook for the file n created by uid and, if
+// it was created with size bytes of data, the OnWrite hook.
+func (fs *FS) created(n *node, uid string, size uint64) {
+	h := fs.hooksOf(n)
+	if h == nil {
+		return
+	}
+	name := n.path()
+	if h.OnCreate != nil {
+		h.OnCreate(name, uid)
+	}
+	if size > 0 && h.OnWrite != nil {
+		h.OnWrite(name, uid, 0, int(size))
+	}
+}
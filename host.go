@@ -0,0 +1,263 @@
+package ramfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+// MountHost serves the host directory hostdir read/write as the new
+// directory name of the main tree, owned by the hostowner, like
+// exportfs. Files and directories created, removed, renamed or chmoded
+// below name are created, removed, renamed or chmoded on the host, and
+// the data of the files is read from and written to the host files
+// directly, so it is neither kept in memory nor charged to the quotas,
+// saved in images or kept in snapshots.
+//
+// The host directory is scanned once: files created on the host by
+// other programs later are not seen. Symbolic links and special files
+// are skipped.
+func (fs *FS) MountHost(name, hostdir string) error {
+	hostdir, err := filepath.Abs(hostdir)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(hostdir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return perror("not a directory")
+	}
+	name = path.Clean(name)
+	parent, err := fs.walk(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if parent.hostPath() != "" {
+		return perror("mount inside a host directory")
+	}
+	if _, err := fs.walk(name); err == nil {
+		return perror("file exists")
+	}
+
+	n, err := parent.Create(fs.hostowner, path.Base(name), plan9.OREAD, plan9.DMDIR|plan9.Perm(fi.Mode().Perm()))
+	if err != nil {
+		return err
+	}
+	fs.hostmu.Lock()
+	n.host = hostdir
+	fs.hostmu.Unlock()
+	return fs.scanHost(n, hostdir)
+}
+
+// scanHost adds the files of the host directory hostdir to dir.
+func (fs *FS) scanHost(dir *node, hostdir string) error {
+	infos, err := ioutil.ReadDir(hostdir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		perm := plan9.Perm(fi.Mode().Perm())
+		switch {
+		case fi.IsDir():
+			perm |= plan9.DMDIR
+		case !fi.Mode().IsRegular():
+			continue
+		}
+		if fs.checkName(fi.Name()) != nil {
+			continue
+		}
+		n, err := dir.Create(fs.hostowner, fi.Name(), plan9.OREAD, perm)
+		if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.dir.Mtime = uint32(fi.ModTime().Unix())
+		n.mu.Unlock()
+		if fi.IsDir() {
+			if err := fs.scanHost(n, filepath.Join(hostdir, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hostPath returns the path on the host of a file served by MountHost,
+// or "" if n is kept in memory.
+func (n *node) hostPath() string {
+	n.fs.hostmu.RLock()
+	defer n.fs.hostmu.RUnlock()
+	return n.host
+}
+
+// hostChild returns the path on the host of the new file name in the
+// directory n, or "" if n is kept in memory.
+func (n *node) hostChild(name string) string {
+	if host := n.hostPath(); host != "" {
+		return filepath.Join(host, name)
+	}
+	return ""
+}
+
+// isMount reports whether n is the directory a host directory is
+// mounted on, which itself only exists in memory.
+func (n *node) isMount() bool {
+	return n.parent.hostPath() == ""
+}
+
+// createHost creates the file or directory host and returns its
+// Buffer. An existing file of the same kind is served as is.
+func createHost(host string, perm plan9.Perm) (Buffer, error) {
+	isDir := perm&plan9.DMDIR != 0
+	if fi, err := os.Lstat(host); err == nil {
+		if fi.IsDir() != isDir || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			return nil, perror("file exists")
+		}
+	} else if isDir {
+		if err := os.Mkdir(host, os.FileMode(perm&0777)); err != nil {
+			return nil, hostError(err)
+		}
+	} else {
+		f, err := os.OpenFile(host, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(perm&0777))
+		if err != nil {
+			return nil, hostError(err)
+		}
+		f.Close()
+	}
+	if isDir {
+		return nil, nil
+	}
+	return &hostFile{}, nil
+}
+
+// wstatHost applies the changes of the mode, times and name of n to the
+// host file host.
+func (n *node) wstatHost(host string, cur, dir *plan9.Dir) error {
+	if n.isMount() {
+		return nil
+	}
+	if dir.Mode != 0xFFFFFFFF && dir.Mode&0777 != cur.Mode&0777 {
+		if err := os.Chmod(host, os.FileMode(dir.Mode&0777)); err != nil {
+			return hostError(err)
+		}
+	}
+	mtime, atime := cur.Mtime, cur.Atime
+	if dir.Mtime != ^uint32(0) {
+		mtime = dir.Mtime
+	}
+	if dir.Atime != ^uint32(0) {
+		atime = dir.Atime
+	}
+	if mtime != cur.Mtime || atime != cur.Atime {
+		if err := os.Chtimes(host, time.Unix(int64(atime), 0), time.Unix(int64(mtime), 0)); err != nil {
+			return hostError(err)
+		}
+	}
+	if dir.Name == "" || dir.Name == cur.Name {
+		return nil
+	}
+	to := filepath.Join(filepath.Dir(host), dir.Name)
+	if _, err := os.Lstat(to); err == nil {
+		return perror("file exists")
+	}
+	if err := os.Rename(host, to); err != nil {
+		return hostError(err)
+	}
+
+	var nodes []*node
+	each(n, func(c *node) { nodes = append(nodes, c) })
+	n.fs.hostmu.Lock()
+	for _, c := range nodes {
+		c.host = to + strings.TrimPrefix(c.host, host)
+	}
+	n.fs.hostmu.Unlock()
+	return nil
+}
+
+// removeHost removes the host file of n, if any.
+func (n *node) removeHost() error {
+	host := n.hostPath()
+	if host == "" || n.isMount() {
+		return nil
+	}
+	if err := os.Remove(host); err != nil && !os.IsNotExist(err) {
+		return hostError(err)
+	}
+	return nil
+}
+
+// hostError returns the error of a host file operation without the
+// path on the host.
+func hostError(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	return perror(err.Error())
+}
+
+// hostFile is the Buffer of a file served by MountHost. Every access
+// opens the host file, so no descriptors are held for idle files.
+type hostFile struct {
+	n *node
+}
+
+func (h *hostFile) ReadAt(p []byte, offset int64) (int, error) {
+	f, err := os.Open(h.n.hostPath())
+	if err != nil {
+		return 0, hostError(err)
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, offset)
+	if err == io.EOF {
+		if fi, e := f.Stat(); n > 0 || (e == nil && offset == fi.Size()) {
+			err = nil
+		}
+	}
+	if err != nil && err != io.EOF {
+		err = hostError(err)
+	}
+	return n, err
+}
+
+func (h *hostFile) WriteAt(p []byte, offset int64) (int, error) {
+	f, err := os.OpenFile(h.n.hostPath(), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, hostError(err)
+	}
+	n, err := f.WriteAt(p, offset)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return n, hostError(err)
+	}
+	return n, nil
+}
+
+func (h *hostFile) Len() uint64 {
+	fi, err := os.Stat(h.n.hostPath())
+	if err != nil {
+		return 0
+	}
+	return uint64(fi.Size())
+}
+
+func (h *hostFile) Close() error { return nil }
+
+func (h *hostFile) truncate(size uint64) error {
+	if err := os.Truncate(h.n.hostPath(), int64(size)); err != nil {
+		return hostError(err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package ramfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The states of a limit in /adm/stats and in limit warnings.
+const (
+	limitOK       = "ok"
+	limitWarning  = "warning"  // the usage crossed FS.SoftLimit percent
+	limitExceeded = "exceeded" // the usage is above the limit
+)
+
+// limitEvent is a change of the state of a limit.
+type limitEvent struct {
+	name         string // "memory" or "quota gid"
+	state        string
+	usage, limit uint64
+}
+
+// limitState returns the state of usage against limit with the soft
+// limit at soft percent of it.
+func limitState(usage, limit uint64, soft int) string {
+	switch {
+	case limit == 0:
+		return limitOK
+	case usage > limit:
+		return limitExceeded
+	case soft > 0 && usage*100 >= limit*uint64(soft):
+		return limitWarning
+	}
+	return limitOK
+}
+
+// transition records the state of the limit name and returns the event
+// if it changed. The caller holds q.mu.
+func (q *quotas) transition(events []limitEvent, name string, usage, limit uint64) []limitEvent {
+	state := limitState(usage, limit, q.fs.SoftLimit)
+	prev := q.state[name]
+	if prev == "" {
+		prev = limitOK
+	}
+	if state == prev {
+		return events
+	}
+	if state == limitOK {
+		delete(q.state, name)
+	} else {
+		q.state[name] = state
+	}
+	return append(events, limitEvent{name, state, usage, limit})
+}
+
+// check returns the changes of the memory limit and the quota of gid.
+// The caller holds q.mu.
+func (q *quotas) check(gid string) []limitEvent {
+	events := q.transition(nil, "memory", q.total, q.fs.MemoryLimit)
+	return q.transition(events, "quota "+gid, q.usage[gid], q.limit[gid])
+}
+
+// checkAll returns the changes of all limits. The caller holds q.mu.
+func (q *quotas) checkAll() []limitEvent {
+	gids := make(map[string]bool)
+	for gid := range q.limit {
+		gids[gid] = true
+	}
+	for name := range q.state {
+		if strings.HasPrefix(name, "quota ") {
+			gids[name[len("quota "):]] = true
+		}
+	}
+	events := q.transition(nil, "memory", q.total, q.fs.MemoryLimit)
+	for gid := range gids {
+		events = q.transition(events, "quota "+gid, q.usage[gid], q.limit[gid])
+	}
+	return events
+}
+
+// warn reports the changes of the limits to LimitWarning, or logs them
+// if it is nil.
+func (fs *FS) warn(events []limitEvent) {
+	for _, e := range events {
+		if fs.LimitWarning != nil {
+			fs.LimitWarning(e.name, e.state, e.usage, e.limit)
+		} else {
+			fs.logf("%s %s: usage %d limit %d", e.name, e.state, e.usage, e.limit)
+		}
+	}
+}
+
+// stats returns a line "name usage limit state" for the memory limit
+// and each group quota.
+func (q *quotas) stats() []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	soft := q.fs.SoftLimit
+	data := []byte(fmt.Sprintf("memory %d %d %s\n", q.total, q.fs.MemoryLimit,
+		limitState(q.total, q.fs.MemoryLimit, soft)))
+	gids := make([]string, 0, len(q.limit))
+	for gid := range q.limit {
+		gids = append(gids, gid)
+	}
+	sort.Strings(gids)
+	for _, gid := range gids {
+		usage, limit := q.usage[gid], q.limit[gid]
+		data = append(data, fmt.Sprintf("quota %s %d %d %s\n", gid, usage, limit,
+			limitState(usage, limit, soft))...)
+	}
+	return data
+}
+
+// statsFile is the synthetic file /adm/stats. Reading it lists the
+// memory limit and the group quotas as lines "memory usage limit state"
+// and "quota gid usage limit state", where state is ok, warning above
+// FS.SoftLimit percent of the limit, or exceeded.
+type statsFile struct {
+	fs *FS
+}
+
+func (f *statsFile) ReadAt(p []byte, offset int64) (int, error) {
+	return readReport(f.fs.quota.stats(), p, offset)
+}
+
+func (f *statsFile) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, perror("writing stats file")
+}
+
+func (f *statsFile) Len() uint64  { return uint64(0) }
+func (f *statsFile) Close() error { return nil }
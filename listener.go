@@ -0,0 +1,123 @@
+package ramfs
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// listener is a network listener of the file server together with the
+// connections it accepted.
+type listener struct {
+	mu      sync.Mutex
+	l       net.Listener
+	conns   map[*conn]bool
+	stopped bool
+}
+
+func newListener(l net.Listener) *listener {
+	return &listener{l: l, conns: make(map[*conn]bool)}
+}
+
+// add registers c. It fails if the listener is already stopped.
+func (l *listener) add(c *conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.conns[c] = true
+	return true
+}
+
+func (l *listener) del(c *conn) {
+	l.mu.Lock()
+	delete(l.conns, c)
+	l.mu.Unlock()
+}
+
+func (l *listener) isStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// close closes the listener and returns its connections.
+func (l *listener) close() []*conn {
+	l.mu.Lock()
+	l.stopped = true
+	conns := make([]*conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	l.l.Close()
+	return conns
+}
+
+// stop closes the listener and drains its connections, giving each of
+// them grace to complete outstanding requests. The returned channel is
+// closed once all connections are closed.
+func (l *listener) stop(grace time.Duration) <-chan struct{} {
+	conns := l.close()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, c := range conns {
+			wg.Add(1)
+			go func(c *conn) {
+				c.drain(grace)
+				wg.Done()
+			}(c)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func listenerKey(network, addr string) string { return network + "!" + addr }
+
+func (fs *FS) addListener(network, addr string, ln net.Listener) (*listener, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return nil, ErrServerClosed
+	}
+	key := listenerKey(network, addr)
+	if _, found := fs.listeners[key]; found {
+		return nil, perror("already listening on " + key)
+	}
+	l := newListener(ln)
+	fs.listeners[key] = l
+	return l, nil
+}
+
+// removeListener forgets the listener l at the given network address,
+// unless it was replaced or removed meanwhile.
+func (fs *FS) removeListener(network, addr string, l *listener) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := listenerKey(network, addr)
+	if fs.listeners[key] == l {
+		delete(fs.listeners, key)
+	}
+}
+
+// unlisten stops the listener at the given network address and drains
+// its connections in the background.
+func (fs *FS) unlisten(network, addr string) error {
+	fs.mu.Lock()
+	key := listenerKey(network, addr)
+	l, found := fs.listeners[key]
+	delete(fs.listeners, key)
+	fs.mu.Unlock()
+
+	if !found {
+		return perror("not listening on " + key)
+	}
+	l.stop(fs.Grace)
+	return nil
+}
@@ -0,0 +1,192 @@
+package ramfs
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"9fans.net/go/plan9"
+)
+
+// mapEntry is the estimated memory of a map entry beside its key and
+// value.
+const mapEntry = 48
+
+// MemoryUsage is the memory attributed to a file tree, a directory or
+// an owner.
+type MemoryUsage struct {
+	Nodes    uint64 // files and directories
+	Data     uint64 // bytes of allocated file data
+	Overhead uint64 // estimated bytes of node bookkeeping
+}
+
+func (u *MemoryUsage) add(data, overhead uint64) {
+	u.Nodes++
+	u.Data += data
+	u.Overhead += overhead
+}
+
+// MemoryReport breaks the memory held by the file server down by file
+// tree, top-level directory and owner. Data blocks shared copy-on-write
+// between files, e.g. by a snapshot or a clone, are counted once, for
+// the first file found to hold them, walking the main tree first and the
+// other trees in order of name.
+type MemoryReport struct {
+	Total MemoryUsage
+
+	// Trees is keyed by tree name: "" for the main tree, the aname of
+	// trees added with AddTree, and "snap/name" for snapshots.
+	Trees map[string]MemoryUsage
+
+	// Dirs is keyed by the path of the top-level directories, e.g.
+	// "/usr", prefixed with the tree name and a colon for other trees
+	// than the main tree, e.g. "build:/src".
+	Dirs map[string]MemoryUsage
+
+	// Owners is keyed by the uid of the file owners.
+	Owners map[string]MemoryUsage
+}
+
+// Memory returns the current memory usage of the file server.
+func (fs *FS) Memory() MemoryReport {
+	r := MemoryReport{
+		Trees:  make(map[string]MemoryUsage),
+		Dirs:   make(map[string]MemoryUsage),
+		Owners: make(map[string]MemoryUsage),
+	}
+
+	fs.mu.Lock()
+	trees := map[string]*node{"": fs.root}
+	for name, root := range fs.trees {
+		trees[name] = root
+	}
+	for name, root := range fs.snaps {
+		trees["snap/"+name] = root
+	}
+	fs.mu.Unlock()
+
+	// Walk the main tree first and the others in order, so shared
+	// blocks are always attributed to the same file.
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[*byte]bool)
+	for _, name := range names {
+		root := trees[name]
+		prefix := ""
+		if name != "" {
+			prefix = name + ":"
+		}
+		root.mu.RLock()
+		children := make([]*node, 0, len(root.children))
+		for _, c := range root.children {
+			children = append(children, c)
+		}
+		root.mu.RUnlock()
+
+		r.account(root, name, "", seen)
+		for _, c := range children {
+			dir := prefix + "/" + c.Stat().Name
+			each(c, func(n *node) { r.account(n, name, dir, seen) })
+		}
+	}
+	return r
+}
+
+// account adds n to the usage of its tree, top-level directory dir and
+// owner.
+func (r *MemoryReport) account(n *node, tree, dir string, seen map[*byte]bool) {
+	n.mu.RLock()
+	data := allocated(n.file, seen)
+	overhead := n.overhead()
+	uid := n.dir.Uid
+	n.mu.RUnlock()
+
+	r.Total.add(data, overhead)
+	u := r.Trees[tree]
+	u.add(data, overhead)
+	r.Trees[tree] = u
+	if dir != "" {
+		u = r.Dirs[dir]
+		u.add(data, overhead)
+		r.Dirs[dir] = u
+	}
+	u = r.Owners[uid]
+	u.add(data, overhead)
+	r.Owners[uid] = u
+}
+
+// allocated returns the bytes of data allocated by b that are not in
+// seen, and adds them to seen. Synthetic files hold no data.
+func allocated(b Buffer, seen map[*byte]bool) uint64 {
+	switch b := b.(type) {
+	case *file:
+		size := uint64(0)
+		blocks := b.block
+		if blocks == nil {
+			blocks = map[uint64][]byte{0: b.inline}
+		}
+		for _, block := range blocks {
+			if cap(block) == 0 {
+				continue
+			}
+			if p := &block[:1][0]; !seen[p] {
+				seen[p] = true
+				size += uint64(cap(block))
+			}
+		}
+		return size
+	case *storage:
+		return b.Len()
+	}
+	return 0
+}
+
+// overhead estimates the memory used by n beside its file data. The
+// caller holds n.mu.
+func (n *node) overhead() uint64 {
+	size := uint64(unsafe.Sizeof(*n)) + uint64(unsafe.Sizeof(plan9.Dir{}))
+	size += uint64(len(n.dir.Name) + len(n.dir.Uid) + len(n.dir.Gid) + len(n.dir.Muid))
+	size += uint64(len(n.children)) * mapEntry
+	for k, v := range n.xattr {
+		size += uint64(len(k)+len(v)) + mapEntry
+	}
+	if f, ok := n.file.(*file); ok {
+		size += uint64(unsafe.Sizeof(*f)) + uint64(len(f.block)+len(f.shared))*mapEntry
+	}
+	return size
+}
+
+// Bytes formats the report as lines "kind name nodes n data d overhead
+// o", where kind is total, tree, dir or owner. The main tree is named
+// "main".
+func (r MemoryReport) Bytes() []byte {
+	var buf []byte
+	line := func(kind, name string, u MemoryUsage) {
+		buf = append(buf, fmt.Sprintf("%s %s nodes %d data %d overhead %d\n",
+			kind, name, u.Nodes, u.Data, u.Overhead)...)
+	}
+	sorted := func(kind string, m map[string]MemoryUsage, rename map[string]string) {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			label := name
+			if s, found := rename[name]; found {
+				label = s
+			}
+			line(kind, label, m[name])
+		}
+	}
+
+	line("total", "-", r.Total)
+	sorted("tree", r.Trees, map[string]string{"": "main"})
+	sorted("dir", r.Dirs, nil)
+	sorted("owner", r.Owners, nil)
+	return buf
+}
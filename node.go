@@ -1,10 +1,13 @@
 package ramfs
 
 import (
+	"io"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"9fans.net/go/plan9"
+	"golang.org/x/text/unicode/norm"
 )
 
 var errPerm = perror("permission denied")
@@ -12,21 +15,29 @@ var errPerm = perror("permission denied")
 type node struct {
 	mu       sync.RWMutex
 	fs       *FS
-	file     buffer
+	file     Buffer
 	dir      *plan9.Dir
 	parent   *node
 	children map[string]*node
-	open     bool // used for OEXCL
-	orclose  bool
+	index    []string          // sorted names of children; kept for large directories
+	xattr    map[string]string // extended attributes
+	opens    map[*Fid]uint8    // open mode of each fid the node is open on
+	orclose  bool              // removed on close, whatever the open mode
+	setgid   bool              // new files inherit the group, new directories also setgid
+	scratch  bool              // new files temporary and removed on last close, new directories also scratch
+	ttl      time.Duration     // age of files removed below a scratch directory; zero means none
+	host     string            // path of a file served by MountHost on the host; guarded by fs.hostmu
+	defgid   string            // default group of new files; set on tree roots only
+	removed  bool              // unlinked; freed when no fid has it open
 }
 
-func newNode(fs *FS, name, uid, gid string, perm plan9.Perm, path uint64, b buffer) *node {
-	now := uint32(time.Now().Unix())
+func newNode(fs *FS, name, uid, gid string, perm plan9.Perm, path uint64, b Buffer) *node {
+	now := uint32(fs.now().Unix())
 	n := &node{
 		fs: fs,
 		dir: &plan9.Dir{
 			Qid: plan9.Qid{
-				Type: uint8(perm >> 24),
+				Type: QidType(Perm(perm)),
 				Vers: uint32(0),
 				Path: path,
 			},
@@ -48,77 +59,380 @@ func newNode(fs *FS, name, uid, gid string, perm plan9.Perm, path uint64, b buff
 	return n
 }
 
-func (n *node) Create(uid, name string, mode uint8, perm plan9.Perm) (*node, error) {
-	if name == "." || name == ".." {
-		return nil, perror("illegal name")
+// checkName validates the file name according to the limits of the
+// file server.
+func (fs *FS) checkName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return perror("illegal name")
+	}
+	if fs.MaxNameLen > 0 && len(name) > fs.MaxNameLen {
+		return perror("file name too long")
+	}
+	if !utf8.ValidString(name) {
+		return perror("file name not valid UTF-8")
+	}
+	for _, c := range name {
+		if c == '/' || c < 0x20 || c == 0x7f {
+			return perror("bad character in file name")
+		}
+	}
+	return nil
+}
+
+// normName returns the normalized form of the file name.
+func (fs *FS) normName(name string) string {
+	if fs.Normalize && !norm.NFC.IsNormalString(name) {
+		return norm.NFC.String(name)
 	}
+	return name
+}
 
+// createPerm returns the permissions of a file created in the directory
+// n, with the umask of the file server applied.
+func (n *node) createPerm(perm plan9.Perm) plan9.Perm {
+	n.mu.RLock()
+	mode, scratch := n.dir.Mode, n.scratch
+	n.mu.RUnlock()
 	if perm&plan9.DMDIR != 0 {
-		perm = (perm &^ 0777) | (n.dir.Mode & 0777)
+		perm = (perm &^ 0777) | (mode & 0777)
 	} else {
-		perm = (perm &^ 0666) | (n.dir.Mode & 0666)
+		perm = (perm &^ 0666) | (mode & 0666)
+	}
+	if scratch {
+		perm |= plan9.DMTMP
+	}
+	return perm &^ plan9.Perm(n.fs.umask())
+}
+
+// newGid returns the group of a file created in the directory n: the
+// group of n if n is setgid or the tree has no default group, otherwise
+// the default group of the tree. The caller must hold n.mu.
+func (n *node) newGid() string {
+	if n.setgid {
+		return n.dir.Gid
+	}
+	root := n
+	for root.parent != nil && root.parent != root {
+		root = root.parent
 	}
+	if root.defgid != "" {
+		return root.defgid
+	}
+	return n.dir.Gid
+}
+
+func (n *node) Create(uid, name string, mode uint8, perm plan9.Perm) (*node, error) {
+	name = n.fs.normName(name)
+	if err := n.fs.checkName(name); err != nil {
+		return nil, err
+	}
+	if perm&plan9.DMAUTH != 0 {
+		return nil, perror("can't create authentication file")
+	}
+
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
+
+	perm = n.createPerm(perm)
+	host := n.hostChild(name)
+	bufName := childPath(n.path(), name)
 
 	n.mu.Lock()
+	defer n.mu.Unlock()
 
 	if n.dir.Mode&plan9.DMDIR == 0 {
-		n.mu.Unlock()
 		return nil, perror("not a directory")
 	}
-	if n.dir.Mode&plan9.DMEXCL != 0 && n.open {
-		n.mu.Unlock()
+	if n.dir.Mode&plan9.DMEXCL != 0 && len(n.opens) > 0 {
 		return nil, perror("exclusive use file already open")
 	}
+	if _, found := n.children[name]; found {
+		return nil, perror("file exists")
+	}
+	if max := n.fs.MaxEntries; max > 0 && len(n.children) >= max {
+		return nil, perror("directory full")
+	}
 
+	// The buffer and the host file are created once all checks passed,
+	// so a failing create leaves nothing behind.
 	path, err := n.fs.newPath()
 	if err != nil {
-		n.mu.Unlock()
 		return nil, err
 	}
-	node := newNode(n.fs, name, uid, n.dir.Gid, perm, path, newFile(BLOCKSIZE))
+	var b Buffer
+	if host != "" {
+		if b, err = createHost(host, perm); err != nil {
+			n.fs.delPath(path)
+			return nil, err
+		}
+	} else if perm&plan9.DMDIR == 0 {
+		b = n.fs.newBuffer(bufName, Perm(perm), 0)
+	}
+	node := newNode(n.fs, name, uid, n.newGid(), perm, path, b)
 	node.parent = n
+	node.setgid = n.setgid && perm&plan9.DMDIR != 0
+	node.scratch = n.scratch
+	if host != "" {
+		if h, ok := b.(*hostFile); ok {
+			h.n = node
+		}
+		n.fs.hostmu.Lock()
+		node.host = host
+		n.fs.hostmu.Unlock()
+	}
+	n.link(name, node)
+	return node, nil
+}
 
-	if f, found := n.children[name]; found {
-		n.mu.Unlock()
-		if err := f.Open(mode); err != nil {
-			return nil, err
+// Open records that fid opened n with mode. With OTRUNC, the data of a
+// file is discarded unless it is append-only. ORCLOSE removes n when
+// fid closes it.
+func (n *node) Open(fid *Fid, mode uint8) error {
+	name := n.path()
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.removed {
+		return perror("file does not exist")
+	}
+	if n.dir.Mode&plan9.DMEXCL != 0 && len(n.opens) > 0 {
+		return perror("exclusive use file already open")
+	}
+	var b Buffer
+	if mode&plan9.OTRUNC != 0 && n.dir.Mode&plan9.DMAPPEND == 0 {
+		if _, ok := n.file.(*hostFile); ok {
+			b = n.file // truncated on the host
+		} else if n.dir.Mode&plan9.DMDIR == 0 && stored(n.file) {
+			b = n.fs.newBuffer(name, Perm(n.dir.Mode), 0)
+		}
+	}
+	if h, ok := b.(*hostFile); ok {
+		if err := h.truncate(0); err != nil {
+			return err
 		}
-		return f, nil
+	}
+	if n.opens == nil {
+		n.opens = make(map[*Fid]uint8)
+	}
+	n.opens[fid] = mode
+	if b != nil {
+		n.truncate(b)
+	}
+	return nil
+}
 
+// truncate replaces the data of n by the empty buffer b. The caller
+// holds n.mu.
+func (n *node) truncate(b Buffer) {
+	if n.charged() {
+		n.fs.quota.release(n.dir.Gid, n.file.Len())
 	}
-	n.children[name] = node
+	n.file.Close()
+	n.file = b
 
-	n.mu.Unlock()
-	return node, nil
+	now := uint32(n.fs.now().Unix())
+	n.dir.Mtime = now
+	n.dir.Length = 0
+	if n.dir.Mode&plan9.DMTMP == 0 {
+		n.dir.Qid.Vers++
+	}
 }
 
-func (n *node) Open(mode uint8) error {
+// setLength shrinks the data of n to size bytes or extends it with
+// zeros. The data of directories, append-only and synthetic files
+// cannot be resized.
+func (n *node) setLength(size uint64) error {
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
+	name := n.path()
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	if n.dir.Mode&plan9.DMEXCL != 0 && n.open {
-		return perror("exclusive use file already open")
+	if err := n.checkLength(size); err != nil {
+		return err
+	}
+	if n.file.Len() == size {
+		return nil
 	}
-	if n.dir.Mode&plan9.DMEXCL != 0 && !n.open {
-		n.open = true
+	if err := n.checkExtend(size); err != nil {
+		return err
+	}
+	if n.charged() && size > n.dir.Length {
+		if err := n.fs.quota.charge(n.dir.Gid, size-n.dir.Length); err != nil {
+			return err
+		}
+	}
+	old := n.dir.Length
+	if err := n.applyLength(name, size); err != nil {
+		if n.charged() && size > old {
+			n.fs.quota.release(n.dir.Gid, size-old)
+		}
+		return err
+	}
+	if n.charged() && size < old {
+		n.fs.quota.release(n.dir.Gid, old-size)
+	}
+	return nil
+}
+
+// checkLength checks that the length of n can be changed. The caller
+// holds n.mu.
+func (n *node) checkLength(size uint64) error {
+	_, host := n.file.(*hostFile)
+	switch {
+	case n.dir.Mode&plan9.DMDIR != 0:
+		return perror("is a directory")
+	case n.dir.Mode&plan9.DMAPPEND != 0:
+		return perror("append-only file")
+	case !stored(n.file) && !host:
+		return perror("cannot change length")
+	}
+	return nil
+}
+
+// maxExtend is the most a file may be extended by in one change of its
+// length, as the zeros are stored like written data.
+const maxExtend = 64 * 1024 * 1024
+
+// checkExtend checks that the data of n may be extended to size bytes:
+// by no more than maxExtend, nor beyond the MemoryLimit of the file
+// server. The quota is charged by the caller. The caller holds n.mu.
+func (n *node) checkExtend(size uint64) error {
+	old := n.file.Len()
+	if !n.charged() || size <= old {
+		return nil
+	}
+	growth := size - old
+	if growth > maxExtend {
+		return perror("file too large")
+	}
+	if limit := n.fs.MemoryLimit; limit > 0 && n.fs.quota.used()+growth > limit {
+		return perror("memory limit exceeded")
+	}
+	return nil
+}
+
+// applyLength changes the length of n, the file name, to size after
+// the checks and the quota charge of the caller. The caller holds n.mu.
+func (n *node) applyLength(name string, size uint64) error {
+	if n.file.Len() == size {
+		return nil
+	}
+	var err error
+	if h, ok := n.file.(*hostFile); ok {
+		err = h.truncate(size)
+	} else {
+		err = n.resize(name, size)
+	}
+	if err != nil {
+		return err
+	}
+
+	n.dir.Mtime = uint32(n.fs.now().Unix())
+	n.dir.Length = size
+	if n.dir.Mode&plan9.DMTMP == 0 {
+		n.dir.Qid.Vers++
+	}
+	return nil
+}
+
+// resize shrinks the data of n, the file name, to size bytes or extends
+// it with zeros. It does not account the change to the quota. The
+// caller holds n.mu.
+func (n *node) resize(name string, size uint64) error {
+	old := n.file.Len()
+	if f, ok := n.file.(*file); ok {
+		if size < old {
+			f.truncate(size)
+			return nil
+		}
+		return extend(f, old, size)
+	}
+	return n.copyResize(name, old, size)
+}
+
+// extend writes zeros to b from offset old up to size.
+func extend(b Buffer, old, size uint64) error {
+	buf := make([]byte, 64*1024)
+	for off := old; off < size; off += uint64(len(buf)) {
+		if rest := size - off; rest < uint64(len(buf)) {
+			buf = buf[:rest]
+		}
+		if _, err := b.WriteAt(buf, int64(off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyResize replaces the data of n, a buffer of a storage policy, by a
+// copy of its first size bytes, extended with zeros.
+func (n *node) copyResize(name string, old, size uint64) error {
+	keep := old
+	if size < keep {
+		keep = size
+	}
+	b := n.fs.newBuffer(name, Perm(n.dir.Mode), size)
+	buf := make([]byte, 64*1024)
+	var err error
+	for off := uint64(0); off < keep && err == nil; off += uint64(len(buf)) {
+		if rest := keep - off; rest < uint64(len(buf)) {
+			buf = buf[:rest]
+		}
+		var m int
+		m, err = n.file.ReadAt(buf, int64(off))
+		zero(buf[m:])
+		if err == nil || err == io.EOF {
+			_, err = b.WriteAt(buf, int64(off))
+		}
+	}
+	if err == nil {
+		err = extend(b, keep, size)
 	}
-	if mode&plan9.ORCLOSE != 0 {
-		n.orclose = true
+	if err != nil {
+		b.Close()
+		return err
 	}
+	n.file.Close()
+	n.file = b
 	return nil
 }
 
-func (n *node) Close() error {
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// openMode returns the mode fid opened n with.
+func (n *node) openMode(fid *Fid) (uint8, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	mode, found := n.opens[fid]
+	return mode, found
+}
+
+// Close records that fid no longer has n open.
+func (n *node) Close(fid *Fid) error {
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	if n.dir.Mode&plan9.DMEXCL != 0 && n.open {
-		n.open = false
+	mode := n.opens[fid]
+	delete(n.opens, fid)
+	if n.removed {
+		if len(n.opens) == 0 {
+			n.free()
+		}
+		return nil
 	}
-	if n.dir.Mode&plan9.DMDIR == 0 {
-		n.file.Close()
+	if n.orclose || mode&plan9.ORCLOSE != 0 {
+		return n.remove()
 	}
-	if n.orclose {
+	if n.scratch && len(n.opens) == 0 && n.dir.Mode&plan9.DMDIR == 0 {
 		return n.remove()
 	}
 	return nil
@@ -132,24 +446,72 @@ func (n *node) remove() error {
 	parent := n.parent
 	parent.mu.Lock()
 	name := n.dir.Name
-	if _, found := parent.children[name]; !found {
+	if c, found := parent.children[name]; !found || c != n {
 		parent.mu.Unlock()
 		return perror("file does not exist")
 	}
-	delete(parent.children, name)
+	if err := n.removeHost(); err != nil {
+		parent.mu.Unlock()
+		return err
+	}
+	parent.unlink(name)
 	parent.mu.Unlock()
 
-	n.fs.delPath(n.dir.Qid.Path)
+	if n.charged() {
+		n.fs.quota.release(n.dir.Gid, n.dir.Length)
+	}
+	n.fs.cache.invalidate()
+	n.retire()
 	return nil
 }
 
+// retire marks n, unlinked from its directory, as removed. Its data is
+// closed and its qid path released once no fid has it open, so the
+// path is not reused while fids still use it. The caller holds n.mu.
+func (n *node) retire() {
+	n.removed = true
+	if len(n.opens) == 0 {
+		n.free()
+	}
+}
+
+// free releases the data and the qid path of a removed file. The caller
+// holds n.mu.
+func (n *node) free() {
+	if n.file != nil {
+		n.file.Close()
+	}
+	n.fs.delPath(n.dir.Qid.Path)
+}
+
+// discard releases the data, the quota and the qid path of n, a new
+// file which was never linked.
+func (n *node) discard() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.charged() {
+		n.fs.quota.release(n.dir.Gid, n.dir.Length)
+	}
+	n.free()
+}
+
 func (n *node) Remove() error {
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	return n.remove()
 }
 
 func (n *node) WriteAt(p []byte, offset int64) (int, error) {
+	return n.write(p, offset, false)
+}
+
+// write writes p at offset. If adopt is set, the data of n may keep p
+// instead of a copy of it.
+func (n *node) write(p []byte, offset int64, adopt bool) (int, error) {
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -164,12 +526,37 @@ func (n *node) WriteAt(p []byte, offset int64) (int, error) {
 		offset = int64(n)
 	}
 
-	m, err := n.file.WriteAt(p, offset)
+	size := n.file.Len()
+	growth := uint64(0)
+	if n.charged() {
+		end := size
+		if offset >= 0 && uint64(offset) < size {
+			end = uint64(offset)
+		}
+		if end += uint64(len(p)); end > size {
+			growth = end - size
+		}
+		if err := n.fs.quota.charge(n.dir.Gid, growth); err != nil {
+			return 0, err
+		}
+	}
+
+	var m int
+	var err error
+	if f, ok := n.file.(*file); ok && adopt {
+		m, err = f.adopt(p, offset)
+	} else {
+		m, err = n.file.WriteAt(p, offset)
+	}
 	if err != nil {
+		n.fs.quota.release(n.dir.Gid, growth)
 		return 0, err
 	}
+	if actual := n.file.Len() - size; actual < growth {
+		n.fs.quota.release(n.dir.Gid, growth-actual)
+	}
 
-	now := uint32(time.Now().Unix())
+	now := uint32(n.fs.now().Unix())
 	n.dir.Atime = now
 	n.dir.Mtime = now
 	n.dir.Length = n.file.Len()
@@ -180,22 +567,30 @@ func (n *node) WriteAt(p []byte, offset int64) (int, error) {
 }
 
 func (n *node) ReadAt(p []byte, offset int64) (int, error) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-
+	n.mu.RLock()
 	if n.dir.Mode&plan9.DMDIR != 0 {
+		n.mu.RUnlock()
 		return 0, perror("is a directory")
 	}
 
 	m, err := n.file.ReadAt(p, offset)
+	atime, mtime := n.dir.Atime, n.dir.Mtime
+	n.mu.RUnlock()
 	if err != nil {
 		return 0, err
 	}
 
-	n.dir.Atime = uint32(time.Now().Unix())
+	now := uint32(n.fs.now().Unix())
+	if n.fs.Atime.update(atime, mtime, now) {
+		n.mu.Lock()
+		n.dir.Atime = now
+		n.mu.Unlock()
+	}
 	return m, nil
 }
 
+// Readdir returns the directory entries of n in the order of their
+// names.
 func (n *node) Readdir() ([]byte, error) {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -205,8 +600,12 @@ func (n *node) Readdir() ([]byte, error) {
 	}
 
 	var data []byte
-	for _, f := range n.children {
-		buf, err := f.dir.Bytes()
+	for _, name := range n.names("", -1) {
+		stat := n.children[name].Stat()
+		if stat.Mode&plan9.DMAUTH != 0 {
+			continue
+		}
+		buf, err := stat.Bytes()
 		if err != nil {
 			return nil, err
 		}
@@ -215,30 +614,69 @@ func (n *node) Readdir() ([]byte, error) {
 	return data, nil
 }
 
+// Stat returns a copy of the directory entry of n, which the caller may
+// keep and modify.
 func (n *node) Stat() *plan9.Dir {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
-	return n.dir
+	dir := *n.dir
+	if h, ok := n.file.(*hostFile); ok {
+		dir.Length = h.Len()
+	}
+	return &dir
 }
 
 func (n *node) Wstat(uname string, dir *plan9.Dir) error {
-	// To change mode, must be owner or group leader. Because of lack of
-	// group file, leader=>group itself.
-	if dir.Mode != 0xFFFFFFFF && dir.Mode != n.dir.Mode {
-		if uname != n.dir.Uid && uname != n.dir.Gid {
+	n.fs.frozen.RLock()
+	defer n.fs.frozen.RUnlock()
+	cur := n.Stat()
+
+	// To change mode or times, must be owner or group leader.
+	mtime := dir.Mtime != ^uint32(0) && dir.Mtime != cur.Mtime
+	atime := dir.Atime != ^uint32(0) && dir.Atime != cur.Atime
+	if (dir.Mode != 0xFFFFFFFF && dir.Mode != cur.Mode) || mtime || atime {
+		if !n.owns(uname, cur) {
 			return perror("not owner")
 		}
 	}
 
+	// To change owner or last modifier, must be the hostowner, and they
+	// must be known users.
+	uid := dir.Uid != "" && dir.Uid != cur.Uid
+	muid := dir.Muid != "" && dir.Muid != cur.Muid
+	if uid || muid {
+		if uname != n.fs.hostowner {
+			return perror("not hostowner")
+		}
+		for _, u := range []string{dir.Uid, dir.Muid} {
+			if u == "" {
+				continue
+			}
+			if _, err := n.fs.group.Get(u); err != nil {
+				return err
+			}
+		}
+	}
+
 	// To change name, must have write permission in parent and name must
 	// be unique.
 	parent := n.parent
-	if dir.Name != "" && dir.Name != n.dir.Name {
+	if dir.Name != "" {
+		dir.Name = n.fs.normName(dir.Name)
+	}
+	if dir.Name != "" && dir.Name != cur.Name {
+		if err := n.fs.checkName(dir.Name); err != nil {
+			return err
+		}
 		if !parent.HasPerm(uname, plan9.DMWRITE) {
 			return errPerm
 		}
 
 		parent.mu.Lock()
+		if c := parent.children[cur.Name]; c != n {
+			parent.mu.Unlock()
+			return perror("file does not exist")
+		}
 		if _, found := parent.children[dir.Name]; found {
 			parent.mu.Unlock()
 			return perror("file exists")
@@ -246,72 +684,194 @@ func (n *node) Wstat(uname string, dir *plan9.Dir) error {
 		parent.mu.Unlock()
 	}
 
-	// To change group, must be owner and member of new group
-	if dir.Gid != "" && dir.Gid != n.dir.Gid {
-		fgroup, err := n.fs.group.Get(n.dir.Gid)
+	// To change group, must be owner and member of new group, or leader
+	// of the current group and leader of the new group.
+	if dir.Gid != "" && dir.Gid != cur.Gid {
+		ngroup, err := n.fs.group.Get(dir.Gid)
 		if err != nil {
-			panic(err) // can't happen
+			return err
 		}
-		if _, found := fgroup.Member[uname]; !found {
+		isLeader := false
+		if fgroup, err := n.fs.group.Get(cur.Gid); err == nil {
+			isLeader = fgroup.Leader == uname && ngroup.Leader == uname
+		}
+		if !(uname == cur.Uid && ngroup.isMember(uname)) && !isLeader {
 			return perror("not owner")
 		}
 	}
 
-	// all ok; do it
-	if dir.Mode != 0xFFFFFFFF && dir.Mode != n.dir.Mode {
-		if dir.Mode&plan9.DMDIR != 0 {
-			n.dir.Mode = (dir.Mode &^ 0777) | (n.dir.Mode & 0777)
-		} else {
-			n.dir.Mode = (dir.Mode &^ 0666) | (n.dir.Mode & 0666)
+	// The directory bit cannot be changed.
+	if dir.Mode != 0xFFFFFFFF && (dir.Mode^cur.Mode)&plan9.DMDIR != 0 {
+		return perror("can't change directory bit")
+	}
+
+	// To change length, must have write permission on the file. The
+	// length of directories and append-only files cannot be changed.
+	length := dir.Length != ^uint64(0) && dir.Length != cur.Length
+	if length {
+		switch {
+		case cur.Mode&plan9.DMDIR != 0:
+			return perror("can't change length of directory")
+		case cur.Mode&plan9.DMAPPEND != 0:
+			return perror("can't change length of append-only file")
+		case !n.HasPerm(uname, plan9.DMWRITE):
+			return errPerm
+		}
+		n.mu.RLock()
+		err := n.checkLength(dir.Length)
+		if err == nil {
+			err = n.checkExtend(dir.Length)
+		}
+		n.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The quota is charged before anything is changed: the new group
+	// is charged the new length, or the group the growth.
+	gid := dir.Gid != "" && dir.Gid != cur.Gid
+	size := cur.Length
+	if length {
+		size = dir.Length
+	}
+	chargeGid, charge := "", uint64(0)
+	if n.charged() {
+		switch {
+		case gid:
+			chargeGid, charge = dir.Gid, size
+		case size > cur.Length:
+			chargeGid, charge = cur.Gid, size-cur.Length
+		}
+		if err := n.fs.quota.charge(chargeGid, charge); err != nil {
+			return err
+		}
+	}
+	undo := func() {
+		if charge > 0 {
+			n.fs.quota.release(chargeGid, charge)
 		}
 	}
-	if dir.Name != "" && dir.Name != n.dir.Name {
+
+	if host := n.hostPath(); host != "" {
+		if err := n.wstatHost(host, cur, dir); err != nil {
+			undo()
+			return err
+		}
+	}
+	if dir.Name != "" && dir.Name != cur.Name {
 		parent.mu.Lock()
-		delete(parent.children, n.dir.Name)
+		err := error(nil)
+		if _, found := parent.children[dir.Name]; found {
+			err = perror("file exists")
+		} else if parent.children[cur.Name] != n {
+			err = perror("file does not exist")
+		}
+		if err != nil {
+			parent.mu.Unlock()
+			undo()
+			return err
+		}
+		parent.unlink(cur.Name)
 
 		n.mu.Lock()
 		n.dir.Name = dir.Name
 		n.mu.Unlock()
 
-		parent.children[dir.Name] = n
+		parent.link(dir.Name, n)
 		parent.mu.Unlock()
+		n.fs.cache.invalidate()
 	}
-	if dir.Gid != "" && dir.Gid != n.dir.Gid {
+	if length {
+		name := n.path()
 		n.mu.Lock()
-		n.dir.Gid = dir.Gid
+		err := n.applyLength(name, dir.Length)
 		n.mu.Unlock()
+		if err != nil {
+			undo()
+			return err
+		}
+	}
+
+	// all ok; do it
+	n.mu.Lock()
+	if dir.Mode != 0xFFFFFFFF && dir.Mode != cur.Mode {
+		if dir.Mode&plan9.DMDIR != 0 {
+			n.dir.Mode = (dir.Mode &^ 0777) | (n.dir.Mode & 0777)
+		} else {
+			n.dir.Mode = (dir.Mode &^ 0666) | (n.dir.Mode & 0666)
+		}
+		n.dir.Qid.Type = QidType(Perm(n.dir.Mode))
+		defer n.fs.cache.invalidate()
+	}
+	if mtime {
+		n.dir.Mtime = dir.Mtime
+	}
+	if atime {
+		n.dir.Atime = dir.Atime
+	}
+	if uid {
+		n.dir.Uid = dir.Uid
+	}
+	if muid {
+		n.dir.Muid = dir.Muid
 	}
+	if n.charged() {
+		// the charge of the caller covers the new length
+		switch {
+		case gid:
+			n.fs.quota.release(cur.Gid, cur.Length)
+		case size < cur.Length:
+			n.fs.quota.release(cur.Gid, cur.Length-size)
+		}
+	}
+	if gid {
+		n.dir.Gid = dir.Gid
+	}
+	n.mu.Unlock()
 	return nil
 }
 
+// owns reports whether uname may change the mode and times of n, whose
+// directory entry is cur: the owner, and the leader of the group, which
+// is the user named like the group if it has none.
+func (n *node) owns(uname string, cur *plan9.Dir) bool {
+	if uname == cur.Uid || uname == cur.Gid {
+		return true
+	}
+	g, err := n.fs.group.Get(cur.Gid)
+	return err == nil && g.Leader == uname
+}
+
 func (n *node) HasPerm(uname string, perm plan9.Perm) bool {
+	n.mu.RLock()
+	mode, uid, gid := n.dir.Mode, n.dir.Uid, n.dir.Gid
+	n.mu.RUnlock()
+
 	other := plan9.Perm(7)
 	perm &= other
 
 	// other
-	fperm := n.dir.Mode & other
+	fperm := mode & other
 	if uname == "none" && (fperm&perm) == perm {
 		return true
 	}
 
 	if _, err := n.fs.group.Get(uname); err == nil {
 		// user
-		if n.dir.Uid == uname {
+		if uid == uname {
 			user := plan9.Perm(6)
-			fperm |= (n.dir.Mode >> user) & other
+			fperm |= (mode >> user) & other
 		}
 		if (fperm & perm) == perm {
 			return true
 		}
 
-		// group
-		fgroup, err := n.fs.group.Get(n.dir.Gid)
-		if err != nil {
-			panic(err) // can't happen
-		}
-		if _, found := fgroup.Member[uname]; found {
+		// group; files of a removed group grant no group permissions
+		fgroup, err := n.fs.group.Get(gid)
+		if err == nil && fgroup.isMember(uname) {
 			group := plan9.Perm(3)
-			fperm |= (n.dir.Mode >> group) & other
+			fperm |= (mode >> group) & other
 		}
 		return (fperm & perm) == perm
 	}
@@ -319,35 +879,86 @@ func (n *node) HasPerm(uname string, perm plan9.Perm) bool {
 	return false
 }
 
+// path returns the path of n within its file tree.
+func (n *node) path() string {
+	var names []string
+	for n.parent != nil && n.parent != n {
+		names = append(names, n.Stat().Name)
+		n = n.parent
+	}
+	if len(names) == 0 {
+		return "/"
+	}
+	p := ""
+	for i := len(names) - 1; i >= 0; i-- {
+		p += "/" + names[i]
+	}
+	return p
+}
+
+// each calls fn for n and every node below it, parents before
+// children.
+func each(n *node, fn func(n *node)) {
+	fn(n)
+
+	n.mu.RLock()
+	if n.dir.Mode&plan9.DMDIR == 0 {
+		n.mu.RUnlock()
+		return
+	}
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	n.mu.RUnlock()
+
+	for _, c := range children {
+		each(c, fn)
+	}
+}
+
 type walkFunc func(root *node, path []string) error
 
-func walk(root *node, path []string, fn walkFunc) error {
-	if len(path) == 0 {
-		return nil
+// walk walks from root along path, calling fn for each file visited.
+// Each directory walked from must be searchable by uid, that is grant it
+// execute permission; the walks of the file server itself pass an empty
+// uid, which skips the check.
+func walk(root *node, uid string, path []string, fn walkFunc) error {
+	fs := root.fs
+	if fs.MaxWalk > 0 && len(path) > fs.MaxWalk {
+		return perror("too many names in walk")
 	}
 
 	node := root
-	name, path := path[0], path[1:]
-	if name == ".." {
-		node = node.parent
-	} else {
-		n, found := node.children[name]
-		if found {
-			node = n
+	depth := 0
+	for len(path) > 0 {
+		if uid != "" && node.Stat().Mode&plan9.DMDIR != 0 && !node.HasPerm(uid, plan9.DMEXEC) {
+			return errPerm
+		}
+		var name string
+		name, path = fs.normName(path[0]), path[1:]
+		if name == ".." {
+			node = node.parent
+			if depth > 0 {
+				depth--
+			}
 		} else {
-			return perror("file does not exist")
+			node.mu.RLock()
+			n, found := node.children[name]
+			node.mu.RUnlock()
+			if !found || isAuth(n) {
+				return perror("file does not exist")
+			}
+			node = n
+			depth++
+			if fs.MaxDepth > 0 && depth > fs.MaxDepth {
+				return perror("walk too deep")
+			}
 		}
-	}
 
-	stat := node.Stat()
-	if (stat.Type & plan9.QTDIR) > 0 {
-		if (stat.Mode & plan9.DMEXEC) > 0 {
-			return errPerm
+		if err := fn(node, path); err != nil {
+			return err
 		}
 	}
-
-	if err := fn(node, path); err != nil {
-		return err
-	}
-	return walk(node, path, fn)
+	return nil
 }
@@ -2,7 +2,12 @@ package ramfs
 
 import (
 	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"9fans.net/go/plan9"
 )
@@ -47,7 +52,7 @@ func TestCreateOpenClose(t *testing.T) {
 	if err != nil {
 		t.Fatalf("create dir: %v", err)
 	}
-	if err := dir.Open(plan9.ORDWR); err != nil {
+	if err := dir.Open(nil, plan9.ORDWR); err != nil {
 		t.Fatalf("open dir: %v", err)
 	}
 
@@ -55,16 +60,16 @@ func TestCreateOpenClose(t *testing.T) {
 	if err != nil {
 		t.Fatalf("create file: %v", err)
 	}
-	if err := file.Open(plan9.ORDWR); err != nil {
+	if err := file.Open(nil, plan9.ORDWR); err != nil {
 		t.Fatalf("open file: %v", err)
 	}
 
 	writeTest(t, file)
 
-	if err := file.Close(); err != nil {
+	if err := file.Close(nil); err != nil {
 		t.Fatalf("close file: %v", err)
 	}
-	if err := dir.Close(); err != nil {
+	if err := dir.Close(nil); err != nil {
 		t.Fatalf("close dir: %v", err)
 	}
 }
@@ -76,10 +81,10 @@ func TestRemove(t *testing.T) {
 	if err != nil {
 		t.Fatalf("create dir: %v", err)
 	}
-	if err := dir.Open(plan9.ORDWR); err != nil {
+	if err := dir.Open(nil, plan9.ORDWR); err != nil {
 		t.Fatalf("open dir: %v", err)
 	}
-	defer dir.Close()
+	defer dir.Close(nil)
 
 	if err := dir.Remove(); err != nil {
 		t.Fatalf("remove dir: %v", err)
@@ -89,19 +94,688 @@ func TestRemove(t *testing.T) {
 func TestExlusiveMode(t *testing.T) {
 	fs := New("adm")
 	file := newNode(fs, "file", "adm", "adm", 0664|plan9.DMEXCL, 0, newFile(BLOCKSIZE))
-	if err := file.Open(plan9.OWRITE); err != nil {
+	if err := file.Open(nil, plan9.OWRITE); err != nil {
 		t.Fatalf("open file: %v", err)
 	}
-	if err := file.Open(plan9.OWRITE); err == nil {
+	if err := file.Open(nil, plan9.OWRITE); err == nil {
 		t.Fatalf("open expected ErrExcl, got nil error")
 	}
-	if err := file.Open(plan9.OWRITE); err == nil {
+	if err := file.Open(nil, plan9.OWRITE); err == nil {
 		t.Fatalf("open expected ErrExcl, got nil error")
 	}
 
 	writeTest(t, file)
 
-	if err := file.Close(); err != nil {
+	if err := file.Close(nil); err != nil {
 		t.Fatalf("close file: %v", err)
 	}
 }
+
+var qidTests = []struct {
+	perm plan9.Perm
+	typ  uint8
+}{
+	{0664, plan9.QTFILE},
+	{0775 | plan9.DMDIR, plan9.QTDIR},
+	{0664 | plan9.DMAPPEND, plan9.QTAPPEND},
+	{0664 | plan9.DMEXCL, plan9.QTEXCL},
+	{0664 | plan9.DMTMP, plan9.QTTMP},
+	{0664 | plan9.DMAPPEND | plan9.DMEXCL, plan9.QTAPPEND | plan9.QTEXCL},
+	{0775 | plan9.DMDIR | plan9.DMEXCL, plan9.QTDIR | plan9.QTEXCL},
+	{0664 | plan9.DMSYMLINK | plan9.DMDEVICE, plan9.QTFILE},
+}
+
+func TestQidType(t *testing.T) {
+	fs := New("adm")
+	root := newNode(fs, "/", "adm", "adm", 0777|plan9.DMDIR, 0, nil)
+	for i, test := range qidTests {
+		name := fmt.Sprintf("file-%d", i)
+		n, err := root.Create("adm", name, plan9.OREAD, test.perm)
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+
+		data, err := n.Stat().Bytes()
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		dir, err := plan9.UnmarshalDir(data)
+		if err != nil {
+			t.Fatalf("unmarshal %s: %v", name, err)
+		}
+		if dir.Qid.Type != test.typ {
+			t.Fatalf("%s: expected qid type %#x, got %#x", Perm(test.perm), test.typ, dir.Qid.Type)
+		}
+		if dir.Mode&plan9.DMDIR != 0 && dir.Qid.Type&plan9.QTDIR == 0 {
+			t.Fatalf("%s: directory without QTDIR", Perm(test.perm))
+		}
+	}
+}
+
+func TestAuthNode(t *testing.T) {
+	fs := New("adm")
+	if _, err := fs.root.Create("adm", "auth", plan9.ORDWR, 0600|plan9.DMAUTH); err == nil {
+		t.Fatalf("create: expected error creating authentication file")
+	}
+
+	n, err := fs.newAuthNode("glenda", newFile(BLOCKSIZE))
+	if err != nil {
+		t.Fatalf("new auth node: %v", err)
+	}
+	stat := n.Stat()
+	if stat.Qid.Type != plan9.QTAUTH {
+		t.Fatalf("expected qid type %#x, got %#x", plan9.QTAUTH, stat.Qid.Type)
+	}
+	if _, err := fs.walk("/" + stat.Name); err == nil {
+		t.Fatalf("walk: expected error walking to authentication file")
+	}
+
+	data, err := fs.root.Readdir()
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	for len(data) > 0 {
+		m := int(data[0]) | int(data[1])<<8 + 2
+		dir, err := plan9.UnmarshalDir(data[:m])
+		if err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if dir.Mode&plan9.DMAUTH != 0 {
+			t.Fatalf("authentication file %s listed", dir.Name)
+		}
+		data = data[m:]
+	}
+
+	if err := n.Close(nil); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, found := fs.root.children[stat.Name]; found {
+		t.Fatalf("authentication file not removed on close")
+	}
+}
+
+func TestWstatQidType(t *testing.T) {
+	fs := New("adm")
+	file := newNode(fs, "file", "adm", "adm", 0664, 0, newFile(BLOCKSIZE))
+	file.parent = fs.root
+
+	dir := plan9.Dir{Mode: 0664 | plan9.DMAPPEND}
+	if err := file.Wstat("adm", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	if typ := file.Stat().Qid.Type; typ != plan9.QTAPPEND {
+		t.Fatalf("expected qid type %#x, got %#x", plan9.QTAPPEND, typ)
+	}
+
+	dir = plan9.Dir{Mode: 0775 | plan9.DMDIR}
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error changing directory bit")
+	}
+}
+
+func TestWstatLength(t *testing.T) {
+	fs := New("adm")
+	file, err := fs.root.Create("adm", "file", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("hello world"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	vers := file.Stat().Qid.Vers
+
+	var dir plan9.Dir
+	dir.Null()
+	dir.Length = 5
+	if err := file.Wstat("glenda", &dir); err != errPerm {
+		t.Fatalf("wstat: expected %v, got %v", errPerm, err)
+	}
+	if err := file.Wstat("adm", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	dir.Length = 8
+	if err := file.Wstat("adm", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	stat := file.Stat()
+	if stat.Length != 8 || stat.Qid.Vers != vers+2 {
+		t.Fatalf("expected length 8, version %d, got %d, %d", vers+2, stat.Length, stat.Qid.Vers)
+	}
+	buf := make([]byte, 16)
+	if n, _ := file.ReadAt(buf, 0); string(buf[:n]) != "hello\x00\x00\x00" {
+		t.Fatalf("expected %q, got %q", "hello\x00\x00\x00", buf[:n])
+	}
+
+	// extensions are bounded, by maxExtend and by the memory limit
+	dir.Length = 1 << 50
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error extending file by %d bytes", dir.Length)
+	}
+	fs.MemoryLimit = 16
+	dir.Length = 17
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error extending file beyond the memory limit")
+	}
+	fs.MemoryLimit = 0
+	if length := file.Stat().Length; length != 8 {
+		t.Fatalf("expected length 8 after failed extensions, got %d", length)
+	}
+
+	dir.Length = 1
+	if err := fs.root.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error changing length of directory")
+	}
+	dir.Null()
+	dir.Mode = 0664 | plan9.DMAPPEND
+	if err := file.Wstat("adm", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	dir.Null()
+	dir.Length = 0
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error truncating append-only file")
+	}
+}
+
+func TestWstatAllOrNone(t *testing.T) {
+	fs := New("adm")
+	fs.group.groupmap["sys"] = user{"sys", "", member{"adm": true}}
+	fs.quota.set("sys", 4)
+	file, err := fs.root.Create("adm", "file", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("hello world"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cur := file.Stat()
+
+	var dir plan9.Dir
+	dir.Null()
+	dir.Name = "renamed"
+	dir.Mtime = 1000000000
+	dir.Gid = "sys"
+	if err := file.Wstat("adm", &dir); err != errQuota {
+		t.Fatalf("wstat: expected %v, got %v", errQuota, err)
+	}
+	if stat := file.Stat(); stat.Name != cur.Name || stat.Mtime != cur.Mtime || stat.Length != cur.Length || stat.Gid != cur.Gid {
+		t.Fatalf("failed wstat changed the file: %v", stat)
+	}
+	if _, err := fs.walk("/file"); err != nil {
+		t.Fatalf("failed wstat renamed the file: %v", err)
+	}
+
+	dir.Length = 4
+	if err := file.Wstat("adm", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	if reply := string(fs.quota.report(true)); reply != "adm 0 0\nsys 4 4\n" && reply != "sys 4 4\n" {
+		t.Fatalf("expected usage of sys 4, got %q", reply)
+	}
+}
+
+func TestWstatTimesAndUid(t *testing.T) {
+	fs := New("adm")
+	fs.group.groupmap["glenda"] = user{"glenda", "glenda", member{}}
+	file, err := fs.root.Create("glenda", "file", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	cur := file.Stat()
+
+	var dir plan9.Dir
+	dir.Null()
+	dir.Mtime = 1000000000
+	if err := file.Wstat("none", &dir); err == nil {
+		t.Fatalf("wstat: expected error changing mtime as other user")
+	}
+	if err := file.Wstat("glenda", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	stat := file.Stat()
+	if stat.Mtime != dir.Mtime || stat.Atime != cur.Atime || stat.Qid.Vers != cur.Qid.Vers {
+		t.Fatalf("expected mtime %d, atime %d, version %d, got %v", dir.Mtime, cur.Atime, cur.Qid.Vers, stat)
+	}
+
+	dir.Null()
+	dir.Uid = "adm"
+	if err := file.Wstat("glenda", &dir); err == nil {
+		t.Fatalf("wstat: expected error changing uid as other than hostowner")
+	}
+	dir.Uid = "nobody"
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error changing uid to unknown user")
+	}
+	dir.Uid, dir.Muid = "adm", "adm"
+	if err := file.Wstat("adm", &dir); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	if stat := file.Stat(); stat.Uid != "adm" || stat.Muid != "adm" || stat.Mtime != 1000000000 {
+		t.Fatalf("expected uid and muid adm, mtime unchanged, got %v", stat)
+	}
+}
+
+func TestOrphanedGroup(t *testing.T) {
+	fs := New("adm")
+	fs.group.groupmap["glenda"] = user{"glenda", "glenda", member{}}
+	file := newNode(fs, "file", "adm", "sys", 0664, 0, newFile(BLOCKSIZE))
+	file.parent = fs.root
+	fs.root.children["file"] = file
+
+	if file.HasPerm("glenda", plan9.DMWRITE) {
+		t.Fatalf("expected no group permission for orphaned group")
+	}
+	if !file.HasPerm("glenda", plan9.DMREAD) {
+		t.Fatalf("expected other read permission")
+	}
+
+	dir := plan9.Dir{Mode: 0xFFFFFFFF, Gid: "nogroup"}
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error for unknown group")
+	}
+	dir.Gid = "glenda"
+	if err := file.Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected error for non-member")
+	}
+
+	if err := fs.regroup("nogroup"); err == nil {
+		t.Fatalf("regroup: expected error for unknown group")
+	}
+	if err := fs.regroup("adm"); err != nil {
+		t.Fatalf("regroup: %v", err)
+	}
+	if gid := file.Stat().Gid; gid != "adm" {
+		t.Fatalf("expected gid adm, got %s", gid)
+	}
+	if gid := fs.root.Stat().Gid; gid != "adm" {
+		t.Fatalf("expected root gid adm, got %s", gid)
+	}
+}
+
+func TestAtimePolicy(t *testing.T) {
+	day := uint32(24 * 60 * 60)
+	var tests = []struct {
+		policy            AtimePolicy
+		atime, mtime, now uint32
+		update            bool
+	}{
+		{Relatime, 100, 100, 200, true},
+		{Relatime, 150, 100, 200, false},
+		{Relatime, 150, 100, 150 + day, true},
+		{Strictatime, 150, 100, 200, true},
+		{Strictatime, 200, 100, 200, false},
+		{Noatime, 100, 200, 300, false},
+	}
+	for i, test := range tests {
+		if update := test.policy.update(test.atime, test.mtime, test.now); update != test.update {
+			t.Fatalf("%d: expected update %v, got %v", i, test.update, update)
+		}
+	}
+
+	fs := New("adm")
+	fs.Atime = Noatime
+	file := newNode(fs, "file", "adm", "adm", 0664, 0, newFile(BLOCKSIZE))
+	file.dir.Atime = 1
+	if _, err := file.ReadAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if atime := file.Stat().Atime; atime != 1 {
+		t.Fatalf("noatime: expected atime 1, got %d", atime)
+	}
+}
+
+func TestNameLimits(t *testing.T) {
+	fs := New("adm")
+	fs.MaxEntries = 2
+	fs.MaxNameLen = 8
+	root := newNode(fs, "/", "adm", "adm", 0775|plan9.DMDIR, 0, nil)
+
+	for _, name := range []string{"", ".", "..", "a/b", "a\nb", "a\x7fb", "toolongname"} {
+		if _, err := root.Create("adm", name, plan9.OREAD, 0664); err == nil {
+			t.Fatalf("create %q: expected error", name)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := root.Create("adm", name, plan9.OREAD, 0664); err != nil {
+			t.Fatalf("create %q: %v", name, err)
+		}
+	}
+	if _, err := root.Create("adm", "c", plan9.OREAD, 0664); err == nil {
+		t.Fatalf("create: expected directory full error")
+	}
+
+	dir := plan9.Dir{Mode: 0xFFFFFFFF, Name: "x/y"}
+	if err := root.children["a"].Wstat("adm", &dir); err == nil {
+		t.Fatalf("wstat: expected bad name error")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	fs := New("adm")
+	root := newNode(fs, "/", "adm", "adm", 0775|plan9.DMDIR, 0, nil)
+	root.parent = root
+	if _, err := root.Create("adm", "bad\xffname", plan9.OREAD, 0664); err == nil {
+		t.Fatalf("create: expected invalid UTF-8 error")
+	}
+
+	nfd, nfc := "cafe\u0301", "caf\u00e9"
+	fs.Normalize = true
+	file, err := root.Create("adm", nfd, plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if name := file.Stat().Name; name != nfc {
+		t.Fatalf("expected name %q, got %q", nfc, name)
+	}
+	if _, err := walkRoot(root, "", "/"+nfd); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	fs := New("adm")
+	root := newNode(fs, "/", "adm", "adm", 0777|plan9.DMDIR, 0, nil)
+	if _, err := newCtl(fs).Query("adm", []byte("umask 022")); err != nil {
+		t.Fatalf("umask: %v", err)
+	}
+	file, err := root.Create("adm", "file", plan9.OREAD, 0666)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if mode := file.Stat().Mode; mode != 0644 {
+		t.Fatalf("expected mode %s, got %s", Perm(0644), Perm(mode))
+	}
+	dir, err := root.Create("adm", "dir", plan9.OREAD, 0777|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if mode := dir.Stat().Mode; mode != 0755|plan9.DMDIR {
+		t.Fatalf("expected mode %s, got %s", Perm(0755|plan9.DMDIR), Perm(mode))
+	}
+	if _, err := newCtl(fs).Query("adm", []byte("umask 999")); err == nil {
+		t.Fatalf("umask: expected error for bad mask")
+	}
+}
+
+func TestOpenModes(t *testing.T) {
+	fs := New("adm")
+	root := newNode(fs, "/", "adm", "adm", 0777|plan9.DMDIR, 0, nil)
+	file, err := root.Create("adm", "file", plan9.OWRITE, 0666)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	r := &Fid{uid: "adm", node: file}
+	if err := r.Open(plan9.OREAD); err != nil {
+		t.Fatalf("open read: %v", err)
+	}
+	if _, err := r.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatalf("write through read-only fid: expected error")
+	}
+	w := &Fid{uid: "adm", node: file}
+	if err := w.Open(plan9.OWRITE | plan9.OTRUNC); err != nil {
+		t.Fatalf("open trunc: %v", err)
+	}
+	if _, err := w.ReadAt(make([]byte, 4), 0); err == nil {
+		t.Fatalf("read through write-only fid: expected error")
+	}
+	if stat := file.Stat(); stat.Length != 0 {
+		t.Fatalf("expected truncated file, got length %d", stat.Length)
+	}
+	if mode, _ := file.openMode(r); mode != plan9.OREAD {
+		t.Fatalf("expected open mode %d, got %d", plan9.OREAD, mode)
+	}
+	r.Close()
+	if _, found := file.openMode(r); found {
+		t.Fatalf("closed fid still recorded")
+	}
+	w.Close()
+
+	appendOnly, err := root.Create("adm", "log", plan9.OWRITE, 0666|plan9.DMAPPEND)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	appendOnly.WriteAt([]byte("entry"), 0)
+	a := &Fid{uid: "adm", node: appendOnly}
+	if err := a.Open(plan9.OWRITE | plan9.OTRUNC); err != nil {
+		t.Fatalf("open trunc: %v", err)
+	}
+	if stat := appendOnly.Stat(); stat.Length != 5 {
+		t.Fatalf("append-only file truncated to %d", stat.Length)
+	}
+	a.Close()
+
+	c := &Fid{uid: "adm", node: root}
+	if err := c.Create("tmp", plan9.OWRITE|plan9.ORCLOSE, 0666); err != nil {
+		t.Fatalf("create orclose: %v", err)
+	}
+	c.Close()
+	if _, err := walkRoot(root, "", "/tmp"); err == nil {
+		t.Fatalf("orclose file not removed")
+	}
+}
+
+func TestStatCopy(t *testing.T) {
+	fs := New("adm")
+	file, err := fs.root.Create("adm", "file", plan9.OREAD, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	stat := file.Stat()
+	stat.Name = "changed"
+	stat.Mode = 0777
+	if s := file.Stat(); s.Name != "file" || s.Mode == 0777 {
+		t.Fatalf("modifying a stat changed the file: %v", s)
+	}
+}
+
+// TestStatRace is meant to be run with -race: it stats, changes and
+// lists files concurrently.
+func TestStatRace(t *testing.T) {
+	fs := New("adm")
+	fs.group.groupmap["sys"] = user{"sys", "sys", member{"adm": true}}
+	dir, err := fs.root.Create("adm", "dir", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	file, err := dir.Create("adm", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				fn(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		d := plan9.Dir{}
+		d.Null()
+		d.Name = []string{"file", "renamed"}[(i+1)%2]
+		d.Mode = plan9.Perm(0664 | plan9.DMAPPEND*plan9.Perm(i%2))
+		d.Gid = []string{"adm", "sys"}[i%2]
+		file.Wstat("adm", &d)
+	})
+	run(func(i int) { file.WriteAt([]byte("data"), int64(i)) })
+	run(func(int) {
+		if stat := file.Stat(); stat.Name != "file" && stat.Name != "renamed" {
+			t.Errorf("unexpected name %q", stat.Name)
+		}
+	})
+	run(func(int) {
+		if _, err := dir.Readdir(); err != nil {
+			t.Errorf("readdir: %v", err)
+		}
+	})
+	run(func(int) { file.HasPerm("adm", plan9.DMREAD) })
+	run(func(int) { each(dir, func(n *node) { n.path() }) })
+	wg.Wait()
+}
+
+func TestDirIndex(t *testing.T) {
+	fs := New("adm")
+	dir, err := fs.root.Create("adm", "big", plan9.OREAD, 0775|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	const count = 2 * indexMin
+	for _, i := range rand.Perm(count) {
+		if _, err := dir.Create("adm", fmt.Sprintf("f%04d", i), plan9.OREAD, 0664); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if dir.index == nil {
+		t.Fatalf("expected index of directory with %d entries", count)
+	}
+
+	data, err := dir.Readdir()
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	for i := 0; len(data) > 0; i++ {
+		m := int(data[0]) | int(data[1])<<8 + 2
+		d, err := plan9.UnmarshalDir(data[:m])
+		if err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if want := fmt.Sprintf("f%04d", i); d.Name != want {
+			t.Fatalf("entry %d: expected %s, got %s", i, want, d.Name)
+		}
+		data = data[m:]
+	}
+
+	f, err := fs.walk("/big/f0003")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	var d plan9.Dir
+	d.Null()
+	d.Name = "z"
+	if err := f.Wstat("adm", &d); err != nil {
+		t.Fatalf("wstat: %v", err)
+	}
+	dir.mu.RLock()
+	page := dir.names("f0001", 3)
+	last := dir.names("f0510", -1)
+	dir.mu.RUnlock()
+	if strings.Join(page, " ") != "f0002 f0004 f0005" {
+		t.Fatalf("unexpected page %v", page)
+	}
+	if strings.Join(last, " ") != "f0511 z" {
+		t.Fatalf("unexpected last page %v", last)
+	}
+
+	for i := 0; i < count; i++ {
+		if n, err := fs.walk(fmt.Sprintf("/big/f%04d", i)); err == nil {
+			n.Remove()
+		}
+	}
+	if dir.index != nil {
+		t.Fatalf("expected index to be dropped from emptied directory")
+	}
+}
+
+func TestWalkSearch(t *testing.T) {
+	fs := New("adm")
+	fs.WalkCache = 16
+	fs.group.groupmap["sys"] = user{"sys", "sys", member{"glenda": true}}
+	fs.group.groupmap["glenda"] = user{"glenda", "glenda", member{}}
+	fs.group.groupmap["bob"] = user{"bob", "bob", member{}}
+	dir, err := fs.root.Create("adm", "dir", plan9.OREAD, 0777|plan9.DMDIR)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := dir.Create("adm", "file", plan9.OREAD, 0666); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir.dir.Gid = "sys"
+
+	tests := []struct {
+		mode             plan9.Perm
+		adm, glenda, bob bool
+	}{
+		{0700, true, false, false},
+		{0710, true, true, false},
+		{0701, true, true, true},
+		{0666, false, false, false},
+	}
+	for _, test := range tests {
+		dir.dir.Mode = test.mode | plan9.DMDIR
+		for uid, expected := range map[string]bool{"adm": test.adm, "glenda": test.glenda, "bob": test.bob} {
+			fid := &Fid{uid: uid, node: fs.root}
+			err := fid.walkTo(&Fid{}, []string{"dir", "file"}, func(*Fid, []string) error { return nil })
+			if (err == nil) != expected {
+				t.Errorf("walk as %s in %v: expected allowed %v, got %v", uid, test.mode, expected, err)
+			}
+			u, _ := fs.As(uid)
+			_, err = u.Stat("/dir/file")
+			if (err == nil) != expected {
+				t.Errorf("stat as %s in %v: expected allowed %v, got %v", uid, test.mode, expected, err)
+			}
+			_, err = fs.Attach(uid, "/dir/file")
+			if (err == nil) != expected {
+				t.Errorf("attach as %s in %v: expected allowed %v, got %v", uid, test.mode, expected, err)
+			}
+			_, err = newCtl(fs).Query(uid, []byte("sum sha1 /dir/file"))
+			if (err == nil) != expected {
+				t.Errorf("sum as %s in %v: expected allowed %v, got %v", uid, test.mode, expected, err)
+			}
+		}
+	}
+}
+
+// stepClock is a Clock advanced by the tests.
+type stepClock struct {
+	t time.Time
+}
+
+func (c *stepClock) Now() time.Time { return c.t }
+
+func TestClock(t *testing.T) {
+	clock := &stepClock{time.Unix(1000000000, 0)}
+	fs := New("adm")
+	fs.Clock = clock
+	fs.Atime = Strictatime
+
+	job, err := fs.root.Create("adm", "job", plan9.OREAD, DMDIR|0775)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	file, err := job.Create("adm", "file", plan9.ORDWR, 0664)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if stat := file.Stat(); stat.Mtime != 1000000000 || stat.Atime != 1000000000 {
+		t.Fatalf("expected times of creation, got mtime %d atime %d", stat.Mtime, stat.Atime)
+	}
+	clock.t = clock.t.Add(time.Minute)
+	if _, err := file.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	clock.t = clock.t.Add(time.Minute)
+	if _, err := file.ReadAt(make([]byte, 4), 0); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if stat := file.Stat(); stat.Mtime != 1000000060 || stat.Atime != 1000000120 {
+		t.Fatalf("expected mtime 1000000060 atime 1000000120, got %d %d", stat.Mtime, stat.Atime)
+	}
+
+	// the files of a scratch directory expire by the clock
+	if _, err := newCtl(fs).Query("adm", []byte("scratch /job on 1h")); err != nil {
+		t.Fatalf("scratch: %v", err)
+	}
+	clock.t = clock.t.Add(2 * time.Hour)
+	expire(job, uint32(fs.now().Add(-time.Hour).Unix()))
+	if _, err := fs.walk("/job/file"); err == nil {
+		t.Fatalf("file not expired")
+	}
+}
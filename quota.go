@@ -0,0 +1,239 @@
+package ramfs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var errQuota = perror("group quota exceeded")
+
+// quotas accounts the file data per group and enforces group quotas.
+// File data is charged to the group of the file.
+type quotas struct {
+	mu    sync.Mutex
+	fs    *FS
+	usage map[string]uint64
+	limit map[string]uint64
+	total uint64            // usage of all groups
+	state map[string]string // of the limits not ok, by name
+}
+
+func newQuotas(fs *FS) *quotas {
+	return &quotas{
+		fs:    fs,
+		usage: make(map[string]uint64),
+		limit: make(map[string]uint64),
+		state: make(map[string]string),
+	}
+}
+
+// charge accounts n more bytes to gid. It fails if this exceeds the
+// quota of gid.
+func (q *quotas) charge(gid string, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	q.mu.Lock()
+	if limit := q.limit[gid]; limit > 0 && q.usage[gid]+n > limit {
+		q.mu.Unlock()
+		return errQuota
+	}
+	q.usage[gid] += n
+	q.total += n
+	events := q.check(gid)
+	q.mu.Unlock()
+	q.fs.warn(events)
+	return nil
+}
+
+// used returns the bytes of file data of all groups.
+func (q *quotas) used() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total
+}
+
+// release accounts n fewer bytes to gid.
+func (q *quotas) release(gid string, n uint64) {
+	if n == 0 {
+		return
+	}
+	q.mu.Lock()
+	if q.usage[gid] <= n {
+		q.total -= q.usage[gid]
+		delete(q.usage, gid)
+	} else {
+		q.usage[gid] -= n
+		q.total -= n
+	}
+	events := q.check(gid)
+	q.mu.Unlock()
+	q.fs.warn(events)
+}
+
+// move accounts n bytes of from to gid regardless of its quota.
+func (q *quotas) move(from, gid string, n uint64) {
+	q.release(from, n)
+	q.mu.Lock()
+	q.usage[gid] += n
+	q.total += n
+	events := q.check(gid)
+	q.mu.Unlock()
+	q.fs.warn(events)
+}
+
+// set sets the quota of gid; zero removes it.
+func (q *quotas) set(gid string, limit uint64) {
+	q.mu.Lock()
+	if limit == 0 {
+		delete(q.limit, gid)
+	} else {
+		q.limit[gid] = limit
+	}
+	events := q.check(gid)
+	q.mu.Unlock()
+	q.fs.warn(events)
+}
+
+// limits returns a copy of the quotas of all groups.
+func (q *quotas) limits() map[string]uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit := make(map[string]uint64, len(q.limit))
+	for gid, n := range q.limit {
+		limit[gid] = n
+	}
+	return limit
+}
+
+// setLimits replaces the quotas of all groups.
+func (q *quotas) setLimits(limit map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = make(map[string]uint64, len(limit))
+	for gid, n := range limit {
+		q.limit[gid] = n
+	}
+}
+
+// recount recomputes the usage of all groups from the file trees.
+func (q *quotas) recount(fs *FS) {
+	usage := make(map[string]uint64)
+	for _, root := range fs.roots() {
+		each(root, func(n *node) {
+			n.mu.RLock()
+			if stored(n.file) {
+				usage[n.dir.Gid] += n.dir.Length
+			}
+			n.mu.RUnlock()
+		})
+	}
+	total := uint64(0)
+	for _, n := range usage {
+		total += n
+	}
+	q.mu.Lock()
+	q.usage = usage
+	q.total = total
+	events := q.checkAll()
+	q.mu.Unlock()
+	q.fs.warn(events)
+}
+
+// report returns a line "gid usage quota" for each group having either.
+func (q *quotas) report(usage bool) []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var gids []string
+	for gid := range q.limit {
+		gids = append(gids, gid)
+	}
+	if usage {
+		for gid := range q.usage {
+			if _, found := q.limit[gid]; !found {
+				gids = append(gids, gid)
+			}
+		}
+	}
+	sort.Strings(gids)
+
+	var data []byte
+	for _, gid := range gids {
+		if usage {
+			data = append(data, fmt.Sprintf("%s %d %d\n", gid, q.usage[gid], q.limit[gid])...)
+		} else {
+			data = append(data, fmt.Sprintf("%s %d\n", gid, q.limit[gid])...)
+		}
+	}
+	return data
+}
+
+// charged reports whether the data of n is accounted in the quotas.
+// Only regular files are; the data of synthetic files is not.
+func (n *node) charged() bool {
+	return stored(n.file)
+}
+
+// quotaFile is the synthetic file /adm/quota. Reading it lists the group
+// quotas as lines "gid bytes"; writing such a line sets the quota of
+// gid, a quota of 0 removes it.
+type quotaFile struct {
+	fs *FS
+}
+
+func (f *quotaFile) ReadAt(p []byte, offset int64) (int, error) {
+	return readReport(f.fs.quota.report(false), p, offset)
+}
+
+func (f *quotaFile) WriteAt(p []byte, offset int64) (int, error) {
+	cmd := command{}
+	if err := unmarshal(p, &cmd); err != nil {
+		return 0, err
+	}
+	if len(cmd.Args) != 1 {
+		return 0, perror("usage: gid bytes")
+	}
+	if _, err := f.fs.group.Get(cmd.Name); err != nil {
+		return 0, err
+	}
+	limit, err := strconv.ParseUint(cmd.Args[0], 10, 64)
+	if err != nil {
+		return 0, perror("bad quota " + cmd.Args[0])
+	}
+	f.fs.quota.set(cmd.Name, limit)
+	return len(p), nil
+}
+
+func (f *quotaFile) Len() uint64  { return uint64(0) }
+func (f *quotaFile) Close() error { return nil }
+
+// usageFile is the synthetic file /adm/usage. Reading it lists lines
+// "gid usage quota" with the bytes of file data of each group.
+type usageFile struct {
+	fs *FS
+}
+
+func (f *usageFile) ReadAt(p []byte, offset int64) (int, error) {
+	return readReport(f.fs.quota.report(true), p, offset)
+}
+
+func (f *usageFile) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, perror("writing usage file")
+}
+
+func (f *usageFile) Len() uint64  { return uint64(0) }
+func (f *usageFile) Close() error { return nil }
+
+func readReport(data, p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, perror("negative offset")
+	}
+	if offset > int64(len(data)) {
+		return 0, io.EOF
+	}
+	return copy(p, data[offset:]), nil
+}
@@ -0,0 +1,170 @@
+package ramfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionOption is the aname suffix carrying a session token.
+const sessionOption = "!session="
+
+// sessionToken splits the session token off aname.
+func sessionToken(aname string) (string, string) {
+	i := strings.LastIndex(aname, sessionOption)
+	if i < 0 || strings.Contains(aname[i+len(sessionOption):], "!") {
+		return aname, ""
+	}
+	return aname[:i], aname[i+len(sessionOption):]
+}
+
+// sessions holds the fids of lost connections by session token until
+// they are resumed or expire.
+type sessions struct {
+	mu sync.Mutex
+	m  map[string]*resumable
+}
+
+// resumable is a session. Its fids are nil while a connection uses it.
+type resumable struct {
+	uid   string
+	fids  map[uint32]*Fid
+	timer *time.Timer
+}
+
+func newSessions() *sessions {
+	return &sessions{m: make(map[string]*resumable)}
+}
+
+// take claims the session token for a connection of uid and returns the
+// fids kept for it, if any. It fails if the token is in use by another
+// connection or belongs to another user.
+func (s *sessions) take(token, uid string) (map[uint32]*Fid, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, found := s.m[token]
+	if !found {
+		s.m[token] = &resumable{uid: uid}
+		return nil, true
+	}
+	if r.uid != uid || r.fids == nil {
+		return nil, false
+	}
+	r.timer.Stop()
+	fids := r.fids
+	r.fids, r.timer = nil, nil
+	return fids, true
+}
+
+// keep holds fids for the session token for ttl, after which they are
+// clunked. They are clunked at once if the token was forgotten
+// meanwhile, as by clear on Shutdown.
+func (s *sessions) keep(token string, fids map[uint32]*Fid, ttl time.Duration) {
+	s.mu.Lock()
+	r, found := s.m[token]
+	if !found {
+		s.mu.Unlock()
+		clunkAll(fids)
+		return
+	}
+	r.fids = fids
+	r.timer = time.AfterFunc(ttl, func() {
+		s.mu.Lock()
+		if s.m[token] != r || r.fids == nil {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.m, token)
+		s.mu.Unlock()
+		clunkAll(fids)
+	})
+	s.mu.Unlock()
+}
+
+// clear clunks the fids of all kept sessions and forgets all tokens.
+func (s *sessions) clear() {
+	s.mu.Lock()
+	m := s.m
+	s.m = make(map[string]*resumable)
+	s.mu.Unlock()
+	for _, r := range m {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		clunkAll(r.fids)
+	}
+}
+
+// resume makes c use the session token of uid, taking over the fids of
+// the lost connection of the session whose files still exist. Fids
+// whose number is already in use by c are clunked.
+func (c *conn) resume(token, uid string) {
+	fids, ok := c.sessions.take(token, uid)
+	if !ok {
+		return
+	}
+
+	var stale []*Fid
+	c.f.Lock()
+	c.token = token
+	for num, fid := range fids {
+		if _, used := c.fidmap[num]; used || !fid.node.linked() {
+			stale = append(stale, fid)
+			continue
+		}
+		c.fidmap[num] = fid
+	}
+	c.stats.fids(len(c.fidmap))
+	c.f.Unlock()
+	for _, fid := range stale {
+		fid.clunk()
+	}
+}
+
+// detach clunks the fids of the ended connection c, or keeps them for
+// resumption if c uses a session.
+func (c *conn) detach() {
+	c.f.Lock()
+	fids := c.fidmap
+	c.fidmap = make(map[uint32]*Fid)
+	token := c.token
+	c.f.Unlock()
+
+	if token != "" {
+		c.sessions.keep(token, fids, c.ttl)
+		return
+	}
+	clunkAll(fids)
+}
+
+func clunkAll(fids map[uint32]*Fid) {
+	for _, fid := range fids {
+		fid.clunk()
+	}
+}
+
+// clunk closes f if it is open, as a Tclunk would.
+func (f *Fid) clunk() {
+	if f.isOpen() {
+		f.Close()
+	}
+}
+
+// linked reports whether n is still linked into its file tree.
+func (n *node) linked() bool {
+	for c := n; ; {
+		c.mu.RLock()
+		parent, name := c.parent, c.dir.Name
+		c.mu.RUnlock()
+		if parent == c {
+			return true
+		}
+		parent.mu.RLock()
+		child := parent.children[name]
+		parent.mu.RUnlock()
+		if child != c {
+			return false
+		}
+		c = parent
+	}
+}
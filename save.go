@@ -0,0 +1,442 @@
+package ramfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+// saveMagic starts the images written by Save since version 3. Older
+// images start directly with the gob encoded header.
+const saveMagic = "ramfs image\n"
+
+// saveVersion is the version of the format written by Save. Version 2
+// adds the group quotas, version 3 the magic line, version 4 the
+// read-only users.
+const saveVersion = 4
+
+// saveCompat is the oldest format version able to read the images
+// written by Save. Fields added to the header or the files in a later
+// version are ignored by older readers, so it is raised only when an
+// older reader would restore a wrong state.
+const saveCompat = 4
+
+// saveHeader follows the magic line of a saved image. It is followed by
+// one saveNode per file, parents before their children.
+type saveHeader struct {
+	Version  int
+	Compat   int      // oldest version able to read the image; 0 before version 2
+	Path     uint64   // next unallocated qid path
+	Free     []uint64 // released qid paths
+	Group    groupmap
+	Reserved []string          // names of removed users
+	ReadOnly []string          // read-only users
+	Quota    map[string]uint64 // group quotas
+}
+
+type saveNode struct {
+	Tree      string // file tree; empty for the main tree
+	Root      bool   // root directory of the tree
+	Parent    uint64 // qid path of the parent directory
+	Dir       plan9.Dir
+	Xattr     map[string]string
+	Setgid    bool
+	Scratch   bool
+	TTL       time.Duration // of a scratch directory
+	Defgid    string
+	Synthetic bool // data is provided by the file server, e.g. /adm/ctl
+	Data      []byte
+}
+
+// Save writes an image of all file trees, the group database and the
+// group quotas to w.
+// The image can be restored with Load. It shows the state at the time
+// Save was called: changes to the trees are blocked only while their
+// directories are copied, file data is shared copy-on-write. The files
+// are then read by SaveWorkers goroutines in parallel while the file
+// server continues serving requests, and are written to w in tree
+// order as soon as they are read.
+func (fs *FS) Save(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+
+	fs.frozen.Lock()
+	fs.mu.Lock()
+	hdr := saveHeader{Version: saveVersion, Compat: saveCompat, Path: fs.path}
+	for path := range fs.pathmap {
+		hdr.Free = append(hdr.Free, path)
+	}
+	trees := map[string]*node{"": fs.root}
+	names := []string{""}
+	for name, root := range fs.trees {
+		trees[name] = root
+		names = append(names, name)
+	}
+	fs.mu.Unlock()
+	for name, root := range trees {
+		trees[name] = freeze(root, nil, true)
+	}
+	fs.group.mu.Lock()
+	hdr.Group = make(groupmap, len(fs.group.groupmap))
+	for uid, u := range fs.group.groupmap {
+		member := make(member, len(u.Member))
+		for m := range u.Member {
+			member[m] = true
+		}
+		hdr.Group[uid] = user{u.Name, u.Leader, member}
+	}
+	for uid := range fs.group.reserved {
+		hdr.Reserved = append(hdr.Reserved, uid)
+	}
+	for uid := range fs.group.readonly {
+		hdr.ReadOnly = append(hdr.ReadOnly, uid)
+	}
+	fs.group.mu.Unlock()
+	hdr.Quota = fs.quota.limits()
+	fs.frozen.Unlock()
+	sort.Strings(names)
+
+	if _, err := io.WriteString(w, saveMagic); err != nil {
+		return err
+	}
+	if err := enc.Encode(&hdr); err != nil {
+		return err
+	}
+
+	workers := fs.SaveWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan saveJob)
+	queue := make(chan chan *saveNode, 4*workers) // bounds the files in memory
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				sn := j.n.saveNode(j.tree)
+				sn.Root = j.root
+				j.out <- sn
+			}
+		}()
+	}
+	go saveWalk(trees, names, jobs, queue, done)
+
+	for out := range queue {
+		if err := enc.Encode(<-out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveFile saves an image of the file system to the file name of the
+// host, compressed as selected by Compression. The image is written to
+// a temporary file first, so a failed save keeps the previous image.
+func (fs *FS) SaveFile(name string) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	cw, err := compress(w, fs.Compression)
+	if err == nil {
+		err = fs.Save(cw)
+		if e := cw.Close(); err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Checkpoint saves an image of the file system to the file name of the
+// host every interval, until the returned function is called. A failed
+// checkpoint is logged and keeps the previous image.
+func (fs *FS) Checkpoint(name string, every time.Duration) (stop func()) {
+	t := fs.sweep.add("checkpoint", every, func() {
+		if err := fs.SaveFile(name); err != nil {
+			fs.logf("checkpoint %s: %v", name, err)
+		}
+	})
+	return func() { fs.sweep.remove(t) }
+}
+
+// dump runs the ctl command "dump", saving an image to the dump file.
+func (fs *FS) dump() error {
+	if fs.DumpFile == "" {
+		return perror("no dump file")
+	}
+	if err := fs.SaveFile(fs.DumpFile); err != nil {
+		fs.logf("dump %s: %v", fs.DumpFile, err)
+		return perror("dump failed")
+	}
+	return nil
+}
+
+// A migration upgrades the header and files of an image of one version
+// to the next version.
+type migration struct {
+	header func(fs *FS, hdr *saveHeader)
+	node   func(sn *saveNode)
+}
+
+// migrations is indexed by the version upgraded from.
+var migrations = map[int]migration{
+	// Version 1 images have no quotas; keep the current ones.
+	1: {header: func(fs *FS, hdr *saveHeader) { hdr.Quota = fs.quota.limits() }},
+	2: {},
+	3: {},
+}
+
+// migrate upgrades hdr of an image of an older version to saveVersion
+// and returns the function upgrading its files.
+func (fs *FS) migrate(hdr *saveHeader) func(sn *saveNode) {
+	var nodes []func(sn *saveNode)
+	for v := hdr.Version; v < saveVersion; v++ {
+		m := migrations[v]
+		if m.header != nil {
+			m.header(fs, hdr)
+		}
+		if m.node != nil {
+			nodes = append(nodes, m.node)
+		}
+	}
+	return func(sn *saveNode) {
+		for _, fn := range nodes {
+			fn(sn)
+		}
+	}
+}
+
+// saveJob asks a Save worker to read the file n.
+type saveJob struct {
+	n    *node
+	tree string
+	root bool
+	out  chan *saveNode // buffered; receives the read file
+}
+
+// saveWalk hands out the files of the trees to the workers reading jobs
+// and queues their results in tree order, parents before children. It
+// stops early when done is closed.
+func saveWalk(trees map[string]*node, names []string, jobs chan<- saveJob, queue chan<- chan *saveNode, done <-chan struct{}) {
+	defer close(queue)
+	defer close(jobs)
+
+	stopped := false
+	for _, name := range names {
+		root := trees[name]
+		each(root, func(n *node) {
+			if stopped || isAuth(n) || n.hostPath() != "" {
+				return
+			}
+			j := saveJob{n, name, n == root, make(chan *saveNode, 1)}
+			select {
+			case queue <- j.out:
+			case <-done:
+				stopped = true
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-done:
+				stopped = true
+			}
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+func (n *node) saveNode(tree string) *saveNode {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	sn := &saveNode{
+		Tree:    tree,
+		Parent:  n.parent.dir.Qid.Path,
+		Dir:     *n.dir,
+		Xattr:   n.copyXattr(),
+		Setgid:  n.setgid,
+		Scratch: n.scratch,
+		TTL:     n.ttl,
+		Defgid:  n.defgid,
+	}
+	switch f := n.file.(type) {
+	case nil:
+	case *file:
+		sn.Data = make([]byte, f.Len())
+		f.ReadAt(sn.Data, 0)
+	case *storage:
+		if c, err := readBuffer(f); err == nil {
+			sn.Data = make([]byte, c.Len())
+			c.ReadAt(sn.Data, 0)
+		}
+	default:
+		sn.Synthetic = true
+	}
+	return sn
+}
+
+// Load replaces all file trees, the group database and the group quotas
+// with the image read from r, which was written by Save. Images of older
+// versions are migrated while they are read; those written before quotas
+// were saved keep the current quotas. Nothing is replaced if the image
+// cannot be read completely. Images compressed with gzip or zstd are
+// detected. Load must be called before the file server starts serving
+// requests.
+func (fs *FS) Load(r io.Reader) error {
+	dr, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	br := bufio.NewReader(dr)
+	magic, err := br.Peek(len(saveMagic))
+	legacy := err != nil || !bytes.Equal(magic, []byte(saveMagic))
+	if !legacy {
+		br.Discard(len(saveMagic))
+	}
+	dec := gob.NewDecoder(br)
+
+	var hdr saveHeader
+	if err := dec.Decode(&hdr); err != nil {
+		if legacy {
+			return perror("not a ramfs image")
+		}
+		return err
+	}
+	switch {
+	case hdr.Version < 1, legacy && hdr.Version > 2:
+		return perror("not a ramfs image")
+	case hdr.Version > saveVersion && (hdr.Compat == 0 || hdr.Compat > saveVersion):
+		return perror("unsupported image version")
+	}
+	migrate := fs.migrate(&hdr)
+
+	synthetic := map[string]Buffer{
+		"group":  fs.group,
+		"ctl":    newCtl(fs),
+		"health": newHealth(fs),
+		"quota":  &quotaFile{fs},
+		"usage":  &usageFile{fs},
+		"fids":   &fidsFile{fs},
+		"access": &accessFile{fs},
+		"stats":  &statsFile{fs},
+	}
+	roots := make(map[string]*node)
+	nodes := make(map[string]map[uint64]*node)
+	var expiring []*node // scratch directories with a ttl
+	for {
+		var sn saveNode
+		if err := dec.Decode(&sn); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		migrate(&sn)
+
+		dir := sn.Dir
+		if nodes[sn.Tree] == nil {
+			nodes[sn.Tree] = make(map[uint64]*node)
+		}
+		var parent *node
+		if !sn.Root {
+			parent = nodes[sn.Tree][sn.Parent]
+			if parent == nil || parent.children == nil {
+				return perror("corrupt image: parent of " + dir.Name + " not found")
+			}
+		}
+
+		var b Buffer
+		switch {
+		case dir.Mode&plan9.DMDIR != 0:
+		case sn.Synthetic:
+			if b = synthetic[dir.Name]; b == nil {
+				continue // no longer provided
+			}
+		default:
+			b = fs.newBuffer(childPath(parent.path(), dir.Name), Perm(dir.Mode), uint64(len(sn.Data)))
+			if _, err := b.WriteAt(sn.Data, 0); err != nil {
+				return err
+			}
+		}
+
+		n := newNode(fs, dir.Name, dir.Uid, dir.Gid, dir.Mode, dir.Qid.Path, b)
+		*n.dir = dir
+		n.xattr = sn.Xattr
+		n.setgid = sn.Setgid
+		n.scratch = sn.Scratch
+		n.ttl = sn.TTL
+		if n.ttl > 0 {
+			expiring = append(expiring, n)
+		}
+		n.defgid = sn.Defgid
+
+		if sn.Root {
+			n.parent = n
+			roots[sn.Tree] = n
+		} else {
+			n.parent = parent
+			parent.link(dir.Name, n)
+		}
+		nodes[sn.Tree][dir.Qid.Path] = n
+	}
+
+	root, found := roots[""]
+	if !found {
+		return perror("corrupt image: no root")
+	}
+	delete(roots, "")
+
+	fs.group.mu.Lock()
+	fs.group.groupmap = hdr.Group
+	fs.group.reserved = make(map[string]bool, len(hdr.Reserved))
+	for _, uid := range hdr.Reserved {
+		fs.group.reserved[uid] = true
+	}
+	fs.group.readonly = make(map[string]bool, len(hdr.ReadOnly))
+	for _, uid := range hdr.ReadOnly {
+		fs.group.readonly[uid] = true
+	}
+	fs.group.mu.Unlock()
+
+	fs.mu.Lock()
+	fs.root = root
+	fs.trees = roots
+	fs.path = hdr.Path
+	fs.pathmap = make(map[uint64]bool, len(hdr.Free))
+	for _, path := range hdr.Free {
+		fs.pathmap[path] = true
+	}
+	fs.mu.Unlock()
+	fs.resetScratch(expiring)
+	fs.cache.invalidate()
+	fs.quota.setLimits(hdr.Quota)
+	fs.quota.recount(fs)
+	return nil
+}
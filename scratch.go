@@ -0,0 +1,114 @@
+package ramfs
+
+import (
+	"path"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+// setScratch marks the directory name a scratch area: files created in
+// it are temporary (DMTMP) and removed when their last fid is closed,
+// and new subdirectories are scratch areas too. With a ttl, all files
+// below the directory unchanged for ttl are removed as well, and then
+// the directories left empty. Only the owner or the group leader may
+// change the mark.
+func (fs *FS) setScratch(uid, name string, on bool, ttl time.Duration) error {
+	n, err := fs.walkAs(uid, path.Clean(name))
+	if err != nil {
+		return err
+	}
+
+	fs.frozen.RLock()
+	n.mu.Lock()
+	if n.dir.Mode&plan9.DMDIR == 0 {
+		n.mu.Unlock()
+		fs.frozen.RUnlock()
+		return perror("not a directory")
+	}
+	if uid != n.dir.Uid {
+		g, err := fs.group.Get(n.dir.Gid)
+		if err != nil || g.Leader != uid {
+			n.mu.Unlock()
+			fs.frozen.RUnlock()
+			return perror("not owner")
+		}
+	}
+	n.scratch = on
+	n.ttl = ttl
+	n.mu.Unlock()
+	fs.frozen.RUnlock()
+
+	fs.expireScratch(n, ttl)
+	return nil
+}
+
+// expireScratch schedules the removal of the files below the scratch
+// directory n unchanged for ttl, replacing an earlier schedule. A zero
+// ttl only cancels it.
+func (fs *FS) expireScratch(n *node, ttl time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if t, found := fs.scratch[n]; found {
+		fs.sweep.remove(t)
+		delete(fs.scratch, n)
+	}
+	if ttl <= 0 {
+		return
+	}
+	every := ttl / 2
+	if every < time.Second {
+		every = time.Second
+	}
+	fs.scratch[n] = fs.sweep.add("scratch", every, func() {
+		if !n.linked() {
+			fs.expireScratch(n, 0)
+			return
+		}
+		expire(n, uint32(fs.now().Add(-ttl).Unix()))
+	})
+}
+
+// expire removes the files below dir last modified before deadline and
+// then the directories left empty which were not modified since.
+func expire(dir *node, deadline uint32) {
+	dir.mu.RLock()
+	children := make([]*node, 0, len(dir.children))
+	for _, c := range dir.children {
+		children = append(children, c)
+	}
+	dir.mu.RUnlock()
+
+	for _, c := range children {
+		stat := c.Stat()
+		if stat.Mode&plan9.DMDIR != 0 {
+			expire(c, deadline)
+			c.mu.RLock()
+			empty := len(c.children) == 0
+			c.mu.RUnlock()
+			if !empty {
+				continue
+			}
+		}
+		if stat.Mtime < deadline {
+			c.Remove() // ignore errors; c may be gone meanwhile
+		}
+	}
+}
+
+// resetScratch replaces the expiry of all scratch directories by the one
+// of dirs, e.g. after an image is loaded.
+func (fs *FS) resetScratch(dirs []*node) {
+	fs.mu.Lock()
+	for n, t := range fs.scratch {
+		fs.sweep.remove(t)
+		delete(fs.scratch, n)
+	}
+	fs.mu.Unlock()
+	for _, n := range dirs {
+		n.mu.RLock()
+		ttl := n.ttl
+		n.mu.RUnlock()
+		fs.expireScratch(n, ttl)
+	}
+}
@@ -1,7 +1,9 @@
 package ramfs
 
 import (
-	"sync"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
 
 	"9fans.net/go/plan9"
 )
@@ -14,34 +16,8 @@ type transaction struct {
 }
 
 type server struct {
-	mu      sync.Mutex
-	work    <-chan *transaction
-	conn    uint32
-	connmap map[uint32]bool
-	fs      *FS
-}
-
-func (s *server) newConn() (uint32, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	for conn := range s.connmap {
-		delete(s.connmap, conn)
-		return conn, nil
-	}
-
-	conn := s.conn
-	if s.conn == maxConn {
-		return 0, perror("max connection reached")
-	}
-	s.conn++
-	return conn, nil
-}
-
-func (s *server) delConn(conn uint32) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.connmap[conn] = true
+	work <-chan *transaction
+	fs   *FS
 }
 
 func (s *server) Version(fid *Fid, tx, rx *plan9.Fcall) error {
@@ -49,8 +25,8 @@ func (s *server) Version(fid *Fid, tx, rx *plan9.Fcall) error {
 	if tx.Msize < plan9.IOHDRSZ {
 		return perror("msize too small")
 	}
-	if tx.Msize > MSIZE {
-		rx.Msize = MSIZE
+	if max := s.fs.msize(); tx.Msize > max {
+		rx.Msize = max
 	} else {
 		rx.Msize = tx.Msize
 	}
@@ -63,11 +39,20 @@ func (s *server) Version(fid *Fid, tx, rx *plan9.Fcall) error {
 }
 
 func (s *server) Auth(fid *Fid, tx, rx *plan9.Fcall) error {
-	return perror("authentication not required")
+	if err := s.fs.auth(fid, tx.Uname, tx.Aname); err != nil {
+		return err
+	}
+	rx.Aqid = fid.node.Stat().Qid
+	return nil
 }
 
 func (s *server) Attach(fid *Fid, tx, rx *plan9.Fcall) error {
-	if tx.Afid != plan9.NOFID {
+	switch {
+	case s.fs.Auth != nil:
+		if err := s.fs.checkAuth(fid.afid, tx.Uname); err != nil {
+			return err
+		}
+	case tx.Afid != plan9.NOFID:
 		return perror("authentication not required")
 	}
 
@@ -78,6 +63,9 @@ func (s *server) Attach(fid *Fid, tx, rx *plan9.Fcall) error {
 	fid.mu.Lock()
 	fid.node = root.node
 	fid.uid = root.uid
+	fid.enc = root.enc
+	fid.ro = root.ro
+	fid.afid = nil
 	fid.mu.Unlock()
 
 	stat := root.node.Stat()
@@ -89,73 +77,119 @@ func (s *server) Clunk(fid *Fid, tx, rx *plan9.Fcall) error {
 	fid.Close() // ignore errors
 	return nil
 }
-func (s *server) Flush(fid *Fid, tx, rx *plan9.Fcall) error {
-	return nil
-}
 
-func (s *server) Walk(fid *Fid, tx, rx *plan9.Fcall) error {
-	wqids := make([]plan9.Qid, len(tx.Wname))
-	i := 0
-	err := fid.Walk(tx.Wname, func(f *Fid, p []string) error {
-		wqids[i] = f.node.Stat().Qid
-		i++
+// Walk returns the handler of a Twalk to newfid. As in walk(5), a walk
+// failing after the first name is not an error: the qids of the names
+// walked are returned and newfid is left unchanged.
+func (s *server) Walk(newfid *Fid) handler {
+	return func(fid *Fid, tx, rx *plan9.Fcall) error {
+		wqids := make([]plan9.Qid, 0, len(tx.Wname))
+		err := fid.walkTo(newfid, tx.Wname, func(f *Fid, p []string) error {
+			wqids = append(wqids, f.node.Stat().Qid)
+			return nil
+		})
+		if err != nil && len(wqids) == 0 {
+			return err
+		}
+
+		rx.Wqid = wqids
 		return nil
-	})
-	if err != nil {
-		return err
 	}
-
-	rx.Wqid = wqids
-	return nil
 }
 
-func (s *server) Open(fid *Fid, tx, rx *plan9.Fcall) error {
-	if err := fid.Open(tx.Mode); err != nil {
-		return err
+// iounit returns the maximum count of a Tread or Twrite fitting into a
+// message of msize bytes, IOUNIT if msize is 0.
+func iounit(msize uint32) uint32 {
+	if msize == 0 {
+		return IOUNIT
 	}
-
-	stat := fid.node.Stat()
-	rx.Qid = stat.Qid
-	rx.Iounit = IOUNIT
-	return nil
+	return msize - plan9.IOHDRSZ
 }
 
-func (s *server) Create(fid *Fid, tx, rx *plan9.Fcall) error {
-	err := fid.Create(tx.Name, tx.Mode, Perm(tx.Perm))
-	if err != nil {
-		return err
-	}
+// Open returns the handler of a Topen on a connection with the msize.
+func (s *server) Open(msize uint32) handler {
+	return func(fid *Fid, tx, rx *plan9.Fcall) error {
+		if err := fid.Open(tx.Mode); err != nil {
+			return err
+		}
 
-	stat := fid.node.Stat()
-	rx.Qid = stat.Qid
-	rx.Iounit = IOUNIT
-	return nil
+		stat := fid.node.Stat()
+		rx.Qid = stat.Qid
+		rx.Iounit = iounit(msize)
+		return nil
+	}
 }
 
-func (s *server) Read(fid *Fid, tx, rx *plan9.Fcall) error {
-	stat := fid.node.Stat()
-	if stat.Mode&plan9.DMDIR != 0 {
-		if tx.Count > plan9.STATMAX {
-			tx.Count = plan9.STATMAX
+// Create returns the handler of a Tcreate on a connection with the msize.
+func (s *server) Create(msize uint32) handler {
+	return func(fid *Fid, tx, rx *plan9.Fcall) error {
+		err := fid.Create(tx.Name, tx.Mode, Perm(tx.Perm))
+		if err != nil {
+			return err
 		}
-	}
-	data := make([]byte, tx.Count)
 
-	n, err := fid.ReadAt(data, int64(tx.Offset))
-	if err != nil {
-		return err
+		stat := fid.node.Stat()
+		rx.Qid = stat.Qid
+		rx.Iounit = iounit(msize)
+		return nil
 	}
+}
 
-	rx.Count = uint32(n)
-	rx.Data = data[:n]
-	return nil
+// Read returns the handler of a Tread on a connection with the msize.
+// The count is clamped to the iounit, so the Rread fits into msize.
+func (s *server) Read(msize uint32) handler {
+	return func(fid *Fid, tx, rx *plan9.Fcall) error {
+		count := tx.Count
+		if max := iounit(msize); count > max {
+			count = max
+		}
+		stat := fid.node.Stat()
+		if stat.Mode&plan9.DMDIR != 0 {
+			if count > plan9.STATMAX {
+				count = plan9.STATMAX
+			}
+		}
+		enc := EncodingNone
+		if stat.Mode&plan9.DMDIR == 0 {
+			enc = fid.enc
+		}
+		data := make([]byte, rawCount(enc, count))
+
+		n, err := fid.ReadAt(data, int64(tx.Offset))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if data, err = encode(enc, data[:n]); err != nil {
+				return err
+			}
+			n = len(data)
+		}
+
+		rx.Count = uint32(n)
+		rx.Data = data[:n]
+		return nil
+	}
 }
 
 func (s *server) Write(fid *Fid, tx, rx *plan9.Fcall) error {
-	n, err := fid.WriteAt(tx.Data, int64(tx.Offset))
+	data, err := decode(fid.enc, tx.Data)
 	if err != nil {
 		return err
 	}
+	// The payload was allocated for this request only and can be
+	// kept by the file without a copy.
+	n, err := fid.write(data, int64(tx.Offset), true)
+	if err != nil {
+		return err
+	}
+	if fid.enc != EncodingNone {
+		// A count of decoded bytes means nothing to the client.
+		if n != len(data) {
+			return perror("short write")
+		}
+		n = len(tx.Data)
+	}
 
 	rx.Count = uint32(n)
 	return nil
@@ -185,6 +219,104 @@ func (s *server) BadFcall(fid *Fid, tx, rx *plan9.Fcall) error {
 	return perror("bad fcall")
 }
 
+var (
+	errTimeout  = perror("request timed out")
+	errInternal = perror("internal server error")
+	errShutdown = perror("server shutting down")
+	errCanceled = perror("request canceled")
+
+	errTooManyFids = perror("too many fids")
+)
+
+type handler func(fid *Fid, tx, rx *plan9.Fcall) error
+
+// call runs fn, injecting the faults set by FS.SetFaults.
+func (s *server) call(fn handler, req *request) error {
+	if req.ctx.Err() != nil {
+		return errCanceled
+	}
+	if f := s.fs.loadFaults(); f != nil {
+		if err := f.inject(req); err != nil {
+			return err
+		}
+		err := s.timedCall(fn, req)
+		if err == nil {
+			f.shorten(req)
+		}
+		return err
+	}
+	return s.timedCall(fn, req)
+}
+
+// changing returns the handler of a request changing files, which runs
+// fn unless req was aborted before. Once fn runs, req is no longer
+// aborted by a timeout or cancellation but answered with the result of
+// fn, so a client is never told that a change failed which was applied.
+func changing(req *request, fn handler) handler {
+	return func(fid *Fid, tx, rx *plan9.Fcall) error {
+		if req.ctx.Err() != nil || !atomic.CompareAndSwapInt32(&req.state, reqPending, reqCommitted) {
+			return errCanceled
+		}
+		return fn(fid, tx, rx)
+	}
+}
+
+// abandon reports whether req may be answered before its handler
+// returns, i.e. the handler has not begun to change files.
+func (req *request) abandon() bool {
+	return atomic.CompareAndSwapInt32(&req.state, reqPending, reqAbandoned)
+}
+
+// timedCall runs fn and enforces the maximum processing time of the file
+// server. A request is aborted when it times out or its context is
+// canceled; fn keeps running, but its reply is discarded. Requests
+// changing files are aborted only before the change begins.
+func (s *server) timedCall(fn handler, req *request) error {
+	rx := &plan9.Fcall{}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.safeCall(fn, req.Fid, req.Tx, rx)
+	}()
+
+	var expired <-chan time.Time
+	timeout := s.fs.Timeout
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-done:
+		*req.Rx = *rx
+		return err
+	case <-expired:
+		if req.abandon() {
+			s.fs.logf("timeout after %v: %s", timeout, req.Tx)
+			return errTimeout
+		}
+	case <-req.ctx.Done():
+		if req.abandon() {
+			return errCanceled
+		}
+	}
+	err := <-done // the change is applied
+	*req.Rx = *rx
+	return err
+}
+
+// safeCall runs fn and converts a panic into an error, so a single bad
+// request does not take down the file server.
+func (s *server) safeCall(fn handler, fid *Fid, tx, rx *plan9.Fcall) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			atomic.AddUint64(&s.fs.panics, 1)
+			s.fs.logf("panic serving %s: %v\n%s", tx, v, debug.Stack())
+			err = errInternal
+		}
+	}()
+	return fn(fid, tx, rx)
+}
+
 func (s *server) Listen() {
 	for txn := range s.work {
 		go func(t *transaction) {
@@ -199,26 +331,24 @@ func (s *server) Listen() {
 				fn = s.Attach
 			case plan9.Tclunk:
 				fn = s.Clunk
-			case plan9.Tflush:
-				fn = s.Flush
 			case plan9.Twalk:
-				fn = s.Walk
+				fn = s.Walk(req.New)
 			case plan9.Topen:
-				fn = s.Open
+				fn = s.Open(req.msize)
 			case plan9.Tcreate:
-				fn = s.Create
+				fn = changing(req, s.Create(req.msize))
 			case plan9.Tread:
-				fn = s.Read
+				fn = s.Read(req.msize)
 			case plan9.Twrite:
-				fn = s.Write
+				fn = changing(req, s.Write)
 			case plan9.Tremove:
-				fn = s.Remove
+				fn = changing(req, s.Remove)
 			case plan9.Tstat:
 				fn = s.Stat
 			case plan9.Twstat:
-				fn = s.Wstat
+				fn = changing(req, s.Wstat)
 			}
-			req.Err = fn(req.Fid, req.Tx, req.Rx)
+			req.Err = s.call(fn, req)
 			t.ch <- req
 			close(t.ch)
 		}(txn)
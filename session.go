@@ -0,0 +1,75 @@
+package ramfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"9fans.net/go/plan9"
+)
+
+// session accounts the usage of a single connection. A summary is
+// logged when the connection ends.
+type session struct {
+	mu      sync.Mutex
+	uid     string
+	start   time.Time
+	ops     uint64
+	errors  uint64
+	read    uint64
+	written uint64
+	created uint64
+	removed uint64
+	maxFids int // peak number of fids
+}
+
+func newSession() *session {
+	return &session{uid: "none", start: time.Now()}
+}
+
+// account records the outcome of a single transaction.
+func (s *session) account(req *request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ops++
+	switch req.Rx.Type {
+	case plan9.Rerror:
+		s.errors++
+	case plan9.Rattach:
+		s.uid = req.Fid.uid
+	case plan9.Rread:
+		s.read += uint64(len(req.Rx.Data))
+	case plan9.Rwrite:
+		s.written += uint64(req.Rx.Count)
+	case plan9.Rcreate:
+		s.created++
+	case plan9.Rremove:
+		s.removed++
+	}
+}
+
+// fids records the current number of fids of the connection.
+func (s *session) fids(n int) {
+	s.mu.Lock()
+	if n > s.maxFids {
+		s.maxFids = n
+	}
+	s.mu.Unlock()
+}
+
+func (s *session) user() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uid
+}
+
+func (s *session) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fmt.Sprintf("session uid=%s duration=%s ops=%d errors=%d "+
+		"read=%d written=%d created=%d removed=%d fids=%d", s.uid,
+		time.Since(s.start), s.ops, s.errors, s.read, s.written, s.created,
+		s.removed, s.maxFids)
+}
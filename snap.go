@@ -0,0 +1,131 @@
+package ramfs
+
+import (
+	"sort"
+	"strings"
+
+	"9fans.net/go/plan9"
+)
+
+var errReadOnly = perror("read-only file system")
+
+// Snap freezes the current state of the main file tree as the snapshot
+// name. File data is shared copy-on-write with the live tree. Clients
+// get a read-only view of the snapshot by attaching with the aname
+// "snap/<name>".
+func (fs *FS) Snap(name string) error {
+	if err := fs.checkName(name); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	_, found := fs.snaps[name]
+	fs.mu.Unlock()
+	if found {
+		return perror("snapshot " + name + " exists")
+	}
+
+	fs.frozen.Lock()
+	root := freeze(fs.root, nil, false)
+	fs.frozen.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, found := fs.snaps[name]; found {
+		return perror("snapshot " + name + " exists")
+	}
+	fs.snaps[name] = root
+	return nil
+}
+
+// RemoveSnap discards the snapshot name.
+func (fs *FS) RemoveSnap(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, found := fs.snaps[name]; !found {
+		return perror("snapshot " + name + " not found")
+	}
+	delete(fs.snaps, name)
+	return nil
+}
+
+// Snaps returns the sorted names of all snapshots.
+func (fs *FS) Snaps() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	names := make([]string, 0, len(fs.snaps))
+	for name := range fs.snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapRoot returns the root of the snapshot selected by an aname of the
+// form "snap/<name>/path" and the remaining path within the snapshot.
+func (fs *FS) snapRoot(aname string) (*node, string, bool) {
+	names := split(aname)
+	if len(names) < 2 || names[0] != "snap" {
+		return nil, "", false
+	}
+	fs.mu.Lock()
+	root, found := fs.snaps[names[1]]
+	fs.mu.Unlock()
+	if !found {
+		return nil, "", false
+	}
+	return root, "/" + strings.Join(names[2:], "/"), true
+}
+
+// freeze returns a copy of the tree below n. Directory entries are
+// copied, file data is shared copy-on-write or copied if it is kept by a
+// storage policy. Authentication files are left out, synthetic files
+// too unless synthetic is set. The copy is consistent if fs.frozen is
+// held, which blocks all changes to the trees.
+func freeze(n, parent *node, synthetic bool) *node {
+	n.mu.Lock() // clone marks the blocks of n shared
+	c := &node{
+		fs:     n.fs,
+		xattr:  n.copyXattr(),
+		setgid: n.setgid,
+		defgid: n.defgid,
+	}
+	dir := *n.dir
+	c.dir = &dir
+	var children []*node
+	if n.dir.Mode&plan9.DMDIR != 0 {
+		c.children = make(map[string]*node, len(n.children))
+		children = make([]*node, 0, len(n.children))
+		for _, child := range n.children {
+			children = append(children, child)
+		}
+	} else if f, ok := n.file.(*file); ok {
+		c.file = f.clone()
+	} else if stored(n.file) {
+		// other storage is copied; a failed read leaves the copy empty
+		if c.file, _ = readBuffer(n.file); c.file == nil {
+			c.file = newFile(BLOCKSIZE)
+		}
+	} else {
+		c.file = n.file
+	}
+	if synthetic {
+		// files of snapshots must not be removed on close
+		c.scratch, c.ttl = n.scratch, n.ttl
+	}
+	n.mu.Unlock()
+
+	if parent == nil {
+		parent = c
+	}
+	c.parent = parent
+	for _, child := range children {
+		stat := child.Stat()
+		if stat.Mode&plan9.DMAUTH != 0 {
+			continue
+		}
+		if !synthetic && !stored(child.file) && stat.Mode&plan9.DMDIR == 0 {
+			continue
+		}
+		c.link(stat.Name, freeze(child, c, synthetic))
+	}
+	return c
+}
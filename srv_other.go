@@ -0,0 +1,23 @@
+// +build !plan9
+
+package ramfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/mars9/ramfs/client"
+)
+
+// Post posts the service as name in the plan9port name space directory
+// and then serves incoming requests, like Listen. The service can be
+// mounted with 9pfuse or used with 9p -s name. A name containing a path
+// separator is the path of the socket. On Windows, Unix domain sockets
+// require Windows 10 1803 or later.
+func (fs *FS) Post(name string) error {
+	sock := client.SocketPath(name)
+	if err := os.MkdirAll(filepath.Dir(sock), 0700); err != nil {
+		return err
+	}
+	return fs.Listen("unix", sock)
+}
@@ -0,0 +1,40 @@
+// +build plan9
+
+package ramfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Post posts the service as /srv/name and then serves the requests of
+// all mounts of it. It returns once the last mount is gone.
+func (fs *FS) Post(name string) error {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		return err
+	}
+
+	srvname := "/srv/" + name
+	f, err := os.OpenFile(srvname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d", p[0])
+	f.Close()
+	syscall.Close(p[0])
+	if err != nil {
+		os.Remove(srvname)
+		syscall.Close(p[1])
+		return err
+	}
+	defer os.Remove(srvname)
+
+	srv, work := fs.newServer()
+	fs.serveConn(context.Background(), srv, work, os.NewFile(uintptr(p[1]), srvname), nil)
+	return nil
+}
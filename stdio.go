@@ -0,0 +1,29 @@
+package ramfs
+
+import (
+	"io"
+	"os"
+)
+
+type stdio struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func (s stdio) Read(p []byte) (int, error)  { return s.r.Read(p) }
+func (s stdio) Write(p []byte) (int, error) { return s.w.Write(p) }
+
+func (s stdio) Close() error {
+	err := s.r.Close()
+	if e := s.w.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// ServeStdio serves a single 9P2000 session on the standard input and
+// output and returns when the standard input reaches EOF. Nothing else
+// may be written to the standard output meanwhile.
+func (fs *FS) ServeStdio() {
+	fs.ServeConn(stdio{os.Stdin, os.Stdout})
+}
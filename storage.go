@@ -0,0 +1,114 @@
+package ramfs
+
+import (
+	"io"
+	"strings"
+)
+
+// Buffer stores the data of a file. ReadAt returns io.EOF at the end of
+// the data. Len returns the length of the data, which becomes the length
+// of the file after every write. Close is called once, when the buffer
+// is no longer used: when its data is replaced, as by a truncating open,
+// or when the file is removed and no fid has it open any more. Close
+// may release the resources of the buffer.
+type Buffer interface {
+	ReadAt(p []byte, offset int64) (int, error)
+	WriteAt(p []byte, offset int64) (int, error)
+	Len() uint64
+	Close() error
+}
+
+// A StoragePolicy selects the Buffer storing the data of new files, e.g.
+// a ring buffer for files below /log or compressed storage below
+// /archive. A policy applies to a new file if all of its conditions
+// hold.
+type StoragePolicy struct {
+	Prefix  string // path prefix in the file tree, e.g. "/log/"
+	Mode    Perm   // permission bits the file must have, e.g. DMTMP
+	MinSize uint64 // minimum size of the data the file is created with
+
+	// New returns the empty Buffer of the file name.
+	New func(name string, perm Perm) Buffer
+}
+
+func (p *StoragePolicy) match(name string, perm Perm, size uint64) bool {
+	return strings.HasPrefix(name, p.Prefix) && perm&p.Mode == p.Mode &&
+		size >= p.MinSize
+}
+
+// AddStorage adds a storage policy. The first added policy applying to a
+// new file selects its storage; files to which no policy applies keep
+// their data in memory blocks of BLOCKSIZE bytes. Policies apply to
+// files created after AddStorage returns, including files created by
+// Load.
+func (fs *FS) AddStorage(p StoragePolicy) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.storage = append(fs.storage, p)
+}
+
+// storage is a Buffer provided by a storage policy. It is wrapped to
+// tell it apart from the buffers of synthetic files.
+type storage struct {
+	Buffer
+}
+
+// newBuffer returns the buffer of the new file name, which is created
+// with size bytes of data.
+func (fs *FS) newBuffer(name string, perm Perm, size uint64) Buffer {
+	fs.mu.Lock()
+	policies := fs.storage
+	fs.mu.Unlock()
+	for i := range policies {
+		if p := &policies[i]; p.match(name, perm, size) {
+			return &storage{p.New(name, perm)}
+		}
+	}
+	return newFile(BLOCKSIZE)
+}
+
+// stored reports whether b keeps file data, as opposed to the buffer of
+// a synthetic file such as /adm/ctl.
+func stored(b Buffer) bool {
+	switch b.(type) {
+	case *file, *storage:
+		return true
+	}
+	return false
+}
+
+// readBuffer returns a copy of the data of b.
+func readBuffer(b Buffer) (*file, error) {
+	f := newFile(BLOCKSIZE)
+	if err := copyBuffer(f, b); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// copyBuffer writes the data of src to dst.
+func copyBuffer(dst, src Buffer) error {
+	data := make([]byte, IOUNIT)
+	offset := int64(0)
+	for {
+		m, err := src.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if m == 0 {
+			return nil
+		}
+		if _, err := dst.WriteAt(data[:m], offset); err != nil {
+			return err
+		}
+		offset += int64(m)
+	}
+}
+
+// childPath returns the path of the file name in the directory dir.
+func childPath(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,141 @@
+package ramfs
+
+import (
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweeper runs the periodic maintenance tasks of the file server, such
+// as the fid leak check, one at a time on a single goroutine. Each run
+// is delayed by a random jitter of up to a tenth of the task interval,
+// so tasks added together drift apart, and successive runs are spaced
+// according to FS.SweepRate. The goroutine exits when no tasks are
+// left.
+type sweeper struct {
+	mu      sync.Mutex
+	fs      *FS
+	tasks   map[*task]bool
+	running bool
+	wake    chan struct{}
+}
+
+// A task is a maintenance function run every interval.
+type task struct {
+	name  string
+	every time.Duration
+	next  time.Time
+	fn    func()
+}
+
+func newSweeper(fs *FS) *sweeper {
+	return &sweeper{
+		fs:    fs,
+		tasks: make(map[*task]bool),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// add schedules fn to run every interval until the task is removed.
+func (s *sweeper) add(name string, every time.Duration, fn func()) *task {
+	t := &task{name: name, every: every, fn: fn}
+	t.next = time.Now().Add(every + jitter(every))
+
+	s.mu.Lock()
+	s.tasks[t] = true
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.mu.Unlock()
+	s.notify()
+	return t
+}
+
+// remove unschedules t. A run of t in progress is not interrupted.
+func (s *sweeper) remove(t *task) {
+	s.mu.Lock()
+	delete(s.tasks, t)
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *sweeper) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns the task to run next and the time it is due. It stops the
+// sweeper if there are no tasks.
+func (s *sweeper) due() (*task, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *task
+	for t := range s.tasks {
+		if next == nil || t.next.Before(next.next) {
+			next = t
+		}
+	}
+	if next == nil {
+		s.running = false
+		return nil, time.Time{}
+	}
+	return next, next.next
+}
+
+func (s *sweeper) run() {
+	last := time.Time{}
+	for {
+		t, at := s.due()
+		if t == nil {
+			return
+		}
+		if rate := s.fs.SweepRate; rate > 0 {
+			if min := last.Add(time.Second / time.Duration(rate)); at.Before(min) {
+				at = min
+			}
+		}
+
+		if d := time.Until(at); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-s.wake:
+				continue // tasks changed
+			}
+		}
+
+		s.mu.Lock()
+		scheduled := s.tasks[t]
+		if scheduled {
+			t.next = time.Now().Add(t.every + jitter(t.every))
+		}
+		s.mu.Unlock()
+		if scheduled {
+			s.call(t)
+			last = time.Now()
+		}
+	}
+}
+
+// call runs t, logging a panic instead of taking down the file server.
+func (s *sweeper) call(t *task) {
+	defer func() {
+		if v := recover(); v != nil {
+			atomic.AddUint64(&s.fs.panics, 1)
+			s.fs.logf("panic in %s task: %v\n%s", t.name, v, debug.Stack())
+		}
+	}()
+	t.fn()
+}
+
+// jitter returns a random duration of up to a tenth of d.
+func jitter(d time.Duration) time.Duration {
+	if d < 10 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d / 10)))
+}
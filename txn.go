@@ -0,0 +1,446 @@
+package ramfs
+
+import (
+	"path"
+	"sort"
+	"strconv"
+
+	"9fans.net/go/plan9"
+)
+
+// txnOp is a change queued on a ctl fid between the commands begin and
+// commit.
+type txnOp struct {
+	name string // create, mkdir, remove or rename
+	path string
+	arg  string // new name of rename
+	perm Perm   // of create and mkdir
+}
+
+// txn holds the changes queued on a ctl fid.
+type txn struct {
+	ops []txnOp
+}
+
+// parseTxnOp returns the change of the ctl command cmd written within a
+// transaction.
+func parseTxnOp(cmd command) (txnOp, error) {
+	op := txnOp{name: cmd.Name}
+	switch cmd.Name {
+	case "create", "mkdir":
+		if len(cmd.Args) != 2 {
+			return op, perror(cmd.Name + " requires 2 arguments")
+		}
+		perm, err := strconv.ParseUint(cmd.Args[1], 8, 32)
+		if err != nil || perm > 0777 {
+			return op, perror("bad permissions " + cmd.Args[1])
+		}
+		op.perm = Perm(perm)
+		if cmd.Name == "mkdir" {
+			op.perm |= DMDIR
+		}
+	case "remove":
+		if len(cmd.Args) != 1 {
+			return op, perror("remove requires 1 argument")
+		}
+	case "rename":
+		if len(cmd.Args) != 2 {
+			return op, perror("rename requires 2 arguments")
+		}
+		op.arg = cmd.Args[1]
+	default:
+		return op, perror("command " + cmd.Name + " not allowed in transaction")
+	}
+	op.path = path.Clean("/" + cmd.Args[0])
+	return op, nil
+}
+
+// query runs the command p written to fid f of the querier q. On the
+// ctl file, begin starts a transaction on f: the following create,
+// mkdir, remove and rename commands are queued until commit applies
+// them at once, or abort discards them.
+func (f *Fid) query(q querier, p []byte) ([]byte, error) {
+	c, ok := q.(*ctl)
+	if !ok {
+		return q.Query(f.uid, p)
+	}
+	cmd := command{}
+	if err := unmarshal(p, &cmd); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	t := f.txn
+	switch {
+	case cmd.Name == "begin":
+		if t != nil {
+			f.mu.Unlock()
+			return nil, perror("transaction already begun")
+		}
+		f.txn = &txn{}
+	case cmd.Name == "commit" || cmd.Name == "abort":
+		f.txn = nil
+	case t != nil:
+		op, err := parseTxnOp(cmd)
+		if err == nil {
+			t.ops = append(t.ops, op)
+		}
+		f.mu.Unlock()
+		return nil, err
+	}
+	f.mu.Unlock()
+
+	switch cmd.Name {
+	case "begin":
+		return nil, nil
+	case "commit", "abort":
+		if t == nil {
+			return nil, perror("no transaction")
+		}
+		if cmd.Name == "abort" {
+			return nil, nil
+		}
+		return nil, c.fs.commit(f.uid, t.ops)
+	}
+	return c.Query(f.uid, p)
+}
+
+// txnStep is a change of a commit, checked and ready to be applied.
+type txnStep struct {
+	op   string
+	dir  *node // directory changed
+	n    *node // file created, removed or renamed
+	name string
+	old  string // name of the renamed file
+	path string // of the created file
+}
+
+// txnPlan checks the changes of a commit against the file tree as it
+// will be after the changes before them.
+type txnPlan struct {
+	fs      *FS
+	uid     string
+	entries map[*node]map[string]*node // changed entries; nil if removed
+	names   map[*node]string           // new names of renamed files
+	steps   []txnStep
+}
+
+// lookup returns the entry name of dir, or nil.
+func (t *txnPlan) lookup(dir *node, name string) *node {
+	if n, found := t.entries[dir][name]; found {
+		return n
+	}
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	n := dir.children[name]
+	if n != nil && isAuth(n) {
+		return nil
+	}
+	return n
+}
+
+// count returns the number of entries of dir.
+func (t *txnPlan) count(dir *node) int {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	count := len(dir.children)
+	for name, n := range t.entries[dir] {
+		_, found := dir.children[name]
+		switch {
+		case n == nil && found:
+			count--
+		case n != nil && !found:
+			count++
+		}
+	}
+	return count
+}
+
+func (t *txnPlan) set(dir *node, name string, n *node) {
+	if t.entries[dir] == nil {
+		t.entries[dir] = make(map[string]*node)
+	}
+	t.entries[dir][name] = n
+}
+
+func (t *txnPlan) name(n *node) string {
+	if name, found := t.names[n]; found {
+		return name
+	}
+	return n.Stat().Name
+}
+
+// resolve walks to the file name.
+func (t *txnPlan) resolve(name string) (*node, error) {
+	n := t.fs.root
+	for _, elem := range split(name) {
+		if n.Stat().Mode&plan9.DMDIR == 0 {
+			return nil, perror("not a directory")
+		}
+		if n = t.lookup(n, t.fs.normName(elem)); n == nil {
+			return nil, perror("file does not exist")
+		}
+	}
+	return n, nil
+}
+
+// parent resolves the directory of the new file name and checks that
+// uid may create the file in it.
+func (t *txnPlan) parent(name string) (*node, string, error) {
+	base := t.fs.normName(path.Base(name))
+	if err := t.fs.checkName(base); err != nil {
+		return nil, "", err
+	}
+	dir, err := t.resolve(path.Dir(name))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := t.writable(dir); err != nil {
+		return nil, "", err
+	}
+	if t.lookup(dir, base) != nil {
+		return nil, "", perror("file exists")
+	}
+	return dir, base, nil
+}
+
+// writable checks that uid may change the entries of dir.
+func (t *txnPlan) writable(dir *node) error {
+	if dir.Stat().Mode&plan9.DMDIR == 0 {
+		return perror("not a directory")
+	}
+	if dir.hostPath() != "" {
+		return perror("can't change host files in transaction")
+	}
+	if !dir.HasPerm(t.uid, plan9.DMWRITE) {
+		return errPerm
+	}
+	return nil
+}
+
+func (t *txnPlan) add(op txnOp) error {
+	fs := t.fs
+	switch op.name {
+	case "create", "mkdir":
+		dir, base, err := t.parent(op.path)
+		if err != nil {
+			return err
+		}
+		if max := fs.MaxEntries; max > 0 && t.count(dir) >= max {
+			return perror("directory full")
+		}
+		perm := dir.createPerm(plan9.Perm(op.perm))
+		dir.mu.RLock()
+		gid := dir.newGid()
+		setgid, scratch := dir.setgid, dir.scratch
+		dir.mu.RUnlock()
+		qpath, err := fs.newPath()
+		if err != nil {
+			return err
+		}
+		// the buffer is allocated by alloc once all changes passed
+		n := newNode(fs, base, t.uid, gid, perm, qpath, nil)
+		n.parent = dir
+		n.setgid = setgid && perm&plan9.DMDIR != 0
+		n.scratch = scratch
+		t.set(dir, base, n)
+		t.steps = append(t.steps, txnStep{op: op.name, dir: dir, n: n, name: base, path: op.path})
+	case "remove":
+		n, err := t.resolve(op.path)
+		if err != nil {
+			return err
+		}
+		dir := n.parent
+		if dir == n {
+			return perror("can't remove root")
+		}
+		if err := t.writable(dir); err != nil {
+			return err
+		}
+		if n.Stat().Mode&plan9.DMDIR != 0 && t.count(n) != 0 {
+			return perror("directory not empty")
+		}
+		name := t.name(n)
+		t.set(dir, name, nil)
+		t.steps = append(t.steps, txnStep{op: op.name, dir: dir, n: n, name: name})
+	case "rename":
+		n, err := t.resolve(op.path)
+		if err != nil {
+			return err
+		}
+		dir := n.parent
+		if dir == n {
+			return perror("can't rename root")
+		}
+		base := fs.normName(op.arg)
+		if err := fs.checkName(base); err != nil {
+			return err
+		}
+		if err := t.writable(dir); err != nil {
+			return err
+		}
+		if t.lookup(dir, base) != nil {
+			return perror("file exists")
+		}
+		old := t.name(n)
+		t.set(dir, old, nil)
+		t.set(dir, base, n)
+		t.names[n] = base
+		t.steps = append(t.steps, txnStep{op: op.name, dir: dir, n: n, name: base, old: old})
+	}
+	return nil
+}
+
+// discard releases the qid paths and buffers of the files created by t.
+func (t *txnPlan) discard() {
+	for _, s := range t.steps {
+		if s.op == "create" || s.op == "mkdir" {
+			if s.n.file != nil {
+				s.n.file.Close()
+			}
+			t.fs.delPath(s.n.dir.Qid.Path)
+		}
+	}
+}
+
+// alloc allocates the buffers of the files created by t.
+func (t *txnPlan) alloc() {
+	for _, s := range t.steps {
+		if s.op == "create" && s.n.dir.Mode&plan9.DMDIR == 0 {
+			s.n.file = t.fs.newBuffer(s.path, Perm(s.n.dir.Mode), 0)
+		}
+	}
+}
+
+// hooks returns the paths of the files removed by t, before they are
+// removed, and the created files, whose paths are known once t is
+// applied. A file both created and removed by t is in neither.
+func (t *txnPlan) hooks() (removed []string, created []*node) {
+	made := make(map[*node]bool)
+	for _, s := range t.steps {
+		switch s.op {
+		case "create", "mkdir":
+			made[s.n] = true
+			created = append(created, s.n)
+		case "remove":
+			if made[s.n] {
+				delete(made, s.n)
+			} else {
+				removed = append(removed, s.n.path())
+			}
+		}
+	}
+	kept := created[:0]
+	for _, n := range created {
+		if made[n] {
+			kept = append(kept, n)
+		}
+	}
+	return removed, kept
+}
+
+// depth returns the number of directories above n.
+func depth(n *node) int {
+	d := 0
+	for ; n.parent != nil && n.parent != n; n = n.parent {
+		d++
+	}
+	return d
+}
+
+// commit applies the changes ops of a transaction of uid at once. They
+// are all checked first, in order, against the file tree as changed by
+// the ones before them, while other changes wait; if one fails, none is
+// applied. The changed directories are then locked together, so a
+// reader sees either none of the changes of a directory or all of them.
+// Files served from the host can't be changed in a transaction. The
+// hooks of the main tree are called for the files created and removed
+// once the transaction is applied; renames call no hooks, as with
+// Twstat.
+func (fs *FS) commit(uid string, ops []txnOp) error {
+	var removedPaths, createdPaths []string
+	defer func() {
+		h := fs.hooksOf(fs.root)
+		if h == nil {
+			return
+		}
+		for _, name := range removedPaths {
+			if h.OnRemove != nil {
+				h.OnRemove(name, uid)
+			}
+		}
+		for _, name := range createdPaths {
+			if h.OnCreate != nil {
+				h.OnCreate(name, uid)
+			}
+		}
+	}()
+	fs.frozen.Lock()
+	defer fs.frozen.Unlock()
+
+	t := &txnPlan{
+		fs:      fs,
+		uid:     uid,
+		entries: make(map[*node]map[string]*node),
+		names:   make(map[*node]string),
+	}
+	for _, op := range ops {
+		if err := t.add(op); err != nil {
+			t.discard()
+			return perror(op.name + " " + op.path + ": " + err.Error())
+		}
+	}
+	t.alloc()
+	removedPaths, created := t.hooks()
+
+	// Lock parents before children, as Readdir does.
+	dirs := make([]*node, 0, len(t.entries))
+	locked := make(map[*node]bool)
+	for _, s := range t.steps {
+		if !locked[s.dir] {
+			locked[s.dir] = true
+			dirs = append(dirs, s.dir)
+		}
+	}
+	sort.SliceStable(dirs, func(i, j int) bool { return depth(dirs[i]) < depth(dirs[j]) })
+	for _, dir := range dirs {
+		dir.mu.Lock()
+	}
+	var removed []*node
+	for _, s := range t.steps {
+		switch s.op {
+		case "create", "mkdir":
+			s.dir.link(s.name, s.n)
+		case "remove":
+			s.dir.unlink(s.name)
+			removed = append(removed, s.n)
+		case "rename":
+			s.dir.unlink(s.old)
+			if !locked[s.n] {
+				s.n.mu.Lock()
+			}
+			s.n.dir.Name = s.name
+			if !locked[s.n] {
+				s.n.mu.Unlock()
+			}
+			s.dir.link(s.name, s.n)
+		}
+	}
+	for _, dir := range dirs {
+		dir.mu.Unlock()
+	}
+
+	for _, n := range removed {
+		n.mu.Lock()
+		if n.charged() {
+			fs.quota.release(n.dir.Gid, n.dir.Length)
+		}
+		n.retire()
+		n.mu.Unlock()
+	}
+	fs.cache.invalidate()
+	for _, n := range created {
+		createdPaths = append(createdPaths, n.path())
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package ramfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"9fans.net/go/plan9"
+)
+
+// parseUsers parses a users file as kept by fossil and cwfs. Each line
+// has the form id:name:leader:members, where members is a comma separated
+// list of user names. Blank lines and lines starting with # are
+// ignored. The numeric ids of cwfs are accepted but not kept; users are
+// identified by name.
+func parseUsers(data []byte) (groupmap, error) {
+	g := groupmap{}
+	for _, line := range bytes.Split(data, groupSep) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		elem := strings.Split(string(line), ":")
+		if len(elem) != 3 && len(elem) != 4 {
+			return nil, perror("bad users line " + string(line))
+		}
+		name := elem[1]
+		if name == "" {
+			return nil, perror("bad users line " + string(line))
+		}
+		if _, found := g[name]; found {
+			return nil, perror("user " + name + " exists")
+		}
+		u := user{name, elem[2], member{}}
+		if len(elem) == 4 {
+			for _, m := range strings.Split(elem[3], ",") {
+				if m != "" {
+					u.Member[m] = true
+				}
+			}
+		}
+		g[name] = u
+	}
+
+	for _, u := range g {
+		if u.Leader != "" && !g.Exist(u.Leader) {
+			return nil, perror("leader " + u.Leader + " of " + u.Name + " not found")
+		}
+		for m := range u.Member {
+			if !g.Exist(m) {
+				return nil, perror("member " + m + " of " + u.Name + " not found")
+			}
+		}
+	}
+	return g, nil
+}
+
+// ImportUsers replaces the group database with the users file read from
+// r, in the id:name:leader:members format of fossil and cwfs. The users
+// none, adm and the hostowner are added if the file lacks them. Users
+// not in the file are removed as by RemoveUser, and the file cannot add
+// removed users again until ReuseUser is called.
+func (fs *FS) ImportUsers(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return fs.importUsers(data)
+}
+
+func (fs *FS) importUsers(data []byte) error {
+	g, err := parseUsers(data)
+	if err != nil {
+		return err
+	}
+	for _, uid := range []string{"none", "adm", fs.hostowner} {
+		if !g.Exist(uid) {
+			g[uid] = user{uid, uid, member{}}
+		}
+	}
+
+	fs.group.mu.Lock()
+	for uid := range g {
+		if fs.group.reserved[uid] {
+			fs.group.mu.Unlock()
+			return perror("user " + uid + " was removed; allow reuse with users reuse " + uid)
+		}
+	}
+	for uid := range fs.group.groupmap {
+		if !g.Exist(uid) {
+			fs.group.reserved[uid] = true
+			delete(fs.group.readonly, uid)
+		}
+	}
+	fs.group.groupmap = g
+	fs.group.mu.Unlock()
+	return nil
+}
+
+// RemoveUser removes the user uid from the group database and from all
+// groups. Files owned by uid keep their owner, so the name is reserved:
+// it cannot be added again until ReuseUser is called, lest a new user
+// silently inherit the files. The hostowner, adm and none cannot be
+// removed.
+func (fs *FS) RemoveUser(uid string) error {
+	if uid == fs.hostowner || uid == "adm" || uid == "none" {
+		return perror("cannot remove user " + uid)
+	}
+	g := fs.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.groupmap.Exist(uid) {
+		return perror("user " + uid + " not found")
+	}
+	delete(g.groupmap, uid)
+	for name, u := range g.groupmap {
+		delete(u.Member, uid)
+		if u.Leader == uid {
+			u.Leader = ""
+			g.groupmap[name] = u
+		}
+	}
+	g.reserved[uid] = true
+	delete(g.readonly, uid)
+	return nil
+}
+
+// ReuseUser releases the name of the removed user uid, which can then be
+// added again and becomes the owner of the files left by the removed
+// user.
+func (fs *FS) ReuseUser(uid string) error {
+	g := fs.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.reserved[uid] {
+		return perror("user " + uid + " is not reserved")
+	}
+	delete(g.reserved, uid)
+	return nil
+}
+
+// reservedUsers returns the sorted names of removed users.
+func (fs *FS) reservedUsers() []string {
+	fs.group.mu.Lock()
+	defer fs.group.mu.Unlock()
+	names := make([]string, 0, len(fs.group.reserved))
+	for uid := range fs.group.reserved {
+		names = append(names, uid)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetReadOnly marks the user uid as read-only, or writable again if ro
+// is false. The attaches of a read-only user succeed, but all requests
+// changing files are denied whatever the permissions of the files, which
+// makes a simple guest mode, e.g. for none. The change affects later
+// attaches only. The hostowner cannot be made read-only.
+func (fs *FS) SetReadOnly(uid string, ro bool) error {
+	if ro && uid == fs.hostowner {
+		return perror("cannot make user " + uid + " read-only")
+	}
+	g := fs.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.groupmap.Exist(uid) {
+		return perror("user " + uid + " not found")
+	}
+	if ro {
+		g.readonly[uid] = true
+	} else {
+		delete(g.readonly, uid)
+	}
+	return nil
+}
+
+// isReadOnly reports whether uid is a read-only user.
+func (g *group) isReadOnly(uid string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.readonly[uid]
+}
+
+// readOnlyUsers returns the sorted names of read-only users.
+func (fs *FS) readOnlyUsers() []string {
+	fs.group.mu.Lock()
+	defer fs.group.mu.Unlock()
+	names := make([]string, 0, len(fs.group.readonly))
+	for uid := range fs.group.readonly {
+		names = append(names, uid)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExportUsers writes the group database to w as a users file in the
+// id:name:leader:members format of fossil and cwfs. The id of each user
+// is its name.
+func (fs *FS) ExportUsers(w io.Writer) error {
+	_, err := w.Write(fs.exportUsers())
+	return err
+}
+
+func (fs *FS) exportUsers() []byte {
+	fs.group.mu.Lock()
+	defer fs.group.mu.Unlock()
+	return fs.group.groupmap.Bytes()
+}
+
+// users runs the ctl command "users import file", "users export
+// [file]", "users remove name", "users reuse name", "users reserved",
+// "users readonly [name]" or "users writable name" for uid. Without a
+// file the export is returned as reply; without a name users readonly
+// lists the read-only users.
+func (fs *FS) users(uid string, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, perror("users requires 1 argument")
+	}
+	u, err := fs.As(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return nil, perror("users import requires a file")
+		}
+		fid, err := u.Open(args[1], plan9.OREAD)
+		if err != nil {
+			return nil, err
+		}
+		defer fid.Close()
+		f, err := readAll(fid.node)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, f.Len())
+		f.ReadAt(data, 0)
+		return nil, fs.importUsers(data)
+	case "export":
+		switch len(args) {
+		case 1:
+			return fs.exportUsers(), nil
+		case 2:
+			return nil, u.writeFile(args[1], fs.exportUsers(), 0664)
+		}
+		return nil, perror("users export takes at most a file")
+	case "remove", "reuse":
+		if len(args) != 2 {
+			return nil, perror("users " + args[0] + " requires a user")
+		}
+		if args[0] == "remove" {
+			return nil, fs.RemoveUser(args[1])
+		}
+		return nil, fs.ReuseUser(args[1])
+	case "reserved":
+		var reply []byte
+		for _, uid := range fs.reservedUsers() {
+			reply = append(reply, uid+"\n"...)
+		}
+		return reply, nil
+	case "readonly", "writable":
+		switch {
+		case len(args) == 2:
+			return nil, fs.SetReadOnly(args[1], args[0] == "readonly")
+		case len(args) == 1 && args[0] == "readonly":
+			var reply []byte
+			for _, uid := range fs.readOnlyUsers() {
+				reply = append(reply, uid+"\n"...)
+			}
+			return reply, nil
+		}
+		return nil, perror("users " + args[0] + " requires a user")
+	}
+	return nil, perror("invalid users command " + args[0])
+}
+
+// writeFile truncates and writes the file name, creating it with perm
+// if it does not exist.
+func (u *UserFS) writeFile(name string, data []byte, perm Perm) error {
+	name = path.Clean(name)
+	fid, err := u.Open(name, plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		if fid, err = u.Create(name, plan9.OWRITE, perm); err != nil {
+			return err
+		}
+	}
+	defer fid.Close()
+	_, err = fid.WriteAt(data, 0)
+	return err
+}
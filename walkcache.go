@@ -0,0 +1,47 @@
+package ramfs
+
+import "sync"
+
+type walkKey struct {
+	root *node
+	path string
+}
+
+// walkCache caches resolved paths of the file trees. Entries are
+// dropped whenever a file is removed, renamed or its permissions change.
+// Each invalidation starts a new generation; the result of a walk begun
+// in an earlier generation may be stale and is not cached.
+type walkCache struct {
+	mu    sync.Mutex
+	nodes map[walkKey]*node
+	gen   uint64
+}
+
+// get returns the cached file path of the tree root and the current
+// generation.
+func (c *walkCache) get(root *node, path string) (*node, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, found := c.nodes[walkKey{root, path}]
+	return n, found, c.gen
+}
+
+// put caches the file n resolved by a walk begun in the generation gen.
+func (c *walkCache) put(root *node, path string, n *node, max int, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if c.nodes == nil || len(c.nodes) >= max {
+		c.nodes = make(map[walkKey]*node)
+	}
+	c.nodes[walkKey{root, path}] = n
+}
+
+func (c *walkCache) invalidate() {
+	c.mu.Lock()
+	c.nodes = nil
+	c.gen++
+	c.mu.Unlock()
+}
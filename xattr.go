@@ -0,0 +1,136 @@
+package ramfs
+
+import (
+	"mime"
+	"path"
+	"sort"
+	"strings"
+
+	"9fans.net/go/plan9"
+)
+
+// SetXattr sets the extended attribute attr of the file name to value.
+// Setting attributes requires write permission on the file.
+func (fs *FS) SetXattr(name, attr, value string) error {
+	return fs.setXattr(fs.hostowner, name, attr, value)
+}
+
+// Xattr returns the extended attribute attr of the file name. Reading
+// attributes requires read permission on the file.
+func (fs *FS) Xattr(name, attr string) (string, error) {
+	return fs.xattr(fs.hostowner, name, attr)
+}
+
+// ListXattr returns the sorted names of the extended attributes of the
+// file name.
+func (fs *FS) ListXattr(name string) ([]string, error) {
+	return fs.listXattr(fs.hostowner, name)
+}
+
+// RemoveXattr removes the extended attribute attr of the file name.
+func (fs *FS) RemoveXattr(name, attr string) error {
+	return fs.setXattr(fs.hostowner, name, attr, "")
+}
+
+// ContentType returns the media type of the file name, see
+// File.ContentType. It requires read permission on the file.
+func (fs *FS) ContentType(name string) (string, error) {
+	n, err := fs.xattrNode(fs.hostowner, name, plan9.DMREAD)
+	if err != nil {
+		return "", err
+	}
+	return n.contentType(), nil
+}
+
+// contentType returns the media type of n: its content-type attribute,
+// or the type of the extension of its name known to package mime, or
+// "" if neither is.
+func (n *node) contentType() string {
+	n.mu.RLock()
+	typ, name, mode := n.xattr["content-type"], n.dir.Name, n.dir.Mode
+	n.mu.RUnlock()
+	if typ != "" || mode&plan9.DMDIR != 0 {
+		return typ
+	}
+	return mime.TypeByExtension(path.Ext(name))
+}
+
+func (fs *FS) xattrNode(uid, name string, perm plan9.Perm) (*node, error) {
+	n, err := fs.walkAs(uid, path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	if !n.HasPerm(uid, perm) {
+		return nil, errPerm
+	}
+	return n, nil
+}
+
+// setXattr sets attr to value; an empty value removes the attribute.
+func (fs *FS) setXattr(uid, name, attr, value string) error {
+	if attr == "" || strings.ContainsAny(attr, " \t\n") {
+		return perror("bad attribute name")
+	}
+	n, err := fs.xattrNode(uid, name, plan9.DMWRITE)
+	if err != nil {
+		return err
+	}
+
+	fs.frozen.RLock()
+	defer fs.frozen.RUnlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if value == "" {
+		delete(n.xattr, attr)
+		return nil
+	}
+	if n.xattr == nil {
+		n.xattr = make(map[string]string)
+	}
+	n.xattr[attr] = value
+	return nil
+}
+
+func (fs *FS) xattr(uid, name, attr string) (string, error) {
+	n, err := fs.xattrNode(uid, name, plan9.DMREAD)
+	if err != nil {
+		return "", err
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	value, found := n.xattr[attr]
+	if !found {
+		return "", perror("attribute " + attr + " not found")
+	}
+	return value, nil
+}
+
+func (fs *FS) listXattr(uid, name string) ([]string, error) {
+	n, err := fs.xattrNode(uid, name, plan9.DMREAD)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.RLock()
+	attrs := make([]string, 0, len(n.xattr))
+	for attr := range n.xattr {
+		attrs = append(attrs, attr)
+	}
+	n.mu.RUnlock()
+	sort.Strings(attrs)
+	return attrs, nil
+}
+
+// copyXattr returns a copy of the extended attributes of n. The caller
+// must hold n.mu.
+func (n *node) copyXattr() map[string]string {
+	if len(n.xattr) == 0 {
+		return nil
+	}
+	xattr := make(map[string]string, len(n.xattr))
+	for attr, value := range n.xattr {
+		xattr[attr] = value
+	}
+	return xattr
+}